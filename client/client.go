@@ -20,7 +20,8 @@ func Auth(addr, user, pass string) error {
 
 	token = getCachedToken()
 
-	log.Info().Str("KUBERNETES_EXEC_INFO", os.Getenv("KUBERNETES_EXEC_INFO")).Msg("Testing variable of interest.")
+	apiVersion := execInfoAPIVersion()
+	log.Info().Str("apiVersion", apiVersion).Msg("ExecCredential version requested by kubectl.")
 
 	err = json.Unmarshal(token, &ec)
 	if err != nil || ec.Status.ExpirationTimestamp.Time.Unix() < time.Now().Unix() {
@@ -30,7 +31,7 @@ func Auth(addr, user, pass string) error {
 			log.Warn().Int64("expirationTimestamp", ec.Status.ExpirationTimestamp.Time.Unix()).Msg("ExecCredential expired.")
 		}
 
-		token, err = performAuth(addr, user, pass)
+		token, err = performAuth(addr, user, pass, apiVersion)
 		if err != nil {
 			log.Error().Err(err).Msg("Could not perform authentication.")
 			return err
@@ -47,7 +48,7 @@ func Auth(addr, user, pass string) error {
 		log.Info().Msg("Token parsed successfully")
 	}
 
-	token, err = ec.Marshal("")
+	token, err = ec.Marshal(apiVersion)
 	if err != nil {
 		log.Error().Err(err).Msg("Could not marshal ExecCredential.")
 	}
@@ -64,3 +65,15 @@ func Auth(addr, user, pass string) error {
 
 	return nil
 }
+
+// execInfoAPIVersion return the ExecCredential apiVersion kubectl expects, read from the
+// KUBERNETES_EXEC_INFO environment variable. It is empty when kubectl did not provide it.
+func execInfoAPIVersion() string {
+	var info types.ExecCredential
+
+	if err := json.Unmarshal([]byte(os.Getenv("KUBERNETES_EXEC_INFO")), &info); err != nil {
+		return ""
+	}
+
+	return info.APIVersion
+}
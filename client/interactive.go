@@ -9,6 +9,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"os"
+	"unicode/utf8"
 
 	"github.com/mattn/go-isatty"
 	"github.com/rs/zerolog/log"
@@ -68,7 +69,7 @@ func password(screen io.ReadWriter) (string, error) {
 	return line, err
 }
 
-func performAuth(addr, user, pass string) ([]byte, error) {
+func performAuth(addr, user, pass, apiVersion string) ([]byte, error) {
 	var (
 		err error
 		res *http.Response
@@ -104,9 +105,15 @@ func performAuth(addr, user, pass string) ([]byte, error) {
 	}
 	log.Info().Msg("Password exists.")
 
+	// json would replace the invalid bytes, another password would be sent
+	if !utf8.ValidString(pass) {
+		return nil, types.ErrPasswordNotUTF8
+	}
+
 	cred := types.Credentials{
-		Username: user,
-		Password: pass,
+		Username:   user,
+		Password:   pass,
+		APIVersion: apiVersion,
 	}
 	data, err := json.Marshal(cred)
 	if err != nil {
@@ -0,0 +1,169 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+	"sigs.k8s.io/yaml"
+)
+
+// requirements lists the flags that cannot be used without other ones, keyed by flag name. A
+// requirement is met by any of its | separated flags. They are declared along with the flags,
+// see require, and the required flags must be flags of the command.
+type requirements map[string][]string
+
+// require record that f cannot be used without the required flags, returning f
+func (r requirements) require(f cli.Flag, required ...string) cli.Flag {
+	r[f.Names()[0]] = required
+
+	return f
+}
+
+// loadConfig set the flags from the YAML file given with --config, its keys are the flag
+// names. Flags given on the command line or through their environment variables take
+// precedence over the file. The required flags are then checked, whatever their source.
+func loadConfig(c *cli.Context, reqs requirements) error {
+	if path := c.String("config"); path != "" {
+		if err := applyConfigFile(c, path); err != nil {
+			return err
+		}
+	}
+
+	return checkRequirements(c, reqs)
+}
+
+// applyConfigFile set the flags not set yet from the values of the YAML file
+func applyConfigFile(c *cli.Context, path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Could not read configuration file, %w", err)
+	}
+
+	var values map[string]interface{}
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		return fmt.Errorf("Could not parse configuration file '%s', %w", path, err)
+	}
+
+	flags := flagNames(c)
+
+	var unknown []string
+	for name := range values {
+		if !flags[name] || name == "config" {
+			unknown = append(unknown, name)
+		}
+	}
+
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("Unknown keys in configuration file '%s': %s", path, strings.Join(unknown, ", "))
+	}
+
+	for name, value := range values {
+		if c.IsSet(name) {
+			continue
+		}
+
+		items, ok := value.([]interface{})
+		if !ok {
+			items = []interface{}{value}
+		}
+
+		for _, item := range items {
+			v, err := configValue(item)
+			if err != nil {
+				return fmt.Errorf("Invalid value for '%s' in configuration file '%s', %w", name, path, err)
+			}
+
+			if err := c.Set(name, v); err != nil {
+				return fmt.Errorf("Invalid value for '%s' in configuration file '%s', %w", name, path, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// flagNames return the names, aliases included, of the flags of the command
+func flagNames(c *cli.Context) map[string]bool {
+	names := map[string]bool{}
+	for _, f := range c.Command.Flags {
+		for _, name := range f.Names() {
+			names[name] = true
+		}
+	}
+
+	return names
+}
+
+// given tells whether the flag was set to a value other than an empty string or false
+func given(c *cli.Context, name string) bool {
+	if !c.IsSet(name) {
+		return false
+	}
+
+	// String return the flag value whatever its type
+	v := c.String(name)
+
+	return v != "" && v != "false"
+}
+
+// givenAny tells whether any of the flags was given, see given
+func givenAny(c *cli.Context, names []string) bool {
+	for _, name := range names {
+		if given(c, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// configValue format a YAML scalar as it would be given on the command line
+func configValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case nil:
+		return "", fmt.Errorf("missing value")
+	default:
+		return "", fmt.Errorf("expected a scalar or a list of scalars, got %T", value)
+	}
+}
+
+// checkRequirements fail with every missing flag required by the flags that were set
+func checkRequirements(c *cli.Context, reqs requirements) error {
+	flags := flagNames(c)
+
+	var missing []string
+
+	for name, required := range reqs {
+		for _, r := range required {
+			alternatives := strings.Split(r, "|")
+			for _, a := range alternatives {
+				// a renamed or removed flag, whether it is set or not
+				if !flags[a] {
+					return fmt.Errorf("The flag '%s' required by %s is not a flag of the command", a, name)
+				}
+			}
+
+			if given(c, name) && !givenAny(c, alternatives) {
+				missing = append(missing, fmt.Sprintf("%s (required by %s)", strings.Join(alternatives, " or "), name))
+			}
+		}
+	}
+
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("Missing required configuration: %s", strings.Join(missing, ", "))
+	}
+
+	return nil
+}
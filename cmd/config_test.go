@@ -0,0 +1,322 @@
+package cmd
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+// runServer run the server command with the given arguments, returning the context its
+// action would have started the server with
+func runServer(t *testing.T, config string, args ...string) (*cli.Context, error) {
+	cmd := getServerCmd()
+
+	var ctx *cli.Context
+	cmd.Action = func(c *cli.Context) error {
+		ctx = c
+		return nil
+	}
+
+	if config != "" {
+		file := path.Join(t.TempDir(), "config.yaml")
+		if err := ioutil.WriteFile(file, []byte(config), 0600); err != nil {
+			t.Fatalf("Failed to write the configuration file, %s", err)
+		}
+
+		args = append([]string{"--config", file}, args...)
+	}
+
+	app := cli.NewApp()
+	app.Writer = ioutil.Discard
+	app.ErrWriter = ioutil.Discard
+	app.Commands = []*cli.Command{cmd}
+
+	err := app.Run(append([]string{"k8s-ldap-auth", "server"}, args...))
+
+	return ctx, err
+}
+
+func TestConfigFile(t *testing.T) {
+	c, err := runServer(t, `
+port: 4000
+ldap-host:
+  - ldaps://ldap1.corp
+  - ldaps://ldap2.corp
+ldap-start-tls: false
+bind-dn: cn=admin,dc=corp
+bind-credentials: password
+cache-ttl: 5m
+`)
+	if err != nil {
+		t.Fatalf("server error = %s", err)
+	}
+
+	if got := c.Int("port"); got != 4000 {
+		t.Errorf("port = %d, want 4000", got)
+	}
+
+	if got := c.StringSlice("ldap-host"); !reflect.DeepEqual(got, []string{"ldaps://ldap1.corp", "ldaps://ldap2.corp"}) {
+		t.Errorf("ldap-host = %v, want both hosts of the file", got)
+	}
+
+	if got := c.String("bind-dn"); got != "cn=admin,dc=corp" {
+		t.Errorf("bind-dn = %q, want cn=admin,dc=corp", got)
+	}
+
+	if got := c.Duration("cache-ttl"); got != 5*time.Minute {
+		t.Errorf("cache-ttl = %s, want 5m", got)
+	}
+
+	// flags missing from the file keep their default
+	if got := c.String("search-filter"); got != "(&(objectClass=inetOrgPerson)(uid=%s))" {
+		t.Errorf("search-filter = %q, want the default", got)
+	}
+}
+
+func TestConfigFileErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		args    []string
+		wantErr string
+	}{
+		{
+			name:    "missing required field",
+			config:  "bind-dn: cn=admin,dc=corp\ntls-cert-file: cert.pem\n",
+			wantErr: "Missing required configuration: bind-credentials or bind-credentials-file (required by bind-dn), tls-key-file (required by tls-cert-file)",
+		},
+
+		{
+			name:    "missing required flag",
+			args:    []string{"--ldap-sasl-external"},
+			wantErr: "ldap-client-cert-file (required by ldap-sasl-external)",
+		},
+		{
+			name:    "reload without a password file",
+			args:    []string{"--bind-credentials-reload-interval", "1m"},
+			wantErr: "bind-credentials-file (required by bind-credentials-reload-interval)",
+		},
+		{
+			name:    "unknown keys",
+			config:  "bind_dn: cn=admin,dc=corp\nldap-hosts: ldap://ldap.corp\nport: 4000\n",
+			wantErr: "Unknown keys in configuration file",
+		},
+		{
+			name:    "missing value",
+			config:  "bind-dn:\n",
+			wantErr: "Invalid value for 'bind-dn'",
+		},
+		{
+			name:    "invalid value",
+			config:  "port: many\n",
+			wantErr: "Invalid value for 'port'",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := runServer(t, tt.config, tt.args...)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("server error = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	os.Setenv("LDAP_BINDDN", "cn=env,dc=corp")
+	defer os.Unsetenv("LDAP_BINDDN")
+
+	config := `
+bind-dn: cn=file,dc=corp
+bind-credentials: password
+search-base: ou=file,dc=corp
+port: 4000
+`
+
+	tests := []struct {
+		name   string
+		args   []string
+		bindDN string
+		port   int
+	}{
+		{name: "environment over file", bindDN: "cn=env,dc=corp", port: 4000},
+		{name: "flag over environment and file", args: []string{"--bind-dn", "cn=flag,dc=corp", "--port", "5000"}, bindDN: "cn=flag,dc=corp", port: 5000},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := runServer(t, config, tt.args...)
+			if err != nil {
+				t.Fatalf("server error = %s", err)
+			}
+
+			if got := c.String("bind-dn"); got != tt.bindDN {
+				t.Errorf("bind-dn = %q, want %q", got, tt.bindDN)
+			}
+
+			if got := c.Int("port"); got != tt.port {
+				t.Errorf("port = %d, want %d", got, tt.port)
+			}
+
+			if got := c.StringSlice("search-base"); !reflect.DeepEqual(got, []string{"ou=file,dc=corp"}) {
+				t.Errorf("search-base = %v, want the file value", got)
+			}
+		})
+	}
+}
+
+func TestRequirementAlternatives(t *testing.T) {
+	// the bind password can be given either way
+	for _, config := range []string{
+		"bind-dn: cn=admin,dc=corp\nbind-credentials: password\n",
+		"bind-dn: cn=admin,dc=corp\nbind-credentials-file: /etc/k8s-ldap-auth/ldap/password\n",
+	} {
+		if _, err := runServer(t, config); err != nil {
+			t.Errorf("server with %q error = %s", config, err)
+		}
+	}
+}
+
+func TestRealmConfig(t *testing.T) {
+	os.Setenv("LDAP_BINDDN", "cn=env,dc=corp")
+	defer os.Unsetenv("LDAP_BINDDN")
+
+	c, err := runServer(t, "", "--bind-credentials", "password")
+	if err != nil {
+		t.Fatalf("server error = %s", err)
+	}
+
+	tests := []struct {
+		name    string
+		config  string
+		bindDN  string
+		wantErr string
+	}{
+		{name: "ldap flags", config: "ldap-host: ldaps://ldap.partners\nsearch-base: ou=people,dc=partners\n"},
+		{name: "own bind dn", config: "bind-dn: cn=admin,dc=partners\nbind-credentials: password\n", bindDN: "cn=admin,dc=partners"},
+		{name: "server flag", config: "port: 4000\n", wantErr: "Unknown keys in configuration file"},
+		{name: "missing required field", config: "bind-dn: cn=admin,dc=partners\n", wantErr: "bind-credentials or bind-credentials-file (required by bind-dn)"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := path.Join(t.TempDir(), "realm.yaml")
+			if err := ioutil.WriteFile(file, []byte(tt.config), 0600); err != nil {
+				t.Fatalf("Failed to write the realm file, %s", err)
+			}
+
+			rc, err := realmContext(c, file)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("realmContext() error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("realmContext() error = %s", err)
+			}
+
+			// neither the server flags nor the environment are inherited
+			if got := rc.String("bind-dn"); got != tt.bindDN {
+				t.Errorf("bind-dn = %q, want %q", got, tt.bindDN)
+			}
+
+			if got := rc.String("search-filter"); got != "(&(objectClass=inetOrgPerson)(uid=%s))" {
+				t.Errorf("search-filter = %q, want the default", got)
+			}
+		})
+	}
+}
+
+func TestRequirementsOfUnknownFlags(t *testing.T) {
+	reqs := requirements{}
+
+	app := cli.NewApp()
+	app.Writer = ioutil.Discard
+	app.ErrWriter = ioutil.Discard
+	app.Commands = []*cli.Command{{
+		Name: "test",
+		// the required flag was renamed
+		Flags:  []cli.Flag{reqs.require(&cli.StringFlag{Name: "bind-dn"}, "bind-password")},
+		Before: func(c *cli.Context) error { return checkRequirements(c, reqs) },
+		Action: func(*cli.Context) error { return nil },
+	}}
+
+	// whether the flag requiring it is set or not
+	for _, args := range [][]string{{}, {"--bind-dn", "cn=admin,dc=corp"}} {
+		err := app.Run(append([]string{"k8s-ldap-auth", "test"}, args...))
+		if err == nil || !strings.Contains(err.Error(), "'bind-password' required by bind-dn is not a flag") {
+			t.Errorf("test %v error = %v, want the unknown required flag", args, err)
+		}
+	}
+}
+
+func TestListEnvVars(t *testing.T) {
+	tests := []struct {
+		name  string
+		flag  string
+		env   string
+		value string
+		args  []string
+		want  []string
+	}{
+		{name: "single dn", flag: "search-base", env: "LDAP_USER_SEARCHBASE", value: "ou=people,dc=corp", want: []string{"ou=people,dc=corp"}},
+		{name: "several dn", flag: "search-base", env: "LDAP_USER_SEARCHBASE", value: "ou=people,dc=corp; ou=admins,dc=corp\n", want: []string{"ou=people,dc=corp", "ou=admins,dc=corp"}},
+		{name: "escaped separator", flag: "search-base", env: "LDAP_USER_SEARCHBASE", value: `ou=a\;b,dc=corp`, want: []string{`ou=a\;b,dc=corp`}},
+		{name: "group search base", flag: "group-search-base", env: "LDAP_GROUP_SEARCHBASE", value: "ou=groups,dc=corp", args: []string{"--group-search-filter", "(member=%s)"}, want: []string{"ou=groups,dc=corp"}},
+		{name: "fallback bind dn", flag: "fallback-bind-dn", env: "LDAP_FALLBACK_BINDDN", value: "cn=old,dc=corp;cn=older,dc=corp", args: []string{"--bind-dn", "cn=admin,dc=corp", "--bind-credentials", "password", "--fallback-bind-credentials", "a", "--fallback-bind-credentials", "b"}, want: []string{"cn=old,dc=corp", "cn=older,dc=corp"}},
+		{name: "fallback bind passwords", flag: "fallback-bind-credentials", env: "LDAP_FALLBACK_BINDCREDENTIALS", value: "pass,word;other", args: []string{"--bind-dn", "cn=admin,dc=corp", "--bind-credentials", "password", "--fallback-bind-dn", "cn=old,dc=corp"}, want: []string{"pass,word", "other"}},
+		{name: "allowed group dn", flag: "allowed-group", env: "ALLOWED_GROUPS", value: "cn=admins,ou=groups,dc=corp", want: []string{"cn=admins,ou=groups,dc=corp"}},
+		{name: "denied group dn", flag: "denied-group", env: "DENIED_GROUPS", value: "cn=contractors,ou=groups,dc=corp", want: []string{"cn=contractors,ou=groups,dc=corp"}},
+		{name: "flags over environment", flag: "search-base", env: "LDAP_USER_SEARCHBASE", value: "ou=people,dc=corp", args: []string{"--search-base", "ou=flag,dc=corp"}, want: []string{"ou=flag,dc=corp"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv(tt.env, tt.value)
+			defer os.Unsetenv(tt.env)
+
+			c, err := runServer(t, "", tt.args...)
+			if err != nil {
+				t.Fatalf("server error = %s", err)
+			}
+
+			if got := c.StringSlice(tt.flag); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("%s = %q, want %q", tt.flag, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRealmWithoutServerCredentials(t *testing.T) {
+	// the password file of the server, as mounted at its default location
+	password := path.Join(t.TempDir(), "password")
+	if err := ioutil.WriteFile(password, []byte("server password"), 0600); err != nil {
+		t.Fatalf("Failed to write the password file, %s", err)
+	}
+
+	realmFlags := ldapFlags(requirements{})
+	for _, f := range realmFlags {
+		if s, ok := f.(*cli.StringFlag); ok && s.Name == "bind-credentials" {
+			s.FilePath = password
+		}
+	}
+
+	set := flag.NewFlagSet("realm", flag.ContinueOnError)
+	for _, f := range withoutEnvironment(realmFlags) {
+		if err := f.Apply(set); err != nil {
+			t.Fatalf("Apply() error = %s", err)
+		}
+	}
+
+	if got := set.Lookup("bind-credentials").Value.String(); got != "" {
+		t.Errorf("realm bind-credentials = %q, want none", got)
+	}
+}
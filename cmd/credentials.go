@@ -0,0 +1,76 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+
+	"vbouchaud/k8s-ldap-auth/ldap"
+)
+
+func getTestCredentialsCmd() *cli.Command {
+	reqs := requirements{}
+
+	return &cli.Command{
+		Name:     "test-credentials",
+		Usage:    "search the directory for a user with the server ldap configuration and print the user dn and what a token would hold, to check the configuration without starting the server, the password being read from the first line of stdin",
+		HideHelp: false,
+		Before: func(c *cli.Context) error {
+			return checkRequirements(c, reqs)
+		},
+		Flags: flags(
+			[]cli.Flag{
+				&cli.StringFlag{
+					Name:     "username",
+					Required: true,
+					Usage:    "The `USERNAME` to search for, as it would be sent to /auth.",
+				},
+			},
+			ldapFlags(reqs),
+		),
+		Action: func(c *cli.Context) error {
+			// never from a flag or an environment variable, which other processes can read
+			line, err := bufio.NewReader(c.App.Reader).ReadString('\n')
+			if err != nil && line == "" {
+				return fmt.Errorf("Could not read the password from stdin, %w", err)
+			}
+
+			password := strings.TrimRight(line, "\r\n")
+
+			l, err := newLdap(c, ldap.WithDNExtra())
+			if err != nil {
+				return fmt.Errorf("There was an error instanciating the ldap client, %w", err)
+			}
+
+			// the same search as /auth, from the username through the groups formatting
+			user, err := l.Search(context.Background(), c.String("username"), password)
+			if err != nil {
+				return fmt.Errorf("The search failed, %w", err)
+			}
+
+			// the dn is not always the uid, ie. with --uid-property or --omit-dn
+			fmt.Fprintf(c.App.Writer, "dn: %s\n", strings.Join(user.Extra[ldap.DNExtraKey], ""))
+			delete(user.Extra, ldap.DNExtraKey)
+
+			fmt.Fprintf(c.App.Writer, "uid: %s\n", user.UID)
+			fmt.Fprintf(c.App.Writer, "username: %s\n", user.Username)
+			fmt.Fprintf(c.App.Writer, "groups: %s\n", strings.Join(user.Groups, ", "))
+
+			names := make([]string, 0, len(user.Extra))
+			for name := range user.Extra {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+
+			for _, name := range names {
+				fmt.Fprintf(c.App.Writer, "extra %s: %s\n", name, strings.Join(user.Extra[name], ", "))
+			}
+
+			return nil
+		},
+	}
+}
@@ -0,0 +1,124 @@
+package cmd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/urfave/cli/v2"
+
+	"vbouchaud/k8s-ldap-auth/internal/ldaptest"
+	"vbouchaud/k8s-ldap-auth/ldap"
+)
+
+func TestTestCredentials(t *testing.T) {
+	srv, err := ldaptest.NewServer(
+		ldaptest.Entry{DN: "cn=admin,dc=corp", Password: "password"},
+		ldaptest.Entry{
+			DN:       "uid=john,ou=people,dc=corp",
+			Password: "secret",
+			Attributes: map[string][]string{
+				"uid":      {"john"},
+				"mail":     {"john@corp"},
+				"memberof": {"cn=admins,ou=groups,dc=corp", "cn=devs,ou=groups,dc=corp"},
+			},
+		},
+		ldaptest.Entry{DN: "uid=jane,ou=people,dc=corp", Password: "secret", Attributes: map[string][]string{"uid": {"jane"}}},
+		ldaptest.Entry{DN: "uid=jane,ou=admins,dc=corp", Password: "secret", Attributes: map[string][]string{"uid": {"jane"}}},
+	)
+	if err != nil {
+		t.Fatalf("Failed to start the ldap server, %s", err)
+	}
+	defer srv.Close()
+
+	ldapArgs := []string{
+		"--ldap-host", srv.URL,
+		"--bind-dn", "cn=admin,dc=corp",
+		"--bind-credentials", "password",
+		"--search-base", "dc=corp",
+		"--search-filter", "(uid=%s)",
+		"--group-format", ldap.GroupFormatCN,
+		"--memberof-property", "memberof",
+		"--extra-attributes", "mail",
+	}
+
+	tests := []struct {
+		name    string
+		args    []string
+		stdin   string
+		want    string
+		wantErr string
+	}{
+		{
+			name:  "valid credentials",
+			args:  []string{"--username", "john"},
+			stdin: "secret\n",
+			want:  "dn: uid=john,ou=people,dc=corp\nuid: uid=john,ou=people,dc=corp\nusername: john\ngroups: admins, devs\nextra mail: john@corp\n",
+		},
+		{
+			name:  "renamed extra attribute",
+			args:  []string{"--username", "john", "--extra-attributes", "email=mail"},
+			stdin: "secret\n",
+			want:  "dn: uid=john,ou=people,dc=corp\nuid: uid=john,ou=people,dc=corp\nusername: john\ngroups: admins, devs\nextra email: john@corp\nextra mail: john@corp\n",
+		},
+		{
+			name:  "dn omitted from the uid",
+			args:  []string{"--username", "john", "--omit-dn"},
+			stdin: "secret",
+			want:  "dn: uid=john,ou=people,dc=corp\nuid: john\nusername: john\ngroups: admins, devs\nextra mail: john@corp\n",
+		},
+		{
+			name:    "no password",
+			args:    []string{"--username", "john"},
+			wantErr: "Could not read the password from stdin",
+		},
+		{
+			name:    "invalid credentials",
+			args:    []string{"--username", "john"},
+			stdin:   "wrong\n",
+			wantErr: ldap.ErrInvalidCredentials.Error(),
+		},
+		{
+			name:    "unknown user",
+			args:    []string{"--username", "nobody"},
+			stdin:   "secret\n",
+			wantErr: ldap.ErrUserNotFound.Error(),
+		},
+		{
+			name:    "several entries",
+			args:    []string{"--username", "jane"},
+			stdin:   "secret\n",
+			wantErr: ldap.ErrTooManyEntries.Error(),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+
+			app := cli.NewApp()
+			app.Reader = strings.NewReader(tt.stdin)
+			app.Writer = &out
+			app.ErrWriter = ioutil.Discard
+			app.Commands = []*cli.Command{getTestCredentialsCmd()}
+
+			err := app.Run(append(append([]string{"k8s-ldap-auth", "test-credentials"}, tt.args...), ldapArgs...))
+
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("test-credentials error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("test-credentials error = %s", err)
+			}
+
+			if got := out.String(); got != tt.want {
+				t.Errorf("test-credentials output = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
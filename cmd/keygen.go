@@ -0,0 +1,38 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/urfave/cli/v2"
+
+	"vbouchaud/k8s-ldap-auth/types"
+)
+
+func getKeygenCmd() *cli.Command {
+	return &cli.Command{
+		Name:     "keygen",
+		Usage:    "generate a signing key and print it PEM encoded, followed by its public key, to be given to the server with --private-key-file",
+		HideHelp: false,
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "algorithm",
+				Value: "RS256",
+				Usage: "The `ALGORITHM` of the key, RS256 or ES256.",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			priv, pub, err := types.GenerateKeyPEM(jwa.SignatureAlgorithm(c.String("algorithm")))
+			if err != nil {
+				return fmt.Errorf("Could not generate the key, %w", err)
+			}
+
+			if _, err := os.Stdout.Write(append(priv, pub...)); err != nil {
+				return err
+			}
+
+			return nil
+		},
+	}
+}
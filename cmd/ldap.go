@@ -0,0 +1,408 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v2"
+
+	"vbouchaud/k8s-ldap-auth/ldap"
+)
+
+// ldapFlags return the flags configuring the ldap search, shared by the commands reaching the
+// directory, see ldapOptions. Their requirements are recorded in reqs.
+func ldapFlags(reqs requirements) []cli.Flag {
+	return []cli.Flag{
+		// ldap server configuration
+		&cli.StringSliceFlag{
+			Name:    "ldap-host",
+			Value:   cli.NewStringSlice("ldap://localhost"),
+			EnvVars: []string{"LDAP_ADDR"},
+			Usage:   "Repeatable. The ldap `HOST` (and scheme) the server will authenticate against. Hosts are tried in order until one is reachable.",
+		},
+		&cli.BoolFlag{
+			Name:    "ldap-randomize-hosts",
+			Value:   false,
+			EnvVars: []string{"LDAP_RANDOMIZE_ADDR"},
+			Usage:   "Try the ldap hosts in a random order instead of the given one.",
+		},
+		&cli.DurationFlag{
+			Name:    "ldap-dial-timeout",
+			Value:   ldap.DefaultDialTimeout,
+			EnvVars: []string{"LDAP_DIAL_TIMEOUT"},
+			Usage:   "The maximum `DURATION` spent dialing each ldap host.",
+		},
+		&cli.IntFlag{
+			Name:    "ldap-retry-attempts",
+			Value:   ldap.DefaultRetryAttempts,
+			EnvVars: []string{"LDAP_RETRY_ATTEMPTS"},
+			Usage:   "The `NUMBER` of times dialing and binding is tried when the ldap hosts cannot be reached or are busy. Rejected credentials are never retried.",
+		},
+		&cli.DurationFlag{
+			Name:    "ldap-retry-backoff",
+			Value:   ldap.DefaultRetryBackoff,
+			EnvVars: []string{"LDAP_RETRY_BACKOFF"},
+			Usage:   "The `DURATION` waited before the first retry, doubled at each attempt.",
+		},
+		&cli.Float64Flag{
+			Name:    "ldap-retry-jitter",
+			Value:   ldap.DefaultRetryJitter,
+			EnvVars: []string{"LDAP_RETRY_JITTER"},
+			Usage:   "The `RATIO`, from 0 to 1, of the backoff randomly added to it.",
+		},
+		&cli.DurationFlag{
+			Name:    "ldap-operation-timeout",
+			Value:   ldap.DefaultOperationTimeout,
+			EnvVars: []string{"LDAP_OPERATION_TIMEOUT"},
+			Usage:   "The maximum `DURATION` to wait for the ldap server to answer a bind or a search.",
+		},
+		&cli.StringFlag{
+			Name:    "ldap-ca-file",
+			EnvVars: []string{"LDAP_CA_FILE"},
+			Usage:   "The `PATH` to a PEM encoded CA bundle used to verify the ldaps server certificate instead of the system pool.",
+		},
+		reqs.require(&cli.StringFlag{
+			Name:    "ldap-client-cert-file",
+			EnvVars: []string{"LDAP_CLIENT_CERT_FILE"},
+			Usage:   "The `PATH` to a PEM encoded client certificate presented to the ldap server, along with --ldap-client-key-file.",
+		}, "ldap-client-key-file"),
+		reqs.require(&cli.StringFlag{
+			Name:    "ldap-client-key-file",
+			EnvVars: []string{"LDAP_CLIENT_KEY_FILE"},
+			Usage:   "The `PATH` to the PEM encoded private key of --ldap-client-cert-file.",
+		}, "ldap-client-cert-file"),
+		reqs.require(&cli.BoolFlag{
+			Name:    "ldap-sasl-external",
+			Value:   false,
+			EnvVars: []string{"LDAP_SASL_EXTERNAL"},
+			Usage:   "Authenticate the service account with its client certificate (SASL EXTERNAL) instead of --bind-dn and --bind-credentials.",
+		}, "ldap-client-cert-file"),
+		&cli.BoolFlag{
+			Name:    "ldap-start-tls",
+			Value:   false,
+			EnvVars: []string{"LDAP_START_TLS"},
+			Usage:   "Upgrade the plain ldap:// connection with StartTLS before binding.",
+		},
+		&cli.BoolFlag{
+			Name:    "ldap-follow-referrals",
+			Value:   false,
+			EnvVars: []string{"LDAP_FOLLOW_REFERRALS"},
+			Usage:   "Follow the referrals returned by the user searches. The service account and user credentials are sent to the referred hosts, restrict them with --ldap-referral-host.",
+		},
+		&cli.StringSliceFlag{
+			Name:    "ldap-referral-host",
+			EnvVars: []string{"LDAP_REFERRAL_HOST"},
+			Usage:   "The `HOST`, with or without its port, referrals can be followed to. Repeatable, any host is followed to when omitted.",
+		},
+		&cli.BoolFlag{
+			Name:    "ldap-insecure-skip-verify",
+			Value:   false,
+			EnvVars: []string{"LDAP_INSECURE_SKIP_VERIFY"},
+			Usage:   "Disable the verification of the ldaps server certificate and hostname. Do not use in production.",
+		},
+		&cli.IntFlag{
+			Name:    "ldap-pool-size",
+			Value:   ldap.DefaultPoolSize,
+			EnvVars: []string{"LDAP_POOL_SIZE"},
+			Usage:   "The maximum `NUMBER` of service account connections kept open to the ldap server.",
+		},
+		&cli.DurationFlag{
+			Name:    "ldap-pool-idle-timeout",
+			Value:   ldap.DefaultPoolIdleTimeout,
+			EnvVars: []string{"LDAP_POOL_IDLETIMEOUT"},
+			Usage:   "The `DURATION` after which an idle ldap connection is closed.",
+		},
+		&cli.IntFlag{
+			Name:    "ldap-max-concurrent-searches",
+			Value:   0,
+			EnvVars: []string{"LDAP_MAX_CONCURRENT_SEARCHES"},
+			Usage:   "The maximum `NUMBER` of searches reaching the ldap server at once, the authentications beyond it are answered with a 503. 0 disables the limit.",
+		},
+		&cli.DurationFlag{
+			Name:    "ldap-concurrent-searches-wait",
+			Value:   time.Second,
+			EnvVars: []string{"LDAP_CONCURRENT_SEARCHES_WAIT"},
+			Usage:   "The `DURATION` a search waits for another one to end once --ldap-max-concurrent-searches is reached before being rejected. 0 rejects it right away.",
+		},
+
+		// bind dn configuration
+		reqs.require(&cli.StringFlag{
+			Name:    "bind-dn",
+			EnvVars: []string{"LDAP_BINDDN"},
+			Usage:   "The service account `DN` to do the ldap search. The search is anonymous when omitted, unless --user-dn-template is set.",
+		}, "bind-credentials|bind-credentials-file"),
+		&cli.StringFlag{
+			Name:     "bind-credentials",
+			EnvVars:  []string{"LDAP_BINDCREDENTIALS"},
+			FilePath: "/etc/k8s-ldap-auth/ldap/password",
+			Usage:    "The service account `PASSWORD` to do the ldap search, can be located in '/etc/k8s-ldap-auth/ldap/password'.",
+		},
+		&cli.StringFlag{
+			Name:    "bind-credentials-file",
+			EnvVars: []string{"LDAP_BINDCREDENTIALS_FILE"},
+			Usage:   "The `PATH` to a file holding the service account password, ie. a mounted secret, read instead of --bind-credentials so that the password is neither in the arguments nor in the environment.",
+		},
+		reqs.require(&cli.DurationFlag{
+			Name:    "bind-credentials-reload-interval",
+			EnvVars: []string{"LDAP_BINDCREDENTIALS_RELOAD_INTERVAL"},
+			Usage:   "The `DURATION` between two checks of --bind-credentials-file for a rotated password, used by the next binds without restarting. 0 never checks it again.",
+		}, "bind-credentials-file"),
+		reqs.require(newListFlag(&cli.StringSliceFlag{
+			Name:    "fallback-bind-dn",
+			EnvVars: []string{"LDAP_FALLBACK_BINDDN"},
+			Usage:   "Repeatable. A service account `DN` bound as, in order, when the ldap server rejects --bind-dn. Each requires a --fallback-bind-credentials, given in the same order. The dn of the environment variable are separated by ';'.",
+		}), "bind-dn", "fallback-bind-credentials"),
+		newListFlag(&cli.StringSliceFlag{
+			Name:    "fallback-bind-credentials",
+			EnvVars: []string{"LDAP_FALLBACK_BINDCREDENTIALS"},
+			Usage:   "Repeatable. The `PASSWORD` of each --fallback-bind-dn. The passwords of the environment variable are separated by ';', those containing one must be given as flags or in the configuration file.",
+		}),
+
+		// user search configuration
+		&cli.StringFlag{
+			Name:    "user-dn-template",
+			EnvVars: []string{"LDAP_USER_DNTEMPLATE"},
+			Usage:   "The `TEMPLATE` of the user dn, ie. 'uid=%s,ou=people,dc=corp'. When set, users bind directly and no service account is used.",
+		},
+		newListFlag(&cli.StringSliceFlag{
+			Name:    "search-base",
+			EnvVars: []string{"LDAP_USER_SEARCHBASE"},
+			Usage:   "Repeatable. The `DN` where the ldap search will take place. Exactly one user must match across all the search bases. The search bases of the environment variable are separated by ';'.",
+		}),
+		&cli.StringFlag{
+			Name:    "search-filter",
+			Value:   "(&(objectClass=inetOrgPerson)(uid=%s))",
+			EnvVars: []string{"LDAP_USER_SEARCHFILTER"},
+			Usage:   "The `FILTER` to select users, where {{.Username}} is replaced by the escaped username, ie. '(|(uid={{.Username}})(mail={{.Username}}))'. A single %s is replaced the same way in filters without placeholders.",
+		},
+		&cli.StringSliceFlag{
+			Name:    "memberof-property",
+			Value:   cli.NewStringSlice("ismemberof"),
+			EnvVars: []string{"LDAP_USER_MEMBEROFPROPERTY"},
+			Usage:   "Repeatable. The `PROPERTY` that will be used to fetch groups. Usually memberof or ismemberof. The groups of every property are merged.",
+		},
+		&cli.StringFlag{
+			Name:    "group-format",
+			Value:   ldap.GroupFormatDN,
+			EnvVars: []string{"LDAP_USER_GROUPFORMAT"},
+			Usage:   "The `FORMAT` of the group names. Can take the values full dn: 'dn', first rdn value: 'rdn' or cn value: 'cn'.",
+		},
+		&cli.StringFlag{
+			Name:    "group-filter",
+			EnvVars: []string{"LDAP_USER_GROUPFILTER"},
+			Usage:   "A `REGEXP` the lowercased group names must match to be kept, ie. '^k8s-'. Every group is kept when omitted.",
+		},
+		&cli.StringFlag{
+			Name:    "group-search-filter",
+			Value:   "",
+			EnvVars: []string{"LDAP_GROUP_SEARCHFILTER"},
+			Usage:   "The `FILTER` of a search for the groups of the user, with the user dn replacing %s, ie. '(&(objectClass=groupOfNames)(member=%s))'. The groups are read from --memberof-property when empty.",
+		},
+		reqs.require(newListFlag(&cli.StringSliceFlag{
+			Name:    "group-search-base",
+			EnvVars: []string{"LDAP_GROUP_SEARCHBASE"},
+			Usage:   "Repeatable. The `DN` the groups are searched in with --group-search-filter, the user search bases when omitted. The search bases of the environment variable are separated by ';'.",
+		}), "group-search-filter"),
+		&cli.IntFlag{
+			Name:    "nested-groups-depth",
+			Value:   0,
+			EnvVars: []string{"LDAP_USER_NESTEDGROUPSDEPTH"},
+			Usage:   "The `DEPTH` up to which the groups of the user groups are resolved. 0 disables nested groups resolution.",
+		},
+		&cli.StringFlag{
+			Name:    "username-property",
+			Value:   "uid",
+			EnvVars: []string{"LDAP_USER_USERNAMEPROPERTY"},
+			Usage:   "The `PROPERTY` that will be used as username in the TokenReview.",
+		},
+		&cli.StringFlag{
+			Name:    "uid-property",
+			EnvVars: []string{"LDAP_USER_UIDPROPERTY"},
+			Usage:   "The `PROPERTY` that will be used as uid in the TokenReview. Defaults to the user dn.",
+		},
+		&cli.BoolFlag{
+			Name:    "case-sensitive",
+			Value:   false,
+			EnvVars: []string{"LDAP_USER_CASESENSITIVE"},
+			Usage:   "Keep the uid and username casing as returned by the ldap server instead of lowercasing them.",
+		},
+		&cli.BoolFlag{
+			Name:    "omit-dn",
+			Value:   false,
+			EnvVars: []string{"LDAP_USER_OMITDN"},
+			Usage:   "Keep the user dn out of the tokens and logs, the TokenReview uid is then the username unless --uid-property is set.",
+		},
+		&cli.StringSliceFlag{
+			Name:    "extra-attributes",
+			EnvVars: []string{"LDAP_USER_EXTRAATTR"},
+			Usage:   "Repeatable. User `PROPERTY` to fetch. Those will be stored in extra values in the UserInfo object, under the property name or under NAME when given as NAME=PROPERTY, ie. displayName=cn.",
+		},
+		&cli.UintFlag{
+			Name:    "search-page-size",
+			Value:   0,
+			EnvVars: []string{"LDAP_SEARCH_PAGESIZE"},
+			Usage:   "The `SIZE` of the result pages when the ldap server requires paged searches. 0 disables paging.",
+		},
+		&cli.StringFlag{
+			Name:    "search-scope",
+			Value:   "sub",
+			EnvVars: []string{"LDAP_USER_SEARCHSCOPE"},
+			Usage:   "The `SCOPE` of the search. Can take to values base object: 'base', single level: 'single' (or 'one', 'onelevel') or whole subtree: 'sub' (or 'subtree'). Any other value is refused.",
+		},
+	}
+}
+
+// ldapOptions build the ldap options from the ldapFlags
+func ldapOptions(c *cli.Context) ([]ldap.Option, error) {
+	opts := []ldap.Option{
+		ldap.WithPool(c.Int("ldap-pool-size"), c.Duration("ldap-pool-idle-timeout")),
+		ldap.WithMaxConcurrentSearches(c.Int("ldap-max-concurrent-searches"), c.Duration("ldap-concurrent-searches-wait")),
+		ldap.WithDialTimeout(c.Duration("ldap-dial-timeout")),
+		ldap.WithOperationTimeout(c.Duration("ldap-operation-timeout")),
+		ldap.WithRetry(c.Int("ldap-retry-attempts"), c.Duration("ldap-retry-backoff"), c.Float64("ldap-retry-jitter")),
+		ldap.WithNestedGroups(c.Int("nested-groups-depth")),
+		ldap.WithGroupSearch(c.String("group-search-filter"), c.StringSlice("group-search-base")),
+		ldap.WithGroupFormat(c.String("group-format")),
+		ldap.WithGroupFilter(c.String("group-filter")),
+		ldap.WithAttributeMap(attributeMap(c)),
+		ldap.WithPaging(uint32(c.Uint("search-page-size"))),
+		ldap.WithUserDNTemplate(c.String("user-dn-template")),
+	}
+
+	if fallbackDNs := c.StringSlice("fallback-bind-dn"); len(fallbackDNs) > 0 {
+		fallbackPasswords := c.StringSlice("fallback-bind-credentials")
+		if len(fallbackPasswords) != len(fallbackDNs) {
+			return nil, fmt.Errorf("Every --fallback-bind-dn requires a --fallback-bind-credentials, got %d dn and %d passwords", len(fallbackDNs), len(fallbackPasswords))
+		}
+
+		accounts := make([]ldap.BindAccount, len(fallbackDNs))
+		for i, dn := range fallbackDNs {
+			accounts[i] = ldap.BindAccount{DN: dn, Password: fallbackPasswords[i]}
+		}
+
+		opts = append(opts, ldap.WithFallbackBindAccounts(accounts...))
+	}
+
+	if passwordFile := c.String("bind-credentials-file"); passwordFile != "" {
+		opts = append(opts, ldap.WithBindPasswordFile(passwordFile))
+	}
+
+	if interval := c.Duration("bind-credentials-reload-interval"); interval > 0 {
+		opts = append(opts, ldap.WithBindPasswordReload(interval))
+	}
+
+	if c.Bool("case-sensitive") {
+		opts = append(opts, ldap.WithCaseSensitive())
+	}
+
+	if c.Bool("omit-dn") {
+		opts = append(opts, ldap.WithoutDN())
+	}
+
+	if c.Bool("ldap-randomize-hosts") {
+		opts = append(opts, ldap.WithRandomizedURLs())
+	}
+
+	if c.Bool("ldap-insecure-skip-verify") {
+		opts = append(opts, ldap.WithInsecureSkipVerify(true))
+	}
+
+	if caFile := c.String("ldap-ca-file"); caFile != "" {
+		opts = append(opts, ldap.WithCAFile(caFile))
+	}
+
+	if c.Bool("ldap-start-tls") {
+		opts = append(opts, ldap.WithStartTLS())
+	}
+
+	if certFile := c.String("ldap-client-cert-file"); certFile != "" {
+		opts = append(opts, ldap.WithClientCertFile(certFile, c.String("ldap-client-key-file")))
+	}
+
+	if c.Bool("ldap-sasl-external") {
+		opts = append(opts, ldap.WithExternalBind())
+	}
+
+	if c.Bool("ldap-follow-referrals") {
+		opts = append(opts, ldap.WithReferrals(c.StringSlice("ldap-referral-host")))
+	}
+
+	return opts, nil
+}
+
+// newLdap build the ldap instance configured by the ldapFlags, the given options applying
+// after the flags ones
+func newLdap(c *cli.Context, opts ...ldap.Option) (*ldap.Ldap, error) {
+	flagOptions, err := ldapOptions(c)
+	if err != nil {
+		return nil, err
+	}
+
+	// the attributes read from the user entry, and so requested, are those of the attribute
+	// map set by ldapOptions
+	var (
+		memberofProperty = firstMemberofProperty(c)
+		usernameProperty = c.String("username-property")
+	)
+
+	return ldap.NewInstance(
+		c.StringSlice("ldap-host"),
+		c.String("bind-dn"),
+		c.String("bind-credentials"),
+		c.StringSlice("search-base"),
+		c.String("search-scope"),
+		c.String("search-filter"),
+		memberofProperty,
+		usernameProperty,
+		nil,
+		[]string{memberofProperty, usernameProperty},
+		append(flagOptions, opts...)...,
+	)
+}
+
+// firstMemberofProperty return the first --memberof-property, given to NewInstance before
+// the attribute map replaces it
+func firstMemberofProperty(c *cli.Context) string {
+	if properties := c.StringSlice("memberof-property"); len(properties) > 0 {
+		return properties[0]
+	}
+
+	return ""
+}
+
+// attributeMap build the attribute map from the user property flags. Every extra attribute
+// is either a property, kept under its own name in the extra values, or NAME=PROPERTY to
+// keep it under another name, ie. displayName=cn.
+func attributeMap(c *cli.Context) ldap.AttributeMap {
+	m := ldap.AttributeMap{
+		Username: c.String("username-property"),
+		UID:      c.String("uid-property"),
+		Groups:   c.StringSlice("memberof-property"),
+	}
+
+	for _, item := range c.StringSlice("extra-attributes") {
+		name, property := item, item
+		if i := strings.Index(item, "="); i >= 0 {
+			name, property = item[:i], item[i+1:]
+		}
+
+		if m.Extra == nil {
+			m.Extra = map[string]string{}
+		}
+
+		m.Extra[name] = property
+	}
+
+	return m
+}
+
+// flags concatenate groups of flags
+func flags(groups ...[]cli.Flag) []cli.Flag {
+	var all []cli.Flag
+	for _, g := range groups {
+		all = append(all, g...)
+	}
+
+	return all
+}
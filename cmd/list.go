@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+)
+
+// listFlag is a repeatable flag whose environment variable holds values separated by ";" or
+// newlines, where cli.StringSliceFlag splits on ",": its values are dn or passwords, which
+// contain commas. A ";" escaped as "\;", as in a dn, does not separate values and is kept
+// escaped. The repeated flags and the lists of the configuration file are taken as is.
+type listFlag struct {
+	*cli.StringSliceFlag
+}
+
+// newListFlag make f a listFlag
+func newListFlag(f *cli.StringSliceFlag) cli.Flag {
+	return &listFlag{f}
+}
+
+// Apply set the values from the environment, then register the flag without its environment
+// variables so that cli.StringSliceFlag does not split them again
+func (f *listFlag) Apply(set *flag.FlagSet) error {
+	if value, ok := lookupList(f.EnvVars, f.FilePath); ok {
+		// like the cli.StringSliceFlag ones, the repeated flags replace these values
+		f.Value = cli.NewStringSlice(splitList(value)...)
+		f.HasBeenSet = true
+	}
+
+	plain := *f.StringSliceFlag
+	plain.EnvVars, plain.FilePath = nil, ""
+
+	if err := plain.Apply(set); err != nil {
+		return err
+	}
+
+	f.Value = plain.Value
+
+	return nil
+}
+
+// lookupList return the value of the first environment variable set, or the content of the
+// file when none is
+func lookupList(envVars []string, filePath string) (string, bool) {
+	for _, name := range envVars {
+		if value, ok := os.LookupEnv(strings.TrimSpace(name)); ok {
+			return value, true
+		}
+	}
+
+	if filePath != "" {
+		if data, err := ioutil.ReadFile(filePath); err == nil {
+			return string(data), true
+		}
+	}
+
+	return "", false
+}
+
+// splitList split value on ";" and newlines, but not on "\;", dropping the empty values
+func splitList(value string) []string {
+	var (
+		items []string
+		start int
+	)
+
+	add := func(item string) {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	for i := 0; i < len(value); i++ {
+		switch value[i] {
+		case '\\':
+			// the escaped character, ie. the "\;" of a dn, is part of the value
+			i++
+		case ';', '\n':
+			add(value[start:i])
+			start = i + 1
+		}
+	}
+	add(value[start:])
+
+	return items
+}
@@ -62,6 +62,8 @@ func Start() error {
 		getServerCmd(),
 		getAuthenticationCmd(),
 		getResetCmd(),
+		getKeygenCmd(),
+		getTestCredentialsCmd(),
 	}
 
 	return app.Run(os.Args)
@@ -0,0 +1,92 @@
+package cmd
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+
+	"vbouchaud/k8s-ldap-auth/ldap"
+	"vbouchaud/k8s-ldap-auth/server"
+)
+
+// realmOptions build a server.WithRealm option for every --realm, the ldap of each realm being
+// configured by its own file, see realmContext
+func realmOptions(c *cli.Context, opts ...ldap.Option) ([]server.Option, error) {
+	var realms []server.Option
+
+	for _, item := range c.StringSlice("realm") {
+		i := strings.Index(item, "=")
+		if i <= 0 || i == len(item)-1 {
+			return nil, fmt.Errorf("Invalid realm '%s', expected NAME=PATH", item)
+		}
+
+		name, path := item[:i], item[i+1:]
+
+		rc, err := realmContext(c, path)
+		if err != nil {
+			return nil, fmt.Errorf("Realm '%s', %w", name, err)
+		}
+
+		l, err := newLdap(rc, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("Realm '%s', %w", name, err)
+		}
+
+		realms = append(realms, server.WithRealm(name, l))
+	}
+
+	return realms, nil
+}
+
+// realmContext return a context holding the ldapFlags read from the YAML file of a realm,
+// keyed by flag name as with --config. The flags of the server, the environment variables and
+// the files the flags default to are not inherited, a realm being another directory.
+func realmContext(c *cli.Context, path string) (*cli.Context, error) {
+	reqs := requirements{}
+	realmFlags := withoutEnvironment(ldapFlags(reqs))
+
+	set := flag.NewFlagSet(path, flag.ContinueOnError)
+	for _, f := range realmFlags {
+		if err := f.Apply(set); err != nil {
+			return nil, err
+		}
+	}
+
+	rc := cli.NewContext(c.App, set, nil)
+	rc.Command.Flags = realmFlags
+
+	if err := applyConfigFile(rc, path); err != nil {
+		return nil, err
+	}
+
+	return rc, checkRequirements(rc, reqs)
+}
+
+// withoutEnvironment drop the environment variables and the files the flags default to, ie.
+// the bind password file of the server, so that they are only set by their configuration file
+func withoutEnvironment(flags []cli.Flag) []cli.Flag {
+	for _, f := range flags {
+		switch f := f.(type) {
+		case *cli.BoolFlag:
+			f.EnvVars, f.FilePath = nil, ""
+		case *cli.DurationFlag:
+			f.EnvVars, f.FilePath = nil, ""
+		case *cli.Float64Flag:
+			f.EnvVars, f.FilePath = nil, ""
+		case *cli.IntFlag:
+			f.EnvVars, f.FilePath = nil, ""
+		case *cli.UintFlag:
+			f.EnvVars, f.FilePath = nil, ""
+		case *cli.StringFlag:
+			f.EnvVars, f.FilePath = nil, ""
+		case *cli.StringSliceFlag:
+			f.EnvVars, f.FilePath = nil, ""
+		case *listFlag:
+			f.EnvVars, f.FilePath = nil, ""
+		}
+	}
+
+	return flags
+}
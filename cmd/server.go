@@ -1,161 +1,612 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
 	"github.com/urfave/cli/v2"
 
+	"vbouchaud/k8s-ldap-auth/ldap"
 	"vbouchaud/k8s-ldap-auth/server"
+	"vbouchaud/k8s-ldap-auth/server/middlewares"
+	"vbouchaud/k8s-ldap-auth/static"
+	"vbouchaud/k8s-ldap-auth/types"
 )
 
 func getServerCmd() *cli.Command {
+	reqs := requirements{}
+
 	return &cli.Command{
 		Name:     "server",
 		Aliases:  []string{"s", "serve"},
 		Usage:    "start the authentication server",
 		HideHelp: false,
-		Flags: []cli.Flag{
-			// server configuration
-			&cli.StringFlag{
-				Name:    "host",
-				Value:   "",
-				EnvVars: []string{"HOST"},
-				Usage:   "The `HOST` the server will listen on.",
-			},
-			&cli.IntFlag{
-				Name:    "port",
-				Value:   3000,
-				EnvVars: []string{"PORT"},
-				Usage:   "The `PORT` the server will listen to.",
-			},
+		Before: func(c *cli.Context) error {
+			return loadConfig(c, reqs)
+		},
+		Flags: flags(
+			[]cli.Flag{
+				&cli.StringFlag{
+					Name:    "config",
+					EnvVars: []string{"CONFIG_FILE"},
+					Usage:   "The `PATH` to a YAML file holding the flags values, keyed by flag name. Flags given on the command line or through their environment variables take precedence.",
+				},
 
-			// ldap server configuration
-			&cli.StringFlag{
-				Name:    "ldap-host",
-				Value:   "ldap://localhost",
-				EnvVars: []string{"LDAP_ADDR"},
-				Usage:   "The ldap `HOST` (and scheme) the server will authenticate against.",
+				// server configuration
+				&cli.StringFlag{
+					Name:    "host",
+					Value:   "",
+					EnvVars: []string{"HOST"},
+					Usage:   "The `HOST` the server will listen on.",
+				},
+				&cli.IntFlag{
+					Name:    "port",
+					Value:   3000,
+					EnvVars: []string{"PORT"},
+					Usage:   "The `PORT` the server will listen to.",
+				},
+				&cli.StringFlag{
+					Name:    "unix-socket",
+					EnvVars: []string{"UNIX_SOCKET"},
+					Usage:   "The `PATH` of a unix socket to listen on instead of --host and --port, ie. to be shared with the api server container.",
+				},
+				&cli.StringFlag{
+					Name:    "base-path",
+					EnvVars: []string{"BASE_PATH"},
+					Usage:   "The `PATH` every route is served below, ie. '/k8s-ldap-auth' to serve /k8s-ldap-auth/auth. Routes are served at the root when omitted.",
+				},
+				&cli.DurationFlag{
+					Name:    "shutdown-timeout",
+					Value:   30 * time.Second,
+					EnvVars: []string{"SHUTDOWN_TIMEOUT"},
+					Usage:   "The maximum `DURATION` to wait for in-flight requests to complete when stopping.",
+				},
+				&cli.StringFlag{
+					Name:    "access-log-format",
+					Value:   middlewares.FormatJSON,
+					EnvVars: []string{"ACCESS_LOG_FORMAT"},
+					Usage:   "The `FORMAT` of the access logs, json or text.",
+				},
+				&cli.DurationFlag{
+					Name:    "read-header-timeout",
+					Value:   server.DefaultReadHeaderTimeout,
+					EnvVars: []string{"READ_HEADER_TIMEOUT"},
+					Usage:   "The maximum `DURATION` allowed to read the request headers.",
+				},
+				&cli.DurationFlag{
+					Name:    "read-timeout",
+					Value:   server.DefaultReadTimeout,
+					EnvVars: []string{"READ_TIMEOUT"},
+					Usage:   "The maximum `DURATION` allowed to read the whole request.",
+				},
+				&cli.DurationFlag{
+					Name:    "write-timeout",
+					Value:   server.DefaultWriteTimeout,
+					EnvVars: []string{"WRITE_TIMEOUT"},
+					Usage:   "The maximum `DURATION` allowed to handle a request and write its response.",
+				},
+				&cli.DurationFlag{
+					Name:    "idle-timeout",
+					Value:   server.DefaultIdleTimeout,
+					EnvVars: []string{"IDLE_TIMEOUT"},
+					Usage:   "The maximum `DURATION` a keep-alive connection is kept open between two requests.",
+				},
+				&cli.Int64Flag{
+					Name:    "max-body-size",
+					Value:   server.DefaultMaxBodySize,
+					EnvVars: []string{"MAX_BODY_SIZE"},
+					Usage:   "The maximum `SIZE` in bytes of the authentication and token review request bodies.",
+				},
+				&cli.Float64Flag{
+					Name:    "rate-limit",
+					Value:   0,
+					EnvVars: []string{"RATE_LIMIT"},
+					Usage:   "The maximum `NUMBER` of authentication requests per second accepted from each client ip, 0 disables rate limiting.",
+				},
+				&cli.IntFlag{
+					Name:    "rate-limit-burst",
+					Value:   10,
+					EnvVars: []string{"RATE_LIMIT_BURST"},
+					Usage:   "The maximum `NUMBER` of authentication requests accepted at once from each client ip when rate limiting.",
+				},
+				&cli.IntFlag{
+					Name:    "lockout-threshold",
+					Value:   0,
+					EnvVars: []string{"LOCKOUT_THRESHOLD"},
+					Usage:   "The `NUMBER` of consecutive failed authentications after which a username is locked out, 0 disables the lockout.",
+				},
+				&cli.DurationFlag{
+					Name:    "lockout-window",
+					Value:   15 * time.Minute,
+					EnvVars: []string{"LOCKOUT_WINDOW"},
+					Usage:   "The `DURATION` failed authentications are counted over, and a username stays locked out for.",
+				},
+				newListFlag(&cli.StringSliceFlag{
+					Name:    "allowed-group",
+					EnvVars: []string{"ALLOWED_GROUPS"},
+					Usage:   "Repeatable. A `GROUP` users must be member of for their tokens to be authenticated, any group is allowed when omitted. The groups of the environment variable are separated by ';'.",
+				}),
+				newListFlag(&cli.StringSliceFlag{
+					Name:    "denied-group",
+					EnvVars: []string{"DENIED_GROUPS"},
+					Usage:   "Repeatable. A `GROUP` whose members tokens are never authenticated, whatever their other groups. The groups of the environment variable are separated by ';'.",
+				}),
+				&cli.IntFlag{
+					Name:    "max-groups",
+					Value:   0,
+					EnvVars: []string{"MAX_GROUPS"},
+					Usage:   "The maximum `NUMBER` of groups carried by a token, unlimited when 0. See --max-groups-strategy.",
+				},
+				&cli.StringFlag{
+					Name:    "max-groups-strategy",
+					Value:   server.GroupLimitTruncate,
+					EnvVars: []string{"MAX_GROUPS_STRATEGY"},
+					Usage:   "The `STRATEGY` applied to users member of more than --max-groups groups. Can take the values keep their first groups: 'truncate' or issue them no token: 'reject'.",
+				},
+				&cli.DurationFlag{
+					Name:    "retry-after",
+					Value:   server.DefaultRetryAfter,
+					EnvVars: []string{"RETRY_AFTER"},
+					Usage:   "The `DURATION` clients are asked to wait with a Retry-After header before retrying a request answered with a 503. 0 disables the header.",
+				},
+				&cli.StringSliceFlag{
+					Name:    "status-code",
+					EnvVars: []string{"STATUS_CODES"},
+					Usage:   "Repeatable. Override the status code answered for an error, as `NAME=CODE`, ie. not_acceptable=400. See the README for the error names and their default codes.",
+				},
+				&cli.BoolFlag{
+					Name:    "gzip",
+					Value:   false,
+					EnvVars: []string{"GZIP"},
+					Usage:   "Compress the responses for the clients accepting gzip, ie. the api server.",
+				},
+				&cli.IntFlag{
+					Name:    "gzip-min-size",
+					Value:   middlewares.DefaultGzipMinSize,
+					EnvVars: []string{"GZIP_MIN_SIZE"},
+					Usage:   "The `SIZE`, in bytes, from which the responses are compressed when --gzip is set.",
+				},
+				reqs.require(&cli.BoolFlag{
+					Name:    "debug-last-lookup",
+					Value:   false,
+					EnvVars: []string{"DEBUG_LAST_LOOKUP"},
+					Usage:   "Serve the username, outcome and latency of the most recent ldap search on /debug/lastlookup, to the clients presenting a certificate signed by --tls-client-ca-file only.",
+				}, "tls-client-ca-file"),
+				reqs.require(&cli.BoolFlag{
+					Name:    "debug-pprof",
+					Value:   false,
+					EnvVars: []string{"DEBUG_PPROF"},
+					Usage:   "Serve the go runtime profiles on /debug/pprof/, to the clients presenting a certificate signed by --tls-client-ca-file only. The cpu profile and trace durations must be shorter than --write-timeout.",
+				}, "tls-client-ca-file"),
+				&cli.BoolFlag{
+					Name:    "userinfo",
+					Value:   false,
+					EnvVars: []string{"USERINFO"},
+					Usage:   "Serve /userinfo, answering the uid, username, groups and extra values of the user a bearer token was issued to as json.",
+				},
+				reqs.require(&cli.BoolFlag{
+					Name:    "group-lookup",
+					Value:   false,
+					EnvVars: []string{"GROUP_LOOKUP"},
+					Usage:   "Serve /groups/{username}, answering the groups a token of the user would hold without checking their password, to the clients presenting a certificate signed by --tls-client-ca-file only.",
+				}, "tls-client-ca-file"),
+				&cli.BoolFlag{
+					Name:    "require-groups",
+					Value:   false,
+					EnvVars: []string{"REQUIRE_GROUPS"},
+					Usage:   "Issue no token to the users member of no group.",
+				},
+				&cli.StringFlag{
+					Name:    "audit-log-file",
+					Value:   "",
+					EnvVars: []string{"AUDIT_LOG_FILE"},
+					Usage:   "The `PATH` of the file every authentication attempt is appended to as a json line, - for stdout. Attempts are not audited when omitted.",
+				},
+				&cli.BoolFlag{
+					Name:    "trust-proxy",
+					Value:   false,
+					EnvVars: []string{"TRUST_PROXY"},
+					Usage:   "Read the client ip from the X-Forwarded-For header set by a trusted reverse proxy.",
+				},
+				&cli.StringSliceFlag{
+					Name:    "cors-allowed-origin",
+					EnvVars: []string{"CORS_ALLOWED_ORIGINS"},
+					Usage:   "Repeatable. An `ORIGIN` allowed to call the server from a browser, * allows any. CORS requests are denied when omitted.",
+				},
+				&cli.StringSliceFlag{
+					Name:    "cors-allowed-method",
+					Value:   cli.NewStringSlice("GET", "POST"),
+					EnvVars: []string{"CORS_ALLOWED_METHODS"},
+					Usage:   "Repeatable. A `METHOD` allowed in CORS requests.",
+				},
+				&cli.StringSliceFlag{
+					Name:    "cors-allowed-header",
+					Value:   cli.NewStringSlice("Content-Type"),
+					EnvVars: []string{"CORS_ALLOWED_HEADERS"},
+					Usage:   "Repeatable. A `HEADER` allowed in CORS requests.",
+				},
+				reqs.require(&cli.StringFlag{
+					Name:    "tls-cert-file",
+					EnvVars: []string{"TLS_CERT_FILE"},
+					Usage:   "The `PATH` to the PEM encoded certificate used to serve requests over TLS. Requires --tls-key-file.",
+				}, "tls-key-file"),
+				reqs.require(&cli.StringFlag{
+					Name:    "tls-key-file",
+					EnvVars: []string{"TLS_KEY_FILE"},
+					Usage:   "The `PATH` to the PEM encoded key used to serve requests over TLS. Requires --tls-cert-file.",
+				}, "tls-cert-file"),
+				reqs.require(&cli.StringFlag{
+					Name:    "tls-client-ca-file",
+					EnvVars: []string{"TLS_CLIENT_CA_FILE"},
+					Usage:   "The `PATH` to the PEM encoded CA bundle verifying the client certificates, /token then requires one, ie. the api server certificate. Requires --tls-cert-file.",
+				}, "tls-cert-file"),
+				reqs.require(&cli.StringFlag{
+					Name:    "tls-min-version",
+					Value:   server.DefaultTLSMinVersion,
+					EnvVars: []string{"TLS_MIN_VERSION"},
+					Usage:   "The minimum TLS `VERSION` accepted from the clients, 1.2 or 1.3. Requires --tls-cert-file.",
+				}, "tls-cert-file"),
+				reqs.require(&cli.StringSliceFlag{
+					Name:    "tls-cipher-suite",
+					EnvVars: []string{"TLS_CIPHER_SUITES"},
+					Usage:   "Repeatable. A TLS 1.2 cipher `SUITE` accepted from the clients, ie. TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256. Defaults to the go secure suites, the insecure ones are refused. Requires --tls-cert-file.",
+				}, "tls-cert-file"),
+				&cli.StringFlag{
+					Name:    "static-users-file",
+					EnvVars: []string{"STATIC_USERS_FILE"},
+					Usage:   "The `PATH` to a YAML file of users keyed by username, each with the bcrypt hash of its password and optionally its uid, groups and extra attributes. The users are then authenticated against the file instead of the ldap server, meant for development and tests.",
+				},
+				&cli.StringSliceFlag{
+					Name:    "realm",
+					EnvVars: []string{"REALMS"},
+					Usage:   "Repeatable. A realm served on /auth/NAME, given as `NAME=PATH`, PATH being a YAML file holding the ldap flags of its directory keyed by flag name, as with --config. The ldap flags of the server are not inherited, the cache ones are.",
+				},
 			},
+			ldapFlags(reqs),
+			[]cli.Flag{
+				&cli.StringFlag{
+					Name:    "ldap-startup-check",
+					Value:   "warn",
+					EnvVars: []string{"LDAP_STARTUP_CHECK"},
+					Usage:   "What to do when binding as the service account or reading the search bases fails at startup. Can take the `MODE` refuse to start: 'fail', log a warning: 'warn' or do not check: 'skip'.",
+				},
+				&cli.DurationFlag{
+					Name:    "cache-ttl",
+					Value:   0,
+					EnvVars: []string{"LDAP_CACHE_TTL"},
+					Usage:   "The `DURATION` successful ldap searches are cached for. 0 disables the cache.",
+				},
+				&cli.IntFlag{
+					Name:    "cache-max-entries",
+					Value:   1000,
+					EnvVars: []string{"LDAP_CACHE_MAXENTRIES"},
+					Usage:   "The maximum `NUMBER` of users kept in the cache.",
+				},
 
-			// bind dn configuration
-			&cli.StringFlag{
-				Name:     "bind-dn",
-				EnvVars:  []string{"LDAP_BINDDN"},
-				Required: true,
-				Usage:    "The service account `DN` to do the ldap search.",
-			},
-			&cli.StringFlag{
-				Name:     "bind-credentials",
-				EnvVars:  []string{"LDAP_BINDCREDENTIALS"},
-				FilePath: "/etc/k8s-ldap-auth/ldap/password",
-				Usage:    "The service account `PASSWORD` to do the ldap search, can be located in '/etc/k8s-ldap-auth/ldap/password'.",
-			},
-
-			// user search configuration
-			&cli.StringFlag{
-				Name:    "search-base",
-				EnvVars: []string{"LDAP_USER_SEARCHBASE"},
-				Usage:   "The `DN` where the ldap search will take place.",
-			},
-			&cli.StringFlag{
-				Name:    "search-filter",
-				Value:   "(&(objectClass=inetOrgPerson)(uid=%s))",
-				EnvVars: []string{"LDAP_USER_SEARCHFILTER"},
-				Usage:   "The `FILTER` to select users.",
-			},
-			&cli.StringFlag{
-				Name:    "memberof-property",
-				Value:   "ismemberof",
-				EnvVars: []string{"LDAP_USER_MEMBEROFPROPERTY"},
-				Usage:   "The `PROPERTY` that will be used to fetch groups. Usually memberof or ismemberof.",
-			},
-			&cli.StringFlag{
-				Name:    "username-property",
-				Value:   "uid",
-				EnvVars: []string{"LDAP_USER_USERNAMEPROPERTY"},
-				Usage:   "The `PROPERTY` that will be used as username in the TokenReview.",
-			},
-			&cli.StringSliceFlag{
-				Name:    "extra-attributes",
-				EnvVars: []string{"LDAP_USER_EXTRAATTR"},
-				Usage:   "Repeatable. User `PROPERTY` to fetch. Those will be stored in extra values in the UserInfo object.",
+				// jtw signing configuration
+				&cli.StringFlag{
+					Name:    "private-key-file",
+					Usage:   "The `PATH` to the PEM encoded RSA private key used to sign tokens. A new key is generated at each start when omitted.",
+					EnvVars: []string{"PRIVATE_KEY_FILE"},
+				},
+				reqs.require(&cli.StringFlag{
+					Name:    "public-key-file",
+					Usage:   "The `PATH` to the public key file, optional when the private key file is given",
+					EnvVars: []string{"PUBLIC_KEY_FILE"},
+				}, "private-key-file"),
+				&cli.StringFlag{
+					Name:    "token-issuer",
+					EnvVars: []string{"TOKEN_ISSUER"},
+					Usage:   "The `ISSUER` set in the iss claim of the tokens, tokens with another issuer are rejected.",
+				},
+				&cli.StringFlag{
+					Name:    "token-audience",
+					EnvVars: []string{"TOKEN_AUDIENCE"},
+					Usage:   "The `AUDIENCE` set in the aud claim of the tokens, tokens for another audience are rejected. It must be one of the api server --api-audiences when they are set, since the TokenReviews then request them.",
+				},
+				&cli.DurationFlag{
+					Name:    "token-leeway",
+					Value:   types.DefaultLeeway,
+					EnvVars: []string{"TOKEN_LEEWAY"},
+					Usage:   "The clock skew `DURATION` tolerated when validating the tokens issuance and expiration times.",
+				},
+				&cli.StringSliceFlag{
+					Name:    "retired-private-key-file",
+					EnvVars: []string{"RETIRED_PRIVATE_KEY_FILE"},
+					Usage:   "Repeatable. The `PATH` to a previous private key, tokens it signed are still accepted until they expire.",
+				},
+				&cli.StringFlag{
+					Name:    "token-algorithm",
+					Value:   "RS256",
+					EnvVars: []string{"TOKEN_ALGORITHM"},
+					Usage:   "The `ALGORITHM` of the key generated when no private key file is given, RS256 or ES256.",
+				},
+				&cli.Int64Flag{
+					Name:    "token-ttl",
+					Value:   43200,
+					EnvVars: []string{"TTL"},
+					Usage:   "The `TTL` for newly generated tokens, in seconds, at most a week.",
+				},
+				&cli.IntFlag{
+					Name:    "max-username-length",
+					Value:   types.DefaultMaxUsernameLength,
+					EnvVars: []string{"MAX_USERNAME_LENGTH"},
+					Usage:   "The maximum `LENGTH` of the usernames sent to /auth, in characters.",
+				},
+				&cli.DurationFlag{
+					Name:    "max-session-lifetime",
+					Value:   0,
+					EnvVars: []string{"MAX_SESSION_LIFETIME"},
+					Usage:   "The `DURATION` tokens can be refreshed on /refresh for after the user authenticated, refresh is disabled when 0.",
+				},
 			},
-			&cli.StringFlag{
-				Name:    "search-scope",
-				Value:   "sub",
-				EnvVars: []string{"LDAP_USER_SEARCHSCOPE"},
-				Usage:   "The `SCOPE` of the search. Can take to values base object: 'base', single level: 'single' or whole subtree: 'sub'.",
-			},
-
-			// jtw signing configuration
-			&cli.StringFlag{
-				Name:    "private-key-file",
-				Usage:   "The `PATH` to the private key file",
-				EnvVars: []string{"PRIVATE_KEY_FILE"},
-			},
-			&cli.StringFlag{
-				Name:    "public-key-file",
-				Usage:   "The `PATH` to the public key file",
-				EnvVars: []string{"PUBLIC_KEY_FILE"},
-			},
-			&cli.Int64Flag{
-				Name:    "token-ttl",
-				Value:   43200,
-				EnvVars: []string{"TTL"},
-				Usage:   "The `TTL` for newly generated tokens, in seconds",
-			},
-		},
+		),
 		Action: func(c *cli.Context) error {
 			var (
 				port = c.Int("port")
 				host = c.String("host")
 
-				ldapURL          = c.String("ldap-host")
-				bindDN           = c.String("bind-dn")
-				bindPassword     = c.String("bind-credentials")
-				searchBase       = c.String("search-base")
-				searchScope      = c.String("search-scope")
-				searchFilter     = c.String("search-filter")
-				searchAttributes = c.StringSlice("search-attributes")
-				memberofProperty = c.String("memberof-property")
-				usernameProperty = c.String("username-property")
+				shutdownTimeout = c.Duration("shutdown-timeout")
+				tlsCertFile     = c.String("tls-cert-file")
+				tlsKeyFile      = c.String("tls-key-file")
+				tlsClientCAFile = c.String("tls-client-ca-file")
+				accessLogFormat = c.String("access-log-format")
+				maxBodySize     = c.Int64("max-body-size")
+				readHeaderTO    = c.Duration("read-header-timeout")
+				readTO          = c.Duration("read-timeout")
+				writeTO         = c.Duration("write-timeout")
+				idleTO          = c.Duration("idle-timeout")
+				rateLimit       = c.Float64("rate-limit")
+				rateLimitBurst  = c.Int("rate-limit-burst")
+				trustProxy      = c.Bool("trust-proxy")
+				corsOrigins     = c.StringSlice("cors-allowed-origin")
+				corsMethods     = c.StringSlice("cors-allowed-method")
+				corsHeaders     = c.StringSlice("cors-allowed-header")
+				lockoutCount    = c.Int("lockout-threshold")
+				lockoutWindow   = c.Duration("lockout-window")
+				auditLogFile    = c.String("audit-log-file")
+				allowedGroups   = c.StringSlice("allowed-group")
+				deniedGroups    = c.StringSlice("denied-group")
+
+				ldapDialTimeout = c.Duration("ldap-dial-timeout")
+				ldapOpTimeout   = c.Duration("ldap-operation-timeout")
 
 				privateKeyFile = c.String("private-key-file")
 				publicKeyFile  = c.String("public-key-file")
+				tokenAlgorithm = c.String("token-algorithm")
+				retiredKeys    = c.StringSlice("retired-private-key-file")
+				tokenIssuer    = c.String("token-issuer")
+				tokenAudience  = c.String("token-audience")
+				tokenLeeway    = c.Duration("token-leeway")
 
 				ttl = c.Int64("token-ttl")
 			)
 
 			addr := fmt.Sprintf("%s:%d", host, port)
+			if socket := c.String("unix-socket"); socket != "" {
+				addr = server.UnixScheme + socket
+			}
 
-			s, err := server.NewInstance(
-				server.WithLdap(
-					ldapURL,
-					bindDN,
-					bindPassword,
-					searchBase,
-					searchScope,
-					searchFilter,
-					memberofProperty,
-					usernameProperty,
-					searchAttributes,
-				),
-				server.WithAccessLogs(),
-				server.WithKey(
+			registry := prometheus.NewRegistry()
+			registry.MustRegister(
+				prometheus.NewGoCollector(),
+				prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+			)
+
+			ldapOptions, err := ldapOptions(c)
+			if err != nil {
+				return err
+			}
+
+			ldapOptions = append(ldapOptions,
+				ldap.WithCache(c.Duration("cache-ttl"), c.Int("cache-max-entries")),
+				ldap.WithMetrics(registry),
+			)
+
+			searcher := server.WithLdap(
+				c.StringSlice("ldap-host"),
+				c.String("bind-dn"),
+				c.String("bind-credentials"),
+				c.StringSlice("search-base"),
+				c.String("search-scope"),
+				c.String("search-filter"),
+				firstMemberofProperty(c),
+				c.String("username-property"),
+				// the extra attributes are those of the attribute map, see ldapOptions
+				nil,
+				ldapOptions...,
+			)
+
+			if usersFile := c.String("static-users-file"); usersFile != "" {
+				users, err := static.Load(usersFile)
+				if err != nil {
+					return err
+				}
+
+				log.Warn().Str("file", usersFile).Msg("The users are authenticated against a static file instead of the ldap server, this is meant for development and tests.")
+				searcher = server.WithSearcher(users)
+			}
+
+			serverOptions := []server.Option{
+				searcher,
+				server.WithRequestLogs(os.Stderr, accessLogFormat),
+				server.WithKeyAlgorithm(
 					privateKeyFile,
 					publicKeyFile,
+					jwa.SignatureAlgorithm(tokenAlgorithm),
 				),
+				server.WithRetiredKeys(retiredKeys...),
+				server.WithIssuer(tokenIssuer),
+				server.WithAudience(tokenAudience),
+				server.WithLeeway(tokenLeeway),
 				server.WithTTL(ttl),
-			)
+				server.WithRefresh(c.Duration("max-session-lifetime")),
+				server.WithMetrics(registry),
+				server.WithMaxBodySize(maxBodySize),
+				server.WithMaxUsernameLength(c.Int("max-username-length")),
+				server.WithTimeouts(readHeaderTO, readTO, writeTO, idleTO),
+				server.WithGroupPolicy(allowedGroups, deniedGroups),
+				server.WithMaxGroups(c.Int("max-groups"), c.String("max-groups-strategy")),
+				server.WithBasePath(c.String("base-path")),
+				server.WithRetryAfter(c.Duration("retry-after")),
+			}
+
+			realms, err := realmOptions(c, ldap.WithCache(c.Duration("cache-ttl"), c.Int("cache-max-entries")))
+			if err != nil {
+				return err
+			}
+
+			serverOptions = append(serverOptions, realms...)
+
+			if items := c.StringSlice("status-code"); len(items) > 0 {
+				codes, err := statusCodes(items)
+				if err != nil {
+					return err
+				}
+
+				serverOptions = append(serverOptions, server.WithStatusCodes(codes))
+			}
+
+			if c.Bool("debug-last-lookup") {
+				serverOptions = append(serverOptions, server.WithLastLookup())
+			}
+
+			if c.Bool("gzip") {
+				serverOptions = append(serverOptions, server.WithGzip(c.Int("gzip-min-size")))
+			}
+
+			if c.Bool("debug-pprof") {
+				serverOptions = append(serverOptions, server.WithPprof())
+			}
+
+			if c.Bool("userinfo") {
+				serverOptions = append(serverOptions, server.WithUserinfo())
+			}
+
+			if c.Bool("group-lookup") {
+				serverOptions = append(serverOptions, server.WithGroupLookup())
+			}
+
+			if c.Bool("require-groups") {
+				serverOptions = append(serverOptions, server.WithRequireGroups())
+			}
+
+			if rateLimit > 0 {
+				serverOptions = append(serverOptions, server.WithRateLimit(rateLimit, rateLimitBurst, trustProxy))
+			}
+
+			if lockoutCount > 0 {
+				serverOptions = append(serverOptions, server.WithLockout(lockoutCount, lockoutWindow))
+			}
+
+			if len(corsOrigins) > 0 {
+				serverOptions = append(serverOptions, server.WithCORS(corsOrigins, corsMethods, corsHeaders))
+			}
+
+			if auditLogFile == "-" {
+				serverOptions = append(serverOptions, server.WithAuditor(server.NewJSONAuditor(os.Stdout), trustProxy))
+			} else if auditLogFile != "" {
+				f, err := os.OpenFile(auditLogFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+				if err != nil {
+					return fmt.Errorf("Could not open the audit log file, %w", err)
+				}
+				defer f.Close()
+
+				serverOptions = append(serverOptions, server.WithAuditor(server.NewJSONAuditor(f), trustProxy))
+			}
+
+			if tlsCertFile != "" || tlsKeyFile != "" {
+				serverOptions = append(serverOptions, server.WithTLSFiles(tlsCertFile, tlsKeyFile))
+			}
+
+			if tlsClientCAFile != "" {
+				serverOptions = append(serverOptions, server.WithClientCAFile(tlsClientCAFile))
+			}
+
+			serverOptions = append(serverOptions, server.WithTLSMinVersion(c.String("tls-min-version")))
+			if suites := c.StringSlice("tls-cipher-suite"); len(suites) > 0 {
+				serverOptions = append(serverOptions, server.WithTLSCipherSuites(suites...))
+			}
+
+			s, err := server.NewInstance(serverOptions...)
 			if err != nil {
 				return fmt.Errorf("There was an error instanciation the server, %w", err)
 			}
 
-			if err := s.Start(addr); err != nil {
-				return fmt.Errorf("There was an error starting the server, %w", err)
+			switch check := c.String("ldap-startup-check"); check {
+			case "skip":
+			case "fail", "warn":
+				ctx, cancel := context.WithTimeout(context.Background(), ldapDialTimeout+ldapOpTimeout)
+				err := s.Validate(ctx)
+				cancel()
+
+				if err != nil && check == "fail" {
+					return fmt.Errorf("The ldap configuration is not valid, %w", err)
+				} else if err != nil {
+					log.Warn().Err(err).Msg("The ldap configuration is not valid, authentications will fail until it is fixed.")
+				} else {
+					log.Info().Msg("Successfully validated the ldap configuration.")
+				}
+			default:
+				return fmt.Errorf("Unknown ldap startup check '%s', expected 'fail', 'warn' or 'skip'", check)
+			}
+
+			errs := make(chan error, 1)
+			go func() {
+				errs <- s.Start(addr)
+			}()
+
+			signals := make(chan os.Signal, 1)
+			signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+			defer signal.Stop(signals)
+
+			select {
+			case err := <-errs:
+				if err != nil {
+					return fmt.Errorf("There was an error starting the server, %w", err)
+				}
+			case sig := <-signals:
+				log.Info().Str("signal", sig.String()).Msg("Received signal.")
+
+				ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+				defer cancel()
+
+				if err := s.Shutdown(ctx); err != nil {
+					return fmt.Errorf("There was an error stopping the server, %w", err)
+				}
 			}
 
 			return nil
 		},
 	}
 }
+
+// statusCodes parse the NAME=CODE status code overrides, see server.WithStatusCodes
+func statusCodes(items []string) (map[string]int, error) {
+	codes := make(map[string]int, len(items))
+
+	for _, item := range items {
+		i := strings.Index(item, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("Invalid status code '%s', expected NAME=CODE", item)
+		}
+
+		code, err := strconv.Atoi(item[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid status code '%s', %w", item, err)
+		}
+
+		codes[item[:i]] = code
+	}
+
+	return codes, nil
+}
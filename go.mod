@@ -5,15 +5,23 @@ go 1.15
 require (
 	github.com/adrg/xdg v0.4.0
 	github.com/etherlabsio/healthcheck/v2 v2.0.0
+	github.com/go-asn1-ber/asn1-ber v1.5.1
 	github.com/go-ldap/ldap/v3 v3.4.1
 	github.com/gorilla/mux v1.8.0
 	github.com/lestrrat-go/jwx v1.2.13
 	github.com/mattn/go-isatty v0.0.14
+	github.com/prometheus/client_golang v1.11.0
 	github.com/rs/zerolog v1.26.1
 	github.com/urfave/cli/v2 v2.3.0
 	github.com/zalando/go-keyring v0.1.1
+	go.opentelemetry.io/otel v1.0.1
+	go.opentelemetry.io/otel/sdk v1.0.1
+	go.opentelemetry.io/otel/trace v1.0.1
+	golang.org/x/crypto v0.0.0-20211215165025-cf75a172585e
 	golang.org/x/term v0.0.0-20210615171337-6886f2dfbf5b
+	golang.org/x/time v0.0.0-20210723032227-1f47c861a9ac
 	k8s.io/api v0.23.1
 	k8s.io/apimachinery v0.23.1
 	k8s.io/client-go v0.23.1
+	sigs.k8s.io/yaml v1.2.0
 )
@@ -0,0 +1,586 @@
+// Package ldaptest provides an in-memory ldap server answering simple binds and searches,
+// for testing purposes only.
+package ldaptest
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	ldap "github.com/go-ldap/ldap/v3"
+)
+
+// Entry is a directory entry. Binding as its dn succeeds with Password, an entry without
+// password cannot bind.
+type Entry struct {
+	DN         string
+	Password   string
+	Attributes map[string][]string
+}
+
+// attribute return the values of the named attribute, attribute names are case insensitive
+func (e Entry) attribute(name string) []string {
+	for k, v := range e.Attributes {
+		if strings.EqualFold(k, name) {
+			return v
+		}
+	}
+
+	return nil
+}
+
+// Server is a ldap server listening on a random local port
+type Server struct {
+	// URL is the ldap:// url of the server, or its ldaps:// url when started with NewTLSServer
+	URL string
+	// CA is the pool holding the authority the certificate of a tls server was issued by
+	CA *x509.CertPool
+
+	l       net.Listener
+	mu      sync.Mutex
+	entries []Entry
+	conns   map[net.Conn]struct{}
+	binds   []string
+	wg      sync.WaitGroup
+	// unauthenticated makes binds with a dn and an empty password succeed, as some servers do
+	unauthenticated bool
+	// failures is the number of connections still to be closed as soon as accepted
+	failures int
+	// referrals are returned as search result references by every search
+	referrals []string
+	// stalled makes the searches wait for the server to be closed without being answered
+	stalled bool
+	// dropped are the connections to be closed upon their next request
+	dropped map[net.Conn]struct{}
+	closed  chan struct{}
+	// ca issues the server and client certificates of a tls server
+	ca    *x509.Certificate
+	caKey crypto.Signer
+}
+
+// NewServer start a server holding the given entries, it must be closed once done
+func NewServer(entries ...Entry) (*Server, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		URL:     "ldap://" + l.Addr().String(),
+		l:       l,
+		entries: entries,
+		conns:   map[net.Conn]struct{}{},
+		dropped: map[net.Conn]struct{}{},
+		closed:  make(chan struct{}),
+	}
+
+	s.wg.Add(1)
+	go s.serve()
+
+	return s, nil
+}
+
+// NewTLSServer start a server like NewServer behind ldaps://, with a certificate for 127.0.0.1
+// issued by CA. Clients presenting a certificate issued by ClientCertificate can bind with
+// the SASL EXTERNAL mechanism, as the certificate subject.
+func NewTLSServer(entries ...Entry) (*Server, error) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ldaptest CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, caKey.Public(), caKey)
+	if err != nil {
+		return nil, err
+	}
+
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		CA:      x509.NewCertPool(),
+		entries: entries,
+		conns:   map[net.Conn]struct{}{},
+		dropped: map[net.Conn]struct{}{},
+		closed:  make(chan struct{}),
+		ca:      ca,
+		caKey:   caKey,
+	}
+	s.CA.AddCert(ca)
+
+	cert, err := s.issue(&x509.Certificate{
+		Subject:     pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+		ClientCAs:    s.CA,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.URL = "ldaps://" + l.Addr().String()
+	s.l = l
+
+	s.wg.Add(1)
+	go s.serve()
+
+	return s, nil
+}
+
+// ClientCertificate issue a client certificate for the given subject common name, returning
+// the PEM encoded certificate and private key. Only servers started with NewTLSServer can.
+func (s *Server) ClientCertificate(cn string) ([]byte, []byte, error) {
+	if s.ca == nil {
+		return nil, nil, errors.New("ldaptest: client certificates require a tls server")
+	}
+
+	cert, err := s.issue(&x509.Certificate{
+		Subject:     pkix.Name{CommonName: cn},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}),
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}),
+		nil
+}
+
+// issue sign the template with the server CA, for a new key
+func (s *Server) issue(template *x509.Certificate) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	template.SerialNumber = serial
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+
+	der, err := x509.CreateCertificate(rand.Reader, template, s.ca, key.Public(), s.caKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// Close stop the server, closing the open connections
+func (s *Server) Close() {
+	close(s.closed)
+	s.l.Close()
+
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+}
+
+// AllowUnauthenticatedBind makes the binds with a dn and an empty password succeed, like the
+// servers allowing the unauthenticated bind mechanism of RFC 4513 do
+func (s *Server) AllowUnauthenticatedBind() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.unauthenticated = true
+}
+
+// FailConnections close the next n connections as soon as they are accepted, as when the
+// server is overloaded or a network blip happens
+func (s *Server) FailConnections(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.failures = n
+}
+
+// Refer return the given urls as search result references with the result of every search,
+// as a server holding only part of the directory does
+func (s *Server) Refer(urls ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.referrals = append(s.referrals, urls...)
+}
+
+// StallSearches makes the server never answer the searches, as an overloaded server would
+func (s *Server) StallSearches() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stalled = true
+}
+
+// DropConnections makes the server close the open connections upon their next request,
+// without answering it, as a firewall dropping idle connections does without the client
+// being told
+func (s *Server) DropConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for conn := range s.conns {
+		s.dropped[conn] = struct{}{}
+	}
+}
+
+// Binds return the dn of every bind request received so far
+func (s *Server) Binds() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string{}, s.binds...)
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+
+	for {
+		conn, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		if s.failures > 0 {
+			s.failures--
+			s.mu.Unlock()
+			conn.Close()
+			continue
+		}
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handle(conn)
+		}()
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		delete(s.dropped, conn)
+		s.mu.Unlock()
+
+		conn.Close()
+	}()
+
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+
+		s.mu.Lock()
+		_, dropped := s.dropped[conn]
+		s.mu.Unlock()
+
+		if dropped {
+			return
+		}
+
+		id := packet.Children[0].Value.(int64)
+		op := packet.Children[1]
+
+		var responses []*ber.Packet
+
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			responses = []*ber.Packet{s.bind(conn, op)}
+		case ldap.ApplicationSearchRequest:
+			s.mu.Lock()
+			stalled := s.stalled
+			s.mu.Unlock()
+
+			if stalled {
+				<-s.closed
+				return
+			}
+
+			responses = s.search(op)
+		case ldap.ApplicationUnbindRequest:
+			return
+		case ldap.ApplicationAbandonRequest:
+			continue
+		default:
+			responses = []*ber.Packet{result(ldap.ApplicationExtendedResponse, ldap.LDAPResultUnwillingToPerform)}
+		}
+
+		for _, response := range responses {
+			envelope := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+			envelope.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "MessageID"))
+			envelope.AppendChild(response)
+
+			if _, err := conn.Write(envelope.Bytes()); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func result(tag ber.Tag, code uint16) *ber.Packet {
+	p := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Result")
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), "resultCode"))
+	p.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "matchedDN"))
+	p.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, ldap.LDAPResultCodeMap[code], "diagnosticMessage"))
+
+	return p
+}
+
+func (s *Server) bind(conn net.Conn, op *ber.Packet) *ber.Packet {
+	// the SASL credentials are a [3] sequence holding the mechanism, only EXTERNAL is supported
+	if op.Children[2].Tag == 3 {
+		return s.externalBind(conn, op.Children[2])
+	}
+
+	dn := op.Children[1].Data.String()
+	password := op.Children[2].Data.String()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.binds = append(s.binds, dn)
+
+	if password == "" && (dn == "" || s.unauthenticated) {
+		return result(ldap.ApplicationBindResponse, ldap.LDAPResultSuccess)
+	}
+
+	for _, e := range s.entries {
+		if strings.EqualFold(e.DN, dn) && e.Password != "" && e.Password == password {
+			return result(ldap.ApplicationBindResponse, ldap.LDAPResultSuccess)
+		}
+	}
+
+	return result(ldap.ApplicationBindResponse, ldap.LDAPResultInvalidCredentials)
+}
+
+// externalBind authenticate the client as the subject of the certificate it presented during
+// the tls handshake, recorded in Binds as "cn=<common name>"
+func (s *Server) externalBind(conn net.Conn, sasl *ber.Packet) *ber.Packet {
+	if len(sasl.Children) == 0 || sasl.Children[0].Data.String() != "EXTERNAL" {
+		return result(ldap.ApplicationBindResponse, ldap.LDAPResultAuthMethodNotSupported)
+	}
+
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok || len(tlsConn.ConnectionState().VerifiedChains) == 0 {
+		return result(ldap.ApplicationBindResponse, ldap.LDAPResultInappropriateAuthentication)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.binds = append(s.binds, "cn="+tlsConn.ConnectionState().PeerCertificates[0].Subject.CommonName)
+
+	return result(ldap.ApplicationBindResponse, ldap.LDAPResultSuccess)
+}
+
+func (s *Server) search(op *ber.Packet) []*ber.Packet {
+	base := op.Children[0].Data.String()
+	scope := op.Children[1].Value.(int64)
+	filter := op.Children[6]
+
+	var attributes []string
+	for _, a := range op.Children[7].Children {
+		attributes = append(attributes, a.Data.String())
+	}
+
+	// like real servers, a base that is not a dn is refused rather than not found
+	if _, err := ldap.ParseDN(base); err != nil {
+		return []*ber.Packet{result(ldap.ApplicationSearchResultDone, ldap.LDAPResultInvalidDNSyntax)}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var responses []*ber.Packet
+
+	// the empty base is the root DSE, which always exists
+	found := base == ""
+
+	for _, e := range s.entries {
+		if strings.EqualFold(e.DN, base) {
+			found = true
+		}
+
+		if !inScope(e.DN, base, scope) || !matches(e, filter) {
+			continue
+		}
+
+		entry := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Search Result Entry")
+		entry.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, e.DN, "objectName"))
+
+		attrs := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "attributes")
+		for name, values := range e.Attributes {
+			if !selected(name, attributes) {
+				continue
+			}
+
+			attr := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "attribute")
+			attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "type"))
+
+			vals := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "vals")
+			for _, v := range values {
+				vals.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, "value"))
+			}
+
+			attr.AppendChild(vals)
+			attrs.AppendChild(attr)
+		}
+
+		entry.AppendChild(attrs)
+		responses = append(responses, entry)
+	}
+
+	if scope == ldap.ScopeBaseObject && !found {
+		return []*ber.Packet{result(ldap.ApplicationSearchResultDone, ldap.LDAPResultNoSuchObject)}
+	}
+
+	for _, url := range s.referrals {
+		ref := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultReference, nil, "Search Result Reference")
+		ref.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, url, "uri"))
+		responses = append(responses, ref)
+	}
+
+	return append(responses, result(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess))
+}
+
+func inScope(dn, base string, scope int64) bool {
+	dn, base = strings.ToLower(dn), strings.ToLower(base)
+
+	switch scope {
+	case ldap.ScopeBaseObject:
+		return dn == base
+	case ldap.ScopeSingleLevel:
+		i := strings.Index(dn, ",")
+		return i >= 0 && dn[i+1:] == base
+	default:
+		return base == "" || dn == base || strings.HasSuffix(dn, ","+base)
+	}
+}
+
+func selected(name string, attributes []string) bool {
+	if len(attributes) == 0 {
+		return true
+	}
+
+	for _, a := range attributes {
+		if a == "*" || strings.EqualFold(a, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matches evaluate the and, or, not, equality, presence and substrings filters, any other
+// filter never matches
+func matches(e Entry, filter *ber.Packet) bool {
+	switch filter.Tag {
+	case ldap.FilterAnd:
+		for _, child := range filter.Children {
+			if !matches(e, child) {
+				return false
+			}
+		}
+
+		return true
+	case ldap.FilterOr:
+		for _, child := range filter.Children {
+			if matches(e, child) {
+				return true
+			}
+		}
+
+		return false
+	case ldap.FilterNot:
+		return !matches(e, filter.Children[0])
+	case ldap.FilterPresent:
+		name := filter.Data.String()
+		return strings.EqualFold(name, "objectClass") || len(e.attribute(name)) > 0
+	case ldap.FilterEqualityMatch:
+		want := filter.Children[1].Data.String()
+		for _, v := range e.attribute(filter.Children[0].Data.String()) {
+			if strings.EqualFold(v, want) {
+				return true
+			}
+		}
+
+		return false
+	case ldap.FilterSubstrings:
+		for _, v := range e.attribute(filter.Children[0].Data.String()) {
+			v = strings.ToLower(v)
+			ok := true
+
+			for _, part := range filter.Children[1].Children {
+				p := strings.ToLower(part.Data.String())
+
+				switch part.Tag {
+				case ldap.FilterSubstringsInitial:
+					ok = ok && strings.HasPrefix(v, p)
+				case ldap.FilterSubstringsFinal:
+					ok = ok && strings.HasSuffix(v, p)
+				default:
+					ok = ok && strings.Contains(v, p)
+				}
+			}
+
+			if ok {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	return false
+}
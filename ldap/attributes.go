@@ -0,0 +1,96 @@
+package ldap
+
+import (
+	"fmt"
+	"sort"
+)
+
+// AttributeMap tells which attributes of the user entry the UserInfo fields are read from, so
+// that directories naming the same data differently, ie. "uid" or "sAMAccountName", produce
+// the same UserInfo
+type AttributeMap struct {
+	// Username is the attribute holding the username, ie. "uid", "sAMAccountName" or
+	// "userPrincipalName"
+	Username string `json:"username"`
+	// UID is the attribute holding the uid, the entry dn is used when empty
+	UID string `json:"uid,omitempty"`
+	// Groups are the attributes holding the groups the entry is a member of, ie. "memberOf"
+	// and "isMemberOf", their values are merged
+	Groups []string `json:"groups,omitempty"`
+	// Extra maps the keys of the UserInfo extra to the attribute they are read from, ie.
+	// "displayName" to "cn"
+	Extra map[string]string `json:"extra,omitempty"`
+}
+
+// copy return a deep copy of the map, so that the caller modifying it cannot race with the
+// searches
+func (m AttributeMap) copy() AttributeMap {
+	c := m
+	c.Groups = append([]string{}, m.Groups...)
+
+	if m.Extra != nil {
+		c.Extra = make(map[string]string, len(m.Extra))
+		for key, attribute := range m.Extra {
+			c.Extra[key] = attribute
+		}
+	}
+
+	return c
+}
+
+// extraKeys return the extra keys, sorted so that the attributes are always requested in the
+// same order
+func (m AttributeMap) extraKeys() []string {
+	keys := make([]string, 0, len(m.Extra))
+	for key := range m.Extra {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// attributes return every attribute read from the user entry, once
+func (m AttributeMap) attributes() []string {
+	all := append([]string{m.Username, m.UID}, m.Groups...)
+	for _, key := range m.extraKeys() {
+		all = append(all, m.Extra[key])
+	}
+
+	res := []string{}
+	for _, attribute := range all {
+		if attribute != "" && !contains(res, attribute) {
+			res = append(res, attribute)
+		}
+	}
+
+	return res
+}
+
+func (m AttributeMap) validate() error {
+	if m.Username == "" {
+		return fmt.Errorf("The attribute map requires a username attribute")
+	}
+
+	for key, attribute := range m.Extra {
+		if key == "" || attribute == "" {
+			return fmt.Errorf("Invalid extra attribute '%s' mapped to '%s', neither can be empty", key, attribute)
+		}
+	}
+
+	return nil
+}
+
+// extraAttributeMap map every attribute to itself, the extra keys being the attribute names
+func extraAttributeMap(attributes []string) map[string]string {
+	if len(attributes) == 0 {
+		return nil
+	}
+
+	m := make(map[string]string, len(attributes))
+	for _, attribute := range attributes {
+		m[attribute] = attribute
+	}
+
+	return m
+}
@@ -0,0 +1,103 @@
+package ldap
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"sync"
+	"time"
+
+	auth "k8s.io/api/authentication/v1"
+)
+
+type cacheEntry struct {
+	user    *auth.UserInfo
+	expires time.Time
+}
+
+// cache keep the result of successful searches for a limited time. Entries are keyed by an
+// hmac of the username and password, with a key generated at startup, so that the
+// passwords cannot be recovered from memory.
+type cache struct {
+	mu         sync.Mutex
+	entries    map[string]cacheEntry
+	key        []byte
+	ttl        time.Duration
+	maxEntries int
+}
+
+func newCache(ttl time.Duration, maxEntries int) (*cache, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+
+	return &cache{
+		entries:    map[string]cacheEntry{},
+		key:        key,
+		ttl:        ttl,
+		maxEntries: maxEntries,
+	}, nil
+}
+
+func (c *cache) hash(username, password string) string {
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write([]byte(username))
+	mac.Write([]byte{0})
+	mac.Write([]byte(password))
+
+	return string(mac.Sum(nil))
+}
+
+func (c *cache) get(username, password string) *auth.UserInfo {
+	key := c.hash(username, password)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+
+	if time.Now().After(entry.expires) {
+		delete(c.entries, key)
+		return nil
+	}
+
+	return entry.user.DeepCopy()
+}
+
+// set store the user of a successful search. When the cache is full, expired entries are
+// dropped first, then the one closest to expiration.
+func (c *cache) set(username, password string, user *auth.UserInfo) {
+	key := c.hash(username, password)
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.maxEntries {
+		var (
+			oldest  string
+			expires time.Time
+		)
+
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			} else if oldest == "" || e.expires.Before(expires) {
+				oldest, expires = k, e.expires
+			}
+		}
+
+		if len(c.entries) >= c.maxEntries {
+			delete(c.entries, oldest)
+		}
+	}
+
+	c.entries[key] = cacheEntry{
+		user:    user.DeepCopy(),
+		expires: now.Add(c.ttl),
+	}
+}
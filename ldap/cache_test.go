@@ -0,0 +1,43 @@
+package ldap
+
+import (
+	"testing"
+	"time"
+
+	auth "k8s.io/api/authentication/v1"
+)
+
+func TestCache(t *testing.T) {
+	c, err := newCache(time.Minute, 2)
+	if err != nil {
+		t.Fatalf("newCache() error = %s", err)
+	}
+
+	c.set("jdoe", "secret", &auth.UserInfo{Username: "jdoe"})
+
+	if got := c.get("jdoe", "secret"); got == nil || got.Username != "jdoe" {
+		t.Errorf("get() = %v, want jdoe", got)
+	}
+
+	if got := c.get("jdoe", "wrong"); got != nil {
+		t.Errorf("get() with a wrong password = %v, want nil", got)
+	}
+
+	c.set("alice", "secret", &auth.UserInfo{Username: "alice"})
+	c.set("bob", "secret", &auth.UserInfo{Username: "bob"})
+
+	if len(c.entries) != 2 {
+		t.Errorf("cache holds %d entries, want 2", len(c.entries))
+	}
+
+	if got := c.get("bob", "secret"); got == nil {
+		t.Errorf("get() of the last entry = nil, want bob")
+	}
+
+	c.ttl = -time.Second
+	c.set("bob", "secret", &auth.UserInfo{Username: "bob"})
+
+	if got := c.get("bob", "secret"); got != nil {
+		t.Errorf("get() of an expired entry = %v, want nil", got)
+	}
+}
@@ -0,0 +1,297 @@
+package ldap
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/url"
+
+	ldap "github.com/go-ldap/ldap/v3"
+	"github.com/rs/zerolog/log"
+)
+
+// urls return the configured ldap urls in the order they should be tried
+func (s *Ldap) urls() []string {
+	urls := make([]string, len(s.ldapURLs))
+	copy(urls, s.ldapURLs)
+
+	if s.randomizeURLs {
+		rand.Shuffle(len(urls), func(i, j int) {
+			urls[i], urls[j] = urls[j], urls[i]
+		})
+	}
+
+	return urls
+}
+
+// dialConn open the network connection to the ldap server of the url, like ldap.DialURL
+// does but stopping when ctx is done
+func (s *Ldap) dialConn(ctx context.Context, u *url.URL, tlsConfig *tls.Config) (net.Conn, error) {
+	d := &net.Dialer{Timeout: s.dialTimeout}
+
+	if u.Scheme == "ldapi" {
+		path := u.Path
+		if path == "" || path == "/" {
+			path = "/var/run/slapd/ldapi"
+		}
+
+		return d.DialContext(ctx, "unix", path)
+	}
+
+	host, port, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		// the port is missing
+		host, port = u.Host, ""
+	}
+
+	switch u.Scheme {
+	case "ldap":
+		if port == "" {
+			port = ldap.DefaultLdapPort
+		}
+
+		return d.DialContext(ctx, "tcp", net.JoinHostPort(host, port))
+	case "ldaps":
+		if port == "" {
+			port = ldap.DefaultLdapsPort
+		}
+
+		td := &tls.Dialer{NetDialer: d, Config: tlsConfig}
+
+		return td.DialContext(ctx, "tcp", net.JoinHostPort(host, port))
+	}
+
+	return nil, fmt.Errorf("Unknown scheme '%s'", u.Scheme)
+}
+
+// closeOnDone close the connection as soon as ctx is done, aborting its pending operations,
+// until the returned function is called
+func closeOnDone(ctx context.Context, l *ldap.Conn) func() {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+
+		select {
+		case <-ctx.Done():
+			l.Close()
+		case <-stop:
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-stopped
+	}
+}
+
+// dialURL open a connection to the given ldap server. When the url scheme is ldaps://, or
+// when StartTLS is enabled, the server certificate is verified against the configured CA
+// (or the system pool) and its hostname must match the url host unless verification was
+// explicitly disabled.
+func (s *Ldap) dialURL(ctx context.Context, addr string) (*ldap.Conn, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, ldap.NewError(ldap.ErrorNetwork, err)
+	}
+
+	tlsConfig := s.tlsConfig
+	if tlsConfig != nil && tlsConfig.ServerName == "" {
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.ServerName = u.Hostname()
+	}
+
+	c, err := s.dialConn(ctx, u, tlsConfig)
+	if err != nil {
+		return nil, ldap.NewError(ldap.ErrorNetwork, err)
+	}
+
+	l := ldap.NewConn(c, u.Scheme == "ldaps")
+	l.Start()
+	l.SetTimeout(s.operationTimeout)
+
+	if s.startTLS {
+		stop := closeOnDone(ctx, l)
+		err = l.StartTLS(tlsConfig)
+		stop()
+
+		// never fall back to plaintext, the bind credentials would be sent unencrypted
+		if err != nil {
+			l.Close()
+			return nil, ldap.NewError(ldap.ErrorNetwork, fmt.Errorf("Could not upgrade the ldap connection with StartTLS, %w", err))
+		}
+
+		log.Debug().Str("url", addr).Msg("Successfully upgraded ldap connection with StartTLS.")
+	}
+
+	return l, nil
+}
+
+// connect dial the configured ldap servers in turn and perform the given bind on the first
+// one reachable. Reaching the next server only happens on connection errors, any other bind
+// error (like invalid credentials) is definitive and returned as is. Dialing and binding
+// are aborted when ctx is done.
+func (s *Ldap) connect(ctx context.Context, bind func(*ldap.Conn) error) (*ldap.Conn, error) {
+	return s.connectTo(ctx, s.urls(), bind)
+}
+
+// connectTo dial the given ldap servers in turn, see connect
+func (s *Ldap) connectTo(ctx context.Context, urls []string, bind func(*ldap.Conn) error) (*ldap.Conn, error) {
+	var err error
+
+	for _, addr := range urls {
+		if ctx.Err() != nil {
+			return nil, ldap.NewError(ldap.ErrorNetwork, ctx.Err())
+		}
+
+		var l *ldap.Conn
+
+		l, err = s.dialURL(ctx, addr)
+		if err == nil {
+			log.Debug().Str("url", addr).Msg("Successfully dialed ldap.")
+
+			if bind == nil {
+				return l, nil
+			}
+
+			stop := closeOnDone(ctx, l)
+			err = bind(l)
+			stop()
+
+			if err == nil {
+				return l, nil
+			}
+
+			// the server dropping the connection is reported as a plain error
+			if l.IsClosing() && !ldap.IsErrorWithCode(err, ldap.ErrorNetwork) {
+				err = ldap.NewError(ldap.ErrorNetwork, err)
+			}
+
+			l.Close()
+
+			if !ldap.IsErrorWithCode(err, ldap.ErrorNetwork) {
+				return nil, err
+			}
+		}
+
+		log.Warn().Err(err).Str("url", addr).Msg("Could not reach ldap server.")
+	}
+
+	return nil, err
+}
+
+// Bind open a connection authenticated as the service account, with a simple bind or with the
+// SASL EXTERNAL mechanism. When no service account is configured (direct bind mode or
+// anonymous search), the connection is only dialed and its operations are anonymous.
+// Dialing and binding are aborted when ctx is done.
+func (s *Ldap) Bind(ctx context.Context) (*ldap.Conn, error) {
+	return s.bindTo(ctx, s.urls())
+}
+
+// bindTo open a connection to one of the given ldap servers authenticated as the service
+// account, see Bind
+func (s *Ldap) bindTo(ctx context.Context, urls []string) (*ldap.Conn, error) {
+	accounts := append([]BindAccount{{DN: s.bindDN, Password: s.bindPassword.get()}}, s.fallbackAccounts...)
+
+	// the accounts are tried in turn on the same connection, only a rejected account makes
+	// the next one be tried
+	bind := func(c *ldap.Conn) error {
+		var err error
+
+		for i, account := range accounts {
+			if err = c.Bind(account.DN, account.Password); err == nil && i > 0 {
+				log.Warn().Str("bind_dn", account.DN).Msg("Authenticated to ldap with a fallback service account.")
+				return nil
+			} else if err == nil {
+				log.Debug().Str("bind_dn", account.DN).Msg("Successfully authenticated to ldap.")
+				return nil
+			}
+
+			if c.IsClosing() || ldap.IsErrorWithCode(err, ldap.ErrorNetwork) {
+				return err
+			}
+
+			log.Warn().Err(err).Str("bind_dn", account.DN).Msg("Ldap server rejected the service account.")
+		}
+
+		return err
+	}
+
+	if s.externalBind {
+		bind = func(c *ldap.Conn) error {
+			if err := c.ExternalBind(); err != nil {
+				return err
+			}
+
+			log.Debug().Msg("Successfully authenticated to ldap with the client certificate.")
+
+			return nil
+		}
+	} else if s.bindDN == "" {
+		return s.connectTo(ctx, urls, nil)
+	}
+
+	l, err := s.connectTo(ctx, urls, bind)
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.ErrorNetwork) {
+		// a rejected service account is a configuration issue, not a user one
+		return nil, fmt.Errorf("%w, could not bind as the service account: %s", ErrDirectoryUnavailable, err.Error())
+	} else if err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// withConn run fn with a pooled service account connection. The connection is closed, and so
+// not given back to the pool, when ctx is done before fn returns. When an idle connection
+// turns out to be dead, fn is run once more with a newly dialed one, so fn must be safe to
+// run again.
+func (s *Ldap) withConn(ctx context.Context, fn func(*ldap.Conn) error) error {
+	l, idle, err := s.pool.get(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = s.runConn(ctx, l, fn)
+
+	// a connection found dead is closed by the client, which is not always told why
+	dead := l.IsClosing() || ldap.IsErrorWithCode(err, ldap.ErrorNetwork)
+	if err == nil || !idle || !dead || ctx.Err() != nil {
+		return err
+	}
+
+	log.Debug().Err(err).Msg("The idle ldap connection is dead, retrying with a new one.")
+
+	if l, err = s.pool.fresh(ctx); err != nil {
+		return err
+	}
+
+	return s.runConn(ctx, l, fn)
+}
+
+// runConn run fn with a connection got from the pool, then give it back
+func (s *Ldap) runConn(ctx context.Context, l *ldap.Conn, fn func(*ldap.Conn) error) error {
+	stop := closeOnDone(ctx, l)
+	err := fn(l)
+	stop()
+
+	s.pool.put(l, err)
+
+	return err
+}
+
+// search run the search request, using the paged results control when a page size was set
+func (s *Ldap) search(l *ldap.Conn, searchRequest *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	if s.pageSize > 0 {
+		return l.SearchWithPaging(searchRequest, s.pageSize)
+	}
+
+	return l.Search(searchRequest)
+}
@@ -0,0 +1,83 @@
+package ldap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	ldap "github.com/go-ldap/ldap/v3"
+)
+
+var (
+	// ErrTimeout means the ldap server could not be dialed or did not answer in time
+	ErrTimeout = errors.New("Ldap operation timed out")
+	// ErrUserNotFound means no entry matched the username
+	ErrUserNotFound = errors.New("User not found")
+	// ErrInvalidCredentials means the user entry was found but the password was rejected
+	ErrInvalidCredentials = errors.New("Invalid credentials")
+	// ErrDirectoryUnavailable means the ldap server could not be reached or used, ie. all the
+	// urls are down or the service account bind failed
+	ErrDirectoryUnavailable = errors.New("Ldap directory unavailable")
+	// ErrTooManyEntries means several entries matched the username, the search filter is not
+	// unique, see TooManyEntriesError
+	ErrTooManyEntries = errors.New("Too many entries returned")
+	// ErrTooManySearches means the maximum number of concurrent searches was reached, the
+	// credentials were not checked, see WithMaxConcurrentSearches
+	ErrTooManySearches = errors.New("Too many concurrent ldap searches")
+	// ErrLookupUnsupported means the users cannot be looked up without their password, they
+	// are bound as directly with WithUserDNTemplate, see LookupGroups
+	ErrLookupUnsupported = errors.New("Users cannot be looked up with a user dn template")
+)
+
+// TooManyEntriesError is returned when several entries matched the username, it wraps
+// ErrTooManyEntries
+type TooManyEntriesError struct {
+	Username string
+	Count    int
+}
+
+func (e *TooManyEntriesError) Error() string {
+	return fmt.Sprintf("%s, %d entries matched '%s'", ErrTooManyEntries.Error(), e.Count, e.Username)
+}
+
+func (e *TooManyEntriesError) Unwrap() error {
+	return ErrTooManyEntries
+}
+
+// the go-ldap library does not expose a typed error for request timeouts
+const errConnectionTimedOut = "ldap: connection timed out"
+
+func isTimeout(err error) bool {
+	var lerr *ldap.Error
+	if errors.As(err, &lerr) && lerr.Err != nil {
+		if lerr.ResultCode == ldap.LDAPResultTimeLimitExceeded || lerr.Err.Error() == errConnectionTimedOut {
+			return true
+		}
+
+		err = lerr.Err
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	var nerr net.Error
+	return errors.As(err, &nerr) && nerr.Timeout()
+}
+
+// wrap translate errors returned by the go-ldap library into the errors of this package
+func wrap(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case isTimeout(err):
+		return fmt.Errorf("%w, %s", ErrTimeout, err.Error())
+	case ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials):
+		return fmt.Errorf("%w, %s", ErrInvalidCredentials, err.Error())
+	case ldap.IsErrorWithCode(err, ldap.ErrorNetwork):
+		return fmt.Errorf("%w, %s", ErrDirectoryUnavailable, err.Error())
+	}
+
+	return err
+}
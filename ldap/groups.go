@@ -0,0 +1,150 @@
+package ldap
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	ldap "github.com/go-ldap/ldap/v3"
+)
+
+// memberof return the values of every group attribute of the entry, the duplicates are
+// removed once sanitized
+func (s *Ldap) memberof(entry *ldap.Entry) []string {
+	var groups []string
+	for _, attribute := range s.attributes.Groups {
+		groups = append(groups, entry.GetAttributeValues(attribute)...)
+	}
+
+	return groups
+}
+
+// memberGroups search the groups the given dn is a direct member of with the group search
+// filter, for directories that do not maintain a memberof attribute. The group dn are
+// returned, like memberof values.
+func (s *Ldap) memberGroups(l *ldap.Conn, dn string) ([]string, error) {
+	var groups []string
+
+	for _, base := range s.groupSearchBases {
+		searchRequest := ldap.NewSearchRequest(
+			base,
+			ldap.ScopeWholeSubtree,
+			ldap.NeverDerefAliases,
+			0,
+			int(s.operationTimeout/time.Second),
+			false,
+			fmt.Sprintf(s.groupSearchFilter, ldap.EscapeFilter(dn)),
+			[]string{"1.1"},
+			nil,
+		)
+
+		result, err := s.search(l, searchRequest)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, entry := range result.Entries {
+			groups = append(groups, entry.DN)
+		}
+	}
+
+	return groups, nil
+}
+
+// parentGroups return the groups the given group is a direct member of
+func (s *Ldap) parentGroups(l *ldap.Conn, group string) ([]string, error) {
+	if s.groupSearchFilter != "" {
+		return s.memberGroups(l, group)
+	}
+
+	// group values are not always dn: names have no entry to read
+	if dn, err := ldap.ParseDN(group); err != nil || len(dn.RDNs) == 0 {
+		return nil, nil
+	}
+
+	searchRequest := ldap.NewSearchRequest(
+		group,
+		ldap.ScopeBaseObject,
+		ldap.NeverDerefAliases,
+		0,
+		int(s.operationTimeout/time.Second),
+		false,
+		"(objectClass=*)",
+		s.attributes.Groups,
+		nil,
+	)
+
+	result, err := s.search(l, searchRequest)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) || ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidDNSyntax) {
+		// the group may have been deleted, or the server may parse dn more strictly
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if len(result.Entries) == 0 {
+		return nil, nil
+	}
+
+	return s.memberof(result.Entries[0]), nil
+}
+
+// resolveNestedGroups walk up the group hierarchy, starting from the user direct groups,
+// for at most s.nestedGroupsDepth levels. Every group is visited once, so that cycles in
+// the group graph do not prevent the walk from ending, and the returned groups are unique.
+func (s *Ldap) resolveNestedGroups(l *ldap.Conn, groups []string) ([]string, error) {
+	var (
+		seen    = map[string]bool{}
+		res     = []string{}
+		current = groups
+	)
+
+	for depth := 0; len(current) > 0; depth++ {
+		next := []string{}
+
+		for _, group := range current {
+			key := strings.ToLower(group)
+			if seen[key] {
+				continue
+			}
+
+			seen[key] = true
+			res = append(res, group)
+
+			if depth >= s.nestedGroupsDepth {
+				continue
+			}
+
+			parents, err := s.parentGroups(l, group)
+			if err != nil {
+				return nil, err
+			}
+
+			next = append(next, parents...)
+		}
+
+		current = next
+	}
+
+	return res, nil
+}
+
+// groups return the groups of the user entry, read from its memberof attributes or searched
+// with the given connection when a group search filter is set, resolving nested groups with
+// that same connection when enabled
+func (s *Ldap) groups(l *ldap.Conn, entry *ldap.Entry) ([]string, error) {
+	groups := s.memberof(entry)
+
+	if s.groupSearchFilter != "" {
+		var err error
+		if groups, err = s.memberGroups(l, entry.DN); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.nestedGroupsDepth > 0 {
+		return s.resolveNestedGroups(l, groups)
+	}
+
+	return groups, nil
+}
@@ -1,132 +1,625 @@
 package ldap
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
 	"strings"
+	"text/template"
+	"time"
 
 	ldap "github.com/go-ldap/ldap/v3"
 	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 
 	auth "k8s.io/api/authentication/v1"
 )
 
+// Ldap authenticate users against a ldap directory. An instance is safe for concurrent use once
+// returned by NewInstance: its configuration is never modified afterwards, and the state
+// shared by the searches, the connection pool, the cache and the reloaded bind password, is
+// guarded by their own locks.
 type Ldap struct {
-	ldapURL          string
-	bindDN           string
-	bindPassword     string
-	searchBase       string
-	searchScope      string
-	searchFilter     string
-	memberofProperty string
-	usernameProperty string
-	extraAttributes  []string
-	searchAttributes []string
+	ldapURLs          []string
+	randomizeURLs     bool
+	dialTimeout       time.Duration
+	operationTimeout  time.Duration
+	bindDN            string
+	bindPassword      *secret
+	passwordReload    time.Duration
+	fallbackAccounts  []BindAccount
+	searchBases       []string
+	searchScope       int
+	searchFilter      string
+	searchTemplate    *template.Template
+	attributes        AttributeMap
+	searchAttributes  []string
+	tlsConfig         *tls.Config
+	startTLS          bool
+	poolSize          int
+	maxSearches       int
+	searchesWait      time.Duration
+	limiter           *limiter
+	poolIdleTimeout   time.Duration
+	pool              *pool
+	nestedGroupsDepth int
+	groupFormat       string
+	groupFilter       *regexp.Regexp
+	groupSearchFilter string
+	groupSearchBases  []string
+	caseSensitive     bool
+	omitDN            bool
+	dnExtra           bool
+	pageSize          uint32
+	userDNTemplate    string
+	cacheTTL          time.Duration
+	cacheMaxEntries   int
+	cache             *cache
+	metrics           *metrics
+	tracer            trace.Tracer
+	retryAttempts     int
+	retryBackoff      time.Duration
+	retryJitter       float64
+	followReferrals   bool
+	externalBind      bool
+	referralHosts     []string
 }
 
-func sanitize(a []string) []string {
-	var res []string
+// filterData holds the values a templated search filter is rendered with, ie.
+// "(|(uid={{.Username}})(mail={{.Username}}))". Every value is escaped.
+type filterData struct {
+	Username string
+}
+
+func contains(a []string, value string) bool {
+	for _, item := range a {
+		if strings.EqualFold(item, value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// groupName extract the part of a group value selected by format. Values that are not a
+// dn, or that do not contain the requested component, are returned as is.
+func groupName(group, format string) string {
+	if format == GroupFormatDN {
+		return group
+	}
+
+	dn, err := ldap.ParseDN(group)
+	if err != nil || len(dn.RDNs) == 0 || len(dn.RDNs[0].Attributes) == 0 {
+		return group
+	}
+
+	if format == GroupFormatRDN {
+		return dn.RDNs[0].Attributes[0].Value
+	}
+
+	for _, attr := range dn.RDNs[0].Attributes {
+		if strings.EqualFold(attr.Type, "cn") {
+			return attr.Value
+		}
+	}
+
+	return group
+}
+
+// sanitize format and lowercase the group values returned by the ldap server, see groupName.
+// Empty values are dropped, and only the names matching filter are kept when set. The names
+// are deduplicated and sorted so that the groups of a user are stable whatever the order the
+// ldap server returned them in.
+func sanitize(a []string, format string, filter *regexp.Regexp) []string {
+	res := []string{}
+	seen := map[string]struct{}{}
 
 	for _, item := range a {
-		res = append(res, strings.ToLower(item))
+		if strings.TrimSpace(item) == "" {
+			continue
+		}
+
+		name := strings.ToLower(groupName(item, format))
+		if filter != nil && !filter.MatchString(name) {
+			continue
+		}
+
+		if _, ok := seen[name]; ok {
+			continue
+		}
+
+		seen[name] = struct{}{}
+		res = append(res, name)
 	}
 
+	sort.Strings(res)
+
 	return res
 }
 
 func NewInstance(
-	ldapURL,
+	ldapURLs []string,
 	bindDN,
-	bindPassword,
-	searchBase,
+	bindPassword string,
+	searchBases []string,
 	searchScope,
 	searchFilter,
 	memberofProperty,
 	usernameProperty string,
 	extraAttributes,
 	searchAttributes []string,
-) *Ldap {
+	opts ...Option,
+) (*Ldap, error) {
+	// the slices are copied so that the caller modifying them cannot race with the searches
 	s := &Ldap{
-		ldapURL:          ldapURL,
+		ldapURLs:         append([]string{}, ldapURLs...),
+		dialTimeout:      DefaultDialTimeout,
+		operationTimeout: DefaultOperationTimeout,
 		bindDN:           bindDN,
-		bindPassword:     bindPassword,
-		searchBase:       searchBase,
-		searchScope:      searchScope,
+		bindPassword:     &secret{password: bindPassword},
+		searchBases:      append([]string{}, searchBases...),
 		searchFilter:     searchFilter,
-		memberofProperty: memberofProperty,
-		usernameProperty: usernameProperty,
-		extraAttributes:  extraAttributes,
-		searchAttributes: searchAttributes,
+		attributes: AttributeMap{
+			Username: usernameProperty,
+			Groups:   []string{memberofProperty},
+			Extra:    extraAttributeMap(extraAttributes),
+		},
+		searchAttributes: append([]string{}, searchAttributes...),
+		poolSize:         DefaultPoolSize,
+		poolIdleTimeout:  DefaultPoolIdleTimeout,
+		groupFormat:      GroupFormatDN,
+		tracer:           trace.NewNoopTracerProvider().Tracer(tracerName),
+		retryAttempts:    DefaultRetryAttempts,
+		retryBackoff:     DefaultRetryBackoff,
+		retryJitter:      DefaultRetryJitter,
+	}
+
+	scope, err := parseScope(searchScope)
+	if err != nil {
+		return nil, err
+	}
+	s.searchScope = scope
+
+	for _, opt := range opts {
+		if err := opt(s); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.startTLS {
+		s.tls()
+	}
+
+	if s.passwordReload > 0 {
+		if s.bindPassword.path == "" {
+			return nil, fmt.Errorf("The bind password can only be reloaded when read from a file")
+		}
+
+		s.bindPassword.interval = s.passwordReload
+	}
+
+	if len(s.searchBases) == 0 {
+		s.searchBases = []string{""}
+	}
+
+	// filters without placeholders keep being formatted with fmt, replacing their %s
+	if strings.Contains(searchFilter, "{{") {
+		t, err := template.New("search-filter").Option("missingkey=error").Parse(searchFilter)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid search filter '%s', %w", searchFilter, err)
+		}
+
+		// unknown fields only fail once executed
+		if err := t.Execute(&strings.Builder{}, filterData{}); err != nil {
+			return nil, fmt.Errorf("Invalid search filter '%s', %w", searchFilter, err)
+		}
+
+		s.searchTemplate = t
+	}
+
+	if s.groupSearchFilter != "" && len(s.groupSearchBases) == 0 {
+		s.groupSearchBases = s.searchBases
+	}
+
+	// the attributes read from the user entry are always requested, whatever the caller gave
+	if len(s.searchAttributes) == 0 {
+		log.Warn().Msg("No search attributes were provided, all the user attributes will be requested.")
+	} else {
+		for _, attribute := range s.attributes.attributes() {
+			if !contains(s.searchAttributes, attribute) {
+				s.searchAttributes = append(s.searchAttributes, attribute)
+			}
+		}
+	}
+
+	if s.externalBind {
+		if bindDN != "" || s.bindPassword.get() != "" || len(s.fallbackAccounts) > 0 {
+			return nil, fmt.Errorf("The SASL EXTERNAL bind cannot be used with a bind dn or password")
+		}
+
+		if s.userDNTemplate != "" {
+			return nil, fmt.Errorf("The SASL EXTERNAL bind cannot be used with a user dn template")
+		}
+
+		if s.tlsConfig == nil || len(s.tlsConfig.Certificates) == 0 {
+			return nil, fmt.Errorf("The SASL EXTERNAL bind requires a client certificate")
+		}
+	} else if bindDN == "" && len(s.fallbackAccounts) > 0 {
+		return nil, fmt.Errorf("Fallback bind accounts require a bind dn")
+	} else if s.userDNTemplate == "" && bindDN == "" {
+		log.Info().Msg("No bind dn was provided, users will be searched anonymously.")
+	}
+
+	if len(ldapURLs) == 0 {
+		return nil, fmt.Errorf("At least one ldap url is required")
+	}
+
+	for _, ldapURL := range ldapURLs {
+		u, err := url.Parse(ldapURL)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid ldap url '%s', %w", ldapURL, err)
+		}
+
+		if u.Scheme == "ldaps" && s.startTLS {
+			return nil, fmt.Errorf("StartTLS cannot be used with a ldaps:// url")
+		}
+
+		if u.Scheme != "ldaps" && !s.startTLS && s.externalBind {
+			return nil, fmt.Errorf("The SASL EXTERNAL bind requires tls, the ldap url '%s' is not ldaps:// and StartTLS is disabled", ldapURL)
+		}
+
+		if u.Scheme != "ldaps" && !s.startTLS && s.tlsConfig != nil {
+			log.Warn().Str("url", ldapURL).Msg("A tls configuration was provided but the ldap url is not ldaps:// and StartTLS is disabled, it will not be used.")
+		}
+	}
+
+	s.pool = newPool(s.poolSize, s.poolIdleTimeout, func(ctx context.Context) (*ldap.Conn, error) {
+		return s.retry(ctx, s.Bind)
+	})
+
+	if s.maxSearches > 0 {
+		s.limiter = newLimiter(s.maxSearches, s.searchesWait)
+	}
+
+	if s.cacheTTL > 0 {
+		c, err := newCache(s.cacheTTL, s.cacheMaxEntries)
+		if err != nil {
+			return nil, err
+		}
+
+		s.cache = c
 	}
 
-	return s
+	return s, nil
 }
 
-func (s *Ldap) Bind() (*ldap.Conn, error) {
-	l, err := ldap.DialURL(s.ldapURL)
+// userInfo build the UserInfo of a user entry with the attribute map. The UID is the entry dn
+// unless a uid attribute was mapped, or the username when the dn is omitted. Both the uid and the username are
+// lowercased unless the instance is case sensitive, group names are always lowercased.
+func (s *Ldap) userInfo(entry *ldap.Entry, groups []string) *auth.UserInfo {
+	var extra map[string]auth.ExtraValue
+
+	// only the configured extra attributes are kept, and only when they have values, to keep
+	// the token small
+	for key, attribute := range s.attributes.Extra {
+		values := entry.GetAttributeValues(attribute)
+		if len(values) == 0 || (s.omitDN && contains(values, entry.DN)) {
+			continue
+		}
+
+		if extra == nil {
+			extra = map[string]auth.ExtraValue{}
+		}
+
+		extra[key] = values
+	}
+
+	if s.dnExtra {
+		if extra == nil {
+			extra = map[string]auth.ExtraValue{}
+		}
+
+		extra[DNExtraKey] = auth.ExtraValue{entry.DN}
+	}
+
+	username := entry.GetAttributeValue(s.attributes.Username)
+
+	uid := entry.DN
+	if s.attributes.UID != "" {
+		uid = entry.GetAttributeValue(s.attributes.UID)
+	} else if s.omitDN {
+		uid = username
+	}
+	if !s.caseSensitive {
+		uid = strings.ToLower(uid)
+		username = strings.ToLower(username)
+	}
+
+	return &auth.UserInfo{
+		UID:      uid,
+		Username: username,
+		Groups:   sanitize(groups, s.groupFormat, s.groupFilter),
+		Extra:    extra,
+	}
+}
+
+// escapeDN escape the special characters of an attribute value so that it can be used in a
+// dn, as described in https://datatracker.ietf.org/doc/html/rfc4514#section-2.4
+func escapeDN(value string) string {
+	var b strings.Builder
+
+	for i, c := range value {
+		switch {
+		case c == '\x00':
+			b.WriteString("\\00")
+			continue
+		case strings.ContainsRune("\"+\\,;<>=", c),
+			(c == ' ' || c == '#') && i == 0,
+			c == ' ' && i == len(value)-1:
+			b.WriteRune('\\')
+		}
+
+		b.WriteRune(c)
+	}
+
+	return b.String()
+}
+
+// filter return the user search filter for the given username, either rendered from the
+// filter template or formatted in place of its %s. The username is escaped so that it cannot
+// alter the filter, ie. "*)(uid=*" does not match every user.
+func (s *Ldap) filter(username string) string {
+	escaped := ldap.EscapeFilter(username)
+
+	if s.searchTemplate == nil {
+		return fmt.Sprintf(s.searchFilter, escaped)
+	}
+
+	// the template was executed by NewInstance, it cannot fail with another username
+	var b strings.Builder
+	s.searchTemplate.Execute(&b, filterData{Username: escaped})
+
+	return b.String()
+}
+
+// userSearchRequest return the request searching the user entry in base
+func (s *Ldap) userSearchRequest(base, username string) *ldap.SearchRequest {
+	return ldap.NewSearchRequest(
+		base,
+		s.searchScope,
+		ldap.NeverDerefAliases,              // Dereference aliases
+		0,                                   // Size limit (0 = no limit)
+		int(s.operationTimeout/time.Second), // Time limit (0 = no limit)
+		false,                               // Types only
+		s.filter(username),
+		s.searchAttributes,
+		nil, // Additional 'Controls'
+	)
+}
+
+// findUser search the user entry in every search base. Exactly one entry must match the
+// username across all the bases, and the referred servers when referrals are followed.
+// The url of the server holding the entry is returned when it is a referred server, the
+// user must be bound there.
+func (s *Ldap) findUser(ctx context.Context, username string) (_ *ldap.Entry, _ string, err error) {
+	_, span := s.startSpan(ctx, "ldap.search")
+	defer func() { endSpan(span, err) }()
+
+	var (
+		entries   []*ldap.Entry
+		servers   []string
+		referrals []string
+	)
+
+	err = s.withConn(ctx, func(l *ldap.Conn) error {
+		entries, servers, referrals = nil, nil, nil
+
+		for _, base := range s.searchBases {
+			result, err := s.search(l, s.userSearchRequest(base, username))
+			if err != nil {
+				return err
+			}
+
+			for _, entry := range result.Entries {
+				entries = append(entries, entry)
+				servers = append(servers, "")
+			}
+
+			referrals = append(referrals, result.Referrals...)
+		}
+
+		return nil
+	})
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
-	log.Debug().Msg("Successfully dialed ldap.")
 
-	err = l.Bind(s.bindDN, s.bindPassword)
+	if s.followReferrals {
+		for _, referral := range referrals {
+			server, found := s.searchReferral(ctx, referral, username)
+			for _, entry := range found {
+				entries = append(entries, entry)
+				servers = append(servers, server)
+			}
+		}
+	} else if len(referrals) > 0 {
+		log.Debug().Strs("referrals", referrals).Msg("Ignored the referrals returned by the search.")
+	}
+
+	if len(entries) == 0 {
+		return nil, "", ErrUserNotFound
+	} else if len(entries) > 1 {
+		return nil, "", &TooManyEntriesError{Username: username, Count: len(entries)}
+	}
+
+	return entries[0], servers[0], nil
+}
+
+// searchBind look the user up with the service account, or anonymously when there is none,
+// then bind as the user to verify their password
+func (s *Ldap) searchBind(ctx context.Context, username, password string) (*ldap.Entry, []string, error) {
+	entry, server, err := s.findUser(ctx, username)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	log.Debug().Msg("Successfully authenticated to ldap.")
+	urls := s.urls()
+	if server != "" {
+		urls = []string{server}
+	}
+
+	// Bind as the user to verify their password, on a dedicated connection so that
+	// the pooled one keeps the service account identity
+	_, span := s.startSpan(ctx, "ldap.bind")
+	uc, err := s.retry(ctx, func(ctx context.Context) (*ldap.Conn, error) {
+		return s.connectTo(ctx, urls, func(c *ldap.Conn) error {
+			return c.Bind(entry.DN, password)
+		})
+	})
+	endSpan(span, err)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	uc.Close()
+
+	groups, err := s.userGroups(ctx, server, entry)
+
+	return entry, groups, err
+}
+
+// userGroups read the groups of an entry found by findUser with the service account, on the
+// referred server holding it when server is set
+func (s *Ldap) userGroups(ctx context.Context, server string, entry *ldap.Entry) (groups []string, err error) {
+	_, span := s.startSpan(ctx, "ldap.groups")
+	defer func() { endSpan(span, err) }()
 
-	return l, nil
+	if server != "" {
+		return s.referredGroups(ctx, server, entry)
+	}
+
+	err = s.withConn(ctx, func(l *ldap.Conn) (err error) {
+		groups, err = s.groups(l, entry)
+		return err
+	})
+
+	return groups, err
 }
 
-func (s *Ldap) Search(username, password string) (*auth.UserInfo, error) {
-	l, err := s.Bind()
+// directBind bind as the user dn built from the template, then read the user own entry
+// with that same connection. No service account is involved.
+func (s *Ldap) directBind(ctx context.Context, username, password string) (*ldap.Entry, []string, error) {
+	dn := fmt.Sprintf(s.userDNTemplate, escapeDN(username))
+
+	_, span := s.startSpan(ctx, "ldap.bind")
+	l, err := s.retry(ctx, func(ctx context.Context) (*ldap.Conn, error) {
+		return s.connect(ctx, func(c *ldap.Conn) error {
+			return c.Bind(dn, password)
+		})
+	})
+	endSpan(span, err)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	defer l.Close()
+	defer closeOnDone(ctx, l)()
 
-	// Execute LDAP Search request
 	searchRequest := ldap.NewSearchRequest(
-		s.searchBase,
-		scopeMap[s.searchScope],
-		ldap.NeverDerefAliases, // Dereference aliases
-		0,                      // Size limit (0 = no limit)
-		0,                      // Time limit (0 = no limit)
-		false,                  // Types only
-		fmt.Sprintf(s.searchFilter, username),
+		dn,
+		ldap.ScopeBaseObject,
+		ldap.NeverDerefAliases,
+		0,
+		int(s.operationTimeout/time.Second),
+		false,
+		"(objectClass=*)",
 		s.searchAttributes,
-		nil, // Additional 'Controls'
+		nil,
 	)
-	result, err := l.Search(searchRequest)
+
+	_, span = s.startSpan(ctx, "ldap.search")
+	result, err := s.search(l, searchRequest)
+	if err == nil && len(result.Entries) != 1 {
+		err = ErrUserNotFound
+	}
+	endSpan(span, err)
 	if err != nil {
+		return nil, nil, err
+	}
+
+	_, span = s.startSpan(ctx, "ldap.groups")
+	groups, err := s.groups(l, result.Entries[0])
+	endSpan(span, err)
+
+	return result.Entries[0], groups, err
+}
+
+// Search authenticate the user and return their UserInfo. A nil user is always returned along
+// with an error, which wraps ErrUserNotFound, ErrInvalidCredentials, ErrDirectoryUnavailable
+// or ErrTimeout when the failure reason is known. The ldap operations are aborted when ctx is
+// done, the error is then ErrTimeout for an expired deadline or context.Canceled.
+// The ldap operations are recorded as children of the span found in ctx, if any.
+func (s *Ldap) Search(ctx context.Context, username, password string) (*auth.UserInfo, error) {
+	var (
+		entry  *ldap.Entry
+		groups []string
+		err    error
+	)
+
+	ctx, span := s.startSpan(ctx, "ldap.Search")
+	defer func() { endSpan(span, err) }()
+
+	// a bind with an empty password is an unauthenticated bind that some servers accept
+	// whatever the dn, it must never reach the server
+	if password == "" {
+		err = fmt.Errorf("%w, empty password", ErrInvalidCredentials)
 		return nil, err
 	}
 
-	// If LDAP Search produced a result, return UserInfo, otherwise, return nil
-	if len(result.Entries) == 0 {
-		return nil, fmt.Errorf("User not found")
-	} else if len(result.Entries) > 1 {
-		return nil, fmt.Errorf("Too many entries returned")
+	if s.cache != nil {
+		if user := s.cache.get(username, password); user != nil {
+			log.Debug().Str("username", username).Msg("Found user in cache.")
+			span.SetAttributes(attribute.Bool("ldap.cached", true))
+			return user, nil
+		}
 	}
 
-	// Bind as the user to verify their password
-	err = l.Bind(result.Entries[0].DN, password)
-	if err != nil {
+	// only the searches reaching the directory are limited, not the cached ones
+	if err = s.limiter.acquire(ctx); err != nil {
+		err = wrap(err)
 		return nil, err
 	}
+	defer s.limiter.release()
 
-	var extra map[string]auth.ExtraValue
+	start := time.Now()
 
-	for _, item := range s.extraAttributes {
-		extra[item] = result.Entries[0].GetAttributeValues(item)
+	if s.userDNTemplate != "" {
+		entry, groups, err = s.directBind(ctx, username, password)
+	} else {
+		entry, groups, err = s.searchBind(ctx, username, password)
 	}
 
-	user := &auth.UserInfo{
-		UID:      strings.ToLower(result.Entries[0].DN),
-		Username: strings.ToLower(result.Entries[0].GetAttributeValue(s.usernameProperty)),
-		Groups:   sanitize(result.Entries[0].GetAttributeValues(s.memberofProperty)),
-		Extra:    extra,
+	s.metrics.observeSearch(start, err)
+
+	if err != nil {
+		// the connections are closed once ctx is done, their errors are the consequence of it
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+
+		err = wrap(err)
+		return nil, err
+	}
+
+	user := s.userInfo(entry, groups)
+
+	// only successful searches reach this point, failures are never cached
+	if s.cache != nil {
+		s.cache.set(username, password, user)
 	}
 
 	log.Debug().Str("uid", user.UID).Strs("groups", user.Groups).Str("username", user.Username).Msg("Research returned a result.")
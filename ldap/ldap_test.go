@@ -0,0 +1,1950 @@
+package ldap
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	ldap "github.com/go-ldap/ldap/v3"
+
+	auth "k8s.io/api/authentication/v1"
+
+	"vbouchaud/k8s-ldap-auth/internal/ldaptest"
+)
+
+func writeCA(t *testing.T, srv *httptest.Server) string {
+	file := path.Join(t.TempDir(), "ca.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+
+	if err := ioutil.WriteFile(file, data, 0600); err != nil {
+		t.Fatalf("Failed to write CA file, %s", err)
+	}
+
+	return file
+}
+
+func TestDialTLS(t *testing.T) {
+	// httptest only serves as a tls endpoint here, the handshake is all we need.
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer srv.Close()
+
+	u, _ := url.Parse(srv.URL)
+	port := u.Port()
+	ca := writeCA(t, srv)
+
+	tests := []struct {
+		name    string
+		url     string
+		opts    []Option
+		wantErr string
+	}{
+		{
+			name:    "Self-signed server",
+			url:     "ldaps://127.0.0.1:" + port,
+			opts:    []Option{},
+			wantErr: "certificate",
+		},
+		{
+			name: "Trusted CA",
+			url:  "ldaps://127.0.0.1:" + port,
+			opts: []Option{WithCAFile(ca)},
+		},
+		{
+			name:    "Hostname mismatch",
+			url:     "ldaps://localhost:" + port,
+			opts:    []Option{WithCAFile(ca)},
+			wantErr: "localhost",
+		},
+		{
+			name: "Hostname mismatch with verification disabled",
+			url:  "ldaps://localhost:" + port,
+			opts: []Option{WithInsecureSkipVerify(true)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewInstance([]string{tt.url}, "cn=admin", "", nil, ScopeWholeSubtree, "", "", "", nil, nil, tt.opts...)
+			if err != nil {
+				t.Fatalf("NewInstance() error = %s", err)
+			}
+
+			c, err := s.dialURL(context.Background(), tt.url)
+			if c != nil {
+				defer c.Close()
+			}
+
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("dialURL() error = %s, want none", err)
+			} else if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("dialURL() error = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestConnectFailover(t *testing.T) {
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer srv.Close()
+
+	// grab a free port and release it so that nothing listens on it
+	down := httptest.NewUnstartedServer(http.NotFoundHandler())
+	unreachable := down.Listener.Addr().String()
+	down.Close()
+
+	u, _ := url.Parse(srv.URL)
+	s, err := NewInstance(
+		[]string{"ldaps://" + unreachable, "ldaps://" + u.Host},
+		"cn=admin", "", nil, ScopeWholeSubtree, "", "", "", nil, nil,
+		WithInsecureSkipVerify(true),
+	)
+	if err != nil {
+		t.Fatalf("NewInstance() error = %s", err)
+	}
+
+	c, err := s.connect(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("connect() error = %s, want none", err)
+	}
+
+	c.Close()
+}
+
+func TestFilter(t *testing.T) {
+	s := &Ldap{searchFilter: "(&(objectClass=inetOrgPerson)(uid=%s))"}
+
+	tests := []struct {
+		name     string
+		username string
+		want     string
+	}{
+		{
+			name:     "Plain username",
+			username: "jdoe",
+			want:     "(&(objectClass=inetOrgPerson)(uid=jdoe))",
+		},
+		{
+			name:     "Wildcard",
+			username: "*",
+			want:     "(&(objectClass=inetOrgPerson)(uid=\\2a))",
+		},
+		{
+			name:     "Filter injection",
+			username: "*)(uid=*",
+			want:     "(&(objectClass=inetOrgPerson)(uid=\\2a\\29\\28uid=\\2a))",
+		},
+		{
+			name:     "Backslash",
+			username: "j\\doe",
+			want:     "(&(objectClass=inetOrgPerson)(uid=j\\5cdoe))",
+		},
+		{
+			name:     "NUL byte",
+			username: "jdoe\x00",
+			want:     "(&(objectClass=inetOrgPerson)(uid=jdoe\\00))",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := s.filter(tt.username); got != tt.want {
+				t.Errorf("filter() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilterTemplate(t *testing.T) {
+	tests := []struct {
+		name     string
+		filter   string
+		username string
+		want     string
+		wantErr  bool
+	}{
+		{
+			name:     "single substitution",
+			filter:   "(&(objectClass=inetOrgPerson)(uid={{.Username}}))",
+			username: "jdoe",
+			want:     "(&(objectClass=inetOrgPerson)(uid=jdoe))",
+		},
+		{
+			name:     "repeated substitution",
+			filter:   "(|(uid={{.Username}})(mail={{.Username}}))",
+			username: "jdoe@corp",
+			want:     "(|(uid=jdoe@corp)(mail=jdoe@corp))",
+		},
+		{
+			name:     "every substitution escaped",
+			filter:   "(|(uid={{.Username}})(mail={{.Username}}))",
+			username: "*)(uid=*",
+			want:     "(|(uid=\\2a\\29\\28uid=\\2a)(mail=\\2a\\29\\28uid=\\2a))",
+		},
+		{
+			name:     "positional filter",
+			filter:   "(uid=%s)",
+			username: "*",
+			want:     "(uid=\\2a)",
+		},
+		{name: "unknown field", filter: "(uid={{.User}})", wantErr: true},
+		{name: "invalid template", filter: "(uid={{.Username)", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewInstance([]string{"ldap://localhost"}, "", "", []string{"dc=corp"}, ScopeWholeSubtree, tt.filter, "memberof", "uid", nil, nil)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("NewInstance() error = nil, want one for the filter %q", tt.filter)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("NewInstance() error = %s", err)
+			}
+
+			if got := s.filter(tt.username); got != tt.want {
+				t.Errorf("filter() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSanitize(t *testing.T) {
+	mixed := []string{"CN=Admins,OU=Groups,DC=Corp", "", "ou=Staff,dc=corp", "developers", "  "}
+
+	tests := []struct {
+		name   string
+		groups []string
+		format string
+		filter string
+		want   []string
+	}{
+		{
+			name:   "No groups",
+			groups: nil,
+			format: GroupFormatDN,
+			want:   []string{},
+		},
+		{
+			name:   "Mixed formats as dn",
+			groups: mixed,
+			format: GroupFormatDN,
+			want:   []string{"cn=admins,ou=groups,dc=corp", "developers", "ou=staff,dc=corp"},
+		},
+		{
+			name:   "Mixed formats as rdn",
+			groups: mixed,
+			format: GroupFormatRDN,
+			want:   []string{"admins", "developers", "staff"},
+		},
+		{
+			name:   "Mixed formats as cn",
+			groups: mixed,
+			format: GroupFormatCN,
+			want:   []string{"admins", "developers", "ou=staff,dc=corp"},
+		},
+		{
+			name:   "Duplicated and unsorted groups",
+			groups: []string{"cn=Viewers,ou=groups,dc=corp", "cn=admins,ou=groups,dc=corp", "CN=Admins,OU=Groups,DC=Corp", "cn=viewers,ou=groups,dc=corp"},
+			format: GroupFormatDN,
+			want:   []string{"cn=admins,ou=groups,dc=corp", "cn=viewers,ou=groups,dc=corp"},
+		},
+		{
+			name:   "Groups with a same name in different branches",
+			groups: []string{"cn=admins,ou=emea,dc=corp", "cn=admins,ou=apac,dc=corp", "cn=developers,dc=corp"},
+			format: GroupFormatCN,
+			want:   []string{"admins", "developers"},
+		},
+		{
+			name:   "Filtered on a prefix",
+			groups: []string{"cn=k8s-viewers,dc=corp", "cn=all-staff,dc=corp", "CN=K8S-Admins,DC=Corp", "cn=k8s-admins,ou=emea,dc=corp", "cn=sales-k8s-fans,dc=corp"},
+			format: GroupFormatCN,
+			filter: "^k8s-",
+			want:   []string{"k8s-admins", "k8s-viewers"},
+		},
+		{
+			name:   "Filter matching no group",
+			groups: []string{"cn=all-staff,dc=corp"},
+			format: GroupFormatCN,
+			filter: "^k8s-",
+			want:   []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var filter *regexp.Regexp
+			if tt.filter != "" {
+				filter = regexp.MustCompile(tt.filter)
+			}
+
+			if got := sanitize(tt.groups, tt.format, filter); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("sanitize() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUserInfo(t *testing.T) {
+	openldap := ldap.NewEntry("uid=jdoe,ou=people,dc=corp", map[string][]string{
+		"uid":        {"jdoe"},
+		"entryUUID":  {"6d2ee1a4-1a3c-4d83-9f34-32a3d5c0d0b4"},
+		"ismemberof": {"cn=admins,ou=groups,dc=corp"},
+	})
+	ad := ldap.NewEntry("CN=John Doe,OU=People,DC=Corp", map[string][]string{
+		"sAMAccountName": {"JDoe"},
+		"memberOf":       {"CN=Admins,OU=Groups,DC=Corp"},
+	})
+
+	tests := []struct {
+		name             string
+		entry            *ldap.Entry
+		usernameProperty string
+		memberofProperty string
+		uidProperty      string
+		caseSensitive    bool
+		omitDN           bool
+		wantUID          string
+		wantUsername     string
+	}{
+		{
+			name:             "OpenLDAP entry",
+			entry:            openldap,
+			usernameProperty: "uid",
+			memberofProperty: "ismemberof",
+			wantUID:          "uid=jdoe,ou=people,dc=corp",
+			wantUsername:     "jdoe",
+		},
+		{
+			name:             "OpenLDAP entry with uid property",
+			entry:            openldap,
+			usernameProperty: "uid",
+			memberofProperty: "ismemberof",
+			uidProperty:      "entryUUID",
+			wantUID:          "6d2ee1a4-1a3c-4d83-9f34-32a3d5c0d0b4",
+			wantUsername:     "jdoe",
+		},
+		{
+			name:             "Active Directory entry",
+			entry:            ad,
+			usernameProperty: "sAMAccountName",
+			memberofProperty: "memberOf",
+			wantUID:          "cn=john doe,ou=people,dc=corp",
+			wantUsername:     "jdoe",
+		},
+		{
+			name:             "Active Directory entry with uid property",
+			entry:            ad,
+			usernameProperty: "sAMAccountName",
+			memberofProperty: "memberOf",
+			uidProperty:      "sAMAccountName",
+			wantUID:          "jdoe",
+			wantUsername:     "jdoe",
+		},
+		{
+			name:             "Active Directory entry without dn",
+			entry:            ad,
+			usernameProperty: "sAMAccountName",
+			memberofProperty: "memberOf",
+			omitDN:           true,
+			wantUID:          "jdoe",
+			wantUsername:     "jdoe",
+		},
+		{
+			name:             "OpenLDAP entry without dn with uid property",
+			entry:            openldap,
+			usernameProperty: "uid",
+			memberofProperty: "ismemberof",
+			uidProperty:      "entryUUID",
+			omitDN:           true,
+			wantUID:          "6d2ee1a4-1a3c-4d83-9f34-32a3d5c0d0b4",
+			wantUsername:     "jdoe",
+		},
+		{
+			name:             "Case sensitive Active Directory entry",
+			entry:            ad,
+			usernameProperty: "sAMAccountName",
+			memberofProperty: "memberOf",
+			caseSensitive:    true,
+			wantUID:          "CN=John Doe,OU=People,DC=Corp",
+			wantUsername:     "JDoe",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Ldap{
+				attributes: AttributeMap{
+					Username: tt.usernameProperty,
+					UID:      tt.uidProperty,
+					Groups:   []string{tt.memberofProperty},
+				},
+				caseSensitive: tt.caseSensitive,
+				omitDN:        tt.omitDN,
+				groupFormat:   GroupFormatDN,
+			}
+
+			got := s.userInfo(tt.entry, tt.entry.GetAttributeValues(tt.memberofProperty))
+			if got.UID != tt.wantUID || got.Username != tt.wantUsername {
+				t.Errorf("userInfo() = %s/%s, want %s/%s", got.UID, got.Username, tt.wantUID, tt.wantUsername)
+			}
+		})
+	}
+}
+
+func TestEscapeDN(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{
+			name:  "Plain value",
+			value: "jdoe",
+			want:  "jdoe",
+		},
+		{
+			name:  "Special characters",
+			value: "doe, john+admin=\"x\"",
+			want:  "doe\\, john\\+admin\\=\\\"x\\\"",
+		},
+		{
+			name:  "Leading and trailing spaces",
+			value: " jdoe ",
+			want:  "\\ jdoe\\ ",
+		},
+		{
+			name:  "Leading hash and NUL byte",
+			value: "#jdoe\x00",
+			want:  "\\#jdoe\\00",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := escapeDN(tt.value); got != tt.want {
+				t.Errorf("escapeDN() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWrap(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want error
+	}{
+		{
+			name: "Invalid credentials",
+			err:  ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("invalid")),
+			want: ErrInvalidCredentials,
+		},
+		{
+			name: "Network error",
+			err:  ldap.NewError(ldap.ErrorNetwork, errors.New("connection refused")),
+			want: ErrDirectoryUnavailable,
+		},
+		{
+			name: "Request timeout",
+			err:  ldap.NewError(ldap.ErrorNetwork, errors.New(errConnectionTimedOut)),
+			want: ErrTimeout,
+		},
+		{
+			name: "Already wrapped",
+			err:  ErrUserNotFound,
+			want: ErrUserNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := wrap(tt.err); !errors.Is(got, tt.want) {
+				t.Errorf("wrap() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUserInfoExtra(t *testing.T) {
+	entry := ldap.NewEntry("uid=jdoe,ou=people,dc=corp", map[string][]string{
+		"uid":          {"jdoe"},
+		"department":   {"r&d"},
+		"employeeType": {"contractor", "remote"},
+		"mail":         {"jdoe@corp"},
+	})
+
+	s := &Ldap{
+		attributes: AttributeMap{
+			Username: "uid",
+			Extra:    extraAttributeMap([]string{"department", "employeeType", "title"}),
+		},
+		groupFormat: GroupFormatDN,
+	}
+
+	want := map[string]auth.ExtraValue{
+		"department":   {"r&d"},
+		"employeeType": {"contractor", "remote"},
+	}
+
+	if got := s.userInfo(entry, nil); !reflect.DeepEqual(got.Extra, want) {
+		t.Errorf("userInfo().Extra = %v, want %v", got.Extra, want)
+	}
+}
+
+func TestAnonymousSearch(t *testing.T) {
+	srv, err := ldaptest.NewServer(ldaptest.Entry{
+		DN:       "uid=john,ou=people,dc=corp",
+		Password: "secret",
+		Attributes: map[string][]string{
+			"uid":      {"john"},
+			"memberof": {"cn=admins,ou=groups,dc=corp"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to start the ldap server, %s", err)
+	}
+	defer srv.Close()
+
+	s, err := NewInstance(
+		[]string{srv.URL},
+		"", "", []string{"dc=corp"}, ScopeWholeSubtree, "(uid=%s)", "memberof", "uid", nil, []string{"uid", "memberof"},
+	)
+	if err != nil {
+		t.Fatalf("NewInstance() error = %s", err)
+	}
+
+	user, err := s.Search(context.Background(), "john", "secret")
+	if err != nil {
+		t.Fatalf("Search() error = %s", err)
+	}
+
+	if user.Username != "john" || !reflect.DeepEqual(user.Groups, []string{"cn=admins,ou=groups,dc=corp"}) {
+		t.Errorf("Search() = %+v, want john member of admins", user)
+	}
+
+	// the password is still verified by binding as the user
+	if _, err := s.Search(context.Background(), "john", "wrong"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("Search() with a wrong password error = %v, want %v", err, ErrInvalidCredentials)
+	}
+}
+
+func TestSearchAttributes(t *testing.T) {
+	srv, err := ldaptest.NewServer(ldaptest.Entry{
+		DN:       "uid=john,ou=people,dc=corp",
+		Password: "secret",
+		Attributes: map[string][]string{
+			"uid":         {"john"},
+			"entryuuid":   {"8f2c"},
+			"mail":        {"john@corp"},
+			"memberof":    {"cn=admins,ou=groups,dc=corp"},
+			"telephone":   {"555"},
+			"objectclass": {"inetOrgPerson"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to start the ldap server, %s", err)
+	}
+	defer srv.Close()
+
+	tests := []struct {
+		name       string
+		attributes []string
+	}{
+		{name: "missing the attributes read", attributes: []string{"objectclass"}},
+		{name: "all attributes", attributes: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewInstance(
+				[]string{srv.URL},
+				"", "", []string{"dc=corp"}, ScopeWholeSubtree, "(uid=%s)", "memberof", "uid", []string{"mail"}, tt.attributes,
+				WithUIDProperty("entryuuid"),
+			)
+			if err != nil {
+				t.Fatalf("NewInstance() error = %s", err)
+			}
+
+			user, err := s.Search(context.Background(), "john", "secret")
+			if err != nil {
+				t.Fatalf("Search() error = %s", err)
+			}
+
+			want := &auth.UserInfo{
+				UID:      "8f2c",
+				Username: "john",
+				Groups:   []string{"cn=admins,ou=groups,dc=corp"},
+				Extra:    map[string]auth.ExtraValue{"mail": {"john@corp"}},
+			}
+			if !reflect.DeepEqual(user, want) {
+				t.Errorf("Search() = %+v, want %+v", user, want)
+			}
+		})
+	}
+}
+
+func TestAttributeMap(t *testing.T) {
+	srv, err := ldaptest.NewServer(
+		ldaptest.Entry{DN: "uid=john,ou=people,dc=corp", Password: "secret", Attributes: map[string][]string{
+			"uid":        {"john"},
+			"entryUUID":  {"8f2c"},
+			"isMemberOf": {"cn=admins,ou=groups,dc=corp"},
+			"cn":         {"John Doe"},
+		}},
+		ldaptest.Entry{DN: "cn=John Doe,ou=users,dc=ad", Password: "secret", Attributes: map[string][]string{
+			"sAMAccountName": {"john"},
+			"objectGUID":     {"8f2c"},
+			"memberOf":       {"cn=admins,ou=groups,dc=corp"},
+			"displayName":    {"John Doe"},
+		}},
+	)
+	if err != nil {
+		t.Fatalf("Failed to start the ldap server, %s", err)
+	}
+	defer srv.Close()
+
+	tests := []struct {
+		name   string
+		base   string
+		filter string
+		m      AttributeMap
+	}{
+		{
+			name:   "OpenLDAP entry",
+			base:   "dc=corp",
+			filter: "(uid=%s)",
+			m: AttributeMap{
+				Username: "uid",
+				UID:      "entryUUID",
+				Groups:   []string{"isMemberOf"},
+				Extra:    map[string]string{"displayName": "cn"},
+			},
+		},
+		{
+			name:   "Active Directory entry",
+			base:   "dc=ad",
+			filter: "(sAMAccountName=%s)",
+			m: AttributeMap{
+				Username: "sAMAccountName",
+				UID:      "objectGUID",
+				Groups:   []string{"memberOf"},
+				Extra:    map[string]string{"displayName": "displayName"},
+			},
+		},
+	}
+
+	want := &auth.UserInfo{
+		UID:      "8f2c",
+		Username: "john",
+		Groups:   []string{"cn=admins,ou=groups,dc=corp"},
+		Extra:    map[string]auth.ExtraValue{"displayName": {"John Doe"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewInstance(
+				[]string{srv.URL},
+				"", "", []string{tt.base}, ScopeWholeSubtree, tt.filter, "memberof", "uid", nil, []string{"objectclass"},
+				WithAttributeMap(tt.m),
+			)
+			if err != nil {
+				t.Fatalf("NewInstance() error = %s", err)
+			}
+
+			user, err := s.Search(context.Background(), "john", "secret")
+			if err != nil {
+				t.Fatalf("Search() error = %s", err)
+			}
+
+			if !reflect.DeepEqual(user, want) {
+				t.Errorf("Search() = %+v, want %+v", user, want)
+			}
+		})
+	}
+
+	if _, err := NewInstance(
+		[]string{srv.URL},
+		"", "", []string{"dc=corp"}, ScopeWholeSubtree, "(uid=%s)", "memberof", "uid", nil, nil,
+		WithAttributeMap(AttributeMap{Groups: []string{"memberOf"}}),
+	); err == nil {
+		t.Errorf("NewInstance() with an attribute map without username error = nil, want an error")
+	}
+}
+
+func TestFallbackBindAccounts(t *testing.T) {
+	srv, err := ldaptest.NewServer(
+		ldaptest.Entry{DN: "cn=admin,dc=corp", Password: "password"},
+		ldaptest.Entry{DN: "cn=backup,dc=corp", Password: "backup"},
+		ldaptest.Entry{DN: "uid=john,ou=people,dc=corp", Password: "secret", Attributes: map[string][]string{"uid": {"john"}}},
+	)
+	if err != nil {
+		t.Fatalf("Failed to start the ldap server, %s", err)
+	}
+	defer srv.Close()
+
+	tests := []struct {
+		name     string
+		accounts []BindAccount
+		want     error
+	}{
+		{name: "first account rejected", accounts: []BindAccount{{DN: "cn=backup,dc=corp", Password: "backup"}}},
+		{name: "every account rejected", accounts: []BindAccount{{DN: "cn=backup,dc=corp", Password: "rotated"}}, want: ErrDirectoryUnavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewInstance(
+				[]string{srv.URL},
+				"cn=admin,dc=corp", "rotated", []string{"dc=corp"}, ScopeWholeSubtree, "(uid=%s)", "memberof", "uid", nil, []string{"uid"},
+				WithFallbackBindAccounts(tt.accounts...),
+			)
+			if err != nil {
+				t.Fatalf("NewInstance() error = %s", err)
+			}
+
+			user, err := s.Search(context.Background(), "john", "secret")
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("Search() error = %v, want %v", err, tt.want)
+			}
+
+			if tt.want == nil && user.Username != "john" {
+				t.Errorf("Search() = %+v, want john", user)
+			}
+		})
+	}
+
+	if _, err := NewInstance(
+		[]string{srv.URL},
+		"", "", []string{"dc=corp"}, ScopeWholeSubtree, "(uid=%s)", "memberof", "uid", nil, []string{"uid"},
+		WithFallbackBindAccounts(BindAccount{DN: "cn=backup,dc=corp", Password: "backup"}),
+	); err == nil {
+		t.Errorf("NewInstance() with fallback accounts but no bind dn error = nil, want an error")
+	}
+}
+
+func TestGroupSearch(t *testing.T) {
+	srv, err := ldaptest.NewServer(
+		ldaptest.Entry{DN: "cn=admin,dc=corp", Password: "password"},
+		ldaptest.Entry{DN: "uid=john,ou=people,dc=corp", Password: "secret", Attributes: map[string][]string{"uid": {"john"}}},
+		ldaptest.Entry{DN: "cn=admins,ou=groups,dc=corp", Attributes: map[string][]string{
+			"objectclass": {"groupOfNames"},
+			"member":      {"uid=jane,ou=people,dc=corp", "uid=john,ou=people,dc=corp"},
+		}},
+		ldaptest.Entry{DN: "cn=devs,ou=groups,dc=corp", Attributes: map[string][]string{
+			"objectclass": {"groupOfNames"},
+			"member":      {"uid=john,ou=people,dc=corp"},
+		}},
+		ldaptest.Entry{DN: "cn=ops,ou=groups,dc=corp", Attributes: map[string][]string{
+			"objectclass": {"groupOfNames"},
+			"member":      {"uid=jane,ou=people,dc=corp"},
+		}},
+		ldaptest.Entry{DN: "cn=staff,ou=groups,dc=corp", Attributes: map[string][]string{
+			"objectclass": {"groupOfNames"},
+			"member":      {"cn=devs,ou=groups,dc=corp"},
+		}},
+		// not a group, even though it references john
+		ldaptest.Entry{DN: "cn=printer,ou=devices,dc=corp", Attributes: map[string][]string{
+			"member": {"uid=john,ou=people,dc=corp"},
+		}},
+	)
+	if err != nil {
+		t.Fatalf("Failed to start the ldap server, %s", err)
+	}
+	defer srv.Close()
+
+	tests := []struct {
+		name string
+		opts []Option
+		want []string
+	}{
+		{
+			name: "direct groups",
+			opts: []Option{WithGroupSearch("(&(objectClass=groupOfNames)(member=%s))", []string{"ou=groups,dc=corp"})},
+			want: []string{"cn=admins,ou=groups,dc=corp", "cn=devs,ou=groups,dc=corp"},
+		},
+		{
+			name: "in the user search bases",
+			opts: []Option{WithGroupSearch("(member=%s)", nil)},
+			want: []string{"cn=admins,ou=groups,dc=corp", "cn=devs,ou=groups,dc=corp", "cn=printer,ou=devices,dc=corp"},
+		},
+		{
+			name: "nested groups",
+			opts: []Option{WithGroupSearch("(&(objectClass=groupOfNames)(member=%s))", []string{"ou=groups,dc=corp"}), WithNestedGroups(1)},
+			want: []string{"cn=admins,ou=groups,dc=corp", "cn=devs,ou=groups,dc=corp", "cn=staff,ou=groups,dc=corp"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewInstance(
+				[]string{srv.URL},
+				"cn=admin,dc=corp", "password", []string{"dc=corp"}, ScopeWholeSubtree, "(uid=%s)", "memberof", "uid", nil, []string{"uid"},
+				tt.opts...,
+			)
+			if err != nil {
+				t.Fatalf("NewInstance() error = %s", err)
+			}
+
+			user, err := s.Search(context.Background(), "john", "secret")
+			if err != nil {
+				t.Fatalf("Search() error = %s", err)
+			}
+
+			if !reflect.DeepEqual(user.Groups, tt.want) {
+				t.Errorf("Search() groups = %v, want %v", user.Groups, tt.want)
+			}
+		})
+	}
+
+	if _, err := NewInstance(
+		[]string{srv.URL},
+		"cn=admin,dc=corp", "password", []string{"dc=corp"}, ScopeWholeSubtree, "(uid=%s)", "memberof", "uid", nil, []string{"uid"},
+		WithGroupSearch("(member=*)", nil),
+	); err == nil {
+		t.Errorf("NewInstance() with a group search filter without %%s error = nil, want an error")
+	}
+}
+
+func TestNestedGroupsNotDN(t *testing.T) {
+	srv, err := ldaptest.NewServer(
+		ldaptest.Entry{DN: "cn=admin,dc=corp", Password: "password"},
+		ldaptest.Entry{
+			DN:       "uid=john,ou=people,dc=corp",
+			Password: "secret",
+			Attributes: map[string][]string{
+				"uid": {"john"},
+				// a group name rather than a dn, and the dn of a deleted group
+				"memberof": {"cn=devs,ou=groups,dc=corp", "admins", "cn=deleted,ou=groups,dc=corp"},
+			},
+		},
+		ldaptest.Entry{DN: "cn=devs,ou=groups,dc=corp", Attributes: map[string][]string{
+			"memberof": {"cn=staff,ou=groups,dc=corp", "staff members"},
+		}},
+	)
+	if err != nil {
+		t.Fatalf("Failed to start the ldap server, %s", err)
+	}
+	defer srv.Close()
+
+	s, err := NewInstance(
+		[]string{srv.URL},
+		"cn=admin,dc=corp", "password", []string{"dc=corp"}, ScopeWholeSubtree, "(uid=%s)", "memberof", "uid", nil, []string{"uid"},
+		WithNestedGroups(2),
+	)
+	if err != nil {
+		t.Fatalf("NewInstance() error = %s", err)
+	}
+
+	user, err := s.Search(context.Background(), "john", "secret")
+	if err != nil {
+		t.Fatalf("Search() error = %s", err)
+	}
+
+	want := []string{"admins", "cn=deleted,ou=groups,dc=corp", "cn=devs,ou=groups,dc=corp", "cn=staff,ou=groups,dc=corp", "staff members"}
+	if !reflect.DeepEqual(user.Groups, want) {
+		t.Errorf("Search() groups = %v, want %v", user.Groups, want)
+	}
+}
+
+func TestMemberofProperties(t *testing.T) {
+	srv, err := ldaptest.NewServer(
+		ldaptest.Entry{DN: "cn=admin,dc=corp", Password: "password"},
+		ldaptest.Entry{DN: "uid=john,ou=people,dc=corp", Password: "secret", Attributes: map[string][]string{
+			"uid":        {"john"},
+			"memberof":   {"cn=admins,ou=groups,dc=corp"},
+			"ismemberof": {"cn=devs,ou=groups,dc=corp", "cn=admins,ou=groups,dc=corp"},
+		}},
+	)
+	if err != nil {
+		t.Fatalf("Failed to start the ldap server, %s", err)
+	}
+	defer srv.Close()
+
+	tests := []struct {
+		name string
+		opts []Option
+		want []string
+	}{
+		{
+			name: "single attribute",
+			want: []string{"cn=admins,ou=groups,dc=corp"},
+		},
+		{
+			name: "both attributes",
+			opts: []Option{WithMemberofProperties("ismemberof")},
+			want: []string{"cn=admins,ou=groups,dc=corp", "cn=devs,ou=groups,dc=corp"},
+		},
+		{
+			name: "missing attribute",
+			opts: []Option{WithMemberofProperties("groupmembership")},
+			want: []string{"cn=admins,ou=groups,dc=corp"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewInstance(
+				[]string{srv.URL},
+				"cn=admin,dc=corp", "password", []string{"dc=corp"}, ScopeWholeSubtree, "(uid=%s)", "memberof", "uid", nil, []string{"uid"},
+				tt.opts...,
+			)
+			if err != nil {
+				t.Fatalf("NewInstance() error = %s", err)
+			}
+
+			user, err := s.Search(context.Background(), "john", "secret")
+			if err != nil {
+				t.Fatalf("Search() error = %s", err)
+			}
+
+			if !reflect.DeepEqual(user.Groups, tt.want) {
+				t.Errorf("Search() groups = %v, want %v", user.Groups, tt.want)
+			}
+		})
+	}
+}
+
+func TestTooManyEntries(t *testing.T) {
+	srv, err := ldaptest.NewServer(
+		ldaptest.Entry{DN: "uid=john,ou=people,dc=corp", Password: "secret", Attributes: map[string][]string{"uid": {"john"}}},
+		ldaptest.Entry{DN: "uid=john,ou=contractors,dc=corp", Password: "secret", Attributes: map[string][]string{"uid": {"john"}}},
+	)
+	if err != nil {
+		t.Fatalf("Failed to start the ldap server, %s", err)
+	}
+	defer srv.Close()
+
+	s, err := NewInstance(
+		[]string{srv.URL},
+		"", "", []string{"dc=corp"}, ScopeWholeSubtree, "(uid=%s)", "memberof", "uid", nil, []string{"uid"},
+	)
+	if err != nil {
+		t.Fatalf("NewInstance() error = %s", err)
+	}
+
+	_, err = s.Search(context.Background(), "john", "secret")
+	if !errors.Is(err, ErrTooManyEntries) {
+		t.Fatalf("Search() error = %v, want %v", err, ErrTooManyEntries)
+	}
+
+	var tooMany *TooManyEntriesError
+	if !errors.As(err, &tooMany) || tooMany.Username != "john" || tooMany.Count != 2 {
+		t.Errorf("Search() error = %#v, want john matching 2 entries", err)
+	}
+}
+
+func TestEmptyPassword(t *testing.T) {
+	srv, err := ldaptest.NewServer(ldaptest.Entry{
+		DN:         "uid=john,ou=people,dc=corp",
+		Password:   "secret",
+		Attributes: map[string][]string{"uid": {"john"}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to start the ldap server, %s", err)
+	}
+	defer srv.Close()
+
+	srv.AllowUnauthenticatedBind()
+
+	tests := []struct {
+		name           string
+		userDNTemplate string
+	}{
+		{name: "search bind"},
+		{name: "direct bind", userDNTemplate: "uid=%s,ou=people,dc=corp"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewInstance(
+				[]string{srv.URL},
+				"", "", []string{"dc=corp"}, ScopeWholeSubtree, "(uid=%s)", "memberof", "uid", nil, []string{"uid"},
+				WithUserDNTemplate(tt.userDNTemplate),
+			)
+			if err != nil {
+				t.Fatalf("NewInstance() error = %s", err)
+			}
+
+			if user, err := s.Search(context.Background(), "john", ""); !errors.Is(err, ErrInvalidCredentials) || user != nil {
+				t.Errorf("Search() = %v, %v, want %v", user, err, ErrInvalidCredentials)
+			}
+
+			for _, dn := range srv.Binds() {
+				if dn == "uid=john,ou=people,dc=corp" {
+					t.Errorf("The empty password bind reached the ldap server")
+				}
+			}
+		})
+	}
+}
+
+func TestSpecialPasswords(t *testing.T) {
+	// the passwords are bound with as is, none of them is trimmed, unescaped or normalized
+	passwords := []struct {
+		name     string
+		password string
+		// altered are the same password modified, ie. trimmed, that must be rejected
+		altered []string
+	}{
+		{name: "spaces", password: "  my secret  ", altered: []string{"my secret", "  my secret", "my  secret"}},
+		{name: "backslashes", password: `s\ecr\et\`, altered: []string{`s\ecr\et`, `secret`}},
+		{name: "unicode", password: "p\u00e2ss w\u00f6rd \U0001F511", altered: []string{"pa\u0302ss wo\u0308rd \U0001F511"}},
+		{name: "decomposed unicode", password: "e\u0301clair", altered: []string{"\u00e9clair"}},
+		{name: "filter characters", password: `*)(uid=*`, altered: []string{`\2a\29\28uid=\2a`}},
+		{name: "quotes and tabs", password: "\"secret\"\t'", altered: []string{"\"secret\"'"}},
+	}
+
+	entries := []ldaptest.Entry{{DN: "cn=admin,dc=corp", Password: "password"}}
+	for i, p := range passwords {
+		uid := fmt.Sprint("user", i)
+		entries = append(entries, ldaptest.Entry{
+			DN:         "uid=" + uid + ",ou=people,dc=corp",
+			Password:   p.password,
+			Attributes: map[string][]string{"uid": {uid}},
+		})
+	}
+
+	srv, err := ldaptest.NewServer(entries...)
+	if err != nil {
+		t.Fatalf("Failed to start the ldap server, %s", err)
+	}
+	defer srv.Close()
+
+	binds := []struct {
+		name           string
+		userDNTemplate string
+	}{
+		{name: "search bind"},
+		{name: "direct bind", userDNTemplate: "uid=%s,ou=people,dc=corp"},
+	}
+
+	for _, b := range binds {
+		s, err := NewInstance(
+			[]string{srv.URL},
+			"cn=admin,dc=corp", "password", []string{"dc=corp"}, ScopeWholeSubtree, "(uid=%s)", "memberof", "uid", nil, []string{"uid"},
+			WithUserDNTemplate(b.userDNTemplate),
+		)
+		if err != nil {
+			t.Fatalf("NewInstance() error = %s", err)
+		}
+
+		for i, p := range passwords {
+			t.Run(b.name+" "+p.name, func(t *testing.T) {
+				uid := fmt.Sprint("user", i)
+
+				if _, err := s.Search(context.Background(), uid, p.password); err != nil {
+					t.Errorf("Search() with %q error = %s", p.password, err)
+				}
+
+				for _, altered := range p.altered {
+					if _, err := s.Search(context.Background(), uid, altered); !errors.Is(err, ErrInvalidCredentials) {
+						t.Errorf("Search() with %q error = %v, want %s", altered, err, ErrInvalidCredentials)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	srv, err := ldaptest.NewServer(
+		ldaptest.Entry{DN: "cn=admin,dc=corp", Password: "password"},
+		ldaptest.Entry{
+			DN:         "uid=john,ou=people,dc=corp",
+			Password:   "secret",
+			Attributes: map[string][]string{"uid": {"john"}},
+		},
+	)
+	if err != nil {
+		t.Fatalf("Failed to start the ldap server, %s", err)
+	}
+	defer srv.Close()
+
+	tests := []struct {
+		name     string
+		attempts int
+		backoff  time.Duration
+		timeout  time.Duration
+		failures int
+		password string
+		want     error
+		// userBinds is the number of binds as john expected to reach the server
+		userBinds int
+	}{
+		{name: "transient failures then success", attempts: 3, backoff: 10 * time.Millisecond, failures: 2, password: "secret", userBinds: 1},
+		{name: "more failures than attempts", attempts: 2, backoff: 10 * time.Millisecond, failures: 3, password: "secret", want: ErrDirectoryUnavailable},
+		{name: "no retry by default", attempts: 1, failures: 1, password: "secret", want: ErrDirectoryUnavailable},
+		{name: "invalid credentials are not retried", attempts: 3, backoff: 10 * time.Millisecond, password: "wrong", want: ErrInvalidCredentials, userBinds: 1},
+		{name: "backoff past the deadline", attempts: 3, backoff: time.Minute, timeout: time.Second, failures: 1, password: "secret", want: ErrDirectoryUnavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewInstance(
+				[]string{srv.URL},
+				"cn=admin,dc=corp", "password", []string{"dc=corp"}, ScopeWholeSubtree, "(uid=%s)", "memberof", "uid", nil, []string{"uid"},
+				WithRetry(tt.attempts, tt.backoff, 0),
+			)
+			if err != nil {
+				t.Fatalf("NewInstance() error = %s", err)
+			}
+
+			ctx := context.Background()
+			if tt.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.timeout)
+				defer cancel()
+			}
+
+			before := 0
+			for _, dn := range srv.Binds() {
+				if dn == "uid=john,ou=people,dc=corp" {
+					before++
+				}
+			}
+
+			srv.FailConnections(tt.failures)
+			defer srv.FailConnections(0)
+
+			start := time.Now()
+			_, err = s.Search(ctx, "john", tt.password)
+			if tt.want == nil && err != nil {
+				t.Errorf("Search() error = %s, want none", err)
+			} else if !errors.Is(err, tt.want) {
+				t.Errorf("Search() error = %v, want %v", err, tt.want)
+			}
+
+			if tt.timeout > 0 && time.Since(start) > tt.timeout {
+				t.Errorf("Search() took %s, want at most the %s deadline", time.Since(start), tt.timeout)
+			}
+
+			binds := -before
+			for _, dn := range srv.Binds() {
+				if dn == "uid=john,ou=people,dc=corp" {
+					binds++
+				}
+			}
+
+			if binds != tt.userBinds {
+				t.Errorf("john binds = %d, want %d", binds, tt.userBinds)
+			}
+		})
+	}
+}
+
+func TestReferrals(t *testing.T) {
+	child, err := ldaptest.NewServer(
+		ldaptest.Entry{DN: "cn=admin,dc=corp", Password: "password"},
+		ldaptest.Entry{
+			DN:       "uid=john,ou=people,dc=child,dc=corp",
+			Password: "secret",
+			Attributes: map[string][]string{
+				"uid":      {"john"},
+				"memberof": {"cn=admins,ou=groups,dc=child,dc=corp"},
+			},
+		},
+	)
+	if err != nil {
+		t.Fatalf("Failed to start the ldap server, %s", err)
+	}
+	defer child.Close()
+
+	root, err := ldaptest.NewServer(ldaptest.Entry{DN: "cn=admin,dc=corp", Password: "password"})
+	if err != nil {
+		t.Fatalf("Failed to start the ldap server, %s", err)
+	}
+	defer root.Close()
+
+	root.Refer(child.URL + "/dc=child,dc=corp")
+
+	tests := []struct {
+		name string
+		opts []Option
+		want error
+	}{
+		{name: "not followed by default", want: ErrUserNotFound},
+		{name: "followed to any host", opts: []Option{WithReferrals(nil)}},
+		{name: "followed to an allowed host", opts: []Option{WithReferrals([]string{"ldap.corp", "127.0.0.1"})}},
+		{name: "not followed to other hosts", opts: []Option{WithReferrals([]string{"ldap.corp"})}, want: ErrUserNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewInstance(
+				[]string{root.URL},
+				"cn=admin,dc=corp", "password", []string{"dc=corp"}, ScopeWholeSubtree, "(uid=%s)", "memberof", "uid", nil, []string{"uid", "memberof"},
+				tt.opts...,
+			)
+			if err != nil {
+				t.Fatalf("NewInstance() error = %s", err)
+			}
+
+			user, err := s.Search(context.Background(), "john", "secret")
+			if tt.want != nil {
+				if !errors.Is(err, tt.want) {
+					t.Errorf("Search() error = %v, want %v", err, tt.want)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Search() error = %s", err)
+			}
+
+			if user.Username != "john" || !reflect.DeepEqual(user.Groups, []string{"cn=admins,ou=groups,dc=child,dc=corp"}) {
+				t.Errorf("Search() = %+v, want john member of admins", user)
+			}
+
+			// the password is verified on the referred server
+			if _, err := s.Search(context.Background(), "john", "wrong"); !errors.Is(err, ErrInvalidCredentials) {
+				t.Errorf("Search() with a wrong password error = %v, want %v", err, ErrInvalidCredentials)
+			}
+		})
+	}
+}
+
+func TestExternalBind(t *testing.T) {
+	srv, err := ldaptest.NewTLSServer(ldaptest.Entry{
+		DN:       "uid=john,ou=people,dc=corp",
+		Password: "secret",
+		Attributes: map[string][]string{
+			"uid":      {"john"},
+			"memberof": {"cn=admins,ou=groups,dc=corp"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to start the ldap server, %s", err)
+	}
+	defer srv.Close()
+
+	certPEM, keyPEM, err := srv.ClientCertificate("k8s-ldap-auth")
+	if err != nil {
+		t.Fatalf("Failed to issue the client certificate, %s", err)
+	}
+
+	dir := t.TempDir()
+	cert, key := path.Join(dir, "cert.pem"), path.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(cert, certPEM, 0600); err != nil {
+		t.Fatalf("Failed to write the client certificate, %s", err)
+	}
+	if err := ioutil.WriteFile(key, keyPEM, 0600); err != nil {
+		t.Fatalf("Failed to write the client key, %s", err)
+	}
+
+	tests := []struct {
+		name     string
+		url      string
+		bindDN   string
+		opts     []Option
+		wantErr  string
+		wantBind string
+	}{
+		{
+			name:     "Client certificate",
+			url:      srv.URL,
+			opts:     []Option{WithClientCertFile(cert, key)},
+			wantBind: "cn=k8s-ldap-auth",
+		},
+		{
+			name:    "No client certificate",
+			url:     srv.URL,
+			wantErr: "client certificate",
+		},
+		{
+			name:    "Bind dn",
+			url:     srv.URL,
+			bindDN:  "cn=admin,dc=corp",
+			opts:    []Option{WithClientCertFile(cert, key)},
+			wantErr: "bind dn",
+		},
+		{
+			name:    "Plain ldap url",
+			url:     strings.Replace(srv.URL, "ldaps://", "ldap://", 1),
+			opts:    []Option{WithClientCertFile(cert, key)},
+			wantErr: "requires tls",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := append([]Option{WithTLSConfig(&tls.Config{RootCAs: srv.CA}), WithExternalBind()}, tt.opts...)
+
+			s, err := NewInstance(
+				[]string{tt.url},
+				tt.bindDN, "", []string{"dc=corp"}, ScopeWholeSubtree, "(uid=%s)", "memberof", "uid", nil, []string{"uid", "memberof"},
+				opts...,
+			)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("NewInstance() error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("NewInstance() error = %s", err)
+			}
+
+			user, err := s.Search(context.Background(), "john", "secret")
+			if err != nil {
+				t.Fatalf("Search() error = %s", err)
+			}
+
+			if user.Username != "john" || !reflect.DeepEqual(user.Groups, []string{"cn=admins,ou=groups,dc=corp"}) {
+				t.Errorf("Search() = %+v, want john member of admins", user)
+			}
+
+			if binds := srv.Binds(); len(binds) == 0 || binds[0] != tt.wantBind {
+				t.Errorf("Binds() = %v, want the service account bound as %q first", binds, tt.wantBind)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	srv, err := ldaptest.NewServer(
+		ldaptest.Entry{DN: "dc=corp"},
+		ldaptest.Entry{DN: "ou=people,dc=corp"},
+		ldaptest.Entry{DN: "cn=admin,dc=corp", Password: "password"},
+	)
+	if err != nil {
+		t.Fatalf("Failed to start the ldap server, %s", err)
+	}
+	defer srv.Close()
+
+	// a closed server, nothing listens on its port anymore
+	down, err := ldaptest.NewServer()
+	if err != nil {
+		t.Fatalf("Failed to start the ldap server, %s", err)
+	}
+	down.Close()
+
+	tests := []struct {
+		name     string
+		url      string
+		bindDN   string
+		password string
+		bases    []string
+		opts     []Option
+		want     error
+		wantErr  string
+	}{
+		{name: "Valid configuration", url: srv.URL, bindDN: "cn=admin,dc=corp", password: "password", bases: []string{"dc=corp", "ou=people,dc=corp"}},
+		{name: "Root search base", url: srv.URL, bindDN: "cn=admin,dc=corp", password: "password"},
+		{name: "Anonymous search", url: srv.URL, bases: []string{"dc=corp"}},
+		{name: "Direct bind", url: srv.URL, bases: []string{"ou=missing,dc=corp"}, opts: []Option{WithUserDNTemplate("uid=%s,ou=people,dc=corp")}},
+		{name: "Wrong password", url: srv.URL, bindDN: "cn=admin,dc=corp", password: "wrong", bases: []string{"dc=corp"}, want: ErrDirectoryUnavailable},
+		{name: "Unknown bind dn", url: srv.URL, bindDN: "cn=nobody,dc=corp", password: "password", bases: []string{"dc=corp"}, want: ErrDirectoryUnavailable},
+		{name: "Missing search base", url: srv.URL, bindDN: "cn=admin,dc=corp", password: "password", bases: []string{"dc=corp", "ou=missing,dc=corp"}, wantErr: "ou=missing,dc=corp"},
+		{name: "Unreachable server", url: down.URL, bindDN: "cn=admin,dc=corp", password: "password", want: ErrDirectoryUnavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewInstance(
+				[]string{tt.url},
+				tt.bindDN, tt.password, tt.bases, ScopeWholeSubtree, "(uid=%s)", "memberof", "uid", nil, []string{"uid"},
+				append([]Option{WithDialTimeout(time.Second)}, tt.opts...)...,
+			)
+			if err != nil {
+				t.Fatalf("NewInstance() error = %s", err)
+			}
+
+			err = s.Validate(context.Background())
+			switch {
+			case tt.want == nil && tt.wantErr == "" && err != nil:
+				t.Errorf("Validate() error = %s, want none", err)
+			case tt.want != nil && !errors.Is(err, tt.want):
+				t.Errorf("Validate() error = %v, want %v", err, tt.want)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("Validate() error = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestConcurrentSearch(t *testing.T) {
+	entries := []ldaptest.Entry{{DN: "cn=admin,dc=corp", Password: "password"}}
+	for i := 0; i < 20; i++ {
+		entries = append(entries, ldaptest.Entry{
+			DN:       fmt.Sprintf("uid=user%d,ou=people,dc=corp", i),
+			Password: fmt.Sprintf("secret%d", i),
+			Attributes: map[string][]string{
+				"uid":      {fmt.Sprintf("user%d", i)},
+				"memberof": {"cn=staff,ou=groups,dc=corp", fmt.Sprintf("cn=team%d,ou=groups,dc=corp", i%3)},
+			},
+		})
+	}
+
+	srv, err := ldaptest.NewServer(entries...)
+	if err != nil {
+		t.Fatalf("Failed to start the ldap server, %s", err)
+	}
+	defer srv.Close()
+
+	bases := []string{"dc=corp"}
+	attributes := []string{"uid", "memberof"}
+
+	// a small pool and cache so that the searches wait for connections and evict each other
+	s, err := NewInstance(
+		[]string{srv.URL},
+		"cn=admin,dc=corp", "password", bases, ScopeWholeSubtree, "(uid=%s)", "memberof", "uid", nil, attributes,
+		WithPool(4, time.Minute),
+		WithCache(time.Minute, 8),
+	)
+	if err != nil {
+		t.Fatalf("NewInstance() error = %s", err)
+	}
+
+	// the instance must not share the slices of the caller
+	bases[0], attributes[0] = "dc=other", "cn"
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 300)
+
+	for i := 0; i < 300; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			n := i % 20
+			username, password := fmt.Sprintf("user%d", n), fmt.Sprintf("secret%d", n)
+			if i%7 == 0 {
+				password = "wrong"
+			}
+
+			user, err := s.Search(context.Background(), username, password)
+			if i%7 == 0 {
+				if !errors.Is(err, ErrInvalidCredentials) {
+					errs <- fmt.Errorf("Search(%s) with a wrong password error = %v, want %v", username, err, ErrInvalidCredentials)
+				}
+				return
+			}
+
+			if err != nil {
+				errs <- fmt.Errorf("Search(%s) error = %s", username, err)
+				return
+			}
+
+			want := []string{"cn=staff,ou=groups,dc=corp", fmt.Sprintf("cn=team%d,ou=groups,dc=corp", n%3)}
+			sort.Strings(want)
+			if user.Username != username || !reflect.DeepEqual(user.Groups, want) {
+				errs <- fmt.Errorf("Search(%s) = %+v, want %s member of %v", username, user, username, want)
+				return
+			}
+
+			// callers own the returned user, modifying it must not affect the other searches
+			user.Groups[0] = "modified"
+		}(i)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestSearchCanceled(t *testing.T) {
+	srv, err := ldaptest.NewServer(
+		ldaptest.Entry{DN: "cn=admin,dc=corp", Password: "password"},
+		ldaptest.Entry{DN: "uid=john,ou=people,dc=corp", Password: "secret", Attributes: map[string][]string{"uid": {"john"}}},
+	)
+	if err != nil {
+		t.Fatalf("Failed to start the ldap server, %s", err)
+	}
+	defer srv.Close()
+
+	srv.StallSearches()
+
+	tests := []struct {
+		name string
+		ctx  func() (context.Context, context.CancelFunc)
+		want error
+	}{
+		{
+			name: "canceled",
+			ctx: func() (context.Context, context.CancelFunc) {
+				ctx, cancel := context.WithCancel(context.Background())
+				time.AfterFunc(100*time.Millisecond, cancel)
+				return ctx, cancel
+			},
+			want: context.Canceled,
+		},
+		{
+			name: "deadline exceeded",
+			ctx: func() (context.Context, context.CancelFunc) {
+				return context.WithTimeout(context.Background(), 100*time.Millisecond)
+			},
+			want: ErrTimeout,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// only the context can stop the search, the server never answers it
+			s, err := NewInstance(
+				[]string{srv.URL},
+				"cn=admin,dc=corp", "password", []string{"dc=corp"}, ScopeWholeSubtree, "(uid=%s)", "memberof", "uid", nil, []string{"uid"},
+				WithOperationTimeout(time.Minute),
+			)
+			if err != nil {
+				t.Fatalf("NewInstance() error = %s", err)
+			}
+
+			ctx, cancel := tt.ctx()
+			defer cancel()
+
+			start := time.Now()
+			if _, err := s.Search(ctx, "john", "secret"); !errors.Is(err, tt.want) {
+				t.Errorf("Search() error = %v, want %v", err, tt.want)
+			}
+
+			if elapsed := time.Since(start); elapsed > 2*time.Second {
+				t.Errorf("Search() returned after %s, want it aborted once the context is done", elapsed)
+			}
+		})
+	}
+}
+
+func TestPoolWait(t *testing.T) {
+	srv, err := ldaptest.NewServer(
+		ldaptest.Entry{DN: "cn=admin,dc=corp", Password: "password"},
+		ldaptest.Entry{DN: "uid=john,ou=people,dc=corp", Password: "secret", Attributes: map[string][]string{"uid": {"john"}}},
+	)
+	if err != nil {
+		t.Fatalf("Failed to start the ldap server, %s", err)
+	}
+	defer srv.Close()
+
+	s, err := NewInstance(
+		[]string{srv.URL},
+		"cn=admin,dc=corp", "password", []string{"dc=corp"}, ScopeWholeSubtree, "(uid=%s)", "memberof", "uid", nil, []string{"uid"},
+		WithPool(1, time.Minute),
+	)
+	if err != nil {
+		t.Fatalf("NewInstance() error = %s", err)
+	}
+
+	// hold the only connection of the pool
+	held := make(chan struct{})
+	release := make(chan struct{})
+	go s.withConn(context.Background(), func(*ldap.Conn) error {
+		close(held)
+		<-release
+		return nil
+	})
+	<-held
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if _, err := s.Search(ctx, "john", "secret"); !errors.Is(err, ErrTimeout) {
+		t.Errorf("Search() while the pool is exhausted error = %v, want %v", err, ErrTimeout)
+	}
+
+	if err := s.CheckPool(ctx); err == nil {
+		t.Errorf("CheckPool() while the pool is exhausted error = nil, want an error")
+	}
+
+	close(release)
+
+	if err := s.CheckPool(context.Background()); err != nil {
+		t.Errorf("CheckPool() once the connection was released error = %s", err)
+	}
+
+	if _, err := s.Search(context.Background(), "john", "secret"); err != nil {
+		t.Errorf("Search() once the connection was released error = %s", err)
+	}
+}
+
+func TestPoolDeadConnection(t *testing.T) {
+	srv, err := ldaptest.NewServer(
+		ldaptest.Entry{DN: "cn=admin,dc=corp", Password: "password"},
+		ldaptest.Entry{DN: "uid=john,ou=people,dc=corp", Password: "secret", Attributes: map[string][]string{"uid": {"john"}}},
+	)
+	if err != nil {
+		t.Fatalf("Failed to start the ldap server, %s", err)
+	}
+	defer srv.Close()
+
+	s, err := NewInstance(
+		[]string{srv.URL},
+		"cn=admin,dc=corp", "password", []string{"dc=corp"}, ScopeWholeSubtree, "(uid=%s)", "memberof", "uid", nil, []string{"uid"},
+		WithPool(1, time.Minute),
+	)
+	if err != nil {
+		t.Fatalf("NewInstance() error = %s", err)
+	}
+
+	if _, err := s.Search(context.Background(), "john", "secret"); err != nil {
+		t.Fatalf("Search() error = %s", err)
+	}
+
+	// the pooled connection is still open on the client side, but dead
+	srv.DropConnections()
+
+	if _, err := s.Search(context.Background(), "john", "secret"); err != nil {
+		t.Errorf("Search() once the pooled connection was dropped error = %s", err)
+	}
+
+	want := []string{"cn=admin,dc=corp", "uid=john,ou=people,dc=corp", "cn=admin,dc=corp", "uid=john,ou=people,dc=corp"}
+	if binds := srv.Binds(); !reflect.DeepEqual(binds, want) {
+		t.Errorf("Binds() = %v, want %v", binds, want)
+	}
+}
+
+func TestMaxConcurrentSearches(t *testing.T) {
+	srv, err := ldaptest.NewServer(
+		ldaptest.Entry{DN: "cn=admin,dc=corp", Password: "password"},
+		ldaptest.Entry{DN: "uid=john,ou=people,dc=corp", Password: "secret", Attributes: map[string][]string{"uid": {"john"}}},
+	)
+	if err != nil {
+		t.Fatalf("Failed to start the ldap server, %s", err)
+	}
+	defer srv.Close()
+
+	srv.StallSearches()
+
+	tests := []struct {
+		name string
+		wait time.Duration
+	}{
+		{name: "rejected right away"},
+		{name: "rejected after waiting", wait: 100 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewInstance(
+				[]string{srv.URL},
+				"cn=admin,dc=corp", "password", []string{"dc=corp"}, ScopeWholeSubtree, "(uid=%s)", "memberof", "uid", nil, []string{"uid"},
+				WithOperationTimeout(time.Minute),
+				WithMaxConcurrentSearches(1, tt.wait),
+			)
+			if err != nil {
+				t.Fatalf("NewInstance() error = %s", err)
+			}
+
+			// the only search allowed never ends, the server never answers it
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				s.Search(ctx, "john", "secret")
+			}()
+			defer func() { cancel(); <-done }()
+
+			for len(s.limiter.tokens) == 0 {
+				time.Sleep(time.Millisecond)
+			}
+
+			start := time.Now()
+			if _, err := s.Search(context.Background(), "john", "secret"); !errors.Is(err, ErrTooManySearches) {
+				t.Errorf("Search() beyond the limit error = %v, want %v", err, ErrTooManySearches)
+			}
+
+			if elapsed := time.Since(start); elapsed < tt.wait || elapsed > tt.wait+time.Second {
+				t.Errorf("Search() beyond the limit returned after %s, want after %s", elapsed, tt.wait)
+			}
+		})
+	}
+
+	l := newLimiter(1, time.Second)
+	if err := l.acquire(context.Background()); err != nil {
+		t.Fatalf("acquire() error = %s", err)
+	}
+	time.AfterFunc(50*time.Millisecond, l.release)
+
+	if err := l.acquire(context.Background()); err != nil {
+		t.Errorf("acquire() once a search ended error = %s", err)
+	}
+
+	if _, err := NewInstance(
+		[]string{srv.URL},
+		"cn=admin,dc=corp", "password", []string{"dc=corp"}, ScopeWholeSubtree, "(uid=%s)", "memberof", "uid", nil, []string{"uid"},
+		WithMaxConcurrentSearches(-1, 0),
+	); err == nil {
+		t.Errorf("NewInstance() with a negative limit error = nil, want an error")
+	}
+}
+
+func TestBindPasswordFile(t *testing.T) {
+	srv, err := ldaptest.NewServer(
+		ldaptest.Entry{DN: "cn=admin,dc=corp", Password: "password"},
+		ldaptest.Entry{DN: "uid=john,ou=people,dc=corp", Password: "secret", Attributes: map[string][]string{"uid": {"john"}}},
+	)
+	if err != nil {
+		t.Fatalf("Failed to start the ldap server, %s", err)
+	}
+	defer srv.Close()
+
+	dir := t.TempDir()
+
+	tests := []struct {
+		name    string
+		content string
+		wantErr bool
+	}{
+		{name: "password", content: "password"},
+		{name: "password with a trailing newline", content: "password\n"},
+		{name: "empty file", content: "\n", wantErr: true},
+		{name: "missing file", wantErr: true},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := path.Join(dir, fmt.Sprint(i))
+			if tt.content != "" {
+				if err := ioutil.WriteFile(file, []byte(tt.content), 0600); err != nil {
+					t.Fatalf("Failed to write the password file, %s", err)
+				}
+			}
+
+			// the password given to NewInstance is replaced by the file one
+			s, err := NewInstance(
+				[]string{srv.URL},
+				"cn=admin,dc=corp", "wrong", []string{"dc=corp"}, ScopeWholeSubtree, "(uid=%s)", "memberof", "uid", nil, []string{"uid"},
+				WithBindPasswordFile(file),
+			)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("NewInstance() error = nil, want an error")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("NewInstance() error = %s", err)
+			}
+
+			if _, err := s.Search(context.Background(), "john", "secret"); err != nil {
+				t.Errorf("Search() error = %s", err)
+			}
+		})
+	}
+}
+
+func TestBindPasswordReload(t *testing.T) {
+	srv, err := ldaptest.NewServer(
+		ldaptest.Entry{DN: "cn=admin,dc=corp", Password: "rotated"},
+		ldaptest.Entry{DN: "uid=john,ou=people,dc=corp", Password: "secret", Attributes: map[string][]string{"uid": {"john"}}},
+	)
+	if err != nil {
+		t.Fatalf("Failed to start the ldap server, %s", err)
+	}
+	defer srv.Close()
+
+	file := path.Join(t.TempDir(), "password")
+	if err := ioutil.WriteFile(file, []byte("password\n"), 0600); err != nil {
+		t.Fatalf("Failed to write the password file, %s", err)
+	}
+
+	interval := 10 * time.Millisecond
+
+	s, err := NewInstance(
+		[]string{srv.URL},
+		"cn=admin,dc=corp", "", []string{"dc=corp"}, ScopeWholeSubtree, "(uid=%s)", "memberof", "uid", nil, []string{"uid"},
+		WithBindPasswordFile(file),
+		WithBindPasswordReload(interval),
+	)
+	if err != nil {
+		t.Fatalf("NewInstance() error = %s", err)
+	}
+
+	if _, err := s.Search(context.Background(), "john", "secret"); !errors.Is(err, ErrDirectoryUnavailable) {
+		t.Fatalf("Search() with the old password error = %v, want %s", err, ErrDirectoryUnavailable)
+	}
+
+	if err := ioutil.WriteFile(file, []byte("rotated\n"), 0600); err != nil {
+		t.Fatalf("Failed to write the password file, %s", err)
+	}
+
+	// a file modified less than an interval ago may still be written to, it is not read yet
+	now := time.Now()
+	if err := os.Chtimes(file, now, now.Add(time.Hour)); err != nil {
+		t.Fatalf("Failed to touch the password file, %s", err)
+	}
+
+	time.Sleep(2 * interval)
+
+	if got := s.bindPassword.get(); got != "password" {
+		t.Errorf("password of a file being written = %q, want %q", got, "password")
+	}
+
+	if err := os.Chtimes(file, now, now.Add(-time.Minute)); err != nil {
+		t.Fatalf("Failed to touch the password file, %s", err)
+	}
+
+	time.Sleep(2 * interval)
+
+	if _, err := s.Search(context.Background(), "john", "secret"); err != nil {
+		t.Errorf("Search() with the rotated password error = %s", err)
+	}
+
+	// a file that can no longer be read keeps the current password
+	if err := os.Remove(file); err != nil {
+		t.Fatalf("Failed to remove the password file, %s", err)
+	}
+
+	time.Sleep(2 * interval)
+
+	if got := s.bindPassword.get(); got != "rotated" {
+		t.Errorf("password of a removed file = %q, want %q", got, "rotated")
+	}
+}
+
+func TestBindPasswordReloadWithoutFile(t *testing.T) {
+	_, err := NewInstance(
+		[]string{"ldap://localhost"},
+		"cn=admin,dc=corp", "password", []string{"dc=corp"}, ScopeWholeSubtree, "(uid=%s)", "memberof", "uid", nil, []string{"uid"},
+		WithBindPasswordReload(time.Minute),
+	)
+	if err == nil {
+		t.Errorf("NewInstance() error = nil, want an error")
+	}
+}
+
+func TestLookupGroups(t *testing.T) {
+	srv, err := ldaptest.NewServer(
+		ldaptest.Entry{DN: "cn=admin,dc=corp", Password: "password"},
+		ldaptest.Entry{
+			DN:       "uid=john,ou=people,dc=corp",
+			Password: "secret",
+			Attributes: map[string][]string{
+				"uid":      {"john"},
+				"memberof": {"cn=devs,ou=groups,dc=corp", "cn=admins,ou=groups,dc=corp"},
+			},
+		},
+	)
+	if err != nil {
+		t.Fatalf("Failed to start the ldap server, %s", err)
+	}
+	defer srv.Close()
+
+	s, err := NewInstance(
+		[]string{srv.URL},
+		"cn=admin,dc=corp", "password", []string{"dc=corp"}, ScopeWholeSubtree, "(uid=%s)", "memberof", "uid", nil, []string{"uid"},
+		WithGroupFormat(GroupFormatCN),
+	)
+	if err != nil {
+		t.Fatalf("NewInstance() error = %s", err)
+	}
+
+	groups, err := s.LookupGroups(context.Background(), "john")
+	if err != nil {
+		t.Fatalf("LookupGroups() error = %s", err)
+	}
+
+	if want := []string{"admins", "devs"}; !reflect.DeepEqual(groups, want) {
+		t.Errorf("LookupGroups() = %v, want %v", groups, want)
+	}
+
+	// the password is never checked, the user is not bound as
+	for _, dn := range srv.Binds() {
+		if dn != "cn=admin,dc=corp" {
+			t.Errorf("LookupGroups() bound as %s, want the service account only", dn)
+		}
+	}
+
+	// the same groups as a token would hold
+	user, err := s.Search(context.Background(), "john", "secret")
+	if err != nil {
+		t.Fatalf("Search() error = %s", err)
+	}
+
+	if !reflect.DeepEqual(user.Groups, groups) {
+		t.Errorf("Search() groups = %v, want the looked up %v", user.Groups, groups)
+	}
+
+	for _, username := range []string{"jane", ""} {
+		if _, err := s.LookupGroups(context.Background(), username); !errors.Is(err, ErrUserNotFound) {
+			t.Errorf("LookupGroups(%q) error = %v, want %s", username, err, ErrUserNotFound)
+		}
+	}
+
+	direct, err := NewInstance(
+		[]string{srv.URL},
+		"", "", []string{"dc=corp"}, ScopeWholeSubtree, "(uid=%s)", "memberof", "uid", nil, []string{"uid"},
+		WithUserDNTemplate("uid=%s,ou=people,dc=corp"),
+	)
+	if err != nil {
+		t.Fatalf("NewInstance() error = %s", err)
+	}
+
+	if _, err := direct.LookupGroups(context.Background(), "john"); !errors.Is(err, ErrLookupUnsupported) {
+		t.Errorf("LookupGroups() with a user dn template error = %v, want %s", err, ErrLookupUnsupported)
+	}
+}
+
+func TestSearchScope(t *testing.T) {
+	srv, err := ldaptest.NewServer(
+		ldaptest.Entry{DN: "cn=admin,dc=corp", Password: "password"},
+		ldaptest.Entry{DN: "uid=john,ou=people,dc=corp", Password: "secret", Attributes: map[string][]string{"uid": {"john"}}},
+	)
+	if err != nil {
+		t.Fatalf("Failed to start the ldap server, %s", err)
+	}
+	defer srv.Close()
+
+	tests := []struct {
+		scope   string
+		base    string
+		wantErr error
+		invalid bool
+	}{
+		{scope: ScopeWholeSubtree, base: "dc=corp"},
+		{scope: "subtree", base: "dc=corp"},
+		{scope: "SubTree", base: "dc=corp"},
+		{scope: ScopeSingleLevel, base: "ou=people,dc=corp"},
+		{scope: "one", base: "ou=people,dc=corp"},
+		{scope: "onelevel", base: "ou=people,dc=corp"},
+		// john is not a direct child of the base
+		{scope: ScopeSingleLevel, base: "dc=corp", wantErr: ErrUserNotFound},
+		{scope: ScopeBaseObject, base: "uid=john,ou=people,dc=corp"},
+		{scope: "wholesubtree", invalid: true},
+		{scope: "", invalid: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.scope, " in ", tt.base), func(t *testing.T) {
+			s, err := NewInstance(
+				[]string{srv.URL},
+				"cn=admin,dc=corp", "password", []string{tt.base}, tt.scope, "(uid=%s)", "memberof", "uid", nil, []string{"uid"},
+			)
+			if tt.invalid {
+				if err == nil || !strings.Contains(err.Error(), "base, one, onelevel, single, sub, subtree") {
+					t.Errorf("NewInstance() error = %v, want the accepted scopes listed", err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("NewInstance() error = %s", err)
+			}
+
+			if _, err := s.Search(context.Background(), "john", "secret"); !errors.Is(err, tt.wantErr) {
+				t.Errorf("Search() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
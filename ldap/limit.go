@@ -0,0 +1,63 @@
+package ldap
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// limiter bound the number of searches running at once, so that a burst of authentications
+// does not open more connections to the directory than it allows. A nil limiter does not
+// limit anything.
+type limiter struct {
+	tokens chan struct{}
+	// wait is how long a search waits for another one to end once the limit is reached, it
+	// is rejected right away when zero
+	wait time.Duration
+}
+
+func newLimiter(max int, wait time.Duration) *limiter {
+	return &limiter{
+		tokens: make(chan struct{}, max),
+		wait:   wait,
+	}
+}
+
+// acquire take a slot for a search, waiting at most l.wait for one to be released. The error
+// wraps ErrTooManySearches when none was, or is the ctx error when it is done first.
+func (l *limiter) acquire(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+
+	select {
+	case l.tokens <- struct{}{}:
+		return nil
+	default:
+	}
+
+	if l.wait <= 0 {
+		return fmt.Errorf("%w, %d searches already running", ErrTooManySearches, cap(l.tokens))
+	}
+
+	timer := time.NewTimer(l.wait)
+	defer timer.Stop()
+
+	select {
+	case l.tokens <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return fmt.Errorf("%w, %d searches still running after %s", ErrTooManySearches, cap(l.tokens), l.wait)
+	}
+}
+
+// release give back the slot taken by acquire
+func (l *limiter) release() {
+	if l == nil {
+		return
+	}
+
+	<-l.tokens
+}
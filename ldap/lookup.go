@@ -0,0 +1,57 @@
+package ldap
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+)
+
+// LookupGroups return the groups a token of the user would hold, formatted and filtered as
+// by Search, without checking their password: the user is searched and their groups read
+// with the service account only, the user is never bound as. It must therefore never be
+// used to authenticate a user, see Search. The lookups are not cached and count in the
+// concurrent searches, see WithMaxConcurrentSearches. The errors are the ones of Search,
+// and ErrLookupUnsupported when the users are bound as directly with WithUserDNTemplate.
+func (s *Ldap) LookupGroups(ctx context.Context, username string) (_ []string, err error) {
+	ctx, span := s.startSpan(ctx, "ldap.LookupGroups")
+	defer func() { endSpan(span, err) }()
+
+	// without service account search, only the user bind can read their entry
+	if s.userDNTemplate != "" {
+		return nil, ErrLookupUnsupported
+	}
+
+	if username == "" {
+		return nil, fmt.Errorf("%w, empty username", ErrUserNotFound)
+	}
+
+	if err = s.limiter.acquire(ctx); err != nil {
+		err = wrap(err)
+		return nil, err
+	}
+	defer s.limiter.release()
+
+	var groups []string
+
+	entry, server, err := s.findUser(ctx, username)
+	if err == nil {
+		groups, err = s.userGroups(ctx, server, entry)
+	}
+
+	if err != nil {
+		// the connections are closed once ctx is done, their errors are the consequence of it
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+
+		err = wrap(err)
+		return nil, err
+	}
+
+	user := s.userInfo(entry, groups)
+
+	log.Debug().Str("username", username).Strs("groups", user.Groups).Msg("Looked the user groups up.")
+
+	return user.Groups, nil
+}
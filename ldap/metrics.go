@@ -0,0 +1,45 @@
+package ldap
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type metrics struct {
+	searchDuration *prometheus.HistogramVec
+}
+
+func newMetrics(reg prometheus.Registerer) (*metrics, error) {
+	m := &metrics{
+		searchDuration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: "k8s_ldap_auth",
+				Subsystem: "ldap",
+				Name:      "search_duration_seconds",
+				Help:      "Duration of the ldap user authentications, from the first dial to the resolution of the groups.",
+				Buckets:   prometheus.DefBuckets,
+			},
+			[]string{"result"},
+		),
+	}
+
+	if err := reg.Register(m.searchDuration); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func (m *metrics) observeSearch(start time.Time, err error) {
+	if m == nil {
+		return
+	}
+
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+
+	m.searchDuration.WithLabelValues(result).Observe(time.Since(start).Seconds())
+}
@@ -1,13 +1,506 @@
 package ldap
 
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	ldap "github.com/go-ldap/ldap/v3"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace"
+)
+
 const (
 	ScopeBaseObject   = "base"
 	ScopeSingleLevel  = "single"
 	ScopeWholeSubtree = "sub"
 )
 
+const (
+	// GroupFormatDN keep the full group dn, ie. "cn=admins,ou=groups,dc=corp"
+	GroupFormatDN = "dn"
+	// GroupFormatRDN keep the value of the first rdn whatever its attribute, ie. "admins"
+	GroupFormatRDN = "rdn"
+	// GroupFormatCN keep the value of the first rdn when it is a cn, the full value otherwise
+	GroupFormatCN = "cn"
+)
+
+// DNExtraKey is the user extra holding the user dn, set when WithDNExtra is given
+const DNExtraKey = "k8s-ldap-auth/dn"
+
+const (
+	DefaultDialTimeout      = 5 * time.Second
+	DefaultOperationTimeout = 5 * time.Second
+)
+
+// scopeMap are the accepted search scopes, along with their common synonyms
 var scopeMap = map[string]int{
-	ScopeBaseObject:   0,
-	ScopeSingleLevel:  1,
-	ScopeWholeSubtree: 2,
+	ScopeBaseObject:   ldap.ScopeBaseObject,
+	ScopeSingleLevel:  ldap.ScopeSingleLevel,
+	"one":             ldap.ScopeSingleLevel,
+	"onelevel":        ldap.ScopeSingleLevel,
+	ScopeWholeSubtree: ldap.ScopeWholeSubtree,
+	"subtree":         ldap.ScopeWholeSubtree,
+}
+
+// parseScope return the search scope of its name or synonym, case insensitive. An unknown
+// scope is an error rather than a search of the base object only, which would not find any
+// user.
+func parseScope(name string) (int, error) {
+	if scope, ok := scopeMap[strings.ToLower(name)]; ok {
+		return scope, nil
+	}
+
+	names := make([]string, 0, len(scopeMap))
+	for n := range scopeMap {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	return 0, fmt.Errorf("Unknown search scope '%s', it must be one of %s", name, strings.Join(names, ", "))
+}
+
+// Option function for configuring a ldap instance
+type Option func(*Ldap) error
+
+func (s *Ldap) tls() *tls.Config {
+	if s.tlsConfig == nil {
+		s.tlsConfig = &tls.Config{}
+	}
+
+	return s.tlsConfig
+}
+
+// WithTLSConfig set the tls configuration used when dialing a ldaps:// url or upgrading
+// the connection with StartTLS. The configuration is ignored for plain ldap:// urls.
+func WithTLSConfig(c *tls.Config) Option {
+	return func(s *Ldap) error {
+		s.tlsConfig = c.Clone()
+
+		return nil
+	}
+}
+
+// WithCAFile load a PEM encoded CA bundle that will be used to verify the ldap server certificate
+// instead of the system certificate pool
+func WithCAFile(caFile string) Option {
+	return func(s *Ldap) error {
+		data, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return fmt.Errorf("Could not read ldap CA file, %w", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("No valid certificate found in ldap CA file '%s'", caFile)
+		}
+
+		s.tls().RootCAs = pool
+
+		return nil
+	}
+}
+
+// WithClientCertFile load a PEM encoded certificate and its private key presented to the ldap
+// server during the tls handshake, see WithExternalBind
+func WithClientCertFile(certFile, keyFile string) Option {
+	return func(s *Ldap) error {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return fmt.Errorf("Could not load ldap client certificate, %w", err)
+		}
+
+		s.tls().Certificates = []tls.Certificate{cert}
+
+		return nil
+	}
+}
+
+// WithExternalBind authenticate the service account with a SASL EXTERNAL bind instead of a
+// simple bind, the ldap server then identifies it by its client certificate. Every ldap url
+// must use tls, and no bind dn nor password can be given.
+func WithExternalBind() Option {
+	return func(s *Ldap) error {
+		s.externalBind = true
+
+		return nil
+	}
+}
+
+// BindAccount is a service account the searches can bind as
+type BindAccount struct {
+	DN       string
+	Password string
+}
+
+// WithFallbackBindAccounts bind as the given service accounts, in turn, when the ldap server
+// rejects the bind dn given to NewInstance, ie. because it is locked out or while its password
+// is being rotated. Unreachable servers never make the next account be tried.
+func WithFallbackBindAccounts(accounts ...BindAccount) Option {
+	return func(s *Ldap) error {
+		for _, account := range accounts {
+			if account.DN == "" {
+				return fmt.Errorf("A fallback bind account requires a dn")
+			}
+		}
+
+		s.fallbackAccounts = append([]BindAccount{}, accounts...)
+
+		return nil
+	}
+}
+
+// WithInsecureSkipVerify disable the verification of the ldap server certificate chain and hostname
+func WithInsecureSkipVerify(skip bool) Option {
+	return func(s *Ldap) error {
+		s.tls().InsecureSkipVerify = skip
+
+		return nil
+	}
+}
+
+// WithStartTLS upgrade plain ldap:// connections with StartTLS before any bind is performed.
+// A failed upgrade is an error, the connection never falls back to plaintext.
+func WithStartTLS() Option {
+	return func(s *Ldap) error {
+		s.startTLS = true
+
+		return nil
+	}
+}
+
+// WithPool set the maximum number of service account connections kept open to the ldap
+// server and how long an idle connection is kept before being closed (0 keeps them forever).
+func WithPool(size int, idleTimeout time.Duration) Option {
+	return func(s *Ldap) error {
+		if size < 1 {
+			return fmt.Errorf("The ldap pool size must be at least 1, got %d", size)
+		}
+
+		s.poolSize = size
+		s.poolIdleTimeout = idleTimeout
+
+		return nil
+	}
+}
+
+// WithBindPasswordFile read the service account password from a file, ie. a mounted secret,
+// instead of using the one given to NewInstance, so that it is never part of the process
+// arguments or environment. A trailing newline is dropped, an empty file is refused.
+func WithBindPasswordFile(path string) Option {
+	return func(s *Ldap) error {
+		password, err := loadSecret(path)
+		if err != nil {
+			return err
+		}
+
+		s.bindPassword = password
+
+		return nil
+	}
+}
+
+// WithBindPasswordReload check the file given to WithBindPasswordFile for a new password at
+// most every interval, so that a rotated password is used by the next connections without
+// restarting. A new password is only read once the file was left untouched for an
+// interval, so that a partially written one is never used.
+func WithBindPasswordReload(interval time.Duration) Option {
+	return func(s *Ldap) error {
+		if interval < 0 {
+			return fmt.Errorf("The bind password reload interval cannot be negative, got %s", interval)
+		}
+
+		s.passwordReload = interval
+
+		return nil
+	}
+}
+
+// WithMaxConcurrentSearches allow at most max searches to reach the directory at once, the
+// cached ones excepted, so that a burst of authentications does not overload it. Once the
+// limit is reached, a search waits at most wait for another one to end, or is rejected right
+// away when wait is zero. Either way the error then wraps ErrTooManySearches. There is no
+// limit when max is zero, the default.
+func WithMaxConcurrentSearches(max int, wait time.Duration) Option {
+	return func(s *Ldap) error {
+		if max < 0 {
+			return fmt.Errorf("The maximum number of concurrent searches cannot be negative, got %d", max)
+		}
+
+		if wait < 0 {
+			return fmt.Errorf("The time waited for a concurrent search to end cannot be negative, got %s", wait)
+		}
+
+		s.maxSearches = max
+		s.searchesWait = wait
+
+		return nil
+	}
+}
+
+// WithRandomizedURLs try the ldap urls in a random order instead of the configured one,
+// spreading the load across replicated servers
+func WithRandomizedURLs() Option {
+	return func(s *Ldap) error {
+		s.randomizeURLs = true
+
+		return nil
+	}
+}
+
+// WithDialTimeout set the maximum amount of time spent dialing each ldap url
+func WithDialTimeout(timeout time.Duration) Option {
+	return func(s *Ldap) error {
+		s.dialTimeout = timeout
+
+		return nil
+	}
+}
+
+// WithOperationTimeout set the maximum amount of time to wait for the ldap server to answer
+// a bind or a search
+func WithOperationTimeout(timeout time.Duration) Option {
+	return func(s *Ldap) error {
+		s.operationTimeout = timeout
+
+		return nil
+	}
+}
+
+// WithNestedGroups resolve the groups the user groups are themselves members of, up to
+// depth levels above the user direct groups
+func WithNestedGroups(depth int) Option {
+	return func(s *Ldap) error {
+		if depth < 0 {
+			return fmt.Errorf("The nested groups depth cannot be negative, got %d", depth)
+		}
+
+		s.nestedGroupsDepth = depth
+
+		return nil
+	}
+}
+
+// WithGroupFormat select how group values are turned into group names, see GroupFormatDN,
+// GroupFormatRDN and GroupFormatCN. Defaults to GroupFormatDN.
+func WithGroupFormat(format string) Option {
+	return func(s *Ldap) error {
+		switch format {
+		case GroupFormatDN, GroupFormatRDN, GroupFormatCN:
+			s.groupFormat = format
+		default:
+			return fmt.Errorf("Unknown group format '%s', expected one of '%s', '%s' or '%s'", format, GroupFormatDN, GroupFormatRDN, GroupFormatCN)
+		}
+
+		return nil
+	}
+}
+
+// WithAttributeMap read the UserInfo fields from the attributes of the given map instead of
+// the properties given to NewInstance, see AttributeMap. The options modifying the map, ie.
+// WithUIDProperty, apply to it when given after it.
+func WithAttributeMap(m AttributeMap) Option {
+	return func(s *Ldap) error {
+		if err := m.validate(); err != nil {
+			return err
+		}
+
+		s.attributes = m.copy()
+
+		return nil
+	}
+}
+
+// WithMemberofProperties read the groups from the given attributes too, along with the
+// memberof property given to NewInstance, ie. "isMemberOf" for directories populating it
+// besides "memberOf". The groups of every attribute are merged.
+func WithMemberofProperties(properties ...string) Option {
+	return func(s *Ldap) error {
+		s.attributes.Groups = append(s.attributes.Groups, properties...)
+
+		return nil
+	}
+}
+
+// WithGroupSearch search the groups whose members include the user dn instead of reading the
+// memberof attribute of the user, for directories that do not maintain it like OpenLDAP with
+// groupOfNames groups. The filter is formatted with the escaped user dn, ie.
+// "(&(objectClass=groupOfNames)(member=%s))", and the groups are searched in the given bases,
+// or in the user search bases when none.
+func WithGroupSearch(filter string, bases []string) Option {
+	return func(s *Ldap) error {
+		if filter != "" && strings.Count(filter, "%s") != 1 {
+			return fmt.Errorf("The group search filter '%s' must contain exactly one %%s, replaced by the user dn", filter)
+		}
+
+		s.groupSearchFilter = filter
+		s.groupSearchBases = append([]string{}, bases...)
+
+		return nil
+	}
+}
+
+// WithGroupFilter only keep the groups whose name matches the regular expression, ie. "^k8s-"
+// to drop the distribution lists. Names are matched once formatted (see WithGroupFormat) and
+// lowercased.
+func WithGroupFilter(pattern string) Option {
+	return func(s *Ldap) error {
+		if pattern == "" {
+			s.groupFilter = nil
+			return nil
+		}
+
+		filter, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("Invalid group filter '%s', %w", pattern, err)
+		}
+
+		s.groupFilter = filter
+
+		return nil
+	}
+}
+
+// WithUIDProperty set the user attribute used as uid in the UserInfo instead of the entry dn,
+// ie. "objectGUID" for Active Directory or "entryUUID" for OpenLDAP. The attribute is added
+// to the search attributes if missing.
+func WithUIDProperty(property string) Option {
+	return func(s *Ldap) error {
+		s.attributes.UID = property
+
+		return nil
+	}
+}
+
+// WithCaseSensitive keep the uid and username casing as returned by the ldap server instead
+// of lowercasing them
+func WithCaseSensitive() Option {
+	return func(s *Ldap) error {
+		s.caseSensitive = true
+
+		return nil
+	}
+}
+
+// WithoutDN keep the user dn out of the UserInfo, and so out of the tokens and logs: the UID
+// is the username unless a uid property was configured, and the extra attributes holding the
+// dn, ie. "distinguishedName", are dropped
+func WithoutDN() Option {
+	return func(s *Ldap) error {
+		s.omitDN = true
+
+		return nil
+	}
+}
+
+// WithDNExtra keep the user dn in the DNExtraKey user extra, whatever the uid is. The dn is
+// kept even with WithoutDN, meant for the tools showing where the user was found.
+func WithDNExtra() Option {
+	return func(s *Ldap) error {
+		s.dnExtra = true
+
+		return nil
+	}
+}
+
+// WithPaging run the searches with the paged results control, fetching pageSize entries per
+// page. Required by directories enforcing a size limit on unpaged searches.
+func WithPaging(pageSize uint32) Option {
+	return func(s *Ldap) error {
+		s.pageSize = pageSize
+
+		return nil
+	}
+}
+
+// WithUserDNTemplate bind directly as the user dn built from the template, ie.
+// "uid=%s,ou=people,dc=corp", instead of looking the user up with the service account.
+// The user entry is then read with the user own connection.
+func WithUserDNTemplate(template string) Option {
+	return func(s *Ldap) error {
+		s.userDNTemplate = template
+
+		return nil
+	}
+}
+
+// WithCache keep the result of successful searches for ttl, so that repeated authentications
+// of a same user do not reach the ldap server. At most maxEntries users are kept.
+// Failed searches are never cached.
+func WithCache(ttl time.Duration, maxEntries int) Option {
+	return func(s *Ldap) error {
+		if ttl > 0 && maxEntries < 1 {
+			return fmt.Errorf("The cache must hold at least 1 entry, got %d", maxEntries)
+		}
+
+		s.cacheTTL = ttl
+		s.cacheMaxEntries = maxEntries
+
+		return nil
+	}
+}
+
+// WithMetrics register the ldap metrics in the given registry
+func WithMetrics(reg prometheus.Registerer) Option {
+	return func(s *Ldap) error {
+		m, err := newMetrics(reg)
+		if err != nil {
+			return err
+		}
+
+		s.metrics = m
+
+		return nil
+	}
+}
+
+// WithTracerProvider record the searches, binds and group resolutions as spans of the given
+// tracer provider. Defaults to a no-op provider.
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(s *Ldap) error {
+		s.tracer = tp.Tracer(tracerName)
+
+		return nil
+	}
+}
+
+// WithRetry try dialing and binding up to attempts times when the ldap server cannot be
+// reached or is busy, waiting backoff before the first retry and doubling it at each
+// attempt, randomly extended by up to jitter (0 to 1) of itself. Rejected credentials are
+// never retried. Defaults to a single attempt.
+func WithRetry(attempts int, backoff time.Duration, jitter float64) Option {
+	return func(s *Ldap) error {
+		if attempts < 1 {
+			return fmt.Errorf("At least 1 ldap attempt is required, got %d", attempts)
+		}
+
+		if jitter < 0 || jitter > 1 {
+			return fmt.Errorf("The ldap retry jitter must be between 0 and 1, got %v", jitter)
+		}
+
+		s.retryAttempts = attempts
+		s.retryBackoff = backoff
+		s.retryJitter = jitter
+
+		return nil
+	}
+}
+
+// WithReferrals follow the referrals returned by the user searches, ie. to the other domains
+// of an Active Directory forest, restricted to the given hosts when any. The service account
+// credentials and, once found, the user password are sent to the referred servers: without
+// a host allowlist, anyone able to add a referral to the directory can collect them. Plain
+// ldap:// referrals are only encrypted when StartTLS is enabled.
+func WithReferrals(hosts []string) Option {
+	return func(s *Ldap) error {
+		s.followReferrals = true
+		s.referralHosts = hosts
+
+		return nil
+	}
 }
@@ -0,0 +1,99 @@
+package ldap
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// readPassword read a password from a file, ie. a mounted secret, without its trailing
+// newline. The bytes read are zeroed once copied to the returned string, which cannot be.
+func readPassword(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("Could not read the bind password file, %w", err)
+	}
+
+	defer func() {
+		for i := range data {
+			data[i] = 0
+		}
+	}()
+
+	password := bytes.TrimRight(data, "\r\n")
+	if len(password) == 0 {
+		return "", fmt.Errorf("The bind password file '%s' is empty", path)
+	}
+
+	return string(password), nil
+}
+
+// secret is the service account password. When read from a file with a reload interval, the
+// file is checked again once the interval elapsed since the last check, on the next bind, so
+// that a rotated password is used without restarting.
+type secret struct {
+	mu       sync.Mutex
+	password string
+	path     string
+	interval time.Duration
+	// checked is when the file was last checked, modTime the modification time of the file
+	// the password was read from
+	checked time.Time
+	modTime time.Time
+}
+
+// loadSecret read the password of the file, see readPassword
+func loadSecret(path string) (*secret, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read the bind password file, %w", err)
+	}
+
+	password, err := readPassword(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &secret{password: password, path: path, checked: time.Now(), modTime: info.ModTime()}, nil
+}
+
+// get return the current password. A modified file is only read once it was left untouched
+// for a whole interval, so that a password being written is never used, and the current
+// password is kept when the file cannot be read or is empty.
+func (s *secret) get() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.interval <= 0 || time.Since(s.checked) < s.interval {
+		return s.password
+	}
+
+	s.checked = time.Now()
+
+	info, err := os.Stat(s.path)
+	if err != nil {
+		log.Warn().Err(err).Str("path", s.path).Msg("Could not check the bind password file, keeping the current password.")
+		return s.password
+	}
+
+	if info.ModTime().Equal(s.modTime) || time.Since(info.ModTime()) < s.interval {
+		return s.password
+	}
+
+	password, err := readPassword(s.path)
+	if err != nil {
+		log.Warn().Err(err).Msg("Could not reload the bind password, keeping the current one.")
+		return s.password
+	}
+
+	s.password = password
+	s.modTime = info.ModTime()
+	log.Info().Str("path", s.path).Msg("Reloaded the bind password.")
+
+	return s.password
+}
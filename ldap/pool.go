@@ -0,0 +1,129 @@
+package ldap
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	ldap "github.com/go-ldap/ldap/v3"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	DefaultPoolSize        = 10
+	DefaultPoolIdleTimeout = time.Minute
+)
+
+type pooledConn struct {
+	conn     *ldap.Conn
+	lastUsed time.Time
+}
+
+// pool keeps connections bound as the service account so that searches do not have to
+// dial and bind for every request. At most size connections are open at any given time,
+// callers wait for a connection to be released when they are all in use.
+type pool struct {
+	mu          sync.Mutex
+	idle        []*pooledConn
+	tokens      chan struct{}
+	idleTimeout time.Duration
+	factory     func(context.Context) (*ldap.Conn, error)
+}
+
+func newPool(size int, idleTimeout time.Duration, factory func(context.Context) (*ldap.Conn, error)) *pool {
+	return &pool{
+		idle:        []*pooledConn{},
+		tokens:      make(chan struct{}, size),
+		idleTimeout: idleTimeout,
+		factory:     factory,
+	}
+}
+
+// get return a healthy connection, either an idle one or a newly dialed one, and whether it
+// was idle. Idle connections that were closed by the server or that idled for too long are
+// discarded, but one dropped without the client noticing, ie. by a firewall, is only found
+// dead when used. Waiting for a connection to be released stops when ctx is done.
+func (p *pool) get(ctx context.Context) (*ldap.Conn, bool, error) {
+	if err := p.acquire(ctx); err != nil {
+		return nil, false, err
+	}
+
+	p.mu.Lock()
+	for len(p.idle) > 0 {
+		c := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+
+		if c.conn.IsClosing() || (p.idleTimeout > 0 && time.Since(c.lastUsed) > p.idleTimeout) {
+			c.conn.Close()
+			continue
+		}
+
+		p.mu.Unlock()
+		return c.conn, true, nil
+	}
+	p.mu.Unlock()
+
+	log.Debug().Msg("No idle ldap connection available, dialing a new one.")
+
+	conn, err := p.dial(ctx)
+	return conn, false, err
+}
+
+// fresh return a newly dialed connection, ignoring the idle ones
+func (p *pool) fresh(ctx context.Context) (*ldap.Conn, error) {
+	if err := p.acquire(ctx); err != nil {
+		return nil, err
+	}
+
+	return p.dial(ctx)
+}
+
+// acquire wait for a connection to be available, until ctx is done
+func (p *pool) acquire(ctx context.Context) error {
+	select {
+	case p.tokens <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ldap.NewError(ldap.ErrorNetwork, fmt.Errorf("No ldap connection released in time, %w", ctx.Err()))
+	}
+}
+
+// dial open a connection once acquired, releasing it when the dial fails
+func (p *pool) dial(ctx context.Context) (*ldap.Conn, error) {
+	conn, err := p.factory(ctx)
+	if err != nil {
+		<-p.tokens
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// wait tells whether a connection could be got before ctx is done, without getting it. The
+// pool is exhausted when every connection is still in use once ctx is done, ie. because they
+// are stuck in operations that never end.
+func (p *pool) wait(ctx context.Context) error {
+	select {
+	case p.tokens <- struct{}{}:
+		<-p.tokens
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("All the %d ldap connections are still in use, %w", cap(p.tokens), ctx.Err())
+	}
+}
+
+// put give a connection back to the pool. Connections that encountered a network error
+// are closed instead so that the next get dials a fresh one.
+func (p *pool) put(conn *ldap.Conn, err error) {
+	defer func() { <-p.tokens }()
+
+	if conn.IsClosing() || ldap.IsErrorWithCode(err, ldap.ErrorNetwork) {
+		conn.Close()
+		return
+	}
+
+	p.mu.Lock()
+	p.idle = append(p.idle, &pooledConn{conn: conn, lastUsed: time.Now()})
+	p.mu.Unlock()
+}
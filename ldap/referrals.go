@@ -0,0 +1,82 @@
+package ldap
+
+import (
+	"context"
+	"net/url"
+	"strings"
+
+	ldap "github.com/go-ldap/ldap/v3"
+	"github.com/rs/zerolog/log"
+)
+
+// referralAllowed tells whether the referred server can be contacted, any server can when no
+// host was configured. Hosts are matched with or without their port.
+func (s *Ldap) referralAllowed(u *url.URL) bool {
+	if len(s.referralHosts) == 0 {
+		return true
+	}
+
+	for _, host := range s.referralHosts {
+		if strings.EqualFold(host, u.Host) || strings.EqualFold(host, u.Hostname()) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// searchReferral search the user on the server a search referred to, bound as the service
+// account. Only one hop is followed, the referrals returned by the referred server are
+// ignored. An unusable referral is logged and skipped so that the users found on the other
+// servers can still authenticate.
+func (s *Ldap) searchReferral(ctx context.Context, referral, username string) (string, []*ldap.Entry) {
+	u, err := url.Parse(referral)
+	if err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") || u.Host == "" {
+		log.Warn().Str("referral", referral).Msg("Ignored an invalid referral.")
+		return "", nil
+	}
+
+	if !s.referralAllowed(u) {
+		log.Warn().Str("referral", referral).Msg("Ignored a referral to a host that is not allowed.")
+		return "", nil
+	}
+
+	server := u.Scheme + "://" + u.Host
+
+	l, err := s.bindTo(ctx, []string{server})
+	if err != nil {
+		log.Warn().Err(err).Str("referral", referral).Msg("Could not reach the referred ldap server.")
+		return "", nil
+	}
+
+	defer l.Close()
+	defer closeOnDone(ctx, l)()
+
+	result, err := s.search(l, s.userSearchRequest(strings.TrimPrefix(u.Path, "/"), username))
+	if err != nil {
+		log.Warn().Err(err).Str("referral", referral).Msg("Could not search the referred ldap server.")
+		return "", nil
+	}
+
+	log.Debug().Str("referral", referral).Int("entries", len(result.Entries)).Msg("Followed referral.")
+
+	return server, result.Entries
+}
+
+// referredGroups return the groups of a user entry found on a referred server, resolving the
+// nested groups on that server
+func (s *Ldap) referredGroups(ctx context.Context, server string, entry *ldap.Entry) ([]string, error) {
+	if s.nestedGroupsDepth == 0 && s.groupSearchFilter == "" {
+		return s.groups(nil, entry)
+	}
+
+	l, err := s.bindTo(ctx, []string{server})
+	if err != nil {
+		return nil, err
+	}
+
+	defer l.Close()
+	defer closeOnDone(ctx, l)()
+
+	return s.groups(l, entry)
+}
@@ -0,0 +1,59 @@
+package ldap
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	ldap "github.com/go-ldap/ldap/v3"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	DefaultRetryAttempts = 1
+	DefaultRetryBackoff  = 100 * time.Millisecond
+	DefaultRetryJitter   = 0.2
+)
+
+// isTransient tells whether the operation may succeed if tried again, that is when the
+// server could not be reached or answered it is busy. Rejected credentials are never
+// transient.
+func isTransient(err error) bool {
+	return ldap.IsErrorWithCode(err, ldap.ErrorNetwork) ||
+		ldap.IsErrorWithCode(err, ldap.LDAPResultBusy) ||
+		ldap.IsErrorWithCode(err, ldap.LDAPResultUnavailable) ||
+		isTimeout(err)
+}
+
+// backoff return the delay before the given retry, doubling at each attempt from the base
+// backoff and randomly extended by up to jitter of itself
+func (s *Ldap) backoff(retry int) time.Duration {
+	d := s.retryBackoff << uint(retry-1)
+
+	return d + time.Duration(rand.Float64()*s.retryJitter*float64(d))
+}
+
+// retry run connect until it succeeds, fails with an error that is not transient, or the
+// configured attempts are exhausted. No retry is attempted when the backoff would go past
+// the ctx deadline.
+func (s *Ldap) retry(ctx context.Context, connect func(context.Context) (*ldap.Conn, error)) (*ldap.Conn, error) {
+	for attempt := 1; ; attempt++ {
+		l, err := connect(ctx)
+		if err == nil || attempt >= s.retryAttempts || !isTransient(err) {
+			return l, err
+		}
+
+		delay := s.backoff(attempt)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			return nil, err
+		}
+
+		log.Warn().Err(err).Int("attempt", attempt).Dur("backoff", delay).Msg("Transient ldap error, retrying.")
+
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(delay):
+		}
+	}
+}
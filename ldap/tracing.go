@@ -0,0 +1,25 @@
+package ldap
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "vbouchaud/k8s-ldap-auth/ldap"
+
+// startSpan start a span named name as a child of the span found in ctx, if any
+func (s *Ldap) startSpan(ctx context.Context, name string) (context.Context, trace.Span) {
+	return s.tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient))
+}
+
+// endSpan end the span, marking it as failed when err is not nil
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
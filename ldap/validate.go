@@ -0,0 +1,67 @@
+package ldap
+
+import (
+	"context"
+	"fmt"
+
+	ldap "github.com/go-ldap/ldap/v3"
+)
+
+// Ping dial the ldap servers and bind as the service account on a fresh connection, the
+// pooled connections are left untouched. The error wraps ErrDirectoryUnavailable or
+// ErrTimeout when the directory cannot be used.
+func (s *Ldap) Ping(ctx context.Context) error {
+	l, err := s.retry(ctx, s.Bind)
+	if err != nil {
+		return wrap(err)
+	}
+
+	l.Close()
+
+	return nil
+}
+
+// CheckPool tell whether a pooled connection is available, or is released before ctx is
+// done, so that connections stuck in use are detected. The directory is not reached: an
+// unreachable directory fails the searches and Ping, not CheckPool.
+func (s *Ldap) CheckPool(ctx context.Context) error {
+	return s.pool.wait(ctx)
+}
+
+// Validate check the configuration against the directory, so that a broken one is reported
+// at startup instead of on the first authentication: see Ping, then every search base must
+// exist. The search bases are not checked when users bind directly, without a service
+// account to read them.
+func (s *Ldap) Validate(ctx context.Context) error {
+	if err := s.Ping(ctx); err != nil {
+		return err
+	}
+
+	if s.userDNTemplate != "" && s.bindDN == "" && !s.externalBind {
+		return nil
+	}
+
+	return wrap(s.withConn(ctx, func(l *ldap.Conn) error {
+		for _, base := range s.searchBases {
+			// a base object search of the base itself, only its existence matters
+			_, err := l.Search(ldap.NewSearchRequest(
+				base,
+				ldap.ScopeBaseObject,
+				ldap.NeverDerefAliases,
+				1,
+				int(s.operationTimeout.Seconds()),
+				false,
+				"(objectClass=*)",
+				[]string{"1.1"},
+				nil,
+			))
+			if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+				return fmt.Errorf("The search base '%s' does not exist", base)
+			} else if err != nil {
+				return fmt.Errorf("Could not read the search base '%s', %w", base, wrap(err))
+			}
+		}
+
+		return nil
+	}))
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"vbouchaud/k8s-ldap-auth/server/middlewares"
+)
+
+// AuditEvent is the record of an authentication attempt. The password is never part of it.
+type AuditEvent struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id,omitempty"`
+	Username  string    `json:"username"`
+	SourceIP  string    `json:"source_ip"`
+	Success   bool      `json:"success"`
+	Reason    string    `json:"reason"`
+}
+
+// Auditor receives an AuditEvent for every authentication attempt, whatever its outcome.
+// Implementations must be safe for concurrent use.
+type Auditor interface {
+	Audit(event AuditEvent) error
+}
+
+// jsonAuditor writes the events as JSON lines
+type jsonAuditor struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// NewJSONAuditor return an Auditor appending the events to out, one JSON object per line
+func NewJSONAuditor(out io.Writer) Auditor {
+	return &jsonAuditor{enc: json.NewEncoder(out)}
+}
+
+func (a *jsonAuditor) Audit(event AuditEvent) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.enc.Encode(event)
+}
+
+// attempt record the outcome of an authentication attempt in the metrics and the audit log
+func (s *Instance) attempt(req *http.Request, username, reason string) {
+	s.metrics.authentication(reason)
+
+	if s.auditor == nil {
+		return
+	}
+
+	err := s.auditor.Audit(AuditEvent{
+		Time:      time.Now().UTC(),
+		RequestID: middlewares.GetRequestID(req.Context()),
+		Username:  username,
+		SourceIP:  middlewares.ClientIP(req, s.auditTrustProxy),
+		Success:   reason == reasonSuccess,
+		Reason:    reason,
+	})
+	if err != nil {
+		s.logger(req).Error().Err(err).Str("username", username).Str("reason", reason).Msg("Could not write the audit event.")
+	}
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"vbouchaud/k8s-ldap-auth/internal/ldaptest"
+	"vbouchaud/k8s-ldap-auth/ldap"
+)
+
+// directory start an in-memory ldap server holding the admin service account and john,
+// a member of the admins group
+func directory(t *testing.T) *ldaptest.Server {
+	srv, err := ldaptest.NewServer(
+		ldaptest.Entry{DN: "cn=admin,dc=corp", Password: "password"},
+		ldaptest.Entry{
+			DN:       "uid=john,ou=people,dc=corp",
+			Password: "secret",
+			Attributes: map[string][]string{
+				"uid":      {"john"},
+				"memberof": {"cn=admins,ou=groups,dc=corp"},
+			},
+		},
+	)
+	if err != nil {
+		t.Fatalf("Failed to start the ldap server, %s", err)
+	}
+
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+// withDirectory bind the instance to the given in-memory ldap server
+func withDirectory(srv *ldaptest.Server, opts ...ldap.Option) Option {
+	return WithLdap(
+		[]string{srv.URL},
+		"cn=admin,dc=corp",
+		"password",
+		[]string{"dc=corp"},
+		ldap.ScopeWholeSubtree,
+		"(uid=%s)",
+		"memberof",
+		"uid",
+		nil,
+		append([]ldap.Option{ldap.WithDialTimeout(time.Second)}, opts...)...,
+	)
+}
+
+func authenticate(s *Instance, username, password string) int {
+	body, _ := json.Marshal(map[string]string{"username": username, "password": password})
+
+	req := httptest.NewRequest(http.MethodPost, "/auth", strings.NewReader(string(body)))
+	req.Header.Set(ContentTypeHeader, ContentTypeJSON)
+	req.RemoteAddr = "192.0.2.1:1234"
+
+	res := httptest.NewRecorder()
+	s.h.ServeHTTP(res, req)
+
+	return res.Code
+}
+
+func TestAudit(t *testing.T) {
+	srv := directory(t)
+
+	// a search filter that is not unique, john is found twice
+	duplicated, err := ldaptest.NewServer(
+		ldaptest.Entry{DN: "cn=admin,dc=corp", Password: "password"},
+		ldaptest.Entry{DN: "uid=john,ou=people,dc=corp", Password: "secret", Attributes: map[string][]string{"uid": {"john"}}},
+		ldaptest.Entry{DN: "uid=john,ou=contractors,dc=corp", Password: "secret", Attributes: map[string][]string{"uid": {"john"}}},
+	)
+	if err != nil {
+		t.Fatalf("Failed to start the ldap server, %s", err)
+	}
+	defer duplicated.Close()
+
+	tests := []struct {
+		name     string
+		opts     []Option
+		password string
+		code     int
+		success  bool
+		reason   string
+	}{
+		{name: "success", opts: []Option{withDirectory(srv)}, password: "secret", code: http.StatusOK, success: true, reason: reasonSuccess},
+		{name: "invalid credentials", opts: []Option{withDirectory(srv)}, password: "wrong", code: http.StatusUnauthorized, reason: reasonInvalidCredentials},
+		{name: "several entries", opts: []Option{withDirectory(duplicated)}, password: "secret", code: http.StatusUnauthorized, reason: reasonTooManyEntries},
+		{name: "unreachable ldap", password: "secret", code: http.StatusServiceUnavailable, reason: reasonDirectoryUnavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf strings.Builder
+			s := newTestInstance(t, append(tt.opts, WithAuditor(NewJSONAuditor(&buf), false))...)
+
+			if code := authenticate(s, "john", tt.password); code != tt.code {
+				t.Errorf("POST /auth = %d, want %d", code, tt.code)
+			}
+
+			var event AuditEvent
+			if err := json.Unmarshal([]byte(buf.String()), &event); err != nil {
+				t.Fatalf("Audit log %q is not a json event, %s", buf.String(), err)
+			}
+
+			if event.Username != "john" || event.SourceIP != "192.0.2.1" || event.Success != tt.success || event.Reason != tt.reason {
+				t.Errorf("audit event = %+v, want john from 192.0.2.1 with success %v and reason %s", event, tt.success, tt.reason)
+			}
+
+			if time.Since(event.Time) > time.Minute {
+				t.Errorf("audit event time = %s, want now", event.Time)
+			}
+
+			if strings.Contains(buf.String(), tt.password) {
+				t.Errorf("The password was audited")
+			}
+		})
+	}
+}
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	auth "k8s.io/api/authentication/v1"
+)
+
+// clientCert return a CA and a client certificate it signed
+func clientCert(t *testing.T) ([]byte, tls.Certificate) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key, %s", err)
+	}
+
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "client-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	caDER, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("Failed to create CA certificate, %s", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key, %s", err)
+	}
+
+	client := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "kube-apiserver"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, client, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("Failed to create client certificate, %s", err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}),
+		tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestClientCert(t *testing.T) {
+	keyPEM := rsaKeyPEM(t)
+	certPEM, serverKeyPEM := selfSignedPEM(t)
+	caPEM, cert := clientCert(t)
+	_, untrusted := clientCert(t)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := ioutil.WriteFile(caFile, caPEM, 0600); err != nil {
+		t.Fatalf("Failed to write CA, %s", err)
+	}
+
+	s := newTestInstance(t, WithKeyPEM(keyPEM), WithTLSPEM(certPEM, serverKeyPEM), WithClientCAFile(caFile))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen, %s", err)
+	}
+
+	go s.serve(l)
+	defer s.Shutdown(context.Background())
+
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(certPEM)
+
+	body, _ := json.Marshal(auth.TokenReview{Spec: auth.TokenReviewSpec{Token: signedToken(t, keyPEM)}})
+
+	tests := []struct {
+		name  string
+		certs []tls.Certificate
+		path  string
+		// code is 0 when the tls handshake is expected to fail
+		code int
+	}{
+		{name: "token review with a valid certificate", certs: []tls.Certificate{cert}, path: "/token", code: http.StatusOK},
+		{name: "token review without certificate", path: "/token", code: http.StatusUnauthorized},
+		{name: "token review with an untrusted certificate", certs: []tls.Certificate{untrusted}, path: "/token"},
+		{name: "other routes without certificate", path: "/healthz", code: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &http.Client{
+				Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, Certificates: tt.certs}},
+			}
+
+			var res *http.Response
+			if tt.path == "/token" {
+				res, err = c.Post("https://"+l.Addr().String()+tt.path, ContentTypeJSON, strings.NewReader(string(body)))
+			} else {
+				res, err = c.Get("https://" + l.Addr().String() + tt.path)
+			}
+
+			if tt.code == 0 {
+				if err == nil {
+					res.Body.Close()
+					t.Errorf("%s = %d, want the handshake to fail", tt.path, res.StatusCode)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("%s failed, %s", tt.path, err)
+			}
+			res.Body.Close()
+
+			if res.StatusCode != tt.code {
+				t.Errorf("%s = %d, want %d", tt.path, res.StatusCode, tt.code)
+			}
+		})
+	}
+}
+
+func TestClientCertRequiresTLS(t *testing.T) {
+	caPEM, _ := clientCert(t)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := ioutil.WriteFile(caFile, caPEM, 0600); err != nil {
+		t.Fatalf("Failed to write CA, %s", err)
+	}
+
+	if _, err := NewInstance(WithKey("", ""), WithClientCAFile(caFile)); err == nil {
+		t.Errorf("NewInstance() without TLS error = nil, want an error")
+	}
+}
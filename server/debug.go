@@ -0,0 +1,114 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/pprof"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"vbouchaud/k8s-ldap-auth/ldap"
+	"vbouchaud/k8s-ldap-auth/server/middlewares"
+)
+
+// lookup is the outcome of the most recent ldap search, served by /debug/lastlookup. Neither
+// the password nor the user entry are kept, only the username. The error is only kept as its
+// reason, ie. user_not_found, the directory messages could tell more about it.
+type lookup struct {
+	Time     time.Time `json:"time"`
+	Username string    `json:"username"`
+	Outcome  string    `json:"outcome"`
+	Latency  string    `json:"latency"`
+}
+
+// lastLookup keep the most recent lookup, a nil lastLookup records nothing
+type lastLookup struct {
+	mu sync.Mutex
+	l  *lookup
+}
+
+func (l *lastLookup) record(username string, latency time.Duration, err error) {
+	if l == nil {
+		return
+	}
+
+	entry := &lookup{
+		Time:     time.Now(),
+		Username: username,
+		Outcome:  lookupOutcome(err),
+		Latency:  latency.String(),
+	}
+
+	l.mu.Lock()
+	l.l = entry
+	l.mu.Unlock()
+}
+
+func (l *lastLookup) get() *lookup {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.l
+}
+
+// lookupOutcome return the reason of a search outcome, as counted by the metrics
+func lookupOutcome(err error) string {
+	var tooMany *ldap.TooManyEntriesError
+
+	switch {
+	case err == nil:
+		return reasonSuccess
+	case errors.Is(err, ldap.ErrTimeout):
+		return reasonTimeout
+	case errors.Is(err, context.Canceled):
+		return reasonCanceled
+	case errors.Is(err, ldap.ErrUserNotFound):
+		return reasonUserNotFound
+	case errors.Is(err, ldap.ErrInvalidCredentials):
+		return reasonInvalidCredentials
+	case errors.Is(err, ldap.ErrDirectoryUnavailable):
+		return reasonDirectoryUnavailable
+	case errors.Is(err, ldap.ErrTooManySearches):
+		return reasonTooManySearches
+	case errors.As(err, &tooMany):
+		return reasonTooManyEntries
+	}
+
+	return reasonError
+}
+
+// lastLookupHandler serves the most recent lookup as json, or a 204 when no search ran yet
+func (s *Instance) lastLookupHandler() http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		l := s.lastLookup.get()
+		if l == nil {
+			res.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		res.Header().Set(ContentTypeHeader, ContentTypeJSON)
+		json.NewEncoder(res).Encode(l)
+	}
+}
+
+// registerPprof serve the net/http/pprof handlers below /debug/pprof/ of routes, to the
+// clients presenting a certificate only: /cmdline shows the flags, secrets included. Importing
+// net/http/pprof also registers them on http.DefaultServeMux, which the server never serves.
+func (s *Instance) registerPprof(routes *mux.Router) {
+	debug := routes.PathPrefix("/debug/pprof").Subrouter()
+	debug.Use(middlewares.RequireClientCert)
+
+	debug.HandleFunc("/", pprof.Index)
+	debug.HandleFunc("/cmdline", pprof.Cmdline)
+	debug.HandleFunc("/profile", pprof.Profile)
+	debug.HandleFunc("/symbol", pprof.Symbol)
+	debug.HandleFunc("/trace", pprof.Trace)
+	// pprof.Index only serves the named profiles below /debug/pprof/, not below a base path
+	debug.HandleFunc("/{profile}", func(res http.ResponseWriter, req *http.Request) {
+		pprof.Handler(mux.Vars(req)["profile"]).ServeHTTP(res, req)
+	})
+}
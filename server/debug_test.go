@@ -0,0 +1,151 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// clientCAOptions return the options verifying the client certificates, along with a client
+// certificate they trust, see verified
+func clientCAOptions(t *testing.T) ([]Option, *x509.Certificate) {
+	certPEM, serverKeyPEM := selfSignedPEM(t)
+	caPEM, cert := clientCert(t)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := ioutil.WriteFile(caFile, caPEM, 0600); err != nil {
+		t.Fatalf("Failed to write CA, %s", err)
+	}
+
+	client, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatalf("Failed to parse the client certificate, %s", err)
+	}
+
+	return []Option{WithTLSPEM(certPEM, serverKeyPEM), WithClientCAFile(caFile)}, client
+}
+
+// verified return req as received over TLS from a client presenting cert
+func verified(req *http.Request, cert *x509.Certificate) *http.Request {
+	req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	return req
+}
+
+func TestLastLookup(t *testing.T) {
+	srv := directory(t)
+	caOpts, cert := clientCAOptions(t)
+
+	get := func(s *Instance) *httptest.ResponseRecorder {
+		res := httptest.NewRecorder()
+		s.h.ServeHTTP(res, verified(httptest.NewRequest(http.MethodGet, "/debug/lastlookup", nil), cert))
+		return res
+	}
+
+	if res := get(newTestInstance(t, withDirectory(srv))); res.Code != http.StatusNotFound {
+		t.Errorf("GET /debug/lastlookup without WithLastLookup = %d, want %d", res.Code, http.StatusNotFound)
+	}
+
+	if _, err := NewInstance(WithKey("", ""), withDirectory(srv), WithLastLookup()); err == nil {
+		t.Errorf("NewInstance() with WithLastLookup but no client CA error = nil, want an error")
+	}
+
+	s := newTestInstance(t, append(caOpts, withDirectory(srv), WithLastLookup())...)
+
+	res := httptest.NewRecorder()
+	s.h.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/debug/lastlookup", nil))
+	if res.Code != http.StatusUnauthorized {
+		t.Errorf("GET /debug/lastlookup without client certificate = %d, want %d", res.Code, http.StatusUnauthorized)
+	}
+
+	if res := get(s); res.Code != http.StatusNoContent {
+		t.Errorf("GET /debug/lastlookup before any search = %d, want %d", res.Code, http.StatusNoContent)
+	}
+
+	tests := []struct {
+		name     string
+		password string
+		outcome  string
+	}{
+		{name: "invalid credentials", password: "wrong-secret", outcome: reasonInvalidCredentials},
+		{name: "success", password: "secret", outcome: reasonSuccess},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			authenticate(s, "john", tt.password)
+
+			res := get(s)
+			if res.Code != http.StatusOK {
+				t.Fatalf("GET /debug/lastlookup = %d, want %d", res.Code, http.StatusOK)
+			}
+
+			// neither the password nor the directory error message are exposed
+			if body := res.Body.String(); strings.Contains(body, tt.password) || strings.Contains(body, "LDAP Result Code") {
+				t.Errorf("GET /debug/lastlookup body = %s, the password or the ldap error was exposed", body)
+			}
+
+			var l lookup
+			if err := json.NewDecoder(res.Body).Decode(&l); err != nil {
+				t.Fatalf("GET /debug/lastlookup body is not json, %s", err)
+			}
+
+			if l.Username != "john" || l.Outcome != tt.outcome || l.Latency == "" {
+				t.Errorf("GET /debug/lastlookup = %+v, want the %s lookup of john", l, tt.outcome)
+			}
+		})
+	}
+}
+
+func TestPprof(t *testing.T) {
+	caOpts, cert := clientCAOptions(t)
+	pprof := append([]Option{WithPprof()}, caOpts...)
+
+	if _, err := NewInstance(WithKey("", ""), WithPprof()); err == nil {
+		t.Errorf("NewInstance() with WithPprof but no client CA error = nil, want an error")
+	}
+
+	tests := []struct {
+		name   string
+		opts   []Option
+		path   string
+		noCert bool
+		code   int
+		body   string
+	}{
+		{name: "disabled index", path: "/debug/pprof/", code: http.StatusNotFound},
+		{name: "disabled profile", path: "/debug/pprof/goroutine", code: http.StatusNotFound},
+		{name: "index", opts: pprof, path: "/debug/pprof/", code: http.StatusOK, body: "goroutine"},
+		{name: "profile", opts: pprof, path: "/debug/pprof/goroutine?debug=1", code: http.StatusOK, body: "goroutine profile:"},
+		{name: "cmdline", opts: pprof, path: "/debug/pprof/cmdline", code: http.StatusOK},
+		{name: "no client certificate", opts: pprof, path: "/debug/pprof/cmdline", noCert: true, code: http.StatusUnauthorized},
+		{name: "below the base path", opts: append([]Option{WithBasePath("/k8s")}, pprof...), path: "/k8s/debug/pprof/goroutine?debug=1", code: http.StatusOK, body: "goroutine profile:"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestInstance(t, tt.opts...)
+
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if !tt.noCert {
+				req = verified(req, cert)
+			}
+
+			res := httptest.NewRecorder()
+			s.h.ServeHTTP(res, req)
+
+			if res.Code != tt.code {
+				t.Fatalf("GET %s = %d, want %d", tt.path, res.Code, tt.code)
+			}
+
+			if !strings.Contains(res.Body.String(), tt.body) {
+				t.Errorf("GET %s body = %.200q, want it to contain %q", tt.path, res.Body.String(), tt.body)
+			}
+		})
+	}
+}
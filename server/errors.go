@@ -5,44 +5,180 @@ import (
 	"net/http"
 )
 
+// ServerError is an error answered to the client along with its http status code
 type ServerError struct {
-	e error
-	s int
+	// name identifies the error when overriding its status code, see WithStatusCodes
+	name string
+	e    error
+	s    int
+}
+
+// Error return the message sent to the client
+func (s *ServerError) Error() string {
+	return s.e.Error()
+}
+
+// Code return the default http status code sent to the client, see WithStatusCodes
+func (s *ServerError) Code() int {
+	return s.s
+}
+
+// Name return the name identifying the error when overriding its status code
+func (s *ServerError) Name() string {
+	return s.name
+}
+
+// errorResponse is the json body of the responses written by writeError
+type errorResponse struct {
+	Error string `json:"error"`
+	Code  int    `json:"code"`
 }
 
 var (
 	ErrServerError = &ServerError{
-		e: errors.New(http.StatusText(http.StatusInternalServerError)),
-		s: http.StatusInternalServerError,
+		name: "server_error",
+		e:    errors.New(http.StatusText(http.StatusInternalServerError)),
+		s:    http.StatusInternalServerError,
 	}
 	// ErrNotAcceptable means that the request is not acceptable because of it's content-type, language or encoding
 	ErrNotAcceptable = &ServerError{
-		e: errors.New(http.StatusText(http.StatusNotAcceptable)),
-		s: http.StatusNotAcceptable,
+		name: "not_acceptable",
+		e:    errors.New(http.StatusText(http.StatusNotAcceptable)),
+		s:    http.StatusNotAcceptable,
 	}
 	// ErrDecodeFailed means the request body could not be decoded
 	ErrDecodeFailed = &ServerError{
-		e: errors.New("Failed Decoding Request Body"),
-		s: http.StatusBadRequest,
+		name: "decode_failed",
+		e:    errors.New("Failed Decoding Request Body"),
+		s:    http.StatusBadRequest,
+	}
+	// ErrRequestTooLarge means the request body is larger than the configured maximum size
+	ErrRequestTooLarge = &ServerError{
+		name: "request_too_large",
+		e:    errors.New(http.StatusText(http.StatusRequestEntityTooLarge)),
+		s:    http.StatusRequestEntityTooLarge,
 	}
 	// ErrMalformedCredentials
 	ErrMalformedCredentials = &ServerError{
-		e: errors.New("Malformed Credential Object"),
-		s: http.StatusBadRequest,
+		name: "malformed_credentials",
+		e:    errors.New("Malformed Credential Object"),
+		s:    http.StatusBadRequest,
 	}
 	// ErrMalformedToken
 	ErrMalformedToken = &ServerError{
-		e: errors.New("Malformed Token Object"),
-		s: http.StatusBadRequest,
+		name: "malformed_token",
+		e:    errors.New("Malformed Token Object"),
+		s:    http.StatusBadRequest,
+	}
+	// ErrNotATokenReview means the /token request body is not a TokenReview
+	ErrNotATokenReview = &ServerError{
+		name: "not_a_token_review",
+		e:    errors.New("Not A TokenReview Object"),
+		s:    http.StatusBadRequest,
+	}
+	// ErrUnsupportedVersion means the TokenReview apiVersion is not supported
+	ErrUnsupportedVersion = &ServerError{
+		name: "unsupported_version",
+		e:    errors.New("Unsupported TokenReview Version"),
+		s:    http.StatusBadRequest,
 	}
 	// ErrUnauthorized
 	ErrUnauthorized = &ServerError{
-		e: errors.New(http.StatusText(http.StatusUnauthorized)),
-		s: http.StatusUnauthorized,
+		name: "unauthorized",
+		e:    errors.New(http.StatusText(http.StatusUnauthorized)),
+		s:    http.StatusUnauthorized,
+	}
+	// ErrGatewayTimeout means the ldap server did not answer in time
+	ErrGatewayTimeout = &ServerError{
+		name: "gateway_timeout",
+		e:    errors.New(http.StatusText(http.StatusGatewayTimeout)),
+		s:    http.StatusGatewayTimeout,
+	}
+	// ErrServiceUnavailable means the ldap server could not be reached or used, the credentials
+	// were not checked
+	ErrServiceUnavailable = &ServerError{
+		name: "service_unavailable",
+		e:    errors.New(http.StatusText(http.StatusServiceUnavailable)),
+		s:    http.StatusServiceUnavailable,
 	}
 	// ErrForbidden
 	ErrForbidden = &ServerError{
-		e: errors.New(http.StatusText(http.StatusForbidden)),
-		s: http.StatusForbidden,
+		name: "forbidden",
+		e:    errors.New(http.StatusText(http.StatusForbidden)),
+		s:    http.StatusForbidden,
+	}
+	// ErrUserNotFound means the user of /groups/{username} is not in the directory
+	ErrUserNotFound = &ServerError{
+		name: "user_not_found",
+		e:    errors.New("User Not Found"),
+		s:    http.StatusNotFound,
+	}
+	// ErrRealmNotFound means the /auth/{realm} realm is not one of the server, see WithRealm
+	ErrRealmNotFound = &ServerError{
+		name: "realm_not_found",
+		e:    errors.New("Realm Not Found"),
+		s:    http.StatusNotFound,
+	}
+	// ErrMethodNotAllowed means the route exists but does not accept the request method
+	ErrMethodNotAllowed = &ServerError{
+		name: "method_not_allowed",
+		e:    errors.New(http.StatusText(http.StatusMethodNotAllowed)),
+		s:    http.StatusMethodNotAllowed,
 	}
 )
+
+// ServerErrors return every ServerError answered by the server, along with their default
+// status codes, for auditing them or overriding them with WithStatusCodes:
+//
+//	name                   code  answered when
+//	server_error           500   an unexpected error occurred
+//	not_acceptable         406   the request or accepted content type is not json
+//	decode_failed          400   the request body is not valid json
+//	request_too_large      413   the request body is larger than the maximum size
+//	malformed_credentials  400   the /auth credentials or ExecCredential are malformed
+//	malformed_token        400   the TokenReview token is not a token
+//	not_a_token_review     400   the /token request body is not a TokenReview
+//	unsupported_version    400   the TokenReview apiVersion is not supported
+//	unauthorized           401   the credentials or the token are invalid
+//	gateway_timeout        504   the ldap server did not answer in time
+//	service_unavailable    503   the ldap server could not be reached or used
+//	forbidden              403   not answered by the current routes
+//	user_not_found         404   the /groups/{username} user is unknown
+//	realm_not_found        404   the /auth/{realm} realm is unknown
+//	method_not_allowed     405   the route does not accept the request method
+//
+// The middlewares answering on their own, ie. the rate limiter, are not ServerErrors.
+func ServerErrors() []*ServerError {
+	return []*ServerError{
+		ErrServerError,
+		ErrNotAcceptable,
+		ErrDecodeFailed,
+		ErrRequestTooLarge,
+		ErrMalformedCredentials,
+		ErrMalformedToken,
+		ErrNotATokenReview,
+		ErrUnsupportedVersion,
+		ErrUnauthorized,
+		ErrGatewayTimeout,
+		ErrServiceUnavailable,
+		ErrForbidden,
+		ErrUserNotFound,
+		ErrRealmNotFound,
+		ErrMethodNotAllowed,
+	}
+}
+
+// statusCode return the status code answered for e, its default one unless overridden
+func (s *Instance) statusCode(e *ServerError) int {
+	if code, ok := s.statusCodes[e.name]; ok {
+		return code
+	}
+
+	return e.s
+}
+
+// isTooLarge tells whether err was returned by a body wrapped by http.MaxBytesReader that
+// reached its limit
+func isTooLarge(err error) bool {
+	return err != nil && err.Error() == "http: request body too large"
+}
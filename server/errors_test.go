@@ -0,0 +1,65 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestStatusCodes(t *testing.T) {
+	tests := []struct {
+		name  string
+		codes map[string]int
+		// code is the status of a /token request that is not json
+		code int
+	}{
+		{name: "default", code: http.StatusNotAcceptable},
+		{name: "overridden", codes: map[string]int{"not_acceptable": http.StatusBadRequest}, code: http.StatusBadRequest},
+		{name: "other error overridden", codes: map[string]int{"unauthorized": http.StatusForbidden}, code: http.StatusNotAcceptable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestInstance(t, WithStatusCodes(tt.codes))
+
+			req := httptest.NewRequest(http.MethodPost, "/token", strings.NewReader("token=junk"))
+			req.Header.Set(ContentTypeHeader, "application/x-www-form-urlencoded")
+
+			res := httptest.NewRecorder()
+			s.h.ServeHTTP(res, req)
+
+			if res.Code != tt.code {
+				t.Errorf("POST /token = %d, want %d", res.Code, tt.code)
+			}
+
+			// the body reports the status actually answered
+			var body errorResponse
+			if err := json.NewDecoder(res.Body).Decode(&body); err != nil || body.Code != tt.code {
+				t.Errorf("POST /token body = %+v, %v, want code %d", body, err, tt.code)
+			}
+		})
+	}
+
+	for _, codes := range []map[string]int{
+		{"not_a_server_error": http.StatusBadRequest},
+		{"not_acceptable": http.StatusOK},
+		{"not_acceptable": 600},
+	} {
+		if _, err := NewInstance(WithKey("", ""), WithStatusCodes(codes)); err == nil {
+			t.Errorf("NewInstance() with the status codes %v error = nil, want an error", codes)
+		}
+	}
+}
+
+func TestServerErrorNames(t *testing.T) {
+	seen := map[string]bool{}
+
+	for _, e := range ServerErrors() {
+		if e.Name() == "" || seen[e.Name()] {
+			t.Errorf("ServerError %q has an empty or duplicated name", e.Error())
+		}
+		seen[e.Name()] = true
+	}
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	machinery "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientv1 "k8s.io/client-go/pkg/apis/clientauthentication/v1"
+	clientv1beta1 "k8s.io/client-go/pkg/apis/clientauthentication/v1beta1"
+)
+
+const (
+	// ExecCredentialV1 is the apiVersion of the ExecCredential sent to kubectl 1.22 and later
+	ExecCredentialV1 = "client.authentication.k8s.io/v1"
+	// ExecCredentialV1beta1 is the apiVersion of the ExecCredential sent by default
+	ExecCredentialV1beta1 = "client.authentication.k8s.io/v1beta1"
+
+	execCredentialKind = "ExecCredential"
+)
+
+// supportedExecCredential tells whether the ExecCredential apiVersion can be answered
+func supportedExecCredential(version string) bool {
+	return version == ExecCredentialV1 || version == ExecCredentialV1beta1
+}
+
+// execCredential return an ExecCredential of the given apiVersion holding the token, or no
+// status at all when the token is empty
+func execCredential(version, token string, expiration time.Time) interface{} {
+	if version == ExecCredentialV1 {
+		ec := clientv1.ExecCredential{
+			TypeMeta: machinery.TypeMeta{Kind: execCredentialKind, APIVersion: ExecCredentialV1},
+		}
+
+		if token != "" {
+			ec.Status = &clientv1.ExecCredentialStatus{
+				Token:               token,
+				ExpirationTimestamp: &machinery.Time{Time: expiration},
+			}
+		}
+
+		return ec
+	}
+
+	ec := clientv1beta1.ExecCredential{
+		TypeMeta: machinery.TypeMeta{Kind: execCredentialKind, APIVersion: ExecCredentialV1beta1},
+	}
+
+	if token != "" {
+		ec.Status = &clientv1beta1.ExecCredentialStatus{
+			Token:               token,
+			ExpirationTimestamp: &machinery.Time{Time: expiration},
+		}
+	}
+
+	return ec
+}
+
+func writeExecCredential(res http.ResponseWriter, version, token string, expiration time.Time) {
+	res.Header().Set(ContentTypeHeader, ContentTypeJSON)
+	json.NewEncoder(res).Encode(execCredential(version, token, expiration))
+}
+
+func (s *Instance) writeExecCredentialError(res http.ResponseWriter, version string, e *ServerError) {
+	res.Header().Set(ContentTypeHeader, ContentTypeJSON)
+	res.WriteHeader(s.statusCode(e))
+	json.NewEncoder(res).Encode(execCredential(version, "", time.Time{}))
+}
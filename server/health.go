@@ -0,0 +1,65 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/etherlabsio/healthcheck/v2"
+)
+
+const (
+	healthTimeout = 5 * time.Second
+	// livenessPoolTimeout is how long /healthz waits for a pooled connection to be released
+	livenessPoolTimeout = time.Second
+)
+
+// liveness tells the process is up and serving requests. When the searcher is a PoolChecker,
+// it also fails when no pooled connection is released within livenessPoolTimeout, so that a
+// server whose connections are all stuck is restarted. The directory itself is not checked,
+// see readiness. The searchers of the realms are checked as well, see WithRealm.
+func (s *Instance) liveness() http.Handler {
+	opts := []healthcheck.Option{
+		healthcheck.WithTimeout(healthTimeout),
+	}
+
+	for _, r := range s.searchers() {
+		if p, ok := r.searcher.(PoolChecker); ok {
+			opts = append(opts, healthcheck.WithChecker(r.checkName("ldap-pool"), healthcheck.CheckerFunc(
+				func(ctx context.Context) error {
+					ctx, cancel := context.WithTimeout(ctx, livenessPoolTimeout)
+					defer cancel()
+
+					return p.CheckPool(ctx)
+				},
+			)))
+		}
+	}
+
+	return healthcheck.Handler(opts...)
+}
+
+// readiness tells the server can actually authenticate users, it binds to the ldap server
+// as the service account and signs a payload with the signing key, answering with a 503
+// when the directory is unreachable or the key is missing or broken. The directory is only
+// checked when the searcher is a Pinger, the directory of every realm is checked as well.
+func (s *Instance) readiness() http.Handler {
+	opts := []healthcheck.Option{
+		healthcheck.WithTimeout(healthTimeout),
+		healthcheck.WithChecker(
+			"key", healthcheck.CheckerFunc(
+				func(_ context.Context) error {
+					return s.k.Check()
+				},
+			),
+		),
+	}
+
+	for _, r := range s.searchers() {
+		if p, ok := r.searcher.(Pinger); ok {
+			opts = append(opts, healthcheck.WithChecker(r.checkName("ldap"), healthcheck.CheckerFunc(p.Ping)))
+		}
+	}
+
+	return healthcheck.Handler(opts...)
+}
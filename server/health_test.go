@@ -0,0 +1,54 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"vbouchaud/k8s-ldap-auth/ldap"
+)
+
+func TestLivenessPoolExhausted(t *testing.T) {
+	srv := directory(t)
+	s := newTestInstance(t, withDirectory(srv, ldap.WithPool(1, time.Minute), ldap.WithOperationTimeout(time.Minute)))
+
+	res := httptest.NewRecorder()
+	s.h.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if res.Code != http.StatusOK {
+		t.Fatalf("GET /healthz = %d, want %d", res.Code, http.StatusOK)
+	}
+
+	// the only connection of the pool is stuck in a search the server never answers
+	srv.StallSearches()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.l.Search(ctx, "john", "secret")
+	}()
+	defer func() { cancel(); <-done }()
+
+	// the search holds the connection once bound, /healthz fails as soon as it does
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		res = httptest.NewRecorder()
+		s.h.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+		if res.Code == http.StatusServiceUnavailable || time.Now().After(deadline) {
+			break
+		}
+	}
+
+	if res.Code != http.StatusServiceUnavailable {
+		t.Fatalf("GET /healthz with an exhausted pool = %d, want %d", res.Code, http.StatusServiceUnavailable)
+	}
+
+	if !strings.Contains(res.Body.String(), "ldap-pool") {
+		t.Errorf("GET /healthz body = %s, want the ldap-pool error", res.Body.String())
+	}
+}
@@ -0,0 +1,24 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"vbouchaud/k8s-ldap-auth/types"
+)
+
+// jwks serves the public half of the signing and retired keys as a JWK Set so that the
+// tokens can be verified without calling /token
+func (s *Instance) jwks() http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		set, err := types.PublicJWKS(s.verificationKeys()...)
+		if err != nil {
+			s.logger(req).Error().Err(err).Msg("Could not build the JWK Set.")
+			s.writeError(res, ErrServerError)
+			return
+		}
+
+		res.Header().Set(ContentTypeHeader, ContentTypeJSON)
+		json.NewEncoder(res).Encode(set)
+	}
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+type failures struct {
+	count       int
+	last        time.Time
+	lockedUntil time.Time
+}
+
+// lockout locks a username out after threshold consecutive failed authentications, each
+// within window of the previous one. The username stays locked for window after the last
+// failure, whatever the source of the attempts.
+type lockout struct {
+	mu        sync.Mutex
+	users     map[string]*failures
+	threshold int
+	window    time.Duration
+}
+
+func newLockout(threshold int, window time.Duration) *lockout {
+	return &lockout{
+		users:     map[string]*failures{},
+		threshold: threshold,
+		window:    window,
+	}
+}
+
+// locked tells whether the username is currently locked out
+func (l *lockout) locked(username string) bool {
+	if l == nil {
+		return false
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	f, ok := l.users[strings.ToLower(username)]
+
+	return ok && time.Now().Before(f.lockedUntil)
+}
+
+// failure record a failed authentication of username
+func (l *lockout) failure(username string) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.purge(now)
+
+	key := strings.ToLower(username)
+	f, ok := l.users[key]
+	if !ok || now.Sub(f.last) > l.window {
+		f = &failures{}
+		l.users[key] = f
+	}
+
+	f.count++
+	f.last = now
+
+	if f.count >= l.threshold {
+		f.lockedUntil = now.Add(l.window)
+	}
+}
+
+// success reset the failures of username
+func (l *lockout) success(username string) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.users, strings.ToLower(username))
+}
+
+// purge forget the users whose failures are too old to matter anymore
+func (l *lockout) purge(now time.Time) {
+	for k, f := range l.users {
+		if now.Sub(f.last) > l.window && now.After(f.lockedUntil) {
+			delete(l.users, k)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestLockout(t *testing.T) {
+	l := newLockout(3, time.Minute)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l.failure("john")
+		}()
+	}
+	wg.Wait()
+
+	if l.locked("john") {
+		t.Fatalf("locked() = true under the threshold, want false")
+	}
+
+	l.failure("John")
+
+	if !l.locked("john") {
+		t.Fatalf("locked() = false at the threshold, want true")
+	}
+
+	if l.locked("jane") {
+		t.Errorf("locked() = true for another user, want false")
+	}
+
+	l.success("john")
+
+	if l.locked("john") {
+		t.Errorf("locked() = true after a success, want false")
+	}
+}
+
+func TestLockoutExpires(t *testing.T) {
+	l := newLockout(1, 50*time.Millisecond)
+
+	l.failure("john")
+	if !l.locked("john") {
+		t.Fatalf("locked() = false at the threshold, want true")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	if l.locked("john") {
+		t.Errorf("locked() = true after the window, want false")
+	}
+}
+
+func TestLockoutConcurrency(t *testing.T) {
+	l := newLockout(100, time.Minute)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				l.failure("john")
+				l.locked("john")
+				if i%10 == 0 {
+					l.success("jane")
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if !l.locked("john") {
+		t.Errorf("locked() = false after 500 failures, want true")
+	}
+}
+
+func TestAuthenticateLockedOut(t *testing.T) {
+	s := newTestInstance(t, WithMetrics(prometheus.NewRegistry()), WithLockout(1, time.Minute))
+	s.lockout.failure("john")
+
+	req := httptest.NewRequest(http.MethodPost, "/auth", strings.NewReader(`{"username":"john","password":"secret"}`))
+	req.Header.Set(ContentTypeHeader, ContentTypeJSON)
+
+	res := httptest.NewRecorder()
+	s.h.ServeHTTP(res, req)
+
+	if res.Code != http.StatusUnauthorized {
+		t.Errorf("POST /auth = %d, want %d", res.Code, http.StatusUnauthorized)
+	}
+
+	if got := testutil.ToFloat64(s.metrics.authentications.WithLabelValues(reasonLockedOut)); got != 1 {
+		t.Errorf("locked out authentications = %v, want 1", got)
+	}
+
+	if got := testutil.ToFloat64(s.metrics.authentications.WithLabelValues(reasonDirectoryUnavailable)); got != 0 {
+		t.Errorf("ldap was contacted for a locked out user")
+	}
+}
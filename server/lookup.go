@@ -0,0 +1,74 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+
+	"vbouchaud/k8s-ldap-auth/ldap"
+)
+
+// groupsResponse is the json body of the /groups/{username} responses
+type groupsResponse struct {
+	Username string   `json:"username"`
+	Groups   []string `json:"groups"`
+}
+
+// groupLookupHandler answer the groups a token of the user would hold, looked up with the
+// service account only. It neither checks a password nor issues a token, so it is only
+// served to the clients presenting a certificate, see WithGroupLookup.
+func (s *Instance) groupLookupHandler(looker GroupLooker) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		logger := s.logger(req)
+
+		ctx, span := s.startSpan(req, "lookupGroups")
+		defer span.End()
+
+		username := mux.Vars(req)["username"]
+		span.SetAttributes(attribute.String("enduser.id", username))
+
+		// the client is known to have a verified certificate, see RequireClientCert
+		client := req.TLS.VerifiedChains[0][0].Subject.CommonName
+
+		groups, err := looker.LookupGroups(ctx, username)
+		if err != nil {
+			span.SetStatus(codes.Error, err.Error())
+
+			switch {
+			case errors.Is(err, ldap.ErrUserNotFound):
+				logger.Info().Str("username", username).Str("client", client).Msg("Group lookup of an unknown user.")
+				s.writeError(res, ErrUserNotFound)
+			case errors.Is(err, ldap.ErrTimeout):
+				logger.Error().Err(err).Str("username", username).Msg("Ldap server did not answer the group lookup in time.")
+				s.writeError(res, ErrGatewayTimeout)
+			case errors.Is(err, ldap.ErrDirectoryUnavailable), errors.Is(err, ldap.ErrTooManySearches):
+				logger.Error().Err(err).Str("username", username).Msg("Could not look the user groups up.")
+				s.writeError(res, ErrServiceUnavailable)
+			case errors.Is(err, context.Canceled):
+				logger.Info().Str("username", username).Msg("Group lookup canceled.")
+				s.writeError(res, ErrServiceUnavailable)
+			default:
+				logger.Error().Err(err).Str("username", username).Msg("Group lookup failed.")
+				s.writeError(res, ErrServerError)
+			}
+			return
+		}
+
+		// every lookup is logged along with the client, the endpoint telling who is a member
+		// of which groups
+		logger.Info().Str("username", username).Str("client", client).Int("groups", len(groups)).Msg("Looked the user groups up.")
+
+		if groups == nil {
+			groups = []string{}
+		}
+
+		res.Header().Set(ContentTypeHeader, ContentTypeJSON)
+		res.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(res).Encode(groupsResponse{Username: username, Groups: groups})
+	}
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestGroupLookup(t *testing.T) {
+	srv := directory(t)
+	certPEM, serverKeyPEM := selfSignedPEM(t)
+	caPEM, cert := clientCert(t)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := ioutil.WriteFile(caFile, caPEM, 0600); err != nil {
+		t.Fatalf("Failed to write CA, %s", err)
+	}
+
+	client, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatalf("Failed to parse the client certificate, %s", err)
+	}
+
+	s := newTestInstance(t, withDirectory(srv), WithTLSPEM(certPEM, serverKeyPEM), WithClientCAFile(caFile), WithGroupLookup())
+
+	tests := []struct {
+		name     string
+		username string
+		verified bool
+		code     int
+		want     []string
+	}{
+		{name: "known user", username: "john", verified: true, code: http.StatusOK, want: []string{"cn=admins,ou=groups,dc=corp"}},
+		{name: "unknown user", username: "jane", verified: true, code: ErrUserNotFound.Code()},
+		{name: "without client certificate", username: "john", code: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/groups/"+tt.username, nil)
+			if tt.verified {
+				req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{client}}}
+			}
+
+			res := httptest.NewRecorder()
+			s.h.ServeHTTP(res, req)
+
+			if res.Code != tt.code {
+				t.Fatalf("GET /groups/%s = %d, want %d", tt.username, res.Code, tt.code)
+			}
+
+			if tt.code != http.StatusOK {
+				return
+			}
+
+			var body groupsResponse
+			if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+				t.Fatalf("Failed to decode the groups, %s", err)
+			}
+
+			if body.Username != tt.username || !reflect.DeepEqual(body.Groups, tt.want) {
+				t.Errorf("GET /groups/%s = %+v, want the groups %v", tt.username, body, tt.want)
+			}
+		})
+	}
+
+	// the lookup is not an authentication, the user was never bound as
+	for _, dn := range srv.Binds() {
+		if dn != "cn=admin,dc=corp" {
+			t.Errorf("The group lookup bound as %s, want the service account only", dn)
+		}
+	}
+}
+
+func TestGroupLookupRequirements(t *testing.T) {
+	certPEM, serverKeyPEM := selfSignedPEM(t)
+	caPEM, _ := clientCert(t)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := ioutil.WriteFile(caFile, caPEM, 0600); err != nil {
+		t.Fatalf("Failed to write CA, %s", err)
+	}
+
+	tests := []struct {
+		name string
+		opts []Option
+	}{
+		{name: "without client certificates", opts: []Option{withDirectory(directory(t)), WithGroupLookup()}},
+		{name: "searcher without lookup", opts: []Option{WithSearcher(fakeSearcher{}), WithTLSPEM(certPEM, serverKeyPEM), WithClientCAFile(caFile), WithGroupLookup()}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewInstance(append([]Option{WithKey("", "")}, tt.opts...)...); err == nil {
+				t.Errorf("NewInstance() error = nil, want an error")
+			}
+		})
+	}
+}
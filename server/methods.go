@@ -0,0 +1,39 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// methodNotAllowed answer the requests to a route with a method it does not accept, listing
+// the methods the matching routes accept in the Allow header
+func (s *Instance) methodNotAllowed(r *mux.Router) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		var allowed []string
+
+		r.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+			methods, err := route.GetMethods()
+			if err != nil {
+				// the route accepts any method
+				return nil
+			}
+
+			for _, method := range methods {
+				probe := req.Clone(req.Context())
+				probe.Method = method
+
+				var match mux.RouteMatch
+				if route.Match(probe, &match) && !containsFold(allowed, method) {
+					allowed = append(allowed, method)
+				}
+			}
+
+			return nil
+		})
+
+		res.Header().Set("Allow", strings.Join(allowed, ", "))
+		s.writeError(res, ErrMethodNotAllowed)
+	})
+}
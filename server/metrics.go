@@ -0,0 +1,117 @@
+package server
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	reasonSuccess              = "success"
+	reasonNotAcceptable        = "not_acceptable"
+	reasonDecodeFailed         = "decode_failed"
+	reasonTooLarge             = "too_large"
+	reasonMalformedCredentials = "malformed_credentials"
+	reasonUserNotFound         = "user_not_found"
+	reasonInvalidCredentials   = "invalid_credentials"
+	reasonDirectoryUnavailable = "directory_unavailable"
+	reasonTimeout              = "timeout"
+	reasonCanceled             = "canceled"
+	reasonLockedOut            = "locked_out"
+	reasonMalformedToken       = "malformed_token"
+	reasonExpired              = "expired"
+	reasonInvalidSignature     = "invalid_signature"
+	reasonRevoked              = "revoked"
+	reasonAudienceMismatch     = "audience_mismatch"
+	reasonGroupDenied          = "group_denied"
+	reasonTooManyGroups        = "too_many_groups"
+	reasonNoGroups             = "no_groups"
+	reasonTooManyEntries       = "too_many_entries"
+	reasonTooManySearches      = "too_many_searches"
+	reasonSessionExpired       = "session_expired"
+	reasonUnsupportedVersion   = "unsupported_version"
+	reasonUnknownRealm         = "unknown_realm"
+	reasonError                = "error"
+)
+
+type metrics struct {
+	authentications *prometheus.CounterVec
+	validations     *prometheus.CounterVec
+	refreshes       *prometheus.CounterVec
+	userinfos       *prometheus.CounterVec
+}
+
+func newMetrics(reg prometheus.Registerer) (*metrics, error) {
+	m := &metrics{
+		authentications: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "k8s_ldap_auth",
+				Name:      "authentications_total",
+				Help:      "Number of authentication requests received on /auth, by outcome.",
+			},
+			[]string{"reason"},
+		),
+		validations: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "k8s_ldap_auth",
+				Name:      "token_validations_total",
+				Help:      "Number of TokenReview received on /token, by outcome.",
+			},
+			[]string{"reason"},
+		),
+		refreshes: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "k8s_ldap_auth",
+				Name:      "token_refreshes_total",
+				Help:      "Number of refresh requests received on /refresh, by outcome.",
+			},
+			[]string{"reason"},
+		),
+		userinfos: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "k8s_ldap_auth",
+				Name:      "userinfo_requests_total",
+				Help:      "Number of userinfo requests received on /userinfo, by outcome.",
+			},
+			[]string{"reason"},
+		),
+	}
+
+	for _, c := range []prometheus.Collector{m.authentications, m.validations, m.refreshes, m.userinfos} {
+		if err := reg.Register(c); err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+func (m *metrics) authentication(reason string) {
+	if m == nil {
+		return
+	}
+
+	m.authentications.WithLabelValues(reason).Inc()
+}
+
+func (m *metrics) validation(reason string) {
+	if m == nil {
+		return
+	}
+
+	m.validations.WithLabelValues(reason).Inc()
+}
+
+func (m *metrics) refresh(reason string) {
+	if m == nil {
+		return
+	}
+
+	m.refreshes.WithLabelValues(reason).Inc()
+}
+
+func (m *metrics) userinfo(reason string) {
+	if m == nil {
+		return
+	}
+
+	m.userinfos.WithLabelValues(reason).Inc()
+}
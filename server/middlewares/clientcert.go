@@ -0,0 +1,28 @@
+package middlewares
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/rs/zerolog/log"
+)
+
+// RequireClientCert provide an HTTP server middleware answering a 401 to the requests that
+// did not present a client certificate verified by the server TLS configuration
+func RequireClientCert(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 {
+			log.Info().Str("ip", ClientIP(req, false)).Str("url", req.URL.Path).Msg("Request without a verified client certificate.")
+
+			res.Header().Set("Content-Type", "application/json")
+			res.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(res).Encode(map[string]interface{}{
+				"error": http.StatusText(http.StatusUnauthorized),
+				"code":  http.StatusUnauthorized,
+			})
+			return
+		}
+
+		next.ServeHTTP(res, req)
+	})
+}
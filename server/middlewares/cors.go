@@ -0,0 +1,44 @@
+package middlewares
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// CORS provide an HTTP server middleware allowing the given origins, "*" allowing any, to
+// call the server from a browser with the given methods and headers. Preflight requests from
+// an allowed origin are answered directly, requests from other origins get no CORS header.
+func CORS(origins, methods, headers []string) mux.MiddlewareFunc {
+	allowed := map[string]bool{}
+	for _, o := range origins {
+		allowed[o] = true
+	}
+
+	allowMethods := strings.Join(methods, ", ")
+	allowHeaders := strings.Join(headers, ", ")
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			origin := req.Header.Get("Origin")
+			if origin == "" || !(allowed["*"] || allowed[origin]) {
+				next.ServeHTTP(res, req)
+				return
+			}
+
+			res.Header().Set("Access-Control-Allow-Origin", origin)
+			res.Header().Add("Vary", "Origin")
+
+			if req.Method == http.MethodOptions && req.Header.Get("Access-Control-Request-Method") != "" {
+				res.Header().Set("Access-Control-Allow-Methods", allowMethods)
+				res.Header().Set("Access-Control-Allow-Headers", allowHeaders)
+				res.Header().Set("Access-Control-Max-Age", "600")
+				res.WriteHeader(http.StatusNoContent)
+				return
+			}
+
+			next.ServeHTTP(res, req)
+		})
+	}
+}
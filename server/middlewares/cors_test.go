@@ -0,0 +1,87 @@
+package middlewares
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCORS(t *testing.T) {
+	handler := CORS([]string{"https://ui.corp"}, []string{"POST"}, []string{"Content-Type"})(
+		http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			res.WriteHeader(http.StatusOK)
+		}),
+	)
+
+	tests := []struct {
+		name        string
+		method      string
+		origin      string
+		preflight   bool
+		wantCode    int
+		wantOrigin  string
+		wantMethods string
+	}{
+		{
+			name:        "Preflight from an allowed origin",
+			method:      http.MethodOptions,
+			origin:      "https://ui.corp",
+			preflight:   true,
+			wantCode:    http.StatusNoContent,
+			wantOrigin:  "https://ui.corp",
+			wantMethods: "POST",
+		},
+		{
+			name:        "Simple POST from an allowed origin",
+			method:      http.MethodPost,
+			origin:      "https://ui.corp",
+			wantCode:    http.StatusOK,
+			wantOrigin:  "https://ui.corp",
+			wantMethods: "",
+		},
+		{
+			name:        "Preflight from another origin",
+			method:      http.MethodOptions,
+			origin:      "https://evil.corp",
+			preflight:   true,
+			wantCode:    http.StatusOK,
+			wantOrigin:  "",
+			wantMethods: "",
+		},
+		{
+			name:        "Same origin request",
+			method:      http.MethodPost,
+			origin:      "",
+			wantCode:    http.StatusOK,
+			wantOrigin:  "",
+			wantMethods: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/auth", nil)
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			if tt.preflight {
+				req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+			}
+
+			res := httptest.NewRecorder()
+			handler.ServeHTTP(res, req)
+
+			if res.Code != tt.wantCode {
+				t.Errorf("%s = %d, want %d", tt.method, res.Code, tt.wantCode)
+			}
+
+			if got := res.Header().Get("Access-Control-Allow-Origin"); got != tt.wantOrigin {
+				t.Errorf("Access-Control-Allow-Origin = %q, want %q", got, tt.wantOrigin)
+			}
+
+			if got := res.Header().Get("Access-Control-Allow-Methods"); got != tt.wantMethods {
+				t.Errorf("Access-Control-Allow-Methods = %q, want %q", got, tt.wantMethods)
+			}
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package middlewares
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// DefaultGzipMinSize is the size, in bytes, from which the responses are compressed
+const DefaultGzipMinSize = 1024
+
+// gzipWriter buffer the response until minSize bytes were written, the response is then
+// compressed. Smaller responses are written as is once the handler returns.
+type gzipWriter struct {
+	http.ResponseWriter
+	minSize int
+	code    int
+	buf     []byte
+	gz      *gzip.Writer
+	// started is set once the status code was written, compressed or not
+	started bool
+}
+
+func (w *gzipWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+}
+
+func (w *gzipWriter) Write(p []byte) (int, error) {
+	if w.started {
+		if w.gz != nil {
+			return w.gz.Write(p)
+		}
+
+		return w.ResponseWriter.Write(p)
+	}
+
+	w.buf = append(w.buf, p...)
+	if len(w.buf) < w.minSize {
+		return len(p), nil
+	}
+
+	w.start(w.Header().Get("Content-Encoding") == "")
+
+	buf := w.buf
+	w.buf = nil
+
+	if _, err := w.Write(buf); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// start write the status code, the response being compressed or not
+func (w *gzipWriter) start(compress bool) {
+	w.started = true
+
+	if compress {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Del("Content-Length")
+		w.gz = gzip.NewWriter(w.ResponseWriter)
+	}
+
+	if w.code != 0 {
+		w.ResponseWriter.WriteHeader(w.code)
+	}
+}
+
+// close write the responses smaller than minSize and flush the compressed ones
+func (w *gzipWriter) close() {
+	if !w.started {
+		w.start(false)
+		if len(w.buf) > 0 {
+			w.ResponseWriter.Write(w.buf)
+		}
+	}
+
+	if w.gz != nil {
+		w.gz.Close()
+	}
+}
+
+// acceptsGzip tells whether the Accept-Encoding header allows a gzip encoded response, ie.
+// "gzip, deflate" but neither "gzip;q=0" nor "identity"
+func acceptsGzip(header string) bool {
+	for _, item := range strings.Split(header, ",") {
+		parts := strings.Split(item, ";")
+
+		if name := strings.TrimSpace(parts[0]); !strings.EqualFold(name, "gzip") && name != "*" {
+			continue
+		}
+
+		for _, param := range parts[1:] {
+			param = strings.TrimSpace(param)
+			if !strings.HasPrefix(param, "q=") {
+				continue
+			}
+
+			if q, err := strconv.ParseFloat(param[len("q="):], 64); err != nil || q == 0 {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	return false
+}
+
+// Gzip provide an HTTP server middleware compressing the responses of at least minSize bytes
+// for the clients accepting it, ie. the TokenReviews of users member of many groups.
+// Responses that are already encoded are left untouched.
+func Gzip(minSize int) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			res.Header().Add("Vary", "Accept-Encoding")
+
+			if !acceptsGzip(req.Header.Get("Accept-Encoding")) {
+				next.ServeHTTP(res, req)
+				return
+			}
+
+			w := &gzipWriter{ResponseWriter: res, minSize: minSize}
+			defer w.close()
+
+			next.ServeHTTP(w, req)
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package middlewares
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGzip(t *testing.T) {
+	large := strings.Repeat(`{"groups":["admins","developers"]}`, 100)
+
+	tests := []struct {
+		name           string
+		acceptEncoding string
+		body           string
+		encoding       string
+		want           bool
+	}{
+		{name: "Large response", acceptEncoding: "gzip", body: large, want: true},
+		{name: "Among other encodings", acceptEncoding: "deflate, gzip;q=0.8", body: large, want: true},
+		{name: "Small response", acceptEncoding: "gzip", body: `{"groups":[]}`, want: false},
+		{name: "Not accepted", acceptEncoding: "", body: large, want: false},
+		{name: "Refused", acceptEncoding: "gzip;q=0, identity", body: large, want: false},
+		{name: "Already encoded", acceptEncoding: "gzip", body: large, encoding: "br", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := Gzip(DefaultGzipMinSize)(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+				if tt.encoding != "" {
+					res.Header().Set("Content-Encoding", tt.encoding)
+				}
+
+				res.WriteHeader(http.StatusCreated)
+
+				// written in several parts, crossing the threshold midway
+				half := len(tt.body) / 2
+				res.Write([]byte(tt.body[:half]))
+				res.Write([]byte(tt.body[half:]))
+			}))
+
+			req := httptest.NewRequest(http.MethodPost, "/token", nil)
+			if tt.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+
+			res := httptest.NewRecorder()
+			handler.ServeHTTP(res, req)
+
+			if res.Code != http.StatusCreated {
+				t.Errorf("status = %d, want %d", res.Code, http.StatusCreated)
+			}
+
+			if got := res.Header().Get("Vary"); got != "Accept-Encoding" {
+				t.Errorf("Vary = %q, want Accept-Encoding", got)
+			}
+
+			body := res.Body.String()
+			if got := res.Header().Get("Content-Encoding") == "gzip"; got != tt.want {
+				t.Fatalf("gzip encoded = %v, want %v", got, tt.want)
+			}
+
+			if tt.want {
+				r, err := gzip.NewReader(res.Body)
+				if err != nil {
+					t.Fatalf("Body is not gzip encoded, %s", err)
+				}
+
+				data, err := ioutil.ReadAll(r)
+				if err != nil {
+					t.Fatalf("Failed to decode the body, %s", err)
+				}
+
+				body = string(data)
+			}
+
+			if body != tt.body {
+				t.Errorf("body = %.50q, want %.50q", body, tt.body)
+			}
+		})
+	}
+}
@@ -1,12 +1,23 @@
 package middlewares
 
 import (
+	"fmt"
+	"io"
 	"net/http"
 	"time"
 
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
+const (
+	// FormatJSON log one json object per request
+	FormatJSON = "json"
+	// FormatText log one human readable line per request
+	FormatText = "text"
+)
+
 // ProxyResponseWriter is a workaround for getting HTTP Response information in the access logs
 // With the default ResponseWriter interface we only have methods to write the status code and parts of
 // the response content. But there's no properties to tell the current status of the response.
@@ -50,22 +61,43 @@ func (brs *ProxyResponseWriter) WriteHeader(code int) {
 // that are not implemented yet (%l should probably be ignore anymay).
 // You can find more information about this format here : https://httpd.apache.org/docs/2.4/logs.html
 func AccessLog(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
-		received := time.Now()
-		wrapper := NewProxyResponseWriter(res)
-		next.ServeHTTP(wrapper, req)
-		elapsed := time.Now().Sub(received)
+	return accessLog(log.Logger)(next)
+}
+
+// RequestLog provide the same middleware as AccessLog, logging to out in the given format,
+// FormatJSON or FormatText, instead of the global logger. The request and response bodies
+// are never logged.
+func RequestLog(out io.Writer, format string) (mux.MiddlewareFunc, error) {
+	switch format {
+	case FormatJSON:
+		return accessLog(zerolog.New(out).With().Timestamp().Logger()), nil
+	case FormatText:
+		return accessLog(zerolog.New(zerolog.ConsoleWriter{Out: out, NoColor: true}).With().Timestamp().Logger()), nil
+	}
 
-		log.Info().
-			Str("remoteaddr", req.RemoteAddr).
-			Str("method", req.Method).
-			Str("url", req.URL.String()).
-			Str("proto", req.Proto).
-			Int("code", wrapper.code).
-			Int("length", wrapper.length).
-			Str("referer", req.Header.Get("Referer")).
-			Str("useragent", req.Header.Get("User-Agent")).
-			Int64("elapsed", elapsed.Microseconds()).
-			Send()
-	})
+	return nil, fmt.Errorf("Unknown log format '%s', expected '%s' or '%s'", format, FormatJSON, FormatText)
+}
+
+func accessLog(logger zerolog.Logger) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			received := time.Now()
+			wrapper := NewProxyResponseWriter(res)
+			next.ServeHTTP(wrapper, req)
+			elapsed := time.Now().Sub(received)
+
+			logger.Info().
+				Str("request_id", GetRequestID(req.Context())).
+				Str("remoteaddr", req.RemoteAddr).
+				Str("method", req.Method).
+				Str("url", req.URL.String()).
+				Str("proto", req.Proto).
+				Int("code", wrapper.code).
+				Int("length", wrapper.length).
+				Str("referer", req.Header.Get("Referer")).
+				Str("useragent", req.Header.Get("User-Agent")).
+				Int64("elapsed", elapsed.Microseconds()).
+				Send()
+		})
+	}
 }
@@ -0,0 +1,81 @@
+package middlewares
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestLog(t *testing.T) {
+	handler := http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.WriteHeader(http.StatusTeapot)
+		res.Write([]byte("short and stout"))
+	})
+
+	newRequest := func() *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "/auth", strings.NewReader(`{"username":"john","password":"secret"}`))
+		req.RemoteAddr = "10.0.0.1:4242"
+		return req
+	}
+
+	t.Run("JSON", func(t *testing.T) {
+		var out bytes.Buffer
+		m, err := RequestLog(&out, FormatJSON)
+		if err != nil {
+			t.Fatalf("RequestLog() error = %s", err)
+		}
+
+		m(handler).ServeHTTP(httptest.NewRecorder(), newRequest())
+
+		var line map[string]interface{}
+		if err := json.Unmarshal(out.Bytes(), &line); err != nil {
+			t.Fatalf("Failed to decode log line %q, %s", out.String(), err)
+		}
+
+		want := map[string]interface{}{
+			"method":     "POST",
+			"url":        "/auth",
+			"remoteaddr": "10.0.0.1:4242",
+			"code":       float64(http.StatusTeapot),
+			"length":     float64(len("short and stout")),
+		}
+		for k, v := range want {
+			if line[k] != v {
+				t.Errorf("log %s = %v, want %v", k, line[k], v)
+			}
+		}
+
+		if _, ok := line["elapsed"]; !ok {
+			t.Errorf("log has no elapsed field")
+		}
+	})
+
+	t.Run("Text", func(t *testing.T) {
+		var out bytes.Buffer
+		m, err := RequestLog(&out, FormatText)
+		if err != nil {
+			t.Fatalf("RequestLog() error = %s", err)
+		}
+
+		m(handler).ServeHTTP(httptest.NewRecorder(), newRequest())
+
+		for _, want := range []string{"method=POST", "url=/auth", "code=418", "remoteaddr=10.0.0.1:4242"} {
+			if !strings.Contains(out.String(), want) {
+				t.Errorf("log %q does not contain %q", out.String(), want)
+			}
+		}
+
+		if strings.Contains(out.String(), "secret") {
+			t.Errorf("log %q contains the request body", out.String())
+		}
+	})
+
+	t.Run("Unknown format", func(t *testing.T) {
+		if _, err := RequestLog(&bytes.Buffer{}, "xml"); err == nil {
+			t.Errorf("RequestLog() error = nil, want an error")
+		}
+	})
+}
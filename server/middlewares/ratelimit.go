@@ -0,0 +1,109 @@
+package middlewares
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/time/rate"
+)
+
+// limiterIdleTimeout is how long the bucket of a client that stopped sending requests is kept
+const limiterIdleTimeout = 10 * time.Minute
+
+type clientLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+type rateLimiter struct {
+	mu         sync.Mutex
+	clients    map[string]*clientLimiter
+	limit      rate.Limit
+	burst      int
+	trustProxy bool
+	lastPurge  time.Time
+}
+
+// RateLimit provide an HTTP server middleware limiting the number of requests of each client
+// ip with a token bucket refilled with limit tokens per second, holding at most burst tokens.
+// Requests over the limit are answered with a 429. The client ip is read from the last
+// X-Forwarded-For value, as set by the proxy, only when trustProxy is set.
+func RateLimit(limit float64, burst int, trustProxy bool) mux.MiddlewareFunc {
+	l := &rateLimiter{
+		clients:    map[string]*clientLimiter{},
+		limit:      rate.Limit(limit),
+		burst:      burst,
+		trustProxy: trustProxy,
+		lastPurge:  time.Now(),
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			ip := ClientIP(req, l.trustProxy)
+
+			if !l.allow(ip) {
+				log.Info().Str("ip", ip).Msg("Rate limit exceeded.")
+
+				res.Header().Set("Content-Type", "application/json")
+				res.Header().Set("Retry-After", "1")
+				res.WriteHeader(http.StatusTooManyRequests)
+				json.NewEncoder(res).Encode(map[string]interface{}{
+					"error": http.StatusText(http.StatusTooManyRequests),
+					"code":  http.StatusTooManyRequests,
+				})
+				return
+			}
+
+			next.ServeHTTP(res, req)
+		})
+	}
+}
+
+func (l *rateLimiter) allow(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.lastPurge) > limiterIdleTimeout {
+		for k, c := range l.clients {
+			if now.Sub(c.lastSeen) > limiterIdleTimeout {
+				delete(l.clients, k)
+			}
+		}
+		l.lastPurge = now
+	}
+
+	c, ok := l.clients[ip]
+	if !ok {
+		c = &clientLimiter{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.clients[ip] = c
+	}
+	c.lastSeen = now
+
+	return c.limiter.Allow()
+}
+
+// ClientIP return the ip of the client that sent the request. When trustProxy is set and
+// the request went through a proxy, the last X-Forwarded-For value is used since it is the
+// one set by the proxy itself.
+func ClientIP(req *http.Request, trustProxy bool) string {
+	if trustProxy {
+		if xff := req.Header.Get("X-Forwarded-For"); xff != "" {
+			values := strings.Split(xff, ",")
+			return strings.TrimSpace(values[len(values)-1])
+		}
+	}
+
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+
+	return host
+}
@@ -0,0 +1,91 @@
+package middlewares
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimit(t *testing.T) {
+	handler := RateLimit(10, 2, false)(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.WriteHeader(http.StatusOK)
+	}))
+
+	send := func(remoteAddr string) int {
+		req := httptest.NewRequest(http.MethodPost, "/auth", nil)
+		req.RemoteAddr = remoteAddr
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		return res.Code
+	}
+
+	for i := 0; i < 2; i++ {
+		if code := send("10.0.0.1:1234"); code != http.StatusOK {
+			t.Fatalf("request %d = %d, want %d", i, code, http.StatusOK)
+		}
+	}
+
+	if code := send("10.0.0.1:5678"); code != http.StatusTooManyRequests {
+		t.Errorf("request over the burst = %d, want %d", code, http.StatusTooManyRequests)
+	}
+
+	if code := send("10.0.0.2:1234"); code != http.StatusOK {
+		t.Errorf("request from another client = %d, want %d", code, http.StatusOK)
+	}
+
+	// the bucket gets a token back every 100ms
+	time.Sleep(150 * time.Millisecond)
+
+	if code := send("10.0.0.1:1234"); code != http.StatusOK {
+		t.Errorf("request after the refill = %d, want %d", code, http.StatusOK)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name       string
+		xff        string
+		trustProxy bool
+		want       string
+	}{
+		{
+			name:       "No proxy",
+			xff:        "",
+			trustProxy: false,
+			want:       "10.0.0.1",
+		},
+		{
+			name:       "Untrusted X-Forwarded-For",
+			xff:        "192.168.0.1",
+			trustProxy: false,
+			want:       "10.0.0.1",
+		},
+		{
+			name:       "Trusted X-Forwarded-For",
+			xff:        "1.2.3.4, 192.168.0.1",
+			trustProxy: true,
+			want:       "192.168.0.1",
+		},
+		{
+			name:       "Trusted proxy without X-Forwarded-For",
+			xff:        "",
+			trustProxy: true,
+			want:       "10.0.0.1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/auth", nil)
+			req.RemoteAddr = "10.0.0.1:1234"
+			if tt.xff != "" {
+				req.Header.Set("X-Forwarded-For", tt.xff)
+			}
+
+			if got := ClientIP(req, tt.trustProxy); got != tt.want {
+				t.Errorf("ClientIP() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
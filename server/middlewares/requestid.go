@@ -0,0 +1,66 @@
+package middlewares
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+// RequestIDHeader is the header carrying the request id, read from the request and echoed in
+// the response
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength bound the size of the ids accepted from the clients
+const maxRequestIDLength = 128
+
+type requestIDKey struct{}
+
+// RequestID provide an HTTP server middleware identifying every request, so that a failed
+// authentication can be correlated with the server logs. The id given by the client in the
+// X-Request-ID header is kept when it is made of at most 128 printable ascii characters, a
+// random one is generated otherwise. The id is stored in the request context, see
+// GetRequestID, and set in the response header.
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		id := req.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+
+		res.Header().Set(RequestIDHeader, id)
+
+		next.ServeHTTP(res, req.WithContext(context.WithValue(req.Context(), requestIDKey{}, id)))
+	})
+}
+
+// GetRequestID return the id of the request set by RequestID, or an empty string
+func GetRequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+
+	return id
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		// a request must never fail for its id, it is only used to correlate logs
+		return "unknown"
+	}
+
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,52 @@
+package middlewares
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestRequestID(t *testing.T) {
+	generated := regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+	tests := []struct {
+		name   string
+		header string
+		// kept tells whether the id of the client is expected in the response
+		kept bool
+	}{
+		{name: "Id given by the client", header: "kubectl-1234", kept: true},
+		{name: "No id", header: ""},
+		{name: "Id with a space", header: "kubectl 1234"},
+		{name: "Id with a newline", header: "kubectl\n1234"},
+		{name: "Id too long", header: strings.Repeat("a", 129)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			handler := RequestID(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+				got = GetRequestID(req.Context())
+			}))
+
+			req := httptest.NewRequest(http.MethodPost, "/auth", nil)
+			req.Header.Set(RequestIDHeader, tt.header)
+
+			res := httptest.NewRecorder()
+			handler.ServeHTTP(res, req)
+
+			id := res.Header().Get(RequestIDHeader)
+			if id != got {
+				t.Errorf("%s = %q, want the id of the context %q", RequestIDHeader, id, got)
+			}
+
+			if tt.kept && id != tt.header {
+				t.Errorf("%s = %q, want %q", RequestIDHeader, id, tt.header)
+			} else if !tt.kept && !generated.MatchString(id) {
+				t.Errorf("%s = %q, want a generated id", RequestIDHeader, id)
+			}
+		})
+	}
+}
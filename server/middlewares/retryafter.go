@@ -0,0 +1,38 @@
+package middlewares
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryAfterHeader tells the clients how long to wait before retrying a request
+const RetryAfterHeader = "Retry-After"
+
+// retryAfterWriter set the Retry-After header of the 503 responses that do not have one
+type retryAfterWriter struct {
+	http.ResponseWriter
+	value string
+}
+
+func (w *retryAfterWriter) WriteHeader(code int) {
+	if code == http.StatusServiceUnavailable && w.Header().Get(RetryAfterHeader) == "" {
+		w.Header().Set(RetryAfterHeader, w.value)
+	}
+
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// RetryAfter provide an HTTP server middleware setting the Retry-After header of the 503
+// responses to delay, rounded up to the second, so that well-behaved clients back off while
+// the server is unavailable. Responses already carrying the header are left untouched.
+func RetryAfter(delay time.Duration) func(http.Handler) http.Handler {
+	value := strconv.Itoa(int(math.Ceil(delay.Seconds())))
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			next.ServeHTTP(&retryAfterWriter{ResponseWriter: res, value: value}, req)
+		})
+	}
+}
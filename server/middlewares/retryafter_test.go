@@ -0,0 +1,40 @@
+package middlewares
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		name   string
+		code   int
+		header string
+		want   string
+	}{
+		{name: "Service unavailable", code: http.StatusServiceUnavailable, want: "2"},
+		{name: "Already set", code: http.StatusServiceUnavailable, header: "60", want: "60"},
+		{name: "Other status", code: http.StatusUnauthorized, want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := RetryAfter(1500 * time.Millisecond)(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+				if tt.header != "" {
+					res.Header().Set(RetryAfterHeader, tt.header)
+				}
+
+				res.WriteHeader(tt.code)
+			}))
+
+			res := httptest.NewRecorder()
+			handler.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+			if got := res.Header().Get(RetryAfterHeader); got != tt.want {
+				t.Errorf("%s = %q, want %q", RetryAfterHeader, got, tt.want)
+			}
+		})
+	}
+}
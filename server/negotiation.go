@@ -0,0 +1,47 @@
+package server
+
+import (
+	"mime"
+	"strconv"
+	"strings"
+)
+
+// isJSON tells whether the Content-Type header value is json, whatever its parameters
+func isJSON(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+
+	return err == nil && mediaType == ContentTypeJSON
+}
+
+// acceptsJSON tells whether the Accept header value allows a json response, a missing Accept
+// header accepts anything
+func acceptsJSON(accept string) bool {
+	if strings.TrimSpace(accept) == "" {
+		return true
+	}
+
+	for _, value := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(value))
+		if err != nil {
+			continue
+		}
+
+		if q, ok := params["q"]; ok {
+			if weight, err := strconv.ParseFloat(q, 64); err == nil && weight == 0 {
+				continue
+			}
+		}
+
+		switch mediaType {
+		case ContentTypeJSON, "application/*", "*/*":
+			return true
+		}
+	}
+
+	return false
+}
+
+// negotiate tells whether the request is json and accepts a json response
+func negotiate(contentType, accept string) bool {
+	return isJSON(contentType) && acceptsJSON(accept)
+}
@@ -1,10 +1,20 @@
 package server
 
 import (
-	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/trace"
 
 	"vbouchaud/k8s-ldap-auth/ldap"
 	"vbouchaud/k8s-ldap-auth/server/middlewares"
@@ -16,37 +26,91 @@ type Option func(*Instance) error
 
 // WithLdap bind a ldap object to a server instance
 func WithLdap(
-	ldapURL,
+	ldapURLs []string,
 	bindDN,
-	bindPassword,
-	searchBase,
+	bindPassword string,
+	searchBases []string,
 	searchScope,
 	searchFilter,
 	memberofProperty,
 	usernameProperty string,
-	extraAttributes []string) Option {
+	extraAttributes []string,
+	opts ...ldap.Option) Option {
 	return func(i *Instance) error {
-		i.l = ldap.NewInstance(
-			ldapURL,
+		l, err := ldap.NewInstance(
+			ldapURLs,
 			bindDN,
 			bindPassword,
-			searchBase,
+			searchBases,
 			searchScope,
 			searchFilter,
 			memberofProperty,
 			usernameProperty,
 			extraAttributes,
 			append(extraAttributes, memberofProperty, usernameProperty),
+			opts...,
 		)
+		if err != nil {
+			return err
+		}
+
+		i.l = l
 
 		return nil
 	}
 }
 
-// WithMiddleware will bind the given middleware function to the root of the router
-func WithMiddleware(m mux.MiddlewareFunc) Option {
+// WithSearcher find the users with the given searcher instead of a ldap directory, see
+// WithLdap
+func WithSearcher(searcher Searcher) Option {
 	return func(i *Instance) error {
-		i.m = append(i.m, m)
+		i.l = searcher
+
+		return nil
+	}
+}
+
+// WithRealm serve /auth/{realm}, finding the users of the realm with searcher, ie. a
+// *ldap.Ldap of another directory. The tokens issued carry the realm in the RealmExtraKey
+// user extra. /auth keeps using the searcher of WithLdap or WithSearcher, and the unknown
+// realms are answered with ErrRealmNotFound.
+func WithRealm(name string, searcher Searcher) Option {
+	return func(i *Instance) error {
+		if name == "" || strings.Contains(name, "/") {
+			return fmt.Errorf("Invalid realm name '%s', it must be a non empty path segment", name)
+		}
+
+		if searcher == nil {
+			return fmt.Errorf("Realm '%s' has no searcher", name)
+		}
+
+		if _, ok := i.realms[name]; ok {
+			return fmt.Errorf("Realm '%s' is given more than once", name)
+		}
+
+		if i.realms == nil {
+			i.realms = map[string]Searcher{}
+		}
+		i.realms[name] = searcher
+
+		return nil
+	}
+}
+
+// WithMiddleware will bind the given middleware functions to the root of the router. They only
+// run for the requests matching a route, in the order they were given across all the calls,
+// the first one being the outermost. From the outermost, a request goes through:
+//   - the panic recovery of every layer below
+//   - the request id, see middlewares.RequestID
+//   - the CORS middleware, see WithCORS
+//   - the response compression, see WithGzip
+//   - the Retry-After of the 503 responses, see WithRetryAfter
+//   - the middlewares given to WithMiddleware, WithAccessLogs and WithRequestLogs
+//   - the panic recovery of the handlers, so that the access logs record their 500
+//   - the /auth only middlewares, see WithRateLimit
+func WithMiddleware(m ...mux.MiddlewareFunc) Option {
+	return func(i *Instance) error {
+		i.m = append(i.m, m...)
 
 		return nil
 	}
@@ -57,20 +121,145 @@ func WithAccessLogs() Option {
 	return WithMiddleware(middlewares.AccessLog)
 }
 
-// WithLdap bind a ldap object to a server instance
+// WithRateLimit limit the number of /auth requests of each client ip to limit per second,
+// with bursts of at most burst requests. X-Forwarded-For is only used to find the client ip
+// when trustProxy is set.
+func WithRateLimit(limit float64, burst int, trustProxy bool) Option {
+	return func(i *Instance) error {
+		if limit <= 0 || burst < 1 {
+			return fmt.Errorf("The rate limit must be positive with a burst of at least 1, got %v and %d", limit, burst)
+		}
+
+		i.am = append(i.am, middlewares.RateLimit(limit, burst, trustProxy))
+
+		return nil
+	}
+}
+
+// WithLockout lock a username out after threshold consecutive failed authentications within
+// window, the ldap server is not even contacted for this username until window elapsed since
+// the last failure. A successful authentication resets the failures.
+func WithLockout(threshold int, window time.Duration) Option {
+	return func(i *Instance) error {
+		if threshold < 1 || window <= 0 {
+			return fmt.Errorf("The lockout threshold and window must be positive, got %d and %s", threshold, window)
+		}
+
+		i.lockout = newLockout(threshold, window)
+
+		return nil
+	}
+}
+
+// WithMaxBodySize set the maximum size in bytes of the /auth and /token request bodies,
+// larger requests are answered with a 413. Defaults to DefaultMaxBodySize.
+func WithMaxBodySize(size int64) Option {
+	return func(i *Instance) error {
+		if size < 1 {
+			return fmt.Errorf("The maximum body size must be positive, got %d", size)
+		}
+
+		i.maxBodySize = size
+
+		return nil
+	}
+}
+
+// WithMaxUsernameLength set the maximum length of the usernames sent to /auth, in characters,
+// longer usernames are answered with a 400. See types.DefaultMaxUsernameLength.
+func WithMaxUsernameLength(length int) Option {
+	return func(i *Instance) error {
+		if length < 1 {
+			return fmt.Errorf("The maximum username length must be positive, got %d", length)
+		}
+
+		i.maxUsernameLength = length
+
+		return nil
+	}
+}
+
+// WithTimeouts set the http server timeouts, see http.Server. A zero value keeps the default
+// one, see DefaultReadHeaderTimeout, DefaultReadTimeout, DefaultWriteTimeout and
+// DefaultIdleTimeout.
+func WithTimeouts(readHeader, read, write, idle time.Duration) Option {
+	return func(i *Instance) error {
+		if readHeader < 0 || read < 0 || write < 0 || idle < 0 {
+			return fmt.Errorf("The server timeouts cannot be negative")
+		}
+
+		if readHeader > 0 {
+			i.srv.ReadHeaderTimeout = readHeader
+		}
+
+		if read > 0 {
+			i.srv.ReadTimeout = read
+		}
+
+		if write > 0 {
+			i.srv.WriteTimeout = write
+		}
+
+		if idle > 0 {
+			i.srv.IdleTimeout = idle
+		}
+
+		return nil
+	}
+}
+
+// WithCORS allow browsers on the given origins, "*" allowing any, to call the server with
+// the given methods and headers. CORS requests are denied by default.
+func WithCORS(origins, methods, headers []string) Option {
+	return func(i *Instance) error {
+		if len(origins) == 0 {
+			return fmt.Errorf("At least one CORS origin must be allowed")
+		}
+
+		i.cors = middlewares.CORS(origins, methods, headers)
+
+		return nil
+	}
+}
+
+// WithRequestLogs add an access log middleware writing to out in the given format,
+// middlewares.FormatJSON or middlewares.FormatText
+func WithRequestLogs(out io.Writer, format string) Option {
+	return func(i *Instance) error {
+		m, err := middlewares.RequestLog(out, format)
+		if err != nil {
+			return err
+		}
+
+		return WithMiddleware(m)(i)
+	}
+}
+
+// WithKey load the token signing key from privateKeyFile, the public key is read from
+// publicKeyFile when given. A new key is generated when no file is given, tokens then do not
+// survive a restart.
 func WithKey(privateKeyFile, publicKeyFile string) Option {
+	return WithKeyAlgorithm(privateKeyFile, publicKeyFile, jwa.RS256)
+}
+
+// WithKeyAlgorithm behave like WithKey, generating a key for the given algorithm, RS256 or
+// ES256, when no file is given. Loaded keys sign with the algorithm matching their type.
+func WithKeyAlgorithm(privateKeyFile, publicKeyFile string, alg jwa.SignatureAlgorithm) Option {
 	return func(i *Instance) error {
 		var (
-			key *rsa.PrivateKey
+			key *types.Key
 			err error
 		)
 
 		if privateKeyFile != "" && publicKeyFile != "" {
 			log.Info().Msg("privateKeyFile and publicKeyFile were provided, loading key.")
 			key, err = types.LoadKey(privateKeyFile, publicKeyFile)
+		} else if privateKeyFile != "" {
+			log.Info().Msg("privateKeyFile was provided, loading key.")
+			key, err = types.LoadPrivateKey(privateKeyFile)
 		} else {
 			log.Info().Msg("No key provided, generating a new one.")
-			key, err = types.GenerateKey()
+			key, err = types.GenerateKey(alg)
 		}
 
 		i.k = key
@@ -79,11 +268,414 @@ func WithKey(privateKeyFile, publicKeyFile string) Option {
 	}
 }
 
-// WithLdap bind a ldap object to a server instance
+// WithIssuer set the iss claim of the issued tokens, validated tokens must carry it
+func WithIssuer(issuer string) Option {
+	return func(i *Instance) error {
+		if issuer != "" {
+			i.tokenOptions = append(i.tokenOptions, types.WithIssuer(issuer))
+		}
+
+		return nil
+	}
+}
+
+// WithAudience set the aud claim of the issued tokens, validated tokens must carry it
+func WithAudience(audience string) Option {
+	return func(i *Instance) error {
+		if audience != "" {
+			i.tokenOptions = append(i.tokenOptions, types.WithAudience(audience))
+		}
+		i.audience = audience
+
+		return nil
+	}
+}
+
+// WithLeeway set the clock skew tolerated when validating the token iat, nbf and exp claims,
+// types.DefaultLeeway by default
+func WithLeeway(leeway time.Duration) Option {
+	return func(i *Instance) error {
+		if leeway < 0 {
+			return fmt.Errorf("The token leeway cannot be negative, got %s", leeway)
+		}
+
+		i.tokenOptions = append(i.tokenOptions, types.WithLeeway(leeway))
+
+		return nil
+	}
+}
+
+// WithRevoker set the store of the revoked tokens, revocations are kept in memory by default
+func WithRevoker(r Revoker) Option {
+	return func(i *Instance) error {
+		i.revoker = r
+
+		return nil
+	}
+}
+
+// WithRetiredKeys load PEM encoded private keys that no longer sign tokens, the tokens they
+// signed are still validated until they expire. To rotate keys, load the new key with WithKey
+// and the previous one with WithRetiredKeys.
+func WithRetiredKeys(privateKeyFiles ...string) Option {
+	return func(i *Instance) error {
+		for _, file := range privateKeyFiles {
+			key, err := types.LoadPrivateKey(file)
+			if err != nil {
+				return fmt.Errorf("Could not load retired key '%s', %w", file, err)
+			}
+
+			i.retired = append(i.retired, key)
+		}
+
+		return nil
+	}
+}
+
+// WithKeyPEM use the given PEM encoded RSA or ECDSA private key to sign tokens
+func WithKeyPEM(privateKey []byte) Option {
+	return func(i *Instance) error {
+		key, err := types.ParseKey(privateKey)
+		if err != nil {
+			return err
+		}
+
+		i.k = key
+
+		return nil
+	}
+}
+
+// MaxTTL is the longest token lifetime accepted by WithTTL, in seconds
+const MaxTTL = 7 * 24 * 60 * 60
+
+// WithTTL set the lifetime of the issued tokens, in seconds. It must be positive and at
+// most MaxTTL.
 func WithTTL(ttl int64) Option {
 	return func(i *Instance) error {
+		if ttl <= 0 || ttl > MaxTTL {
+			return fmt.Errorf("The token ttl must be between 1 and %d seconds, got %d", MaxTTL, ttl)
+		}
+
 		i.ttl = ttl
 
 		return nil
 	}
 }
+
+// WithMetrics register the server metrics in the given registry and serve it on /metrics
+func WithMetrics(registry *prometheus.Registry) Option {
+	return func(i *Instance) error {
+		m, err := newMetrics(registry)
+		if err != nil {
+			return err
+		}
+
+		i.registry = registry
+		i.metrics = m
+
+		return nil
+	}
+}
+
+// WithTLSFiles serve requests over TLS using the PEM encoded certificate and key files
+func WithTLSFiles(certFile, keyFile string) Option {
+	return func(i *Instance) error {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return fmt.Errorf("Could not load the server certificate, %w", err)
+		}
+
+		i.tls = &tls.Config{Certificates: []tls.Certificate{cert}}
+
+		return nil
+	}
+}
+
+// WithTLSPEM serve requests over TLS using the given PEM encoded certificate and key,
+// ie. when they come from a mounted secret
+func WithTLSPEM(certPEM, keyPEM []byte) Option {
+	return func(i *Instance) error {
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return fmt.Errorf("Could not parse the server certificate, %w", err)
+		}
+
+		i.tls = &tls.Config{Certificates: []tls.Certificate{cert}}
+
+		return nil
+	}
+}
+
+// WithTLSMinVersion refuse the TLS handshakes of the clients not supporting at least the given
+// version, "1.2" or "1.3". Defaults to DefaultTLSMinVersion, older versions are refused.
+func WithTLSMinVersion(version string) Option {
+	return func(i *Instance) error {
+		v, err := parseTLSVersion(version)
+		if err != nil {
+			return err
+		}
+
+		i.tlsMinVersion = v
+
+		return nil
+	}
+}
+
+// WithTLSCipherSuites restrict the TLS 1.2 cipher suites to the named ones, ie.
+// TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256. The insecure suites are refused, and the TLS 1.3
+// suites are not configurable. Defaults to the go secure suites.
+func WithTLSCipherSuites(names ...string) Option {
+	return func(i *Instance) error {
+		ids, err := parseCipherSuites(names)
+		if err != nil {
+			return err
+		}
+
+		i.tlsCipherSuites = ids
+
+		return nil
+	}
+}
+
+// WithClientCAFile verify the client certificates against the PEM encoded CA bundle, and
+// only answer /token requests presenting a valid one so that only the api server can review
+// tokens. /auth does not require a certificate. Requires TLS, see WithTLSFiles.
+func WithClientCAFile(caFile string) Option {
+	return func(i *Instance) error {
+		data, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return fmt.Errorf("Could not read the client CA file, %w", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("No valid certificate found in the client CA file '%s'", caFile)
+		}
+
+		i.clientCAs = pool
+
+		return nil
+	}
+}
+
+// WithTracerProvider record the /auth and /token requests as spans of the given tracer
+// provider, continuing the W3C trace context found in the request headers. Defaults to a
+// no-op provider. Use ldap.WithTracerProvider to also record the ldap operations.
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(i *Instance) error {
+		i.tracer = tp.Tracer(tracerName)
+
+		return nil
+	}
+}
+
+// WithLogger log the requests decisions with the given logger instead of the global one.
+// Passwords and tokens are never logged, only the usernames and token ids.
+func WithLogger(logger zerolog.Logger) Option {
+	return func(i *Instance) error {
+		i.log = logger
+
+		return nil
+	}
+}
+
+// WithAuditor send an AuditEvent to the auditor for every authentication attempt, see
+// NewJSONAuditor. X-Forwarded-For is only used to find the source ip when trustProxy is set.
+func WithAuditor(auditor Auditor, trustProxy bool) Option {
+	return func(i *Instance) error {
+		i.auditor = auditor
+		i.auditTrustProxy = trustProxy
+
+		return nil
+	}
+}
+
+// WithGroupPolicy only authenticate the tokens of users member of one of the allowed groups
+// (any group when empty) and of none of the denied groups, even if the token is valid.
+// Group names must be given as they appear in the tokens, see ldap.WithGroupFormat.
+func WithGroupPolicy(allowed, denied []string) Option {
+	return func(i *Instance) error {
+		if len(allowed) == 0 && len(denied) == 0 {
+			i.groupPolicy = nil
+			return nil
+		}
+
+		i.groupPolicy = &groupPolicy{allowed: allowed, denied: denied}
+
+		return nil
+	}
+}
+
+// WithMaxGroups limit the number of groups carried by the issued tokens to max (no limit when
+// 0). Users member of more groups get a token with only the first max groups when strategy
+// is GroupLimitTruncate, or no token at all when it is GroupLimitReject.
+func WithMaxGroups(max int, strategy string) Option {
+	return func(i *Instance) error {
+		if max < 0 {
+			return fmt.Errorf("The maximum number of groups cannot be negative, got %d", max)
+		}
+
+		switch strategy {
+		case GroupLimitTruncate, GroupLimitReject:
+		default:
+			return fmt.Errorf("Unknown group limit strategy '%s', expected '%s' or '%s'", strategy, GroupLimitTruncate, GroupLimitReject)
+		}
+
+		if max == 0 {
+			i.groupLimit = nil
+			return nil
+		}
+
+		i.groupLimit = &groupLimit{max: max, strategy: strategy}
+
+		return nil
+	}
+}
+
+// WithRequireGroups refuse to issue a token to the users member of no group, they could not
+// be bound to any RBAC role anyway
+func WithRequireGroups() Option {
+	return func(i *Instance) error {
+		i.requireGroups = true
+
+		return nil
+	}
+}
+
+// WithLastLookup serve /debug/lastlookup, a snapshot of the most recent ldap search: its
+// username, outcome and latency. The password is never kept. The route is only served to the
+// clients presenting a certificate, WithClientCAFile is required.
+func WithLastLookup() Option {
+	return func(i *Instance) error {
+		i.lastLookup = &lastLookup{}
+
+		return nil
+	}
+}
+
+// WithStatusCodes override the status code answered for the ServerErrors, keyed by their
+// name, ie. {"not_acceptable": 400} for gateways handling the 406 on their own. See
+// ServerErrors for their names and default codes. Only client and server error codes, from
+// 400 to 599, are accepted so that an error is never answered as a success.
+func WithStatusCodes(codes map[string]int) Option {
+	return func(i *Instance) error {
+		known := map[string]bool{}
+		for _, e := range ServerErrors() {
+			known[e.name] = true
+		}
+
+		overrides := make(map[string]int, len(codes))
+		for name, code := range codes {
+			if !known[name] {
+				return fmt.Errorf("Unknown server error '%s'", name)
+			}
+
+			if code < 400 || code > 599 {
+				return fmt.Errorf("The status code of '%s' must be between 400 and 599, got %d", name, code)
+			}
+
+			overrides[name] = code
+		}
+
+		i.statusCodes = overrides
+
+		return nil
+	}
+}
+
+// WithUserinfo serve /userinfo, answering the user a bearer token was issued to as json, like
+// an OpenID Connect userinfo endpoint, for the tools that need it outside of a TokenReview.
+// It is not part of the webhook contract, so it is not served by default.
+func WithUserinfo() Option {
+	return func(i *Instance) error {
+		i.userinfo = true
+
+		return nil
+	}
+}
+
+// WithGroupLookup serve /groups/{username}, answering as json the groups a token of the user
+// would hold, for troubleshooting the RBAC bindings. The user password is not checked and no
+// token is issued, the groups are looked up with the service account, see ldap.LookupGroups.
+// The route is only served to the clients presenting a certificate, WithClientCAFile is
+// required, and the searcher must be a GroupLooker.
+func WithGroupLookup() Option {
+	return func(i *Instance) error {
+		i.groupLookup = true
+
+		return nil
+	}
+}
+
+// WithPprof serve the net/http/pprof profiles below /debug/pprof/, meant to be enabled
+// while investigating a running server only. The routes require a client certificate, and so
+// WithClientCAFile. The cpu profile and trace durations must be shorter than the write
+// timeout, see WithTimeouts.
+func WithPprof() Option {
+	return func(i *Instance) error {
+		i.pprof = true
+
+		return nil
+	}
+}
+
+// WithGzip compress the responses of at least minSize bytes for the clients accepting gzip,
+// ie. the TokenReviews and ExecCredentials of users member of many groups, see
+// middlewares.DefaultGzipMinSize
+func WithGzip(minSize int) Option {
+	return func(i *Instance) error {
+		if minSize < 0 {
+			return fmt.Errorf("The gzip minimum size cannot be negative, got %d", minSize)
+		}
+
+		i.gzip = true
+		i.gzipMinSize = minSize
+
+		return nil
+	}
+}
+
+// WithRetryAfter set the Retry-After header of the 503 responses, ie. of /readyz when the
+// directory is unreachable, so that the clients back off. The header is not set when zero.
+// Defaults to DefaultRetryAfter.
+func WithRetryAfter(delay time.Duration) Option {
+	return func(i *Instance) error {
+		if delay < 0 {
+			return fmt.Errorf("The retry after delay cannot be negative, got %s", delay)
+		}
+
+		i.retryAfter = delay
+
+		return nil
+	}
+}
+
+// WithBasePath serve every route below path, ie. /auth on /k8s-ldap-auth/auth for the
+// "/k8s-ldap-auth" path. Routes are served at the root by default.
+func WithBasePath(path string) Option {
+	return func(i *Instance) error {
+		path = strings.TrimRight(path, "/")
+		if path != "" && !strings.HasPrefix(path, "/") {
+			return fmt.Errorf("The base path must start with a /, got '%s'", path)
+		}
+
+		i.basePath = path
+
+		return nil
+	}
+}
+
+// WithRefresh serve /refresh, exchanging a still valid token for a new one without asking
+// the user for their credentials again, for at most maxSession after they authenticated.
+func WithRefresh(maxSession time.Duration) Option {
+	return func(i *Instance) error {
+		if maxSession < 0 {
+			return fmt.Errorf("The maximum session lifetime cannot be negative, got %s", maxSession)
+		}
+
+		i.maxSession = maxSession
+
+		return nil
+	}
+}
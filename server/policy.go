@@ -0,0 +1,74 @@
+package server
+
+import "strings"
+
+// groupPolicy is a coarse gate applied by /token on top of RBAC. Users member of a denied
+// group are never authenticated, and when allowed groups are set users must be member of
+// at least one of them. Group names are compared case insensitively.
+type groupPolicy struct {
+	allowed []string
+	denied  []string
+}
+
+// permits tells whether a member of groups passes the policy, a nil policy permits everyone
+func (p *groupPolicy) permits(groups []string) bool {
+	if p == nil {
+		return true
+	}
+
+	for _, group := range groups {
+		if containsFold(p.denied, group) {
+			return false
+		}
+	}
+
+	if len(p.allowed) == 0 {
+		return true
+	}
+
+	for _, group := range groups {
+		if containsFold(p.allowed, group) {
+			return true
+		}
+	}
+
+	return false
+}
+
+const (
+	// GroupLimitTruncate keep the first groups of the users member of too many groups
+	GroupLimitTruncate = "truncate"
+	// GroupLimitReject refuse to issue a token to the users member of too many groups
+	GroupLimitReject = "reject"
+)
+
+// groupLimit bound the number of groups carried by the issued tokens, so that tokens stay
+// below the header size limits of the downstream tooling
+type groupLimit struct {
+	max      int
+	strategy string
+}
+
+// apply return the groups to carry in the token and whether a token can be issued at all, a
+// nil limit keeps every group. Groups are sorted, truncation keeps the first ones.
+func (l *groupLimit) apply(groups []string) ([]string, bool) {
+	if l == nil || len(groups) <= l.max {
+		return groups, true
+	}
+
+	if l.strategy == GroupLimitReject {
+		return nil, false
+	}
+
+	return groups[:l.max], true
+}
+
+func containsFold(a []string, value string) bool {
+	for _, item := range a {
+		if strings.EqualFold(item, value) {
+			return true
+		}
+	}
+
+	return false
+}
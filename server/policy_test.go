@@ -0,0 +1,186 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	auth "k8s.io/api/authentication/v1"
+	clientv1beta1 "k8s.io/client-go/pkg/apis/clientauthentication/v1beta1"
+
+	"vbouchaud/k8s-ldap-auth/internal/ldaptest"
+	"vbouchaud/k8s-ldap-auth/types"
+)
+
+func TestGroupPolicy(t *testing.T) {
+	tests := []struct {
+		name          string
+		allowed       []string
+		denied        []string
+		groups        []string
+		authenticated bool
+	}{
+		{name: "no policy", groups: []string{"devs"}, authenticated: true},
+		{name: "no policy without groups", authenticated: true},
+		{name: "allowed", allowed: []string{"admins", "devs"}, groups: []string{"devs"}, authenticated: true},
+		{name: "allowed case insensitive", allowed: []string{"Devs"}, groups: []string{"devs"}, authenticated: true},
+		{name: "not allowed", allowed: []string{"admins"}, groups: []string{"devs"}, authenticated: false},
+		{name: "not allowed without groups", allowed: []string{"admins"}, authenticated: false},
+		{name: "denied", denied: []string{"contractors"}, groups: []string{"devs", "contractors"}, authenticated: false},
+		{name: "not denied", denied: []string{"contractors"}, groups: []string{"devs"}, authenticated: true},
+		{name: "denied wins over allowed", allowed: []string{"devs"}, denied: []string{"contractors"}, groups: []string{"devs", "contractors"}, authenticated: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keyPEM := rsaKeyPEM(t)
+			s := newTestInstance(t, WithKeyPEM(keyPEM), WithGroupPolicy(tt.allowed, tt.denied))
+
+			key, err := types.ParseKey(keyPEM)
+			if err != nil {
+				t.Fatalf("ParseKey() error = %s", err)
+			}
+
+			token, err := types.NewToken(&auth.UserInfo{Username: "john", Groups: tt.groups}, 60)
+			if err != nil {
+				t.Fatalf("NewToken() error = %s", err)
+			}
+
+			payload, err := token.Payload(key)
+			if err != nil {
+				t.Fatalf("Payload() error = %s", err)
+			}
+
+			code, tr := review(t, s, string(payload))
+			if code != http.StatusOK {
+				t.Errorf("POST /token = %d, want %d", code, http.StatusOK)
+			}
+
+			if tr.Status.Authenticated != tt.authenticated {
+				t.Errorf("Authenticated = %v, want %v", tr.Status.Authenticated, tt.authenticated)
+			}
+
+			if !tt.authenticated && tr.Status.User.Username != "" {
+				t.Errorf("User = %+v, want no user for a denied token", tr.Status.User)
+			}
+		})
+	}
+}
+
+// issueToken post the credentials to /auth
+func issueToken(t *testing.T, s *Instance, username, password string) (int, clientv1beta1.ExecCredential) {
+	body, err := json.Marshal(map[string]string{"username": username, "password": password})
+	if err != nil {
+		t.Fatalf("Failed to marshal credentials, %s", err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/auth", strings.NewReader(string(body)))
+	req.Header.Set(ContentTypeHeader, ContentTypeJSON)
+
+	res := httptest.NewRecorder()
+	s.h.ServeHTTP(res, req)
+
+	var ec clientv1beta1.ExecCredential
+	json.NewDecoder(res.Body).Decode(&ec)
+
+	return res.Code, ec
+}
+
+func TestMaxGroups(t *testing.T) {
+	srv, err := ldaptest.NewServer(
+		ldaptest.Entry{DN: "cn=admin,dc=corp", Password: "password"},
+		ldaptest.Entry{
+			DN:       "uid=john,ou=people,dc=corp",
+			Password: "secret",
+			Attributes: map[string][]string{
+				"uid":      {"john"},
+				"memberof": {"cn=viewers,dc=corp", "cn=admins,dc=corp", "cn=devs,dc=corp"},
+			},
+		},
+	)
+	if err != nil {
+		t.Fatalf("Failed to start the ldap server, %s", err)
+	}
+	defer srv.Close()
+
+	tests := []struct {
+		name     string
+		max      int
+		strategy string
+		code     int
+		groups   []string
+	}{
+		{name: "no limit", strategy: GroupLimitTruncate, code: http.StatusOK, groups: []string{"cn=admins,dc=corp", "cn=devs,dc=corp", "cn=viewers,dc=corp"}},
+		{name: "below the limit", max: 3, strategy: GroupLimitReject, code: http.StatusOK, groups: []string{"cn=admins,dc=corp", "cn=devs,dc=corp", "cn=viewers,dc=corp"}},
+		{name: "truncated", max: 2, strategy: GroupLimitTruncate, code: http.StatusOK, groups: []string{"cn=admins,dc=corp", "cn=devs,dc=corp"}},
+		{name: "rejected", max: 2, strategy: GroupLimitReject, code: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestInstance(t, withDirectory(srv), WithMaxGroups(tt.max, tt.strategy))
+
+			code, ec := issueToken(t, s, "john", "secret")
+			if code != tt.code {
+				t.Fatalf("POST /auth = %d, want %d", code, tt.code)
+			}
+
+			if tt.code != http.StatusOK {
+				return
+			}
+
+			token, err := types.Parse([]byte(ec.Status.Token), s.verificationKeys())
+			if err != nil {
+				t.Fatalf("Parse() error = %s", err)
+			}
+
+			user, err := token.GetUser()
+			if err != nil {
+				t.Fatalf("GetUser() error = %s", err)
+			}
+
+			if !reflect.DeepEqual(user.Groups, tt.groups) {
+				t.Errorf("Groups = %v, want %v", user.Groups, tt.groups)
+			}
+		})
+	}
+}
+
+func TestMaxGroupsStrategy(t *testing.T) {
+	if _, err := NewInstance(WithMaxGroups(2, "drop")); err == nil || !strings.Contains(err.Error(), "strategy") {
+		t.Errorf("NewInstance() error = %v, want an unknown strategy error", err)
+	}
+}
+
+func TestRequireGroups(t *testing.T) {
+	srv, err := ldaptest.NewServer(
+		ldaptest.Entry{DN: "cn=admin,dc=corp", Password: "password"},
+		ldaptest.Entry{DN: "uid=bot,ou=people,dc=corp", Password: "secret", Attributes: map[string][]string{"uid": {"bot"}}},
+	)
+	if err != nil {
+		t.Fatalf("Failed to start the ldap server, %s", err)
+	}
+	defer srv.Close()
+
+	tests := []struct {
+		name string
+		opts []Option
+		code int
+	}{
+		{name: "groups not required", opts: []Option{withDirectory(srv)}, code: http.StatusOK},
+		{name: "groups required", opts: []Option{withDirectory(srv), WithRequireGroups()}, code: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestInstance(t, tt.opts...)
+
+			if code, _ := issueToken(t, s, "bot", "secret"); code != tt.code {
+				t.Errorf("POST /auth for a user member of no group = %d, want %d", code, tt.code)
+			}
+		})
+	}
+}
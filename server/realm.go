@@ -0,0 +1,70 @@
+package server
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/gorilla/mux"
+)
+
+// RealmExtraKey is the user extra holding the realm the user authenticated in, set on the
+// tokens issued by /auth/{realm} only
+const RealmExtraKey = "k8s-ldap-auth/realm"
+
+// searcher return the searcher of the realm of an /auth request, the default one for /auth.
+// ok is false when the realm is unknown, or for /auth when there are only realms.
+func (s *Instance) searcher(req *http.Request) (searcher Searcher, realm string, ok bool) {
+	realm, named := mux.Vars(req)["realm"]
+	if !named {
+		return s.l, "", s.l != nil
+	}
+
+	searcher, ok = s.realms[realm]
+
+	return searcher, realm, ok
+}
+
+// realmSearcher is the searcher of a realm, the default searcher having no realm
+type realmSearcher struct {
+	realm    string
+	searcher Searcher
+}
+
+// checkName is the name of the health checks of the searcher, suffixed by its realm
+func (r realmSearcher) checkName(name string) string {
+	if r.realm == "" {
+		return name
+	}
+
+	return name + "-" + r.realm
+}
+
+// searchers return the default searcher, when set, followed by the realms ones by name
+func (s *Instance) searchers() []realmSearcher {
+	all := make([]realmSearcher, 0, len(s.realms)+1)
+	if s.l != nil {
+		all = append(all, realmSearcher{searcher: s.l})
+	}
+
+	names := make([]string, 0, len(s.realms))
+	for name := range s.realms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		all = append(all, realmSearcher{realm: name, searcher: s.realms[name]})
+	}
+
+	return all
+}
+
+// lockoutKey is the key the failures of username are counted with, the same username in two
+// realms being two users
+func lockoutKey(realm, username string) string {
+	if realm == "" {
+		return username
+	}
+
+	return realm + "\x00" + username
+}
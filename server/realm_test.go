@@ -0,0 +1,148 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	auth "k8s.io/api/authentication/v1"
+	clientv1beta1 "k8s.io/client-go/pkg/apis/clientauthentication/v1beta1"
+
+	"vbouchaud/k8s-ldap-auth/types"
+)
+
+func TestRealms(t *testing.T) {
+	employees := fakeSearcher{
+		"john": {password: "secret", user: auth.UserInfo{UID: "1000", Username: "john", Groups: []string{"admins"}}},
+	}
+	// the same username in another directory is another user
+	contractors := fakeSearcher{
+		"john": {password: "other", user: auth.UserInfo{UID: "2000", Username: "john", Groups: []string{"contractors"}}},
+	}
+
+	s := newTestInstance(t, WithRealm("employees", employees), WithRealm("contractors", contractors))
+
+	tests := []struct {
+		name     string
+		path     string
+		password string
+		code     int
+		uid      string
+	}{
+		{name: "first realm", path: "/auth/employees", password: "secret", code: http.StatusOK, uid: "1000"},
+		{name: "second realm", path: "/auth/contractors", password: "other", code: http.StatusOK, uid: "2000"},
+		{name: "password of another realm", path: "/auth/contractors", password: "secret", code: http.StatusUnauthorized},
+		{name: "unknown realm", path: "/auth/partners", password: "secret", code: ErrRealmNotFound.Code()},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, err := json.Marshal(map[string]string{"username": "john", "password": tt.password})
+			if err != nil {
+				t.Fatalf("Failed to marshal credentials, %s", err)
+			}
+
+			req := httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader(string(body)))
+			req.Header.Set(ContentTypeHeader, ContentTypeJSON)
+
+			res := httptest.NewRecorder()
+			s.h.ServeHTTP(res, req)
+
+			if res.Code != tt.code {
+				t.Fatalf("POST %s = %d, want %d", tt.path, res.Code, tt.code)
+			}
+
+			if tt.code != http.StatusOK {
+				return
+			}
+
+			var ec clientv1beta1.ExecCredential
+			if err := json.NewDecoder(res.Body).Decode(&ec); err != nil {
+				t.Fatalf("Failed to decode ExecCredential, %s", err)
+			}
+
+			token, err := types.Parse([]byte(ec.Status.Token), s.verificationKeys())
+			if err != nil {
+				t.Fatalf("Parse() error = %s", err)
+			}
+
+			user, err := token.GetUser()
+			if err != nil {
+				t.Fatalf("GetUser() error = %s", err)
+			}
+
+			realm := strings.TrimPrefix(tt.path, "/auth/")
+			if user.UID != tt.uid || !reflect.DeepEqual(user.Extra[RealmExtraKey], auth.ExtraValue{realm}) {
+				t.Errorf("token user = %+v, want uid %s in realm %s", user, tt.uid, realm)
+			}
+
+			code, tr := review(t, s, ec.Status.Token)
+			if code != http.StatusOK || !tr.Status.Authenticated || !reflect.DeepEqual(tr.Status.User.Extra[RealmExtraKey], auth.ExtraValue{realm}) {
+				t.Errorf("POST /token = %d, user %+v, want the user of realm %s", code, tr.Status.User, realm)
+			}
+		})
+	}
+
+	// the searchers of the realms were not modified
+	if extra := employees["john"].user.Extra; extra != nil {
+		t.Errorf("searcher user extra = %v, want none", extra)
+	}
+}
+
+func TestRealmsOnly(t *testing.T) {
+	employees := fakeSearcher{
+		"john": {password: "secret", user: auth.UserInfo{UID: "1000", Username: "john"}},
+	}
+
+	s, err := NewInstance(WithKey("", ""), WithTTL(60), WithRealm("employees", employees))
+	if err != nil {
+		t.Fatalf("NewInstance() error = %s", err)
+	}
+
+	tests := []struct {
+		path string
+		code int
+	}{
+		{path: "/auth", code: ErrRealmNotFound.Code()},
+		{path: "/auth/employees", code: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader(`{"username":"john","password":"secret"}`))
+			req.Header.Set(ContentTypeHeader, ContentTypeJSON)
+
+			res := httptest.NewRecorder()
+			s.h.ServeHTTP(res, req)
+
+			if res.Code != tt.code {
+				t.Errorf("POST %s = %d, want %d", tt.path, res.Code, tt.code)
+			}
+		})
+	}
+}
+
+func TestRealmOptions(t *testing.T) {
+	searcher := fakeSearcher{}
+
+	tests := []struct {
+		name string
+		opts []Option
+	}{
+		{name: "empty name", opts: []Option{WithRealm("", searcher)}},
+		{name: "not a path segment", opts: []Option{WithRealm("a/b", searcher)}},
+		{name: "no searcher", opts: []Option{WithRealm("employees", nil)}},
+		{name: "given twice", opts: []Option{WithRealm("employees", searcher), WithRealm("employees", searcher)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewInstance(tt.opts...); err == nil {
+				t.Errorf("NewInstance() error = nil, want an error")
+			}
+		})
+	}
+}
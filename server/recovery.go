@@ -0,0 +1,31 @@
+package server
+
+import (
+	"net/http"
+	"runtime/debug"
+)
+
+// recovery catch the panics of the next handlers, so that a single bad request is answered
+// with a 500 instead of killing its connection
+func (s *Instance) recovery(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		defer func() {
+			if err := recover(); err != nil {
+				if err == http.ErrAbortHandler {
+					panic(err)
+				}
+
+				s.logger(req).Error().
+					Interface("panic", err).
+					Str("method", req.Method).
+					Str("url", req.URL.Path).
+					Bytes("stack", debug.Stack()).
+					Msg("Recovered from a panic while serving a request.")
+
+				s.writeError(res, ErrServerError)
+			}
+		}()
+
+		next.ServeHTTP(res, req)
+	})
+}
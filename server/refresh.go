@@ -0,0 +1,135 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"vbouchaud/k8s-ldap-auth/types"
+)
+
+// refreshRequest is the /refresh request body
+type refreshRequest struct {
+	Token      string `json:"token"`
+	APIVersion string `json:"apiVersion,omitempty"`
+}
+
+// refresh exchange a still valid token for a new one, without contacting the ldap server.
+// The new token keeps the user and the auth_time of the original one so that a session
+// never lasts more than s.maxSession after the user last gave their credentials.
+func (s *Instance) refresh() http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		logger := s.logger(req)
+
+		_, span := s.startSpan(req, "refresh")
+		defer span.End()
+
+		version := ExecCredentialV1beta1
+
+		if !negotiate(req.Header.Get(ContentTypeHeader), req.Header.Get("Accept")) {
+			s.metrics.refresh(reasonNotAcceptable)
+			s.writeExecCredentialError(res, version, ErrNotAcceptable)
+			return
+		}
+
+		decoder := json.NewDecoder(http.MaxBytesReader(res, req.Body, s.maxBodySize))
+		var rr refreshRequest
+		if err := decoder.Decode(&rr); isTooLarge(err) {
+			s.metrics.refresh(reasonTooLarge)
+			s.writeExecCredentialError(res, version, ErrRequestTooLarge)
+			return
+		} else if err != nil {
+			logger.Debug().Err(err).Msg("Could not decode refresh request.")
+			s.metrics.refresh(reasonDecodeFailed)
+			s.writeExecCredentialError(res, version, ErrDecodeFailed)
+			return
+		}
+		defer req.Body.Close()
+
+		if rr.APIVersion != "" {
+			if !supportedExecCredential(rr.APIVersion) {
+				s.metrics.refresh(reasonMalformedCredentials)
+				s.writeExecCredentialError(res, version, ErrMalformedCredentials)
+				return
+			}
+
+			version = rr.APIVersion
+		}
+
+		token, err := types.Parse([]byte(rr.Token), s.verificationKeys(), s.tokenOptions...)
+		if err != nil {
+			logger.Debug().Err(err).Msg("Failed to parse the token to refresh.")
+			s.metrics.refresh(reasonMalformedToken)
+			s.writeExecCredentialError(res, version, ErrUnauthorized)
+			return
+		}
+
+		if !token.IsValid() {
+			s.metrics.refresh(reasonExpired)
+			s.writeExecCredentialError(res, version, ErrUnauthorized)
+			return
+		}
+
+		if id := token.ID(); id != "" {
+			revoked, err := s.revoker.IsRevoked(id)
+			if err != nil {
+				logger.Error().Err(err).Msg("Could not check whether the token was revoked.")
+				s.metrics.refresh(reasonError)
+				s.writeExecCredentialError(res, version, ErrServerError)
+				return
+			} else if revoked {
+				logger.Info().Str("jti", id).Msg("Refused to refresh a revoked token.")
+				s.metrics.refresh(reasonRevoked)
+				s.writeExecCredentialError(res, version, ErrUnauthorized)
+				return
+			}
+		}
+
+		user, err := token.GetUser()
+		if err != nil {
+			s.metrics.refresh(reasonError)
+			s.writeExecCredentialError(res, version, ErrServerError)
+			return
+		}
+
+		// the new token cannot outlive the session, the user must authenticate again then
+		authTime := token.AuthTime()
+		ttl := s.ttl
+		if remaining := int64(time.Until(authTime.Add(s.maxSession)) / time.Second); remaining < ttl {
+			ttl = remaining
+		}
+
+		if ttl < 1 {
+			logger.Info().Str("username", user.Username).Time("auth_time", authTime).Msg("Session reached its maximum lifetime, refusing to refresh.")
+			s.metrics.refresh(reasonSessionExpired)
+			s.writeExecCredentialError(res, version, ErrUnauthorized)
+			return
+		}
+
+		refreshed, err := types.NewToken(user, ttl, append(s.tokenOptions, types.WithAuthTime(authTime))...)
+		if err != nil {
+			s.metrics.refresh(reasonError)
+			s.writeExecCredentialError(res, version, ErrServerError)
+			return
+		}
+
+		tokenData, err := refreshed.Payload(s.k)
+		if err != nil {
+			s.metrics.refresh(reasonError)
+			s.writeExecCredentialError(res, version, ErrServerError)
+			return
+		}
+
+		tokenExp, err := refreshed.Expiration()
+		if err != nil {
+			s.metrics.refresh(reasonError)
+			s.writeExecCredentialError(res, version, ErrServerError)
+			return
+		}
+
+		s.metrics.refresh(reasonSuccess)
+		logger.Info().Str("username", user.Username).Str("jti", refreshed.ID()).Str("refreshed_jti", token.ID()).Time("expires", tokenExp).Msg("Refreshed token.")
+
+		writeExecCredential(res, version, string(tokenData), tokenExp)
+	}
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	auth "k8s.io/api/authentication/v1"
+	clientv1beta1 "k8s.io/client-go/pkg/apis/clientauthentication/v1beta1"
+
+	"vbouchaud/k8s-ldap-auth/types"
+)
+
+// refreshToken post token to /refresh
+func refreshToken(t *testing.T, s *Instance, token string) (int, clientv1beta1.ExecCredential) {
+	body, err := json.Marshal(refreshRequest{Token: token})
+	if err != nil {
+		t.Fatalf("Failed to marshal refresh request, %s", err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/refresh", strings.NewReader(string(body)))
+	req.Header.Set(ContentTypeHeader, ContentTypeJSON)
+
+	res := httptest.NewRecorder()
+	s.h.ServeHTTP(res, req)
+
+	var ec clientv1beta1.ExecCredential
+	json.NewDecoder(res.Body).Decode(&ec)
+
+	return res.Code, ec
+}
+
+func TestRefresh(t *testing.T) {
+	keyPEM := rsaKeyPEM(t)
+	key, err := types.ParseKey(keyPEM)
+	if err != nil {
+		t.Fatalf("ParseKey() error = %s", err)
+	}
+
+	tests := []struct {
+		name string
+		// authenticated is how long ago the user authenticated
+		authenticated time.Duration
+		code          int
+		// maxExpiry is the latest expiration expected for the refreshed token
+		maxExpiry time.Duration
+	}{
+		{name: "within the session lifetime", authenticated: time.Minute, code: http.StatusOK, maxExpiry: time.Minute},
+		{name: "capped by the session lifetime", authenticated: time.Hour - 30*time.Second, code: http.StatusOK, maxExpiry: 31 * time.Second},
+		{name: "beyond the session lifetime", authenticated: 2 * time.Hour, code: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestInstance(t, WithKeyPEM(keyPEM), WithRefresh(time.Hour))
+
+			authTime := time.Now().Add(-tt.authenticated)
+			token, err := types.NewToken(&auth.UserInfo{Username: "john"}, 60, types.WithAuthTime(authTime))
+			if err != nil {
+				t.Fatalf("NewToken() error = %s", err)
+			}
+
+			payload, err := token.Payload(key)
+			if err != nil {
+				t.Fatalf("Payload() error = %s", err)
+			}
+
+			code, ec := refreshToken(t, s, string(payload))
+			if code != tt.code {
+				t.Fatalf("POST /refresh = %d, want %d", code, tt.code)
+			}
+
+			if tt.code != http.StatusOK {
+				if ec.Status != nil {
+					t.Errorf("Status = %+v, want no token", ec.Status)
+				}
+				return
+			}
+
+			refreshed, err := types.Parse([]byte(ec.Status.Token), s.verificationKeys())
+			if err != nil {
+				t.Fatalf("Parse() error = %s", err)
+			}
+
+			if refreshed.ID() == token.ID() {
+				t.Errorf("Refreshed token has the same id as the original one")
+			}
+
+			if got := refreshed.AuthTime(); got.Unix() != authTime.Unix() {
+				t.Errorf("AuthTime() = %s, want the original %s", got, authTime)
+			}
+
+			if exp := ec.Status.ExpirationTimestamp.Time; exp.After(time.Now().Add(tt.maxExpiry)) {
+				t.Errorf("Expiration = %s, want at most %s from now", exp, tt.maxExpiry)
+			}
+
+			if _, tr := review(t, s, ec.Status.Token); !tr.Status.Authenticated || tr.Status.User.Username != "john" {
+				t.Errorf("Refreshed token review = %+v, want john authenticated", tr.Status)
+			}
+		})
+	}
+}
+
+func TestRefreshRejected(t *testing.T) {
+	keyPEM := rsaKeyPEM(t)
+	s := newTestInstance(t, WithKeyPEM(keyPEM), WithRefresh(time.Hour))
+
+	revoked := signedToken(t, keyPEM)
+	parsed, err := types.Parse([]byte(revoked), s.verificationKeys())
+	if err != nil {
+		t.Fatalf("Parse() error = %s", err)
+	}
+
+	if err := s.Revoke(parsed.ID()); err != nil {
+		t.Fatalf("Revoke() error = %s", err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{name: "malformed", token: "not a token"},
+		{name: "unknown key", token: signedToken(t, rsaKeyPEM(t))},
+		{name: "revoked", token: revoked},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code, _ := refreshToken(t, s, tt.token); code != http.StatusUnauthorized {
+				t.Errorf("POST /refresh = %d, want %d", code, http.StatusUnauthorized)
+			}
+		})
+	}
+}
+
+func TestRefreshDisabled(t *testing.T) {
+	keyPEM := rsaKeyPEM(t)
+	s := newTestInstance(t, WithKeyPEM(keyPEM))
+
+	if code, _ := refreshToken(t, s, signedToken(t, keyPEM)); code != http.StatusNotFound {
+		t.Errorf("POST /refresh = %d, want %d", code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// Revoker keeps the ids of the revoked tokens, a revoked token is not authenticated anymore
+// by /token. Implementations must be safe for concurrent use.
+type Revoker interface {
+	// Revoke mark the token id as revoked, the revocation can be forgotten after expires
+	// since the token is expired by then
+	Revoke(id string, expires time.Time) error
+	// IsRevoked tells whether the token id was revoked
+	IsRevoked(id string) (bool, error)
+}
+
+// memoryRevoker is the default Revoker, revocations are lost on restart and are not shared
+// between replicas
+type memoryRevoker struct {
+	mu      sync.Mutex
+	revoked map[string]time.Time
+}
+
+func newMemoryRevoker() *memoryRevoker {
+	return &memoryRevoker{
+		revoked: map[string]time.Time{},
+	}
+}
+
+func (m *memoryRevoker) Revoke(id string, expires time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for k, v := range m.revoked {
+		if now.After(v) {
+			delete(m.revoked, k)
+		}
+	}
+
+	m.revoked[id] = expires
+
+	return nil
+}
+
+func (m *memoryRevoker) IsRevoked(id string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, ok := m.revoked[id]
+
+	return ok, nil
+}
+
+// Revoke revoke the token with the given jti, the revocation is kept for the token ttl
+func (s *Instance) Revoke(id string) error {
+	return s.revoker.Revoke(id, time.Now().Add(time.Duration(s.ttl)*time.Second))
+}
@@ -0,0 +1,39 @@
+package server
+
+import (
+	"context"
+
+	auth "k8s.io/api/authentication/v1"
+)
+
+// Searcher find the user the credentials belong to, ie. a *ldap.Ldap. The errors wrapping the
+// ldap errors, ie. ldap.ErrInvalidCredentials or ldap.ErrDirectoryUnavailable, are reported
+// with their reason, any other error is an internal failure. Implementations must be safe for
+// concurrent use.
+type Searcher interface {
+	Search(ctx context.Context, username, password string) (*auth.UserInfo, error)
+}
+
+// Pinger is implemented by the searchers that can tell whether their backend is reachable,
+// /readyz then reports it
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// PoolChecker is implemented by the searchers holding a pool of connections that can tell
+// whether one is released in time, /healthz then fails when they are all stuck in use
+type PoolChecker interface {
+	CheckPool(ctx context.Context) error
+}
+
+// GroupLooker is implemented by the searchers that can tell the groups of a user without
+// their password, ie. a *ldap.Ldap, see WithGroupLookup
+type GroupLooker interface {
+	LookupGroups(ctx context.Context, username string) ([]string, error)
+}
+
+// Validator is implemented by the searchers whose configuration can be checked against their
+// backend, see Instance.Validate
+type Validator interface {
+	Validate(ctx context.Context) error
+}
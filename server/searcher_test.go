@@ -0,0 +1,83 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	auth "k8s.io/api/authentication/v1"
+
+	"vbouchaud/k8s-ldap-auth/ldap"
+	"vbouchaud/k8s-ldap-auth/types"
+)
+
+// fakeSearcher is an in-memory Searcher, users are keyed by username
+type fakeSearcher map[string]struct {
+	password string
+	user     auth.UserInfo
+}
+
+func (f fakeSearcher) Search(_ context.Context, username, password string) (*auth.UserInfo, error) {
+	u, ok := f[username]
+	if !ok {
+		return nil, ldap.ErrUserNotFound
+	}
+
+	if u.password != password {
+		return nil, fmt.Errorf("%w, wrong password", ldap.ErrInvalidCredentials)
+	}
+
+	user := u.user
+
+	return &user, nil
+}
+
+func TestSearcher(t *testing.T) {
+	searcher := fakeSearcher{
+		"john": {
+			password: "secret",
+			user:     auth.UserInfo{UID: "1000", Username: "john", Groups: []string{"admins"}},
+		},
+	}
+
+	s := newTestInstance(t, WithSearcher(searcher))
+
+	code, ec := issueToken(t, s, "john", "secret")
+	if code != http.StatusOK {
+		t.Fatalf("POST /auth = %d, want %d", code, http.StatusOK)
+	}
+
+	token, err := types.Parse([]byte(ec.Status.Token), s.verificationKeys())
+	if err != nil {
+		t.Fatalf("Parse() error = %s", err)
+	}
+
+	user, err := token.GetUser()
+	if err != nil {
+		t.Fatalf("GetUser() error = %s", err)
+	}
+
+	if want := searcher["john"].user; user.UID != want.UID || user.Username != want.Username || !reflect.DeepEqual(user.Groups, want.Groups) {
+		t.Errorf("token user = %+v, want %+v", user, want)
+	}
+
+	for _, credentials := range [][2]string{{"john", "wrong"}, {"jane", "secret"}} {
+		if code := authenticate(s, credentials[0], credentials[1]); code != http.StatusUnauthorized {
+			t.Errorf("POST /auth as %s = %d, want %d", credentials[0], code, http.StatusUnauthorized)
+		}
+	}
+
+	// neither a Pinger nor a Validator, the searcher is always ready and valid
+	res := httptest.NewRecorder()
+	s.h.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if res.Code != http.StatusOK {
+		t.Errorf("GET /readyz = %d, want %d", res.Code, http.StatusOK)
+	}
+
+	if err := s.Validate(context.Background()); err != nil {
+		t.Errorf("Validate() error = %s, want none", err)
+	}
+}
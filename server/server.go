@@ -2,37 +2,147 @@ package server
 
 import (
 	"context"
-	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"os"
+	"strings"
 	"time"
 
-	"github.com/etherlabsio/healthcheck/v2"
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 
 	auth "k8s.io/api/authentication/v1"
-	machinery "k8s.io/apimachinery/pkg/apis/meta/v1"
-	client "k8s.io/client-go/pkg/apis/clientauthentication/v1beta1"
 
 	"vbouchaud/k8s-ldap-auth/ldap"
+	"vbouchaud/k8s-ldap-auth/server/middlewares"
 	"vbouchaud/k8s-ldap-auth/types"
 )
 
+// DefaultMaxBodySize is the default maximum size of the /auth and /token request bodies
+const DefaultMaxBodySize = 1 << 20
+
+// UnixScheme prefix the Start addresses of unix sockets
+const UnixScheme = "unix://"
+
+const (
+	// DefaultReadHeaderTimeout is the default time allowed to read the request headers
+	DefaultReadHeaderTimeout = 5 * time.Second
+	// DefaultReadTimeout is the default time allowed to read the whole request
+	DefaultReadTimeout = 10 * time.Second
+	// DefaultWriteTimeout is the default time allowed to handle the request and write the
+	// response, it must leave enough time to reach the ldap servers
+	DefaultWriteTimeout = 30 * time.Second
+	// DefaultIdleTimeout is the default time a keep-alive connection is kept open between
+	// two requests
+	DefaultIdleTimeout = 2 * time.Minute
+	// DefaultRetryAfter is how long the clients are asked to wait before retrying a request
+	// answered with a 503
+	DefaultRetryAfter = 30 * time.Second
+)
+
+const (
+	// TokenReviewV1 is the TokenReview apiVersion answered when the request has none
+	TokenReviewV1 = "authentication.k8s.io/v1"
+	// TokenReviewV1beta1 is the TokenReview apiVersion sent by older api servers
+	TokenReviewV1beta1 = "authentication.k8s.io/v1beta1"
+
+	tokenReviewKind = "TokenReview"
+)
+
 const ContentTypeHeader = "Content-Type"
 const ContentTypeJSON = "application/json"
 
 type Instance struct {
-	l   *ldap.Ldap
-	m   []mux.MiddlewareFunc
-	k   *rsa.PrivateKey
-	ttl int64
+	h   http.Handler
+	srv *http.Server
+	tls *tls.Config
+	// tlsMinVersion and tlsCipherSuites are applied to tls, whichever option set it
+	tlsMinVersion   uint16
+	tlsCipherSuites []uint16
+	// clientCAs, when set, verify the client certificates and /token requires one
+	clientCAs *x509.CertPool
+	l         Searcher
+	// realms are the searchers of /auth/{realm}, keyed by realm
+	realms map[string]Searcher
+	m      []mux.MiddlewareFunc
+	// cors wraps the whole router so that it also answers preflight requests
+	cors mux.MiddlewareFunc
+	// am are the middlewares only applied to /auth
+	am []mux.MiddlewareFunc
+	k  *types.Key
+	// retired keys no longer sign tokens but the tokens they signed are still accepted
+	retired []*types.Key
+	// tokenOptions are used both when issuing and validating tokens
+	tokenOptions []types.TokenOption
+	// audience is the aud claim of the issued tokens, see WithAudience
+	audience string
+	revoker  Revoker
+	// auditor, when set, records every authentication attempt
+	auditor         Auditor
+	auditTrustProxy bool
+	maxBodySize     int64
+	// maxUsernameLength is the maximum length of the usernames sent to /auth, in characters
+	maxUsernameLength int
+	lockout           *lockout
+	groupPolicy       *groupPolicy
+	groupLimit        *groupLimit
+	// requireGroups refuse to issue tokens to users member of no group
+	requireGroups bool
+	// lastLookup, when set, keeps the most recent ldap search for /debug/lastlookup
+	lastLookup *lastLookup
+	// pprof serve the profiling handlers below /debug/pprof/
+	pprof bool
+	// userinfo serve /userinfo, answering the user of a bearer token
+	userinfo bool
+	// groupLookup serve /groups/{username}, answering the groups of a user without their
+	// password to the clients presenting a certificate only
+	groupLookup bool
+	ttl         int64
+	// maxSession is how long tokens can be refreshed after the user authenticated, refresh is
+	// disabled when zero
+	maxSession time.Duration
+	// basePath prefix the path of every route, without trailing slash
+	basePath string
+	// retryAfter is the Retry-After of the 503 responses, the header is not set when zero
+	retryAfter time.Duration
+	// statusCodes override the status code of the ServerErrors, keyed by name
+	statusCodes map[string]int
+	// gzip compress the responses of at least gzipMinSize bytes
+	gzip        bool
+	gzipMinSize int
+
+	registry *prometheus.Registry
+	metrics  *metrics
+	tracer   trace.Tracer
+	log      zerolog.Logger
 }
 
 func NewInstance(opts ...Option) (*Instance, error) {
 	s := &Instance{
-		m: []mux.MiddlewareFunc{},
+		m:                 []mux.MiddlewareFunc{},
+		maxBodySize:       DefaultMaxBodySize,
+		maxUsernameLength: types.DefaultMaxUsernameLength,
+		retryAfter:        DefaultRetryAfter,
+		tlsMinVersion:     tlsVersions[DefaultTLSMinVersion],
+		tracer:            trace.NewNoopTracerProvider().Tracer(tracerName),
+		log:               log.Logger,
+		srv: &http.Server{
+			ReadHeaderTimeout: DefaultReadHeaderTimeout,
+			ReadTimeout:       DefaultReadTimeout,
+			WriteTimeout:      DefaultWriteTimeout,
+			IdleTimeout:       DefaultIdleTimeout,
+		},
 	}
 
 	log.Info().Msg("Applying extra options.")
@@ -43,183 +153,606 @@ func NewInstance(opts ...Option) (*Instance, error) {
 		}
 	}
 
+	if s.revoker == nil {
+		s.revoker = newMemoryRevoker()
+	}
+
+	if s.tls != nil {
+		if len(s.tlsCipherSuites) > 0 && s.tlsMinVersion >= tls.VersionTLS13 {
+			return nil, fmt.Errorf("The cipher suites cannot be configured when the minimum TLS version is 1.3")
+		}
+
+		s.tls.MinVersion = s.tlsMinVersion
+		s.tls.CipherSuites = s.tlsCipherSuites
+	}
+
+	if s.clientCAs != nil {
+		if s.tls == nil {
+			return nil, fmt.Errorf("Client certificates can only be verified when serving over TLS")
+		}
+
+		// /auth is called by users without certificates, only /token requires one
+		s.tls.ClientCAs = s.clientCAs
+		s.tls.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	if s.lastLookup != nil && s.clientCAs == nil {
+		return nil, fmt.Errorf("The last lookup requires the client certificates to be verified, see WithClientCAFile")
+	}
+
+	if s.pprof && s.clientCAs == nil {
+		return nil, fmt.Errorf("The profiles require the client certificates to be verified, see WithClientCAFile")
+	}
+
+	var looker GroupLooker
+	if s.groupLookup {
+		if s.clientCAs == nil {
+			return nil, fmt.Errorf("The group lookup requires the client certificates to be verified, see WithClientCAFile")
+		}
+
+		var ok bool
+		if looker, ok = s.l.(GroupLooker); !ok {
+			return nil, fmt.Errorf("The searcher cannot look the user groups up")
+		}
+	}
+
 	r := mux.NewRouter()
 
-	log.Info().Msg("Registering route handlers.")
-	r.HandleFunc("/auth", s.authenticate()).Methods("POST")
-	r.HandleFunc("/token", s.validate()).Methods("POST")
-	r.Handle("/health", healthcheck.Handler(
-		healthcheck.WithTimeout(5*time.Second),
-		healthcheck.WithChecker(
-			"ldap", healthcheck.CheckerFunc(
-				func(_ context.Context) error {
-					c, err := s.l.Bind()
-
-					if err != nil {
-						return err
-					}
-
-					defer c.Close()
-
-					return nil
-				},
-			),
-		),
-	))
-
-	log.Info().Msg("Applying middlewares.")
+	// every route is served below the base path, nothing is served outside of it
+	routes := r
+	if s.basePath != "" {
+		routes = r.PathPrefix(s.basePath).Subrouter()
+	}
+
+	s.log.Info().Str("base_path", s.basePath).Msg("Registering route handlers.")
+	var authenticate http.Handler = s.authenticate()
+	for i := len(s.am) - 1; i >= 0; i-- {
+		authenticate = s.am[i](authenticate)
+	}
+
+	routes.Handle("/auth", authenticate).Methods("POST")
+	if len(s.realms) > 0 {
+		routes.Handle("/auth/{realm}", authenticate).Methods("POST")
+	}
+	var validate http.Handler = s.validate()
+	if s.clientCAs != nil {
+		validate = middlewares.RequireClientCert(validate)
+	}
+
+	routes.Handle("/token", validate).Methods("POST")
+	if s.maxSession > 0 {
+		routes.HandleFunc("/refresh", s.refresh()).Methods("POST")
+	}
+	if s.userinfo {
+		routes.HandleFunc("/userinfo", s.userinfoHandler()).Methods("GET", "POST")
+	}
+	if looker != nil {
+		routes.Handle("/groups/{username}", middlewares.RequireClientCert(s.groupLookupHandler(looker))).Methods("GET")
+	}
+	routes.Handle("/health", s.readiness())
+	routes.Handle("/healthz", s.liveness())
+	routes.Handle("/readyz", s.readiness())
+	routes.HandleFunc("/.well-known/jwks.json", s.jwks()).Methods("GET")
+
+	if s.lastLookup != nil {
+		routes.Handle("/debug/lastlookup", middlewares.RequireClientCert(s.lastLookupHandler())).Methods("GET")
+	}
+
+	if s.pprof {
+		s.registerPprof(routes)
+	}
+
+	if s.registry != nil {
+		routes.Handle("/metrics", promhttp.HandlerFor(s.registry, promhttp.HandlerOpts{}))
+	}
+
+	r.MethodNotAllowedHandler = s.methodNotAllowed(r)
+
+	s.log.Info().Msg("Applying middlewares.")
+	if s.gzip {
+		r.Use(middlewares.Gzip(s.gzipMinSize))
+	}
+	if s.retryAfter > 0 {
+		r.Use(middlewares.RetryAfter(s.retryAfter))
+	}
 	r.Use(s.m...)
+	// inside the access logs as well, so that they record the 500 of a panicking handler
+	r.Use(s.recovery)
 
-	http.Handle("/", r)
+	s.h = r
+	if s.cors != nil {
+		s.h = s.cors(r)
+	}
+	// so that every response and log line carries the request id, even the preflight and
+	// method not allowed ones
+	s.h = middlewares.RequestID(s.h)
+	// outermost so that the panics of every other layer are recovered
+	s.h = s.recovery(s.h)
+	s.srv.Handler = s.h
 
 	return s, nil
 }
 
-func (s *Instance) Start(addr string) error {
-	if err := http.ListenAndServe(addr, nil); err != http.ErrServerClosed {
-		return fmt.Errorf("Server stopped unexpectedly, %w", err)
+// Validate check the searcher configuration against its backend, see ldap.Validate. Meant to
+// be called before Start so that a broken configuration is reported right away. Searchers
+// that are not a Validator are always valid. The searchers of the realms are validated too.
+func (s *Instance) Validate(ctx context.Context) error {
+	for _, r := range s.searchers() {
+		if v, ok := r.searcher.(Validator); ok {
+			if err := v.Validate(ctx); err != nil {
+				if r.realm != "" {
+					return fmt.Errorf("Realm '%s', %w", r.realm, err)
+				}
+
+				return err
+			}
+		}
 	}
 
 	return nil
 }
 
-func writeExecCredentialError(res http.ResponseWriter, s *ServerError) {
-	res.WriteHeader(s.s)
+// Start listen on addr and serve requests until Shutdown is called. An addr of the form
+// unix:///path/to/socket listens on a unix socket, see StartUnix.
+func (s *Instance) Start(addr string) error {
+	if strings.HasPrefix(addr, UnixScheme) {
+		return s.StartUnix(strings.TrimPrefix(addr, UnixScheme))
+	}
 
-	ec := client.ExecCredential{
-		Spec: client.ExecCredentialSpec{},
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("Could not listen on %s, %w", addr, err)
 	}
 
-	res.Header().Set(ContentTypeHeader, ContentTypeJSON)
-	json.NewEncoder(res).Encode(ec)
+	return s.serve(l)
+}
+
+// StartUnix listen on a unix socket created at socketPath and serve requests until Shutdown
+// is called. The socket can only be connected to by its owner and group, it is removed once
+// the server stopped. A socket left over by a previous run is replaced, any other file at
+// socketPath is an error.
+func (s *Instance) StartUnix(socketPath string) error {
+	if info, err := os.Lstat(socketPath); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return fmt.Errorf("Could not listen on %s, the file exists and is not a socket", socketPath)
+		}
+
+		if err := os.Remove(socketPath); err != nil {
+			return fmt.Errorf("Could not remove the stale socket %s, %w", socketPath, err)
+		}
+	}
+
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return fmt.Errorf("Could not listen on %s, %w", socketPath, err)
+	}
+
+	// closing the listener on shutdown removes the socket file
+	if err := os.Chmod(socketPath, 0660); err != nil {
+		l.Close()
+		return fmt.Errorf("Could not restrict the permissions of %s, %w", socketPath, err)
+	}
+
+	return s.serve(l)
+}
+
+func (s *Instance) serve(l net.Listener) error {
+	if s.tls != nil {
+		s.log.Info().Str("addr", l.Addr().String()).Msg("Serving requests over TLS.")
+		l = tls.NewListener(l, s.tls)
+	} else {
+		s.log.Info().Str("addr", l.Addr().String()).Msg("Serving requests.")
+	}
+
+	if err := s.srv.Serve(l); err != http.ErrServerClosed {
+		return fmt.Errorf("Server stopped unexpectedly, %w", err)
+	}
+
+	return nil
+}
+
+// Shutdown stop accepting new connections and wait for the in-flight requests to complete,
+// or for ctx to be done
+func (s *Instance) Shutdown(ctx context.Context) error {
+	s.log.Info().Msg("Shutting down, draining in-flight requests.")
+
+	return s.srv.Shutdown(ctx)
 }
 
 func (s *Instance) authenticate() http.HandlerFunc {
 	return func(res http.ResponseWriter, req *http.Request) {
-		if req.Header.Get(ContentTypeHeader) != ContentTypeJSON {
-			writeExecCredentialError(res, ErrNotAcceptable)
+		logger := s.logger(req)
+
+		ctx, span := s.startSpan(req, "authenticate")
+		defer span.End()
+
+		version := ExecCredentialV1beta1
+		var credentials types.Credentials
+
+		searcher, realm, ok := s.searcher(req)
+		if !ok {
+			logger.Debug().Str("realm", realm).Msg("Rejected authentication request, unknown realm.")
+			s.attempt(req, credentials.Username, reasonUnknownRealm)
+			s.writeExecCredentialError(res, version, ErrRealmNotFound)
 			return
+		} else if realm != "" {
+			l := logger.With().Str("realm", realm).Logger()
+			logger = &l
+			span.SetAttributes(attribute.String("realm", realm))
 		}
 
-		decoder := json.NewDecoder(req.Body)
-		var credentials types.Credentials
-		if err := decoder.Decode(&credentials); err != nil {
-			writeExecCredentialError(res, ErrDecodeFailed)
+		if !negotiate(req.Header.Get(ContentTypeHeader), req.Header.Get("Accept")) {
+			logger.Debug().Str("content_type", req.Header.Get(ContentTypeHeader)).Str("accept", req.Header.Get("Accept")).Msg("Rejected authentication request, not json.")
+			s.attempt(req, credentials.Username, reasonNotAcceptable)
+			s.writeExecCredentialError(res, version, ErrNotAcceptable)
+			return
+		}
+
+		decoder := json.NewDecoder(http.MaxBytesReader(res, req.Body, s.maxBodySize))
+		if err := decoder.Decode(&credentials); isTooLarge(err) {
+			logger.Debug().Int64("max_body_size", s.maxBodySize).Msg("Rejected authentication request, body too large.")
+			s.attempt(req, credentials.Username, reasonTooLarge)
+			s.writeExecCredentialError(res, version, ErrRequestTooLarge)
+			return
+		} else if err != nil {
+			logger.Debug().Err(err).Msg("Could not decode authentication request.")
+			s.attempt(req, credentials.Username, reasonDecodeFailed)
+			s.writeExecCredentialError(res, version, ErrDecodeFailed)
 			return
 		}
 		defer req.Body.Close()
 
-		if !credentials.IsValid() {
-			writeExecCredentialError(res, ErrMalformedCredentials)
+		if credentials.APIVersion != "" {
+			if !supportedExecCredential(credentials.APIVersion) {
+				s.attempt(req, credentials.Username, reasonMalformedCredentials)
+				s.writeExecCredentialError(res, version, ErrMalformedCredentials)
+				return
+			}
+
+			version = credentials.APIVersion
+		}
+
+		if err := credentials.Validate(s.maxUsernameLength); err != nil {
+			logger.Debug().Err(err).Msg("Rejected malformed credentials.")
+			s.attempt(req, credentials.Username, reasonMalformedCredentials)
+			s.writeExecCredentialError(res, version, ErrMalformedCredentials)
 			return
 		}
 
-		log.Debug().Str("username", credentials.Username).Msg("Received valid authentication request.")
-		user, err := s.l.Search(credentials.Username, credentials.Password)
+		logger.Debug().Str("username", credentials.Username).Msg("Received valid authentication request.")
+
+		lockoutKey := lockoutKey(realm, credentials.Username)
+		if s.lockout.locked(lockoutKey) {
+			logger.Info().Str("username", credentials.Username).Msg("User is locked out.")
+			s.attempt(req, credentials.Username, reasonLockedOut)
+			s.writeExecCredentialError(res, version, ErrUnauthorized)
+			return
+		}
+
+		span.SetAttributes(attribute.String("enduser.id", credentials.Username))
+
+		start := time.Now()
+		user, err := searcher.Search(ctx, credentials.Username, credentials.Password)
+		s.lastLookup.record(credentials.Username, time.Since(start), err)
 		if err != nil {
-			writeExecCredentialError(res, ErrUnauthorized)
+			span.SetStatus(codes.Error, err.Error())
+		}
+
+		if errors.Is(err, ldap.ErrTimeout) {
+			logger.Error().Err(err).Str("username", credentials.Username).Msg("Ldap server did not answer in time.")
+			s.attempt(req, credentials.Username, reasonTimeout)
+			s.writeExecCredentialError(res, version, ErrGatewayTimeout)
+			return
+		} else if err != nil {
+			var tooMany *ldap.TooManyEntriesError
+
+			// the reason is only logged, the client get a generic answer telling apart the
+			// rejected credentials from the unavailable directory
+			switch {
+			case errors.Is(err, ldap.ErrUserNotFound):
+				logger.Info().Str("username", credentials.Username).Msg("User not found.")
+				s.attempt(req, credentials.Username, reasonUserNotFound)
+				s.lockout.failure(lockoutKey)
+			case errors.Is(err, ldap.ErrInvalidCredentials):
+				logger.Info().Str("username", credentials.Username).Msg("Invalid credentials.")
+				s.attempt(req, credentials.Username, reasonInvalidCredentials)
+				s.lockout.failure(lockoutKey)
+			case errors.Is(err, ldap.ErrDirectoryUnavailable):
+				logger.Error().Err(err).Str("username", credentials.Username).Msg("Ldap directory unavailable.")
+				s.attempt(req, credentials.Username, reasonDirectoryUnavailable)
+				s.writeExecCredentialError(res, version, ErrServiceUnavailable)
+				return
+			case errors.Is(err, ldap.ErrTooManySearches):
+				logger.Warn().Str("username", credentials.Username).Msg("Too many concurrent ldap searches, the user was not authenticated.")
+				s.attempt(req, credentials.Username, reasonTooManySearches)
+				s.writeExecCredentialError(res, version, ErrServiceUnavailable)
+				return
+			case errors.Is(err, context.Canceled):
+				logger.Info().Str("username", credentials.Username).Msg("Request canceled before the user was authenticated.")
+				s.attempt(req, credentials.Username, reasonCanceled)
+			case errors.As(err, &tooMany):
+				logger.Error().Str("username", tooMany.Username).Int("entries", tooMany.Count).Msg("Several ldap entries matched the user, the search filter is not unique.")
+				s.attempt(req, credentials.Username, reasonTooManyEntries)
+			default:
+				logger.Error().Err(err).Str("username", credentials.Username).Msg("Authentication failed.")
+				s.attempt(req, credentials.Username, reasonError)
+			}
+
+			s.writeExecCredentialError(res, version, ErrUnauthorized)
+			return
+		}
+
+		logger.Debug().Str("username", credentials.Username).Msg("Successfully authenticated.")
+		s.lockout.success(lockoutKey)
+
+		if s.requireGroups && len(user.Groups) == 0 {
+			logger.Warn().Str("username", credentials.Username).Msg("User is member of no group, no token issued.")
+			s.attempt(req, credentials.Username, reasonNoGroups)
+			s.writeExecCredentialError(res, version, ErrUnauthorized)
 			return
 		}
 
-		log.Debug().Str("username", credentials.Username).Msg("Successfully authenticated.")
+		groups, ok := s.groupLimit.apply(user.Groups)
+		if !ok {
+			logger.Warn().Str("username", credentials.Username).Int("groups", len(user.Groups)).Int("max_groups", s.groupLimit.max).Msg("User is member of too many groups, no token issued.")
+			s.attempt(req, credentials.Username, reasonTooManyGroups)
+			s.writeExecCredentialError(res, version, ErrUnauthorized)
+			return
+		} else if len(groups) < len(user.Groups) {
+			logger.Warn().Str("username", credentials.Username).Int("groups", len(user.Groups)).Int("max_groups", s.groupLimit.max).Msg("User is member of too many groups, truncated the token groups.")
+			user.Groups = groups
+		}
 
-		token, err := types.NewToken(user, s.ttl)
+		// the realm is kept by the refreshed tokens, it is part of the user
+		if realm != "" {
+			user = user.DeepCopy()
+			if user.Extra == nil {
+				user.Extra = map[string]auth.ExtraValue{}
+			}
+			user.Extra[RealmExtraKey] = auth.ExtraValue{realm}
+		}
+
+		token, err := types.NewToken(user, s.ttl, s.tokenOptions...)
 		if err != nil {
-			writeExecCredentialError(res, ErrServerError)
+			s.attempt(req, credentials.Username, reasonError)
+			s.writeExecCredentialError(res, version, ErrServerError)
 			return
 		}
 
 		tokenData, err := token.Payload(s.k)
 		if err != nil {
-			writeExecCredentialError(res, ErrServerError)
+			s.attempt(req, credentials.Username, reasonError)
+			s.writeExecCredentialError(res, version, ErrServerError)
 			return
 		}
 
 		tokenExp, err := token.Expiration()
 		if err != nil {
-			writeExecCredentialError(res, ErrServerError)
+			s.attempt(req, credentials.Username, reasonError)
+			s.writeExecCredentialError(res, version, ErrServerError)
 			return
 		}
 
-		log.Debug().Str("username", credentials.Username).Str("token", string(tokenData)).Msg("Sending back token.")
+		s.attempt(req, credentials.Username, reasonSuccess)
+
+		// never log the token itself, it would be enough to impersonate the user
+		logger.Info().Str("username", credentials.Username).Str("jti", token.ID()).Time("expires", tokenExp).Msg("Issued token.")
+
+		writeExecCredential(res, version, string(tokenData), tokenExp)
+	}
+}
 
-		res.Header().Set(ContentTypeHeader, ContentTypeJSON)
-		json.NewEncoder(res).Encode(client.ExecCredential{
-			Status: &client.ExecCredentialStatus{
-				Token: string(tokenData),
-				ExpirationTimestamp: &machinery.Time{
-					Time: tokenExp,
-				},
-			},
-		})
+// logger return the logger of a request, carrying its id, see middlewares.RequestID
+func (s *Instance) logger(req *http.Request) *zerolog.Logger {
+	id := middlewares.GetRequestID(req.Context())
+	if id == "" {
+		return &s.log
 	}
+
+	l := s.log.With().Str("request_id", id).Logger()
+
+	return &l
+}
+
+// verificationKeys return the signing key followed by the retired keys
+func (s *Instance) verificationKeys() []*types.Key {
+	return append([]*types.Key{s.k}, s.retired...)
 }
 
-func writeError(res http.ResponseWriter, s *ServerError) {
-	res.WriteHeader(s.s)
-	res.Write([]byte(s.e.Error()))
+func (s *Instance) writeError(res http.ResponseWriter, e *ServerError) {
+	code := s.statusCode(e)
+
+	res.Header().Set(ContentTypeHeader, ContentTypeJSON)
+	res.WriteHeader(code)
+	json.NewEncoder(res).Encode(errorResponse{
+		Error: e.Error(),
+		Code:  code,
+	})
+}
+
+// honoredAudiences return the audiences of a TokenReview the token is valid for, the
+// intersection of the requested ones with the token aud claim, and whether there is any.
+// Without requested audiences, the token ones are returned. Tokens issued without audience
+// are valid for any of them only when the server has no audience either, they are valid for
+// none otherwise.
+func honoredAudiences(requested, aud []string, audience string) ([]string, bool) {
+	if len(aud) == 0 && audience != "" {
+		return nil, false
+	}
+
+	if len(requested) == 0 {
+		return aud, true
+	}
+
+	if len(aud) == 0 {
+		return requested, true
+	}
+
+	var honored []string
+	for _, a := range requested {
+		for _, b := range aud {
+			if a == b {
+				honored = append(honored, a)
+				break
+			}
+		}
+	}
+
+	return honored, len(honored) > 0
 }
 
-func writeTokenReviewError(res http.ResponseWriter, s *ServerError, tr auth.TokenReview) {
-	res.WriteHeader(s.s)
+// writeTokenReview answer the TokenReview with its status, authenticated or not
+func writeTokenReview(res http.ResponseWriter, tr auth.TokenReview) {
+	res.Header().Set(ContentTypeHeader, ContentTypeJSON)
+	json.NewEncoder(res).Encode(tr)
+}
 
+func (s *Instance) writeTokenReviewError(res http.ResponseWriter, e *ServerError, tr auth.TokenReview) {
 	tr.Status.Authenticated = false
-	tr.Status.Error = s.e.Error()
+	tr.Status.Error = e.Error()
 
 	res.Header().Set(ContentTypeHeader, ContentTypeJSON)
+	res.WriteHeader(s.statusCode(e))
 	json.NewEncoder(res).Encode(tr)
 }
 
 func (s *Instance) validate() http.HandlerFunc {
 	return func(res http.ResponseWriter, req *http.Request) {
-		log.Debug().Msg("Got a request.")
+		logger := s.logger(req)
+
+		_, span := s.startSpan(req, "validate")
+		defer span.End()
 
-		if req.Header.Get(ContentTypeHeader) != ContentTypeJSON {
-			writeError(res, ErrNotAcceptable)
+		logger.Debug().Msg("Got a request.")
+
+		if !negotiate(req.Header.Get(ContentTypeHeader), req.Header.Get("Accept")) {
+			logger.Debug().Str("content_type", req.Header.Get(ContentTypeHeader)).Str("accept", req.Header.Get("Accept")).Msg("Rejected token review, not json.")
+			s.metrics.validation(reasonNotAcceptable)
+			s.writeError(res, ErrNotAcceptable)
 			return
 		}
 
-		log.Debug().Msg("Request is in JSON.")
+		logger.Debug().Msg("Request is in JSON.")
 
-		decoder := json.NewDecoder(req.Body)
+		decoder := json.NewDecoder(http.MaxBytesReader(res, req.Body, s.maxBodySize))
 		var tr auth.TokenReview
-		if err := decoder.Decode(&tr); err != nil {
-			writeError(res, ErrDecodeFailed)
+		if err := decoder.Decode(&tr); isTooLarge(err) {
+			logger.Debug().Int64("max_body_size", s.maxBodySize).Msg("Rejected token review, body too large.")
+			s.metrics.validation(reasonTooLarge)
+			s.writeError(res, ErrRequestTooLarge)
+			return
+		} else if err != nil {
+			logger.Debug().Err(err).Msg("Could not decode token review.")
+			s.metrics.validation(reasonDecodeFailed)
+			s.writeError(res, ErrDecodeFailed)
 			return
 		}
 		defer req.Body.Close()
 
-		log.Debug().Str("token", tr.Spec.Token).Msg("Request is a TokenReview.")
+		if tr.Kind != "" && tr.Kind != tokenReviewKind {
+			s.metrics.validation(reasonDecodeFailed)
+			s.writeError(res, ErrNotATokenReview)
+			return
+		}
 
-		token, err := types.Parse([]byte(tr.Spec.Token), s.k)
-		if err != nil {
-			log.Debug().Str("err", err.Error()).Msg("Failed to parse token")
+		switch tr.APIVersion {
+		case "":
+			tr.APIVersion = TokenReviewV1
+		case TokenReviewV1, TokenReviewV1beta1:
+		default:
+			s.metrics.validation(reasonDecodeFailed)
+			s.writeError(res, ErrUnsupportedVersion)
+			return
+		}
+		// the answer has the same kind and apiVersion as the request, both versions share
+		// the same schema
+		tr.Kind = tokenReviewKind
 
-			writeTokenReviewError(res, ErrMalformedToken, tr)
+		logger.Debug().Str("api_version", tr.APIVersion).Msg("Request is a TokenReview.")
+
+		// only garbage is an error, the well formed tokens that are rejected are answered as
+		// not authenticated like the api server expects
+		token, err := types.Parse([]byte(tr.Spec.Token), s.verificationKeys(), s.tokenOptions...)
+		if err != nil {
+			switch {
+			case errors.Is(err, types.ErrMalformedToken):
+				logger.Debug().Str("err", err.Error()).Msg("Failed to parse token")
+				s.metrics.validation(reasonMalformedToken)
+				s.writeTokenReviewError(res, ErrMalformedToken, tr)
+			case errors.Is(err, types.ErrInvalidSignature):
+				logger.Info().Str("err", err.Error()).Msg("TokenReview signature is not valid.")
+				s.metrics.validation(reasonInvalidSignature)
+				writeTokenReview(res, tr)
+			case errors.Is(err, types.ErrInvalidClaims):
+				logger.Debug().Str("err", err.Error()).Msg("TokenReview is not valid.")
+				s.metrics.validation(reasonExpired)
+				writeTokenReview(res, tr)
+			case errors.Is(err, types.ErrUnsupportedTokenVersion):
+				logger.Warn().Str("err", err.Error()).Msg("TokenReview was issued by a newer version.")
+				s.metrics.validation(reasonUnsupportedVersion)
+				writeTokenReview(res, tr)
+			default:
+				logger.Error().Err(err).Msg("Could not verify the token.")
+				s.metrics.validation(reasonError)
+				s.writeTokenReviewError(res, ErrServerError, tr)
+			}
 			return
 		}
 
-		log.Debug().Msg("TokenReview was parsed.")
+		logger.Debug().Msg("TokenReview was parsed.")
+
+		revoked := false
+		if id := token.ID(); id != "" {
+			revoked, err = s.revoker.IsRevoked(id)
+			if err != nil {
+				logger.Error().Err(err).Msg("Could not check whether the token was revoked.")
+
+				s.metrics.validation(reasonError)
+				s.writeTokenReviewError(res, ErrServerError, tr)
+				return
+			}
+		}
+
+		audiences, audienceMatch := honoredAudiences(tr.Spec.Audiences, token.Audiences(), s.audience)
 
 		if token.IsValid() == false {
-			log.Debug().Msg("TokenReview is not valid.")
+			logger.Debug().Str("jti", token.ID()).Msg("TokenReview is not valid.")
+			s.metrics.validation(reasonExpired)
+			tr.Status.Authenticated = false
+		} else if revoked {
+			logger.Info().Str("jti", token.ID()).Msg("Token was revoked.")
+			s.metrics.validation(reasonRevoked)
+			tr.Status.Authenticated = false
+		} else if !audienceMatch {
+			logger.Info().Strs("audiences", tr.Spec.Audiences).Strs("aud", token.Audiences()).Msg("Token is not valid for any of the requested audiences.")
+			s.metrics.validation(reasonAudienceMismatch)
 			tr.Status.Authenticated = false
 		} else {
 			user, err := token.GetUser()
 			if err != nil {
-				log.Debug().Str("error", err.Error()).Msg("Could not extract user.")
+				logger.Debug().Str("error", err.Error()).Msg("Could not extract user.")
 
-				writeTokenReviewError(res, ErrServerError, tr)
+				s.metrics.validation(reasonError)
+				s.writeTokenReviewError(res, ErrServerError, tr)
 				return
 			}
 
-			log.Debug().Msg("Got user from token.")
+			span.SetAttributes(attribute.String("enduser.id", user.Username))
 
-			tr.Status.Authenticated = true
-			tr.Status.User = *user
+			if !s.groupPolicy.permits(user.Groups) {
+				logger.Info().Str("username", user.Username).Strs("groups", user.Groups).Msg("User groups are not allowed.")
+				s.metrics.validation(reasonGroupDenied)
+				tr.Status.Authenticated = false
+			} else {
+				logger.Debug().Str("username", user.Username).Str("jti", token.ID()).Msg("Authenticated token.")
+				s.metrics.validation(reasonSuccess)
+
+				tr.Status.Authenticated = true
+				tr.Status.User = *user
+				tr.Status.Audiences = audiences
+			}
 		}
 
-		res.Header().Set(ContentTypeHeader, ContentTypeJSON)
-		json.NewEncoder(res).Encode(tr)
+		writeTokenReview(res, tr)
 	}
 }
@@ -0,0 +1,1531 @@
+package server
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/lestrrat-go/jwx/jwt"
+	"github.com/rs/zerolog"
+
+	auth "k8s.io/api/authentication/v1"
+	clientv1beta1 "k8s.io/client-go/pkg/apis/clientauthentication/v1beta1"
+
+	"vbouchaud/k8s-ldap-auth/internal/ldaptest"
+	"vbouchaud/k8s-ldap-auth/ldap"
+	"vbouchaud/k8s-ldap-auth/server/middlewares"
+	"vbouchaud/k8s-ldap-auth/types"
+)
+
+// unreachableLdap return the url of a port nothing listens on
+func unreachableLdap(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to find a free port, %s", err)
+	}
+
+	addr := l.Addr().String()
+	l.Close()
+
+	return "ldap://" + addr
+}
+
+func newTestInstance(t *testing.T, opts ...Option) *Instance {
+	opts = append([]Option{
+		WithLdap(
+			[]string{unreachableLdap(t)},
+			"cn=admin,dc=corp",
+			"password",
+			nil,
+			ldap.ScopeWholeSubtree,
+			"(uid=%s)",
+			"memberof",
+			"uid",
+			nil,
+			ldap.WithDialTimeout(time.Second),
+		),
+		WithKey("", ""),
+		WithTTL(60),
+	}, opts...)
+
+	s, err := NewInstance(opts...)
+	if err != nil {
+		t.Fatalf("NewInstance() error = %s", err)
+	}
+
+	return s
+}
+
+func TestHealth(t *testing.T) {
+	s := newTestInstance(t)
+
+	tests := []struct {
+		name string
+		path string
+		want int
+	}{
+		{
+			name: "Liveness",
+			path: "/healthz",
+			want: http.StatusOK,
+		},
+		{
+			name: "Readiness with a down directory",
+			path: "/readyz",
+			want: http.StatusServiceUnavailable,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := httptest.NewRecorder()
+			s.h.ServeHTTP(res, httptest.NewRequest(http.MethodGet, tt.path, nil))
+
+			if res.Code != tt.want {
+				t.Errorf("GET %s = %d, want %d", tt.path, res.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+		want int
+	}{
+		{name: "default", want: int(DefaultRetryAfter.Seconds())},
+		{name: "configured", opts: []Option{WithRetryAfter(5 * time.Second)}, want: 5},
+		{name: "disabled", opts: []Option{WithRetryAfter(0)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestInstance(t, tt.opts...)
+
+			res := httptest.NewRecorder()
+			s.h.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+			if res.Code != http.StatusServiceUnavailable {
+				t.Fatalf("GET /readyz with a down directory = %d, want %d", res.Code, http.StatusServiceUnavailable)
+			}
+
+			header := res.Header().Get(middlewares.RetryAfterHeader)
+			if tt.want == 0 {
+				if header != "" {
+					t.Errorf("%s = %q, want none", middlewares.RetryAfterHeader, header)
+				}
+				return
+			}
+
+			if got, err := strconv.Atoi(header); err != nil || got != tt.want {
+				t.Errorf("%s = %q, want %d seconds", middlewares.RetryAfterHeader, header, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuthDirectoryUnavailable(t *testing.T) {
+	srv := directory(t)
+
+	tests := []struct {
+		name       string
+		opts       []Option
+		password   string
+		code       int
+		retryAfter bool
+	}{
+		{name: "down directory", password: "secret", code: http.StatusServiceUnavailable, retryAfter: true},
+		{name: "bad password", opts: []Option{withDirectory(srv)}, password: "wrong", code: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestInstance(t, tt.opts...)
+
+			req := httptest.NewRequest(http.MethodPost, "/auth", strings.NewReader(`{"username":"john","password":"`+tt.password+`"}`))
+			req.Header.Set(ContentTypeHeader, ContentTypeJSON)
+
+			res := httptest.NewRecorder()
+			s.h.ServeHTTP(res, req)
+
+			if res.Code != tt.code {
+				t.Fatalf("POST /auth = %d, want %d", res.Code, tt.code)
+			}
+
+			if got := res.Header().Get(middlewares.RetryAfterHeader) != ""; got != tt.retryAfter {
+				t.Errorf("%s set = %v, want %v", middlewares.RetryAfterHeader, got, tt.retryAfter)
+			}
+		})
+	}
+}
+
+func TestAuthTooManySearches(t *testing.T) {
+	srv := directory(t)
+	s := newTestInstance(t, withDirectory(srv, ldap.WithOperationTimeout(time.Minute), ldap.WithMaxConcurrentSearches(1, 0)))
+
+	// the only search allowed never ends, the server never answers it
+	srv.StallSearches()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.l.Search(ctx, "john", "secret")
+	}()
+	defer func() { cancel(); <-done }()
+
+	// the search holds the only slot once it bound as the service account
+	for len(srv.Binds()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/auth", strings.NewReader(`{"username":"john","password":"secret"}`))
+	req.Header.Set(ContentTypeHeader, ContentTypeJSON)
+
+	res := httptest.NewRecorder()
+	s.h.ServeHTTP(res, req)
+
+	if res.Code != http.StatusServiceUnavailable {
+		t.Fatalf("POST /auth beyond the concurrent searches limit = %d, want %d", res.Code, http.StatusServiceUnavailable)
+	}
+
+	if res.Header().Get(middlewares.RetryAfterHeader) == "" {
+		t.Errorf("%s not set, want it set", middlewares.RetryAfterHeader)
+	}
+}
+
+func TestGzip(t *testing.T) {
+	groups := make([]string, 200)
+	for i := range groups {
+		groups[i] = "group-" + strconv.Itoa(i)
+	}
+
+	searcher := fakeSearcher{
+		"john": {password: "secret", user: auth.UserInfo{UID: "1000", Username: "john", Groups: groups}},
+	}
+
+	s := newTestInstance(t, WithSearcher(searcher), WithGzip(middlewares.DefaultGzipMinSize))
+
+	req := httptest.NewRequest(http.MethodPost, "/auth", strings.NewReader(`{"username":"john","password":"secret"}`))
+	req.Header.Set(ContentTypeHeader, ContentTypeJSON)
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	res := httptest.NewRecorder()
+	s.h.ServeHTTP(res, req)
+
+	if res.Code != http.StatusOK {
+		t.Fatalf("POST /auth = %d, want %d", res.Code, http.StatusOK)
+	}
+
+	if got := res.Header().Get("Content-Encoding"); got != "gzip" {
+		t.Fatalf("Content-Encoding = %q, want gzip", got)
+	}
+
+	r, err := gzip.NewReader(res.Body)
+	if err != nil {
+		t.Fatalf("Body is not gzip encoded, %s", err)
+	}
+
+	var ec clientv1beta1.ExecCredential
+	if err := json.NewDecoder(r).Decode(&ec); err != nil {
+		t.Fatalf("Failed to decode the ExecCredential, %s", err)
+	}
+
+	token, err := types.Parse([]byte(ec.Status.Token), s.verificationKeys())
+	if err != nil {
+		t.Fatalf("Parse() error = %s", err)
+	}
+
+	user, err := token.GetUser()
+	if err != nil {
+		t.Fatalf("GetUser() error = %s", err)
+	}
+
+	if len(user.Groups) != len(groups) {
+		t.Errorf("token groups = %d, want %d", len(user.Groups), len(groups))
+	}
+}
+
+func TestReadinessKey(t *testing.T) {
+	srv := directory(t)
+
+	tests := []struct {
+		name  string
+		nokey bool
+		want  int
+	}{
+		{name: "usable key", want: http.StatusOK},
+		{name: "missing key", nokey: true, want: http.StatusServiceUnavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestInstance(t, withDirectory(srv))
+			if tt.nokey {
+				s.k = nil
+			}
+
+			res := httptest.NewRecorder()
+			s.h.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+			if res.Code != tt.want {
+				t.Fatalf("GET /readyz = %d, want %d", res.Code, tt.want)
+			}
+
+			if tt.nokey && !strings.Contains(res.Body.String(), types.ErrPrivKeyNotFound.Error()) {
+				t.Errorf("GET /readyz body = %s, want the key error", res.Body.String())
+			}
+		})
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	entered := make(chan struct{})
+	release := make(chan struct{})
+
+	s := newTestInstance(t, WithMiddleware(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			close(entered)
+			<-release
+			next.ServeHTTP(res, req)
+		})
+	}))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen, %s", err)
+	}
+
+	served := make(chan error, 1)
+	go func() {
+		served <- s.serve(l)
+	}()
+
+	responses := make(chan *http.Response, 1)
+	go func() {
+		res, err := http.Get("http://" + l.Addr().String() + "/healthz")
+		if err != nil {
+			t.Errorf("In-flight request failed, %s", err)
+			close(responses)
+			return
+		}
+		res.Body.Close()
+		responses <- res
+	}()
+
+	<-entered
+
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- s.Shutdown(context.Background())
+	}()
+
+	select {
+	case err := <-stopped:
+		t.Fatalf("Shutdown() returned before the in-flight request completed, err = %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+
+	if res, ok := <-responses; ok && res.StatusCode != http.StatusOK {
+		t.Errorf("In-flight request = %d, want %d", res.StatusCode, http.StatusOK)
+	}
+
+	if err := <-stopped; err != nil {
+		t.Errorf("Shutdown() error = %s", err)
+	}
+
+	if err := <-served; err != nil {
+		t.Errorf("serve() error = %s", err)
+	}
+}
+
+func TestStartUnix(t *testing.T) {
+	s := newTestInstance(t)
+	socket := filepath.Join(t.TempDir(), "k8s-ldap-auth.sock")
+
+	served := make(chan error, 1)
+	go func() {
+		served <- s.Start(UnixScheme + socket)
+	}()
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+
+	var (
+		res *http.Response
+		err error
+	)
+	// the socket is created once the server started
+	for i := 0; i < 50; i++ {
+		if res, err = client.Get("http://k8s-ldap-auth/healthz"); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("GET /healthz over the unix socket failed, %s", err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("GET /healthz = %d, want %d", res.StatusCode, http.StatusOK)
+	}
+
+	info, err := os.Stat(socket)
+	if err != nil {
+		t.Fatalf("Stat() error = %s", err)
+	}
+
+	if perm := info.Mode().Perm(); perm != 0660 {
+		t.Errorf("socket permissions = %o, want 660", perm)
+	}
+
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Errorf("Shutdown() error = %s", err)
+	}
+
+	if err := <-served; err != nil {
+		t.Errorf("Start() error = %s", err)
+	}
+
+	if _, err := os.Stat(socket); !os.IsNotExist(err) {
+		t.Errorf("Stat() error = %v, want the socket removed on shutdown", err)
+	}
+}
+
+func TestStartUnixNotASocket(t *testing.T) {
+	s := newTestInstance(t)
+	file := filepath.Join(t.TempDir(), "config.yaml")
+
+	if err := ioutil.WriteFile(file, []byte("port: 3000"), 0600); err != nil {
+		t.Fatalf("Failed to write file, %s", err)
+	}
+
+	if err := s.StartUnix(file); err == nil || !strings.Contains(err.Error(), "not a socket") {
+		t.Errorf("StartUnix() error = %v, want a not a socket error", err)
+	}
+
+	if data, _ := ioutil.ReadFile(file); string(data) != "port: 3000" {
+		t.Errorf("The file was modified")
+	}
+}
+
+// selfSignedPEM return a PEM encoded certificate and key valid for 127.0.0.1
+func selfSignedPEM(t *testing.T) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key, %s", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "k8s-ldap-auth"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate, %s", err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key, %s", err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func TestServeTLS(t *testing.T) {
+	certPEM, keyPEM := selfSignedPEM(t)
+	s := newTestInstance(t, WithTLSPEM(certPEM, keyPEM))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen, %s", err)
+	}
+
+	go s.serve(l)
+	defer s.Shutdown(context.Background())
+
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(certPEM)
+	c := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+	}
+
+	res, err := c.Get("https://" + l.Addr().String() + "/healthz")
+	if err != nil {
+		t.Fatalf("GET /healthz over TLS failed, %s", err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("GET /healthz = %d, want %d", res.StatusCode, http.StatusOK)
+	}
+
+	// the tls listener answers plain http requests with a 400
+	if res, err := http.Get("http://" + l.Addr().String() + "/healthz"); err == nil {
+		res.Body.Close()
+		if res.StatusCode == http.StatusOK {
+			t.Errorf("GET /healthz over plain http = %d, want a failure", res.StatusCode)
+		}
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	s := newTestInstance(t)
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		want        *ServerError
+	}{
+		{
+			name:        "Not a json request",
+			contentType: "text/plain",
+			body:        "",
+			want:        ErrNotAcceptable,
+		},
+		{
+			name:        "Undecodable body",
+			contentType: ContentTypeJSON,
+			body:        "{",
+			want:        ErrDecodeFailed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/token", strings.NewReader(tt.body))
+			req.Header.Set(ContentTypeHeader, tt.contentType)
+
+			res := httptest.NewRecorder()
+			s.h.ServeHTTP(res, req)
+
+			if res.Code != tt.want.Code() {
+				t.Errorf("POST /token = %d, want %d", res.Code, tt.want.Code())
+			}
+
+			if got := res.Header().Get(ContentTypeHeader); got != ContentTypeJSON {
+				t.Errorf("%s = %s, want %s", ContentTypeHeader, got, ContentTypeJSON)
+			}
+
+			var body errorResponse
+			if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+				t.Fatalf("Failed to decode the error body, %s", err)
+			}
+
+			if body.Error != tt.want.Error() || body.Code != tt.want.Code() {
+				t.Errorf("error body = %+v, want {Error:%s Code:%d}", body, tt.want.Error(), tt.want.Code())
+			}
+		})
+	}
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	s := newTestInstance(t, WithRefresh(time.Hour))
+
+	tests := []struct {
+		method string
+		path   string
+		allow  string
+	}{
+		{method: http.MethodGet, path: "/auth", allow: "POST"},
+		{method: http.MethodGet, path: "/token", allow: "POST"},
+		{method: http.MethodPut, path: "/refresh", allow: "POST"},
+		{method: http.MethodPost, path: "/.well-known/jwks.json", allow: "GET"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			res := httptest.NewRecorder()
+			s.h.ServeHTTP(res, httptest.NewRequest(tt.method, tt.path, nil))
+
+			if res.Code != http.StatusMethodNotAllowed {
+				t.Errorf("%s %s = %d, want %d", tt.method, tt.path, res.Code, http.StatusMethodNotAllowed)
+			}
+
+			if got := res.Header().Get("Allow"); got != tt.allow {
+				t.Errorf("Allow = %q, want %q", got, tt.allow)
+			}
+		})
+	}
+
+	// unknown routes are still not found
+	res := httptest.NewRecorder()
+	s.h.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/unknown", nil))
+
+	if res.Code != http.StatusNotFound {
+		t.Errorf("GET /unknown = %d, want %d", res.Code, http.StatusNotFound)
+	}
+}
+
+func TestBasePath(t *testing.T) {
+	s := newTestInstance(t, WithBasePath("/k8s-ldap-auth/"))
+
+	tests := []struct {
+		method string
+		path   string
+		code   int
+	}{
+		{method: http.MethodGet, path: "/k8s-ldap-auth/healthz", code: http.StatusOK},
+		{method: http.MethodGet, path: "/k8s-ldap-auth/.well-known/jwks.json", code: http.StatusOK},
+		{method: http.MethodPost, path: "/k8s-ldap-auth/auth", code: http.StatusNotAcceptable},
+		{method: http.MethodPost, path: "/k8s-ldap-auth/token", code: http.StatusNotAcceptable},
+		{method: http.MethodGet, path: "/k8s-ldap-auth/token", code: http.StatusMethodNotAllowed},
+		{method: http.MethodGet, path: "/healthz", code: http.StatusNotFound},
+		{method: http.MethodPost, path: "/auth", code: http.StatusNotFound},
+		{method: http.MethodPost, path: "/token", code: http.StatusNotFound},
+		{method: http.MethodPost, path: "/k8s-ldap-authtoken", code: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			res := httptest.NewRecorder()
+			s.h.ServeHTTP(res, httptest.NewRequest(tt.method, tt.path, nil))
+
+			if res.Code != tt.code {
+				t.Errorf("%s %s = %d, want %d", tt.method, tt.path, res.Code, tt.code)
+			}
+		})
+	}
+
+	if _, err := NewInstance(WithBasePath("k8s-ldap-auth")); err == nil {
+		t.Errorf("NewInstance() with a relative base path error = nil, want an error")
+	}
+}
+
+func TestJWKS(t *testing.T) {
+	s := newTestInstance(t)
+
+	res := httptest.NewRecorder()
+	s.h.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/.well-known/jwks.json", nil))
+
+	if res.Code != http.StatusOK {
+		t.Fatalf("GET /.well-known/jwks.json = %d, want %d", res.Code, http.StatusOK)
+	}
+
+	set, err := jwk.Parse(res.Body.Bytes())
+	if err != nil {
+		t.Fatalf("Failed to parse the JWK Set, %s", err)
+	}
+
+	if key, ok := set.Get(0); !ok || key.KeyID() == "" {
+		t.Fatalf("JWK Set has no identified key")
+	}
+
+	// sign the token the same way /auth does
+	token, err := types.NewToken(&auth.UserInfo{Username: "john"}, s.ttl)
+	if err != nil {
+		t.Fatalf("NewToken() error = %s", err)
+	}
+
+	payload, err := token.Payload(s.k)
+	if err != nil {
+		t.Fatalf("Payload() error = %s", err)
+	}
+
+	if _, err := jwt.Parse(payload, jwt.WithKeySet(set), jwt.WithValidate(true)); err != nil {
+		t.Errorf("Token does not validate against the JWK Set, %s", err)
+	}
+}
+
+func TestWithTTL(t *testing.T) {
+	tests := []struct {
+		name    string
+		ttl     int64
+		wantErr bool
+	}{
+		{
+			name:    "One hour",
+			ttl:     3600,
+			wantErr: false,
+		},
+		{
+			name:    "Zero",
+			ttl:     0,
+			wantErr: true,
+		},
+		{
+			name:    "Negative",
+			ttl:     -60,
+			wantErr: true,
+		},
+		{
+			name:    "Longer than a week",
+			ttl:     MaxTTL + 1,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Instance{}
+			if err := WithTTL(tt.ttl)(s); (err != nil) != tt.wantErr {
+				t.Errorf("WithTTL(%d) error = %v, wantErr %v", tt.ttl, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func rsaKeyPEM(t *testing.T) []byte {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key, %s", err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+}
+
+// signedToken return a token for john signed the same way /auth does
+func signedToken(t *testing.T, keyPEM []byte) string {
+	key, err := types.ParseKey(keyPEM)
+	if err != nil {
+		t.Fatalf("ParseKey() error = %s", err)
+	}
+
+	token, err := types.NewToken(&auth.UserInfo{Username: "john"}, 60)
+	if err != nil {
+		t.Fatalf("NewToken() error = %s", err)
+	}
+
+	payload, err := token.Payload(key)
+	if err != nil {
+		t.Fatalf("Payload() error = %s", err)
+	}
+
+	return string(payload)
+}
+
+// review post a TokenReview for token to /token
+func review(t *testing.T, s *Instance, token string) (int, auth.TokenReview) {
+	body, err := json.Marshal(auth.TokenReview{Spec: auth.TokenReviewSpec{Token: token}})
+	if err != nil {
+		t.Fatalf("Failed to marshal TokenReview, %s", err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/token", strings.NewReader(string(body)))
+	req.Header.Set(ContentTypeHeader, ContentTypeJSON)
+
+	res := httptest.NewRecorder()
+	s.h.ServeHTTP(res, req)
+
+	var tr auth.TokenReview
+	if err := json.NewDecoder(res.Body).Decode(&tr); err != nil {
+		t.Fatalf("Failed to decode TokenReview, %s", err)
+	}
+
+	return res.Code, tr
+}
+
+func TestTokenReviewAudiences(t *testing.T) {
+	tests := []struct {
+		name      string
+		audience  string
+		requested []string
+		// withoutAud issues the token without the server audience
+		withoutAud bool
+		want       []string
+		auth       bool
+	}{
+		{name: "matching", audience: "k8s", requested: []string{"other", "k8s"}, want: []string{"k8s"}, auth: true},
+		{name: "not matching", audience: "k8s", requested: []string{"other"}, auth: false},
+		{name: "none requested", audience: "k8s", want: []string{"k8s"}, auth: true},
+		{name: "token and server without audience", requested: []string{"api"}, want: []string{"api"}, auth: true},
+		{name: "token without audience", audience: "k8s", requested: []string{"k8s"}, withoutAud: true, auth: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestInstance(t, WithAudience(tt.audience))
+
+			opts := s.tokenOptions
+			if tt.withoutAud {
+				opts = newTestInstance(t).tokenOptions
+			}
+
+			token, err := types.NewToken(&auth.UserInfo{Username: "john"}, 60, opts...)
+			if err != nil {
+				t.Fatalf("NewToken() error = %s", err)
+			}
+
+			payload, err := token.Payload(s.k)
+			if err != nil {
+				t.Fatalf("Payload() error = %s", err)
+			}
+
+			body, err := json.Marshal(auth.TokenReview{Spec: auth.TokenReviewSpec{Token: string(payload), Audiences: tt.requested}})
+			if err != nil {
+				t.Fatalf("Failed to marshal TokenReview, %s", err)
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/token", strings.NewReader(string(body)))
+			req.Header.Set(ContentTypeHeader, ContentTypeJSON)
+
+			res := httptest.NewRecorder()
+			s.h.ServeHTTP(res, req)
+
+			var tr auth.TokenReview
+			if err := json.NewDecoder(res.Body).Decode(&tr); err != nil {
+				t.Fatalf("Failed to decode TokenReview, %s", err)
+			}
+
+			if res.Code != http.StatusOK || tr.Status.Authenticated != tt.auth {
+				t.Fatalf("POST /token = %d, authenticated %v, want %d and %v", res.Code, tr.Status.Authenticated, http.StatusOK, tt.auth)
+			}
+
+			if !reflect.DeepEqual(tr.Status.Audiences, tt.want) {
+				t.Errorf("TokenReview audiences = %v, want %v", tr.Status.Audiences, tt.want)
+			}
+		})
+	}
+}
+
+func TestHonoredAudiences(t *testing.T) {
+	tests := []struct {
+		name      string
+		requested []string
+		aud       []string
+		audience  string
+		want      []string
+		ok        bool
+	}{
+		{name: "intersection", requested: []string{"api", "k8s"}, aud: []string{"k8s"}, audience: "k8s", want: []string{"k8s"}, ok: true},
+		{name: "none requested", aud: []string{"k8s"}, audience: "k8s", want: []string{"k8s"}, ok: true},
+		{name: "no audience at all", requested: []string{"api"}, want: []string{"api"}, ok: true},
+		{name: "empty aud on a server with an audience", requested: []string{"k8s"}, audience: "k8s", ok: false},
+		{name: "empty aud on a server with an audience, none requested", audience: "k8s", ok: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := honoredAudiences(tt.requested, tt.aud, tt.audience)
+			if ok != tt.ok || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("honoredAudiences() = %v, %v, want %v, %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestOmitDN(t *testing.T) {
+	srv := directory(t)
+
+	tests := []struct {
+		name   string
+		opts   []ldap.Option
+		uid    string
+		omitDN bool
+	}{
+		{name: "dn kept", uid: "uid=john,ou=people,dc=corp"},
+		{name: "dn omitted", opts: []ldap.Option{ldap.WithoutDN()}, uid: "john", omitDN: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestInstance(t, withDirectory(srv, tt.opts...))
+
+			code, ec := issueToken(t, s, "john", "secret")
+			if code != http.StatusOK {
+				t.Fatalf("POST /auth = %d, want %d", code, http.StatusOK)
+			}
+
+			token, err := types.Parse([]byte(ec.Status.Token), s.verificationKeys())
+			if err != nil {
+				t.Fatalf("Parse() error = %s", err)
+			}
+
+			user, err := token.GetUser()
+			if err != nil {
+				t.Fatalf("GetUser() error = %s", err)
+			}
+
+			if user.UID != tt.uid {
+				t.Errorf("token uid = %q, want %q", user.UID, tt.uid)
+			}
+
+			payload, _ := json.Marshal(user)
+			if tt.omitDN && strings.Contains(string(payload), "ou=people") {
+				t.Errorf("token user = %s, want no dn", payload)
+			}
+		})
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	current, retired, unknown := rsaKeyPEM(t), rsaKeyPEM(t), rsaKeyPEM(t)
+
+	retiredFile := filepath.Join(t.TempDir(), "retired.pem")
+	if err := ioutil.WriteFile(retiredFile, retired, 0600); err != nil {
+		t.Fatalf("Failed to write key, %s", err)
+	}
+
+	s := newTestInstance(t, WithKeyPEM(current), WithRetiredKeys(retiredFile))
+
+	tests := []struct {
+		name string
+		key  []byte
+		want bool
+	}{
+		{
+			name: "Signed by the current key",
+			key:  current,
+			want: true,
+		},
+		{
+			name: "Signed by a retired key",
+			key:  retired,
+			want: true,
+		},
+		{
+			name: "Signed by an unknown key",
+			key:  unknown,
+			want: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, tr := review(t, s, signedToken(t, tt.key))
+
+			if tr.Status.Authenticated != tt.want {
+				t.Errorf("Authenticated = %t, want %t", tr.Status.Authenticated, tt.want)
+			}
+		})
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	key := rsaKeyPEM(t)
+	s := newTestInstance(t, WithKeyPEM(key))
+
+	revoked, kept := signedToken(t, key), signedToken(t, key)
+
+	parsed, err := types.Parse([]byte(revoked), s.verificationKeys())
+	if err != nil {
+		t.Fatalf("Parse() error = %s", err)
+	}
+
+	if _, tr := review(t, s, revoked); !tr.Status.Authenticated {
+		t.Fatalf("Authenticated = false before revocation, want true")
+	}
+
+	if err := s.Revoke(parsed.ID()); err != nil {
+		t.Fatalf("Revoke() error = %s", err)
+	}
+
+	if _, tr := review(t, s, revoked); tr.Status.Authenticated {
+		t.Errorf("Authenticated = true for a revoked token, want false")
+	}
+
+	if _, tr := review(t, s, kept); !tr.Status.Authenticated {
+		t.Errorf("Authenticated = false for another token, want true")
+	}
+}
+
+func TestRecovery(t *testing.T) {
+	s := newTestInstance(t, WithMiddleware(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			if req.URL.Query().Get("panic") != "" {
+				panic("bad request")
+			}
+			next.ServeHTTP(res, req)
+		})
+	}))
+
+	res := httptest.NewRecorder()
+	s.h.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/healthz?panic=1", nil))
+
+	if res.Code != http.StatusInternalServerError {
+		t.Errorf("panicking request = %d, want %d", res.Code, http.StatusInternalServerError)
+	}
+
+	var body errorResponse
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil || body.Code != http.StatusInternalServerError {
+		t.Errorf("panicking request body = %+v, err = %v, want a json error", body, err)
+	}
+
+	res = httptest.NewRecorder()
+	s.h.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+
+	if res.Code != http.StatusOK {
+		t.Errorf("request after the panic = %d, want %d", res.Code, http.StatusOK)
+	}
+}
+
+// panicSearcher panics on every search, as a buggy searcher would
+type panicSearcher struct{}
+
+func (panicSearcher) Search(context.Context, string, string) (*auth.UserInfo, error) {
+	panic("bad searcher")
+}
+
+func TestRecoveryAccessLog(t *testing.T) {
+	var logs strings.Builder
+	s := newTestInstance(t, WithSearcher(panicSearcher{}), WithRequestLogs(&logs, middlewares.FormatJSON))
+
+	if code := authenticate(s, "john", "secret"); code != http.StatusInternalServerError {
+		t.Errorf("POST /auth with a panicking searcher = %d, want %d", code, http.StatusInternalServerError)
+	}
+
+	var entry struct {
+		URL  string `json:"url"`
+		Code int    `json:"code"`
+	}
+	if err := json.Unmarshal([]byte(logs.String()), &entry); err != nil || entry.URL != "/auth" || entry.Code != http.StatusInternalServerError {
+		t.Errorf("access log = %q, want the 500 of /auth", logs.String())
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	// tag record the middlewares a request went through in the X-Middlewares header
+	tag := func(name string) mux.MiddlewareFunc {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+				if middlewares.GetRequestID(req.Context()) == "" {
+					t.Errorf("Middleware %s ran before the request id was set", name)
+				}
+
+				res.Header().Add("X-Middlewares", name)
+				next.ServeHTTP(res, req)
+			})
+		}
+	}
+
+	s := newTestInstance(t, WithMiddleware(tag("first"), tag("second")), WithMiddleware(tag("third")))
+
+	res := httptest.NewRecorder()
+	s.h.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+
+	if got, want := res.Header().Values("X-Middlewares"), []string{"first", "second", "third"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("middlewares = %v, want %v", got, want)
+	}
+}
+
+func TestMaxBodySize(t *testing.T) {
+	s := newTestInstance(t, WithMaxBodySize(64))
+
+	for _, path := range []string{"/auth", "/token"} {
+		t.Run(path, func(t *testing.T) {
+			body := `{"username":"` + strings.Repeat("a", 128) + `"}`
+			req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+			req.Header.Set(ContentTypeHeader, ContentTypeJSON)
+
+			res := httptest.NewRecorder()
+			s.h.ServeHTTP(res, req)
+
+			if res.Code != http.StatusRequestEntityTooLarge {
+				t.Errorf("POST %s = %d, want %d", path, res.Code, http.StatusRequestEntityTooLarge)
+			}
+		})
+	}
+}
+
+func TestTimeouts(t *testing.T) {
+	s := newTestInstance(t, WithTimeouts(100*time.Millisecond, 0, 0, 0))
+
+	if s.srv.ReadTimeout != DefaultReadTimeout || s.srv.WriteTimeout != DefaultWriteTimeout || s.srv.IdleTimeout != DefaultIdleTimeout {
+		t.Errorf("zero timeouts did not keep the defaults, got %+v", s.srv)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen, %s", err)
+	}
+
+	go s.serve(l)
+	defer s.Shutdown(context.Background())
+
+	// a client that never sends its headers must be disconnected
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial, %s", err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte("POST /auth HTTP/1.1\r\n"))
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	buf := make([]byte, 1)
+	for {
+		if _, err := conn.Read(buf); err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				t.Errorf("Connection still open after the read header timeout")
+			}
+			break
+		}
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		accept      string
+		want        bool
+	}{
+		{
+			name:        "Plain json",
+			contentType: "application/json",
+			accept:      "",
+			want:        true,
+		},
+		{
+			name:        "Json with a charset",
+			contentType: "application/json; charset=utf-8",
+			accept:      "application/json",
+			want:        true,
+		},
+		{
+			name:        "Wildcard accept",
+			contentType: "application/json",
+			accept:      "*/*",
+			want:        true,
+		},
+		{
+			name:        "Application wildcard among others",
+			contentType: "application/json",
+			accept:      "text/html, application/*;q=0.8",
+			want:        true,
+		},
+		{
+			name:        "Not a json request",
+			contentType: "text/plain",
+			accept:      "",
+			want:        false,
+		},
+		{
+			name:        "Unsupported accept",
+			contentType: "application/json",
+			accept:      "text/html",
+			want:        false,
+		},
+		{
+			name:        "Json explicitly refused",
+			contentType: "application/json",
+			accept:      "application/json;q=0",
+			want:        false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := negotiate(tt.contentType, tt.accept); got != tt.want {
+				t.Errorf("negotiate(%q, %q) = %t, want %t", tt.contentType, tt.accept, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExecCredentialVersion(t *testing.T) {
+	s := newTestInstance(t)
+
+	tests := []struct {
+		name        string
+		body        string
+		wantCode    int
+		wantVersion string
+	}{
+		{
+			name:        "Default version",
+			body:        `{"username":"john"}`,
+			wantCode:    http.StatusBadRequest,
+			wantVersion: ExecCredentialV1beta1,
+		},
+		{
+			name:        "v1",
+			body:        `{"username":"john","apiVersion":"client.authentication.k8s.io/v1"}`,
+			wantCode:    http.StatusBadRequest,
+			wantVersion: ExecCredentialV1,
+		},
+		{
+			name:        "v1beta1",
+			body:        `{"username":"john","apiVersion":"client.authentication.k8s.io/v1beta1"}`,
+			wantCode:    http.StatusBadRequest,
+			wantVersion: ExecCredentialV1beta1,
+		},
+		{
+			name:        "Unsupported version",
+			body:        `{"username":"john","password":"secret","apiVersion":"client.authentication.k8s.io/v2"}`,
+			wantCode:    http.StatusBadRequest,
+			wantVersion: ExecCredentialV1beta1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/auth", strings.NewReader(tt.body))
+			req.Header.Set(ContentTypeHeader, ContentTypeJSON)
+
+			res := httptest.NewRecorder()
+			s.h.ServeHTTP(res, req)
+
+			if res.Code != tt.wantCode {
+				t.Errorf("POST /auth = %d, want %d", res.Code, tt.wantCode)
+			}
+
+			var ec types.ExecCredential
+			if err := json.NewDecoder(res.Body).Decode(&ec); err != nil {
+				t.Fatalf("Failed to decode ExecCredential, %s", err)
+			}
+
+			if ec.Kind != "ExecCredential" || ec.APIVersion != tt.wantVersion {
+				t.Errorf("ExecCredential = %s %s, want ExecCredential %s", ec.Kind, ec.APIVersion, tt.wantVersion)
+			}
+		})
+	}
+
+	for _, version := range []string{ExecCredentialV1, ExecCredentialV1beta1} {
+		t.Run("Token in "+version, func(t *testing.T) {
+			data, err := json.Marshal(execCredential(version, "token", time.Now()))
+			if err != nil {
+				t.Fatalf("Failed to marshal ExecCredential, %s", err)
+			}
+
+			var ec types.ExecCredential
+			if err := json.Unmarshal(data, &ec); err != nil {
+				t.Fatalf("Failed to decode ExecCredential, %s", err)
+			}
+
+			if ec.APIVersion != version || ec.Status == nil || ec.Status.Token != "token" {
+				t.Errorf("ExecCredential = %s, want a %s credential holding the token", data, version)
+			}
+		})
+	}
+}
+
+func TestTokenReviewVersion(t *testing.T) {
+	s := newTestInstance(t)
+
+	tests := []struct {
+		name        string
+		body        string
+		wantCode    int
+		wantVersion string
+	}{
+		{
+			name:        "v1",
+			body:        `{"kind":"TokenReview","apiVersion":"authentication.k8s.io/v1","spec":{"token":"invalid"}}`,
+			wantCode:    http.StatusBadRequest,
+			wantVersion: TokenReviewV1,
+		},
+		{
+			name:        "v1beta1",
+			body:        `{"kind":"TokenReview","apiVersion":"authentication.k8s.io/v1beta1","spec":{"token":"invalid"}}`,
+			wantCode:    http.StatusBadRequest,
+			wantVersion: TokenReviewV1beta1,
+		},
+		{
+			name:        "No TypeMeta",
+			body:        `{"spec":{"token":"invalid"}}`,
+			wantCode:    http.StatusBadRequest,
+			wantVersion: TokenReviewV1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/token", strings.NewReader(tt.body))
+			req.Header.Set(ContentTypeHeader, ContentTypeJSON)
+
+			res := httptest.NewRecorder()
+			s.h.ServeHTTP(res, req)
+
+			if res.Code != tt.wantCode {
+				t.Errorf("POST /token = %d, want %d", res.Code, tt.wantCode)
+			}
+
+			var tr auth.TokenReview
+			if err := json.NewDecoder(res.Body).Decode(&tr); err != nil {
+				t.Fatalf("Failed to decode TokenReview, %s", err)
+			}
+
+			if tr.Kind != "TokenReview" || tr.APIVersion != tt.wantVersion {
+				t.Errorf("TokenReview = %s %s, want TokenReview %s", tr.Kind, tr.APIVersion, tt.wantVersion)
+			}
+		})
+	}
+
+	invalid := []struct {
+		name string
+		body string
+		want *ServerError
+	}{
+		{
+			name: "Wrong kind",
+			body: `{"kind":"SubjectAccessReview","apiVersion":"authorization.k8s.io/v1","spec":{}}`,
+			want: ErrNotATokenReview,
+		},
+		{
+			name: "Unsupported version",
+			body: `{"kind":"TokenReview","apiVersion":"authentication.k8s.io/v2","spec":{}}`,
+			want: ErrUnsupportedVersion,
+		},
+	}
+
+	for _, tt := range invalid {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/token", strings.NewReader(tt.body))
+			req.Header.Set(ContentTypeHeader, ContentTypeJSON)
+
+			res := httptest.NewRecorder()
+			s.h.ServeHTTP(res, req)
+
+			var body errorResponse
+			if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+				t.Fatalf("Failed to decode the error body, %s", err)
+			}
+
+			if res.Code != tt.want.Code() || body.Error != tt.want.Error() {
+				t.Errorf("POST /token = %d %s, want %d %s", res.Code, body.Error, tt.want.Code(), tt.want.Error())
+			}
+		})
+	}
+}
+
+func TestLogger(t *testing.T) {
+	var buf strings.Builder
+	s := newTestInstance(t, WithLogger(zerolog.New(&buf)))
+
+	req := httptest.NewRequest(http.MethodPost, "/auth", strings.NewReader(`{"username":"john","password":"secret"}`))
+	req.Header.Set(ContentTypeHeader, ContentTypeJSON)
+	s.h.ServeHTTP(httptest.NewRecorder(), req)
+
+	token := signedToken(t, rsaKeyPEM(t))
+	review(t, s, token)
+
+	type record struct {
+		Level    string `json:"level"`
+		Message  string `json:"message"`
+		Username string `json:"username"`
+	}
+
+	var records []record
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var r record
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			t.Fatalf("Log line %q is not json, %s", line, err)
+		}
+
+		records = append(records, r)
+	}
+
+	found := false
+	for _, r := range records {
+		if r.Level == "error" && r.Username == "john" && r.Message == "Ldap directory unavailable." {
+			found = true
+		}
+	}
+
+	if !found {
+		t.Errorf("No error record for the failed authentication of john in %v", records)
+	}
+
+	if strings.Contains(buf.String(), "secret") {
+		t.Errorf("The password was logged")
+	}
+
+	if strings.Contains(buf.String(), token) {
+		t.Errorf("The token was logged")
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+	}{
+		{name: "given by the client", header: "kubectl-1234"},
+		{name: "generated"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf strings.Builder
+			s := newTestInstance(t, WithLogger(zerolog.New(&buf)))
+			buf.Reset()
+
+			req := httptest.NewRequest(http.MethodPost, "/auth", strings.NewReader(`{"username":"john","password":"secret"}`))
+			req.Header.Set(ContentTypeHeader, ContentTypeJSON)
+			if tt.header != "" {
+				req.Header.Set(middlewares.RequestIDHeader, tt.header)
+			}
+
+			res := httptest.NewRecorder()
+			s.h.ServeHTTP(res, req)
+
+			id := res.Header().Get(middlewares.RequestIDHeader)
+			if tt.header != "" && id != tt.header {
+				t.Errorf("%s = %q, want %q", middlewares.RequestIDHeader, id, tt.header)
+			} else if id == "" {
+				t.Errorf("%s is missing", middlewares.RequestIDHeader)
+			}
+
+			lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+			for _, line := range lines {
+				var record struct {
+					RequestID string `json:"request_id"`
+				}
+				if err := json.Unmarshal([]byte(line), &record); err != nil {
+					t.Fatalf("Log line %q is not json, %s", line, err)
+				}
+
+				if record.RequestID != id {
+					t.Errorf("Log line %q request_id = %q, want %q", line, record.RequestID, id)
+				}
+			}
+		})
+	}
+}
+
+func TestAuthSpecialPassword(t *testing.T) {
+	// escaped by the json encoding, the password must reach the directory as is
+	password := " <p\u00e2ss> & \\\"w\u00f6rd\"\t\U0001F511 "
+
+	srv, err := ldaptest.NewServer(
+		ldaptest.Entry{DN: "cn=admin,dc=corp", Password: "password"},
+		ldaptest.Entry{DN: "uid=john,ou=people,dc=corp", Password: password, Attributes: map[string][]string{"uid": {"john"}}},
+	)
+	if err != nil {
+		t.Fatalf("Failed to start the ldap server, %s", err)
+	}
+	defer srv.Close()
+
+	s := newTestInstance(t, withDirectory(srv))
+
+	if code, _ := issueToken(t, s, "john", password); code != http.StatusOK {
+		t.Errorf("POST /auth = %d, want %d", code, http.StatusOK)
+	}
+
+	if code, _ := issueToken(t, s, "john", strings.TrimSpace(password)); code != http.StatusUnauthorized {
+		t.Errorf("POST /auth with the trimmed password = %d, want %d", code, http.StatusUnauthorized)
+	}
+}
+
+func TestMalformedCredentials(t *testing.T) {
+	s := newTestInstance(t, WithMaxUsernameLength(8))
+
+	tests := []struct {
+		name     string
+		username string
+		password string
+	}{
+		{name: "empty username", password: "secret"},
+		{name: "empty password", username: "john"},
+		{name: "username too long", username: "johnathan", password: "secret"},
+		{name: "username with control characters", username: "jo\nhn", password: "secret"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code := authenticate(s, tt.username, tt.password); code != ErrMalformedCredentials.Code() {
+				t.Errorf("POST /auth = %d, want %d", code, ErrMalformedCredentials.Code())
+			}
+		})
+	}
+}
+
+func TestValidateSignature(t *testing.T) {
+	key := rsaKeyPEM(t)
+	s := newTestInstance(t, WithKeyPEM(key))
+
+	valid := strings.Split(signedToken(t, key), ".")
+	other := strings.Split(signedToken(t, rsaKeyPEM(t)), ".")
+
+	parsed, err := types.ParseKey(key)
+	if err != nil {
+		t.Fatalf("ParseKey() error = %s", err)
+	}
+
+	token, err := types.NewToken(&auth.UserInfo{Username: "john"}, -60)
+	if err != nil {
+		t.Fatalf("NewToken() error = %s", err)
+	}
+
+	expired, err := token.Payload(parsed)
+	if err != nil {
+		t.Fatalf("Payload() error = %s", err)
+	}
+
+	// a token issued by a newer server, ie. during a rolling upgrade
+	private, err := jwk.ParseKey(key, jwk.WithPEM(true))
+	if err != nil {
+		t.Fatalf("Failed to parse the key, %s", err)
+	}
+
+	newer := jwt.New()
+	newer.Set(types.VersionKey, types.TokenVersion+1)
+	newer.Set(jwt.ExpirationKey, time.Now().Add(time.Minute).Unix())
+	newer.Set("user", []byte(`{"username":"john"}`))
+
+	newerPayload, err := jwt.Sign(newer, jwa.RS256, private)
+	if err != nil {
+		t.Fatalf("Failed to sign the token, %s", err)
+	}
+
+	// well formed tokens are rejected as not authenticated, only garbage is an error
+	tests := []struct {
+		name  string
+		token string
+		code  int
+	}{
+		{name: "expired", token: string(expired), code: http.StatusOK},
+		{name: "newer version", token: string(newerPayload), code: http.StatusOK},
+		{name: "signed with another key", token: strings.Join(other, "."), code: http.StatusOK},
+		{name: "tampered payload", token: valid[0] + "." + other[1] + "." + valid[2], code: http.StatusOK},
+		{name: "without signature", token: valid[0] + "." + valid[1] + ".", code: http.StatusOK},
+		{name: "junk", token: "not-a-token", code: ErrMalformedToken.Code()},
+		{name: "truncated", token: valid[0] + "." + valid[1], code: ErrMalformedToken.Code()},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, tr := review(t, s, tt.token)
+			if code != tt.code || tr.Status.Authenticated {
+				t.Errorf("POST /token = %d, authenticated %v, want %d and not authenticated", code, tr.Status.Authenticated, tt.code)
+			}
+
+			if wantError := tt.code != http.StatusOK; (tr.Status.Error != "") != wantError {
+				t.Errorf("TokenReview error = %q, want one: %v", tr.Status.Error, wantError)
+			}
+		})
+	}
+}
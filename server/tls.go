@@ -0,0 +1,64 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+)
+
+// DefaultTLSMinVersion is the default minimum TLS version accepted from the clients
+const DefaultTLSMinVersion = "1.2"
+
+// tlsVersions are the TLS versions the server can be restricted to, the older ones being
+// considered weak
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// weakTLSVersions are refused as minimum version
+var weakTLSVersions = map[string]bool{
+	"1.0": true,
+	"1.1": true,
+}
+
+func parseTLSVersion(version string) (uint16, error) {
+	if v, ok := tlsVersions[version]; ok {
+		return v, nil
+	}
+
+	if weakTLSVersions[version] {
+		return 0, fmt.Errorf("TLS %s is too weak, the minimum TLS version must be 1.2 or 1.3", version)
+	}
+
+	return 0, fmt.Errorf("Unknown TLS version '%s', must be 1.2 or 1.3", version)
+}
+
+// parseCipherSuites return the ids of the named cipher suites, ie.
+// TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, refusing the ones go considers insecure
+func parseCipherSuites(names []string) ([]uint16, error) {
+	secure := map[string]uint16{}
+	for _, c := range tls.CipherSuites() {
+		secure[c.Name] = c.ID
+	}
+
+	insecure := map[string]bool{}
+	for _, c := range tls.InsecureCipherSuites() {
+		insecure[c.Name] = true
+	}
+
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := secure[name]
+		if !ok {
+			if insecure[name] {
+				return nil, fmt.Errorf("The cipher suite '%s' is insecure", name)
+			}
+
+			return nil, fmt.Errorf("Unknown cipher suite '%s'", name)
+		}
+
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
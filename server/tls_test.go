@@ -0,0 +1,101 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestTLSMinVersion(t *testing.T) {
+	certPEM, keyPEM := selfSignedPEM(t)
+
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(certPEM)
+
+	tests := []struct {
+		name string
+		opts []Option
+		// client is the maximum TLS version of the client
+		client uint16
+		ok     bool
+	}{
+		{name: "TLS 1.1 client refused by default", client: tls.VersionTLS11},
+		{name: "TLS 1.2 client by default", client: tls.VersionTLS12, ok: true},
+		{name: "TLS 1.1 client with a 1.2 minimum", opts: []Option{WithTLSMinVersion("1.2")}, client: tls.VersionTLS11},
+		{name: "TLS 1.2 client with a 1.3 minimum", opts: []Option{WithTLSMinVersion("1.3")}, client: tls.VersionTLS12},
+		{name: "TLS 1.3 client with a 1.3 minimum", opts: []Option{WithTLSMinVersion("1.3")}, client: tls.VersionTLS13, ok: true},
+		{
+			name:   "TLS 1.2 client with restricted cipher suites",
+			opts:   []Option{WithTLSCipherSuites("TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256")},
+			client: tls.VersionTLS12,
+			ok:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestInstance(t, append([]Option{WithTLSPEM(certPEM, keyPEM)}, tt.opts...)...)
+
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("Failed to listen, %s", err)
+			}
+
+			go s.serve(l)
+			defer s.Shutdown(context.Background())
+
+			c := &http.Client{
+				Transport: &http.Transport{TLSClientConfig: &tls.Config{
+					RootCAs:    pool,
+					MinVersion: tls.VersionTLS10,
+					MaxVersion: tt.client,
+				}},
+			}
+
+			res, err := c.Get("https://" + l.Addr().String() + "/healthz")
+			if !tt.ok {
+				if err == nil {
+					res.Body.Close()
+					t.Errorf("/healthz = %d, want the handshake to fail", res.StatusCode)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("/healthz failed, %s", err)
+			}
+			res.Body.Close()
+		})
+	}
+}
+
+func TestTLSWeakConfig(t *testing.T) {
+	certPEM, keyPEM := selfSignedPEM(t)
+
+	tests := []struct {
+		name string
+		opts []Option
+	}{
+		{name: "TLS 1.0 minimum", opts: []Option{WithTLSMinVersion("1.0")}},
+		{name: "TLS 1.1 minimum", opts: []Option{WithTLSMinVersion("1.1")}},
+		{name: "unknown version", opts: []Option{WithTLSMinVersion("2")}},
+		{name: "insecure cipher suite", opts: []Option{WithTLSCipherSuites("TLS_RSA_WITH_RC4_128_SHA")}},
+		{name: "unknown cipher suite", opts: []Option{WithTLSCipherSuites("TLS_NOPE")}},
+		{
+			name: "cipher suites with a 1.3 minimum",
+			opts: []Option{WithTLSMinVersion("1.3"), WithTLSCipherSuites("TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256")},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := append([]Option{WithKey("", ""), WithTLSPEM(certPEM, keyPEM)}, tt.opts...)
+			if _, err := NewInstance(opts...); err == nil {
+				t.Errorf("NewInstance() error = nil, want an error")
+			}
+		})
+	}
+}
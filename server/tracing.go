@@ -0,0 +1,19 @@
+package server
+
+import (
+	"context"
+	"net/http"
+
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "vbouchaud/k8s-ldap-auth/server"
+
+// startSpan start a server span named name, continuing the trace propagated in the request
+// headers, if any
+func (s *Instance) startSpan(req *http.Request, name string) (context.Context, trace.Span) {
+	ctx := propagation.TraceContext{}.Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+
+	return s.tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindServer))
+}
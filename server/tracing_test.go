@@ -0,0 +1,92 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"vbouchaud/k8s-ldap-auth/ldap"
+)
+
+func TestTracing(t *testing.T) {
+	sr := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr))
+
+	s := newTestInstance(t,
+		WithLdap(
+			[]string{unreachableLdap(t)},
+			"cn=admin,dc=corp",
+			"password",
+			nil,
+			ldap.ScopeWholeSubtree,
+			"(uid=%s)",
+			"memberof",
+			"uid",
+			nil,
+			ldap.WithDialTimeout(time.Second),
+			ldap.WithTracerProvider(tp),
+		),
+		WithTracerProvider(tp),
+	)
+
+	const (
+		traceID  = "4bf92f3577b34da6a3ce929d0e0e4736"
+		parentID = "00f067aa0ba902b7"
+	)
+
+	req := httptest.NewRequest(http.MethodPost, "/auth", strings.NewReader(`{"username":"john","password":"secret"}`))
+	req.Header.Set(ContentTypeHeader, ContentTypeJSON)
+	req.Header.Set("traceparent", "00-"+traceID+"-"+parentID+"-01")
+	s.h.ServeHTTP(httptest.NewRecorder(), req)
+
+	review(t, s, "not a token")
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range sr.Ended() {
+		spans[span.Name()] = span
+	}
+
+	parents := []struct {
+		name   string
+		parent string
+	}{
+		{name: "authenticate"},
+		{name: "ldap.Search", parent: "authenticate"},
+		{name: "ldap.search", parent: "ldap.Search"},
+		{name: "validate"},
+	}
+
+	for _, tt := range parents {
+		span, ok := spans[tt.name]
+		if !ok {
+			t.Errorf("span %s was not recorded", tt.name)
+			continue
+		}
+
+		if tt.parent != "" {
+			parent, ok := spans[tt.parent]
+			if ok && span.Parent().SpanID() != parent.SpanContext().SpanID() {
+				t.Errorf("span %s parent = %s, want %s", tt.name, span.Parent().SpanID(), tt.parent)
+			}
+		}
+	}
+
+	if span, ok := spans["authenticate"]; ok {
+		if got := span.SpanContext().TraceID().String(); got != traceID {
+			t.Errorf("authenticate trace id = %s, want the propagated %s", got, traceID)
+		}
+
+		if got := span.Parent().SpanID().String(); got != parentID {
+			t.Errorf("authenticate parent = %s, want the propagated %s", got, parentID)
+		}
+	}
+
+	if span, ok := spans["validate"]; ok && span.Parent().IsValid() {
+		t.Errorf("validate span has a parent but no trace context was propagated")
+	}
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+
+	"vbouchaud/k8s-ldap-auth/types"
+)
+
+const bearerPrefix = "Bearer "
+
+// writeUnauthorizedBearer answer a 401 telling the client its bearer token was refused, see
+// https://datatracker.ietf.org/doc/html/rfc6750#section-3
+func (s *Instance) writeUnauthorizedBearer(res http.ResponseWriter) {
+	res.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+	s.writeError(res, ErrUnauthorized)
+}
+
+// userinfoHandler answer the user a bearer token was issued to as json, its uid, which is the user
+// dn unless a uid property is set, its username, groups and extra values. The token is
+// validated like a TokenReview, only the audiences are not checked. Any invalid token is
+// answered with a 401.
+func (s *Instance) userinfoHandler() http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		logger := s.logger(req)
+
+		_, span := s.startSpan(req, "userinfo")
+		defer span.End()
+
+		header := req.Header.Get("Authorization")
+		if len(header) <= len(bearerPrefix) || !strings.EqualFold(header[:len(bearerPrefix)], bearerPrefix) {
+			s.metrics.userinfo(reasonMalformedToken)
+			s.writeUnauthorizedBearer(res)
+			return
+		}
+
+		token, err := types.Parse([]byte(strings.TrimSpace(header[len(bearerPrefix):])), s.verificationKeys(), s.tokenOptions...)
+		if err != nil {
+			logger.Debug().Err(err).Msg("Failed to parse the userinfo token.")
+			s.metrics.userinfo(reasonMalformedToken)
+			s.writeUnauthorizedBearer(res)
+			return
+		}
+
+		if !token.IsValid() {
+			s.metrics.userinfo(reasonExpired)
+			s.writeUnauthorizedBearer(res)
+			return
+		}
+
+		if id := token.ID(); id != "" {
+			revoked, err := s.revoker.IsRevoked(id)
+			if err != nil {
+				logger.Error().Err(err).Msg("Could not check whether the token was revoked.")
+				s.metrics.userinfo(reasonError)
+				s.writeError(res, ErrServerError)
+				return
+			} else if revoked {
+				logger.Info().Str("jti", id).Msg("Refused the userinfo of a revoked token.")
+				s.metrics.userinfo(reasonRevoked)
+				s.writeUnauthorizedBearer(res)
+				return
+			}
+		}
+
+		user, err := token.GetUser()
+		if err != nil {
+			s.metrics.userinfo(reasonError)
+			s.writeError(res, ErrServerError)
+			return
+		}
+
+		span.SetAttributes(attribute.String("enduser.id", user.Username))
+
+		if !s.groupPolicy.permits(user.Groups) {
+			logger.Info().Str("username", user.Username).Strs("groups", user.Groups).Msg("User groups are not allowed.")
+			s.metrics.userinfo(reasonGroupDenied)
+			s.writeUnauthorizedBearer(res)
+			return
+		}
+
+		s.metrics.userinfo(reasonSuccess)
+
+		res.Header().Set(ContentTypeHeader, ContentTypeJSON)
+		res.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(res).Encode(user)
+	}
+}
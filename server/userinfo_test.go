@@ -0,0 +1,121 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	auth "k8s.io/api/authentication/v1"
+
+	"vbouchaud/k8s-ldap-auth/types"
+)
+
+func TestUserinfo(t *testing.T) {
+	keyPEM := rsaKeyPEM(t)
+	s := newTestInstance(t, WithKeyPEM(keyPEM), withDirectory(directory(t)), WithUserinfo())
+
+	code, ec := issueToken(t, s, "john", "secret")
+	if code != http.StatusOK {
+		t.Fatalf("POST /auth = %d, want %d", code, http.StatusOK)
+	}
+
+	key, err := types.ParseKey(keyPEM)
+	if err != nil {
+		t.Fatalf("ParseKey() error = %s", err)
+	}
+
+	token, err := types.NewToken(&auth.UserInfo{Username: "john"}, -60)
+	if err != nil {
+		t.Fatalf("NewToken() error = %s", err)
+	}
+
+	expired, err := token.Payload(key)
+	if err != nil {
+		t.Fatalf("Payload() error = %s", err)
+	}
+
+	tests := []struct {
+		name   string
+		header string
+		method string
+		code   int
+		want   *auth.UserInfo
+	}{
+		{
+			name:   "valid token",
+			header: "Bearer " + ec.Status.Token,
+			method: http.MethodGet,
+			code:   http.StatusOK,
+			want: &auth.UserInfo{
+				UID:      "uid=john,ou=people,dc=corp",
+				Username: "john",
+				Groups:   []string{"cn=admins,ou=groups,dc=corp"},
+			},
+		},
+		{
+			name:   "valid token posted",
+			header: "bearer " + ec.Status.Token,
+			method: http.MethodPost,
+			code:   http.StatusOK,
+			want: &auth.UserInfo{
+				UID:      "uid=john,ou=people,dc=corp",
+				Username: "john",
+				Groups:   []string{"cn=admins,ou=groups,dc=corp"},
+			},
+		},
+		{name: "without token", method: http.MethodGet, code: http.StatusUnauthorized},
+		{name: "not a bearer token", header: "Basic am9objpzZWNyZXQ=", method: http.MethodGet, code: http.StatusUnauthorized},
+		{name: "malformed token", header: "Bearer junk", method: http.MethodGet, code: http.StatusUnauthorized},
+		{name: "expired token", header: "Bearer " + string(expired), method: http.MethodGet, code: http.StatusUnauthorized},
+		{name: "signed with another key", header: "Bearer " + signedToken(t, rsaKeyPEM(t)), method: http.MethodGet, code: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/userinfo", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+
+			res := httptest.NewRecorder()
+			s.h.ServeHTTP(res, req)
+
+			if res.Code != tt.code {
+				t.Fatalf("%s /userinfo = %d, want %d", tt.method, res.Code, tt.code)
+			}
+
+			if tt.want == nil {
+				if got := res.Header().Get("WWW-Authenticate"); got != `Bearer error="invalid_token"` {
+					t.Errorf("%s /userinfo WWW-Authenticate = %q, want the invalid_token error", tt.method, got)
+				}
+				return
+			}
+
+			var user auth.UserInfo
+			if err := json.NewDecoder(res.Body).Decode(&user); err != nil {
+				t.Fatalf("Failed to decode the user, %s", err)
+			}
+
+			if !reflect.DeepEqual(&user, tt.want) {
+				t.Errorf("%s /userinfo = %+v, want %+v", tt.method, user, tt.want)
+			}
+		})
+	}
+}
+
+func TestUserinfoDisabled(t *testing.T) {
+	keyPEM := rsaKeyPEM(t)
+	s := newTestInstance(t, WithKeyPEM(keyPEM))
+
+	req := httptest.NewRequest(http.MethodGet, "/userinfo", nil)
+	req.Header.Set("Authorization", "Bearer "+signedToken(t, keyPEM))
+
+	res := httptest.NewRecorder()
+	s.h.ServeHTTP(res, req)
+
+	if res.Code != http.StatusNotFound {
+		t.Errorf("GET /userinfo without WithUserinfo = %d, want %d", res.Code, http.StatusNotFound)
+	}
+}
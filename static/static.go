@@ -0,0 +1,119 @@
+// Package static authenticates the users of a fixed list instead of a ldap directory, so that
+// the server can be run locally or in integration tests without one.
+package static
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"sort"
+
+	"golang.org/x/crypto/bcrypt"
+	auth "k8s.io/api/authentication/v1"
+	"sigs.k8s.io/yaml"
+
+	"vbouchaud/k8s-ldap-auth/ldap"
+)
+
+// User is a user of the static list, its username is its key in the list
+type User struct {
+	// Password is the bcrypt hash of the user password, ie. generated with htpasswd -nB
+	Password string `json:"password"`
+	// UID defaults to the username
+	UID    string              `json:"uid,omitempty"`
+	Groups []string            `json:"groups,omitempty"`
+	Extra  map[string][]string `json:"extra,omitempty"`
+}
+
+// Static authenticates the users of a fixed list, it is safe for concurrent use
+type Static struct {
+	users map[string]User
+	// dummy is compared to the password of unknown users, so that they take as long to reject
+	// as a wrong password
+	dummy []byte
+}
+
+// New return a Static authenticating the given users, keyed by username. Every password must
+// be a bcrypt hash.
+func New(users map[string]User) (*Static, error) {
+	s := &Static{users: make(map[string]User, len(users))}
+
+	cost := bcrypt.MinCost
+	for username, user := range users {
+		c, err := bcrypt.Cost([]byte(user.Password))
+		if err != nil {
+			return nil, fmt.Errorf("The password of '%s' is not a bcrypt hash, %w", username, err)
+		}
+
+		if c > cost {
+			cost = c
+		}
+
+		s.users[username] = user
+	}
+
+	dummy, err := bcrypt.GenerateFromPassword([]byte("dummy"), cost)
+	if err != nil {
+		return nil, err
+	}
+
+	s.dummy = dummy
+
+	return s, nil
+}
+
+// Load return a Static authenticating the users of a YAML file, keyed by username, ie.
+//
+//	john:
+//	  password: $2y$10$...
+//	  groups: [admins]
+func Load(path string) (*Static, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read the users file, %w", err)
+	}
+
+	var users map[string]User
+	if err := yaml.UnmarshalStrict(data, &users); err != nil {
+		return nil, fmt.Errorf("Could not parse the users file '%s', %w", path, err)
+	}
+
+	return New(users)
+}
+
+// Search return the user the credentials belong to. The errors wrap ldap.ErrUserNotFound and
+// ldap.ErrInvalidCredentials so that they are reported as the ldap ones.
+func (s *Static) Search(_ context.Context, username, password string) (*auth.UserInfo, error) {
+	user, ok := s.users[username]
+	if !ok {
+		bcrypt.CompareHashAndPassword(s.dummy, []byte(password))
+		return nil, ldap.ErrUserNotFound
+	}
+
+	if password == "" || bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)) != nil {
+		return nil, fmt.Errorf("%w, wrong password for '%s'", ldap.ErrInvalidCredentials, username)
+	}
+
+	uid := user.UID
+	if uid == "" {
+		uid = username
+	}
+
+	var extra map[string]auth.ExtraValue
+	if len(user.Extra) > 0 {
+		extra = make(map[string]auth.ExtraValue, len(user.Extra))
+		for name, values := range user.Extra {
+			extra[name] = append(auth.ExtraValue{}, values...)
+		}
+	}
+
+	groups := append([]string{}, user.Groups...)
+	sort.Strings(groups)
+
+	return &auth.UserInfo{
+		UID:      uid,
+		Username: username,
+		Groups:   groups,
+		Extra:    extra,
+	}, nil
+}
@@ -0,0 +1,113 @@
+package static
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"path"
+	"reflect"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+	auth "k8s.io/api/authentication/v1"
+
+	"vbouchaud/k8s-ldap-auth/ldap"
+)
+
+func hash(t *testing.T, password string) string {
+	h, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("Failed to hash the password, %s", err)
+	}
+
+	return string(h)
+}
+
+func TestSearch(t *testing.T) {
+	s, err := New(map[string]User{
+		"john": {Password: hash(t, "secret"), Groups: []string{"devs", "admins"}, Extra: map[string][]string{"mail": {"john@corp"}}},
+		"jane": {Password: hash(t, "secret"), UID: "1001"},
+	})
+	if err != nil {
+		t.Fatalf("New() error = %s", err)
+	}
+
+	tests := []struct {
+		name     string
+		username string
+		password string
+		want     *auth.UserInfo
+		wantErr  error
+	}{
+		{
+			name:     "success",
+			username: "john",
+			password: "secret",
+			want: &auth.UserInfo{
+				UID:      "john",
+				Username: "john",
+				Groups:   []string{"admins", "devs"},
+				Extra:    map[string]auth.ExtraValue{"mail": {"john@corp"}},
+			},
+		},
+		{
+			name:     "configured uid",
+			username: "jane",
+			password: "secret",
+			want:     &auth.UserInfo{UID: "1001", Username: "jane", Groups: []string{}},
+		},
+		{name: "wrong password", username: "john", password: "wrong", wantErr: ldap.ErrInvalidCredentials},
+		{name: "empty password", username: "john", password: "", wantErr: ldap.ErrInvalidCredentials},
+		{name: "unknown user", username: "nobody", password: "secret", wantErr: ldap.ErrUserNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := s.Search(context.Background(), tt.username, tt.password)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Search() error = %v, want %v", err, tt.wantErr)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Search() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr bool
+	}{
+		{name: "valid file", content: "john:\n  password: '" + hash(t, "secret") + "'\n  groups: [admins]\n"},
+		{name: "plain password", content: "john:\n  password: secret\n", wantErr: true},
+		{name: "unknown field", content: "john:\n  password: '" + hash(t, "secret") + "'\n  group: admins\n", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := path.Join(t.TempDir(), "users.yaml")
+			if err := ioutil.WriteFile(file, []byte(tt.content), 0600); err != nil {
+				t.Fatalf("Failed to write the users file, %s", err)
+			}
+
+			s, err := Load(file)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("Load() error = nil, want one")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Load() error = %s", err)
+			}
+
+			if _, err := s.Search(context.Background(), "john", "secret"); err != nil {
+				t.Errorf("Search() error = %s, want none", err)
+			}
+		})
+	}
+}
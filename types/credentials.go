@@ -1,10 +1,63 @@
 package types
 
+import (
+	"errors"
+	"fmt"
+	"unicode"
+	"unicode/utf8"
+)
+
+// DefaultMaxUsernameLength is the default maximum length of a username, in characters
+const DefaultMaxUsernameLength = 256
+
+var (
+	ErrEmptyUsername       = errors.New("The username is empty")
+	ErrEmptyPassword       = errors.New("The password is empty")
+	ErrUsernameTooLong     = errors.New("The username is too long")
+	ErrUsernameNotUTF8     = errors.New("The username is not valid UTF-8")
+	ErrUsernameControlChar = errors.New("The username contains control characters")
+	// ErrPasswordNotUTF8 means the password cannot be sent as json without its invalid bytes
+	// being replaced, the ldap server would then be given another password
+	ErrPasswordNotUTF8 = errors.New("The password is not valid UTF-8")
+)
+
 type Credentials struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
+	// APIVersion is the ExecCredential apiVersion the client expects, v1beta1 when omitted
+	APIVersion string `json:"apiVersion,omitempty"`
+}
+
+// Validate return the reason the credentials cannot be sent to the ldap server, if any. Both
+// the username and the password must be set, an empty password would be an unauthenticated
+// bind. The username must be valid UTF-8 without control characters, and at most
+// maxUsernameLength characters long. The password must be valid UTF-8, it is otherwise bound
+// with as is: neither trimmed nor normalized, ie. its spaces and backslashes are kept.
+func (c *Credentials) Validate(maxUsernameLength int) error {
+	switch {
+	case len(c.Username) == 0:
+		return ErrEmptyUsername
+	case len(c.Password) == 0:
+		return ErrEmptyPassword
+	case !utf8.ValidString(c.Username):
+		return ErrUsernameNotUTF8
+	case !utf8.ValidString(c.Password):
+		return ErrPasswordNotUTF8
+	case utf8.RuneCountInString(c.Username) > maxUsernameLength:
+		return fmt.Errorf("%w, at most %d characters are allowed", ErrUsernameTooLong, maxUsernameLength)
+	}
+
+	for _, r := range c.Username {
+		if unicode.IsControl(r) {
+			return ErrUsernameControlChar
+		}
+	}
+
+	return nil
 }
 
+// IsValid tells whether the credentials are valid with the default maximum username length,
+// see Validate
 func (c *Credentials) IsValid() bool {
-	return len(c.Username) != 0 && len(c.Password) != 0
+	return c.Validate(DefaultMaxUsernameLength) == nil
 }
@@ -0,0 +1,38 @@
+package types
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestCredentialsValidate(t *testing.T) {
+	tests := []struct {
+		name        string
+		credentials Credentials
+		want        error
+	}{
+		{name: "Valid", credentials: Credentials{Username: "john", Password: "secret"}},
+		{name: "Valid non ascii", credentials: Credentials{Username: "jöhn.dœ", Password: "secret"}},
+		{name: "Valid at the maximum length", credentials: Credentials{Username: strings.Repeat("é", 16), Password: "secret"}},
+		{name: "Empty username", credentials: Credentials{Password: "secret"}, want: ErrEmptyUsername},
+		{name: "Empty password", credentials: Credentials{Username: "john"}, want: ErrEmptyPassword},
+		{name: "Username too long", credentials: Credentials{Username: strings.Repeat("a", 17), Password: "secret"}, want: ErrUsernameTooLong},
+		{name: "Username with a newline", credentials: Credentials{Username: "john\nadmin", Password: "secret"}, want: ErrUsernameControlChar},
+		{name: "Username with a nul byte", credentials: Credentials{Username: "john\x00", Password: "secret"}, want: ErrUsernameControlChar},
+		{name: "Username not utf8", credentials: Credentials{Username: "john\xff", Password: "secret"}, want: ErrUsernameNotUTF8},
+		{name: "Password with spaces, backslashes and unicode", credentials: Credentials{Username: "john", Password: " s\\ecr\\et pàss 🔑 "}},
+		{name: "Password not utf8", credentials: Credentials{Username: "john", Password: "s\xe9cret"}, want: ErrPasswordNotUTF8},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.credentials.Validate(16)
+			if tt.want == nil && err != nil {
+				t.Errorf("Validate() error = %s, want none", err)
+			} else if !errors.Is(err, tt.want) {
+				t.Errorf("Validate() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
@@ -28,13 +28,15 @@ func NewExecCredential(APIVersion string) ExecCredential {
 	return ec
 }
 
+// Marshal the ExecCredential with the given apiVersion, or the AUTH_API_VERSION environment
+// variable value. The current apiVersion is kept when neither is set.
 func (ec *ExecCredential) Marshal(APIVersion string) ([]byte, error) {
 	ec.Kind = "ExecCredential"
 
 	if APIVersion != "" {
 		ec.APIVersion = APIVersion
-	} else {
-		ec.APIVersion = os.Getenv("AUTH_API_VERSION")
+	} else if env := os.Getenv("AUTH_API_VERSION"); env != "" {
+		ec.APIVersion = env
 	}
 
 	data, err := json.Marshal(ec)
@@ -1,65 +1,196 @@
 package types
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
 	"errors"
+	"fmt"
 	"io/ioutil"
 
+	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/lestrrat-go/jwx/jws"
 	"github.com/rs/zerolog/log"
 )
 
-func GenerateKey() (*rsa.PrivateKey, error) {
-	key, err := rsa.GenerateKey(rand.Reader, 2048)
+// Key is a private key tokens are signed with, either a RSA key signing with RS256 or an
+// ECDSA key signing with ES256, ES384 or ES512 depending on its curve
+type Key struct {
+	private crypto.Signer
+	alg     jwa.SignatureAlgorithm
+	id      string
+}
+
+// NewKey wrap a *rsa.PrivateKey or a *ecdsa.PrivateKey, selecting the matching algorithm
+func NewKey(private crypto.Signer) (*Key, error) {
+	var alg jwa.SignatureAlgorithm
+
+	switch k := private.(type) {
+	case *rsa.PrivateKey:
+		alg = jwa.RS256
+	case *ecdsa.PrivateKey:
+		switch k.Curve {
+		case elliptic.P256():
+			alg = jwa.ES256
+		case elliptic.P384():
+			alg = jwa.ES384
+		case elliptic.P521():
+			alg = jwa.ES512
+		default:
+			return nil, fmt.Errorf("Unsupported ECDSA curve %s", k.Curve.Params().Name)
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported key type %T", private)
+	}
+
+	k, err := jwkOf(private.Public(), alg)
 	if err != nil {
 		return nil, err
 	}
 
-	return key, nil
+	return &Key{private: private, alg: alg, id: k.KeyID()}, nil
+}
+
+// Algorithm return the JWS algorithm the key signs with
+func (k *Key) Algorithm() jwa.SignatureAlgorithm {
+	return k.alg
+}
+
+// Public return the public half of the key
+func (k *Key) Public() crypto.PublicKey {
+	return k.private.Public()
+}
+
+// GenerateKey generate a new key for the given algorithm, RS256 or ES256
+func GenerateKey(alg jwa.SignatureAlgorithm) (*Key, error) {
+	var (
+		private crypto.Signer
+		err     error
+	)
+
+	switch alg {
+	case jwa.RS256:
+		private, err = rsa.GenerateKey(rand.Reader, 2048)
+	case jwa.ES256:
+		private, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	default:
+		return nil, fmt.Errorf("Unsupported signing algorithm %s, expected %s or %s", alg, jwa.RS256, jwa.ES256)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return NewKey(private)
+}
+
+// GenerateKeyPEM generate a new key for the given algorithm, see GenerateKey, and return its
+// PKCS8 private key and its PKIX public key PEM encoded. Both can be loaded with LoadKey.
+func GenerateKeyPEM(alg jwa.SignatureAlgorithm) ([]byte, []byte, error) {
+	key, err := GenerateKey(alg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	priv, err := x509.MarshalPKCS8PrivateKey(key.private)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pub, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: priv}),
+		pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub}),
+		nil
 }
 
 var (
-	ErrPrivKeyNotFound    = errors.New("No RSA private key found")
+	ErrPrivKeyNotFound    = errors.New("No private key found")
 	ErrPrivKeyNotReadable = errors.New("Unable to parse private key")
-	ErrPubKeyNotFound     = errors.New("No RSA private key found")
+	ErrPrivKeyInvalid     = errors.New("Invalid private key")
+	ErrPubKeyNotFound     = errors.New("No public key found")
 	ErrPubKeyNotReadable  = errors.New("Unable to parse public key")
+	ErrPubKeyMismatch     = errors.New("Public key does not match the private key")
 )
 
-// The following is heavily inspired from https://gist.github.com/jshap70/259a87a7146393aab5819873a193b88c
-func LoadKey(rsaPrivateKeyLocation, rsaPublicKeyLocation string) (*rsa.PrivateKey, error) {
-	priv, err := ioutil.ReadFile(rsaPrivateKeyLocation)
+// LoadPrivateKey read a PEM encoded private key from a file, see ParseKey
+func LoadPrivateKey(privateKeyLocation string) (*Key, error) {
+	priv, err := ioutil.ReadFile(privateKeyLocation)
 	if err != nil {
 		log.Error().Msg("Private key file was not found.")
 		return nil, ErrPrivKeyNotFound
 	}
 
+	return ParseKey(priv)
+}
+
+// ParseKey parse a PEM encoded RSA private key (PKCS1 or PKCS8) or ECDSA private key
+// (SEC1 or PKCS8) and check it is usable for signing tokens
+func ParseKey(priv []byte) (*Key, error) {
 	privPem, _ := pem.Decode(priv)
-	var privPemBytes []byte
-	if privPem.Type != "RSA PRIVATE KEY" {
-		log.Warn().Str("pem_type", privPem.Type).Msg("RSA private key has the wrong type")
-	}
-	privPemBytes = privPem.Bytes
-
-	var parsedKey interface{}
-	if parsedKey, err = x509.ParsePKCS1PrivateKey(privPemBytes); err != nil {
-		log.Error().Err(err).Msg("Could not parse to PKCS1 key.")
-		if parsedKey, err = x509.ParsePKCS8PrivateKey(privPemBytes); err != nil { // note this returns type `interface{}`
-			log.Error().Err(err).Msg("Could not parse to PKCS8 key.")
-			return nil, ErrPrivKeyNotReadable
+	if privPem == nil {
+		log.Error().Msg("Could not decode pem private key.")
+		return nil, ErrPrivKeyNotReadable
+	}
+
+	var (
+		parsedKey interface{}
+		err       error
+	)
+
+	switch privPem.Type {
+	case "RSA PRIVATE KEY":
+		parsedKey, err = x509.ParsePKCS1PrivateKey(privPem.Bytes)
+	case "EC PRIVATE KEY":
+		parsedKey, err = x509.ParseECPrivateKey(privPem.Bytes)
+	default:
+		parsedKey, err = x509.ParsePKCS8PrivateKey(privPem.Bytes)
+	}
+
+	if err != nil {
+		log.Error().Err(err).Str("pem_type", privPem.Type).Msg("Could not parse private key.")
+		return nil, ErrPrivKeyNotReadable
+	}
+
+	if rsaKey, ok := parsedKey.(*rsa.PrivateKey); ok {
+		if err := rsaKey.Validate(); err != nil {
+			log.Error().Err(err).Msg("RSA private key is not valid.")
+			return nil, ErrPrivKeyInvalid
 		}
 	}
 
-	var privateKey *rsa.PrivateKey
-	var ok bool
-	privateKey, ok = parsedKey.(*rsa.PrivateKey)
+	signer, ok := parsedKey.(crypto.Signer)
 	if !ok {
-		log.Error().Msg("Could not parse to PKCS8 key.")
+		log.Error().Msg("Private key is not a signing key.")
 		return nil, ErrPrivKeyNotReadable
 	}
 
-	pub, err := ioutil.ReadFile(rsaPublicKeyLocation)
+	key, err := NewKey(signer)
+	if err != nil {
+		log.Error().Err(err).Msg("Private key cannot be used to sign tokens.")
+		return nil, ErrPrivKeyInvalid
+	}
+
+	return key, nil
+}
+
+// LoadKey read a PEM encoded private key and its PKIX public key, the public key must
+// match the private one
+func LoadKey(privateKeyLocation, publicKeyLocation string) (*Key, error) {
+	key, err := LoadPrivateKey(privateKeyLocation)
+	if err != nil {
+		return nil, err
+	}
+
+	pub, err := ioutil.ReadFile(publicKeyLocation)
 	if err != nil {
 		log.Error().Msg("Public key file was not found.")
 		return nil, ErrPubKeyNotFound
@@ -76,18 +207,86 @@ func LoadKey(rsaPrivateKeyLocation, rsaPublicKeyLocation string) (*rsa.PrivateKe
 		return nil, ErrPubKeyNotReadable
 	}
 
-	if parsedKey, err = x509.ParsePKIXPublicKey(pubPem.Bytes); err != nil {
+	parsedKey, err := x509.ParsePKIXPublicKey(pubPem.Bytes)
+	if err != nil {
 		log.Error().Err(err).Msg("Could not parse to PKIX public key.")
 		return nil, ErrPubKeyNotReadable
 	}
 
-	var pubKey *rsa.PublicKey
-	if pubKey, ok = parsedKey.(*rsa.PublicKey); !ok {
-		log.Error().Err(err).Msg("Could not parse public key to rsa.")
-		return nil, ErrPubKeyNotReadable
+	public, ok := key.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !public.Equal(parsedKey) {
+		log.Error().Msg("Public key does not match the private key.")
+		return nil, ErrPubKeyMismatch
+	}
+
+	return key, nil
+}
+
+// Check sign a small payload with the key and verify it with its public half, so that a key
+// unable to sign tokens is detected before any user authenticates
+func (k *Key) Check() error {
+	if k == nil || k.private == nil {
+		return ErrPrivKeyNotFound
+	}
+
+	private, err := jwkOf(k.private, k.alg)
+	if err != nil {
+		return fmt.Errorf("%w, %s", ErrPrivKeyInvalid, err.Error())
+	}
+
+	signed, err := jws.Sign([]byte("check"), k.alg, private)
+	if err != nil {
+		return fmt.Errorf("%w, could not sign: %s", ErrPrivKeyInvalid, err.Error())
+	}
+
+	if _, err := jws.Verify(signed, k.alg, k.Public()); err != nil {
+		return fmt.Errorf("%w, could not verify its own signature: %s", ErrPrivKeyInvalid, err.Error())
 	}
 
-	privateKey.PublicKey = *pubKey
+	return nil
+}
+
+// ID return the key id set in the header of the tokens signed by the key, the RFC 7638
+// thumbprint of the public key
+func (k *Key) ID() string {
+	return k.id
+}
+
+// jwkOf return key as a jwk for the key algorithm, identified by its RFC 7638 thumbprint
+func jwkOf(key interface{}, alg jwa.SignatureAlgorithm) (jwk.Key, error) {
+	k, err := jwk.New(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := jwk.AssignKeyID(k); err != nil {
+		return nil, err
+	}
+
+	if err := k.Set(jwk.AlgorithmKey, alg); err != nil {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+// PublicJWKS return the public half of the keys as a JWK Set, so that tokens signed by any
+// of them can be verified by third parties
+func PublicJWKS(keys ...*Key) (jwk.Set, error) {
+	set := jwk.NewSet()
+
+	for _, key := range keys {
+		k, err := jwkOf(key.Public(), key.alg)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := k.Set(jwk.KeyUsageKey, jwk.ForSignature); err != nil {
+			return nil, err
+		}
+
+		set.Add(k)
+	}
 
-	return privateKey, nil
+	return set, nil
 }
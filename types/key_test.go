@@ -0,0 +1,212 @@
+package types
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/lestrrat-go/jwx/jwa"
+
+	auth "k8s.io/api/authentication/v1"
+)
+
+func keyPEM(key *rsa.PrivateKey) []byte {
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	})
+}
+
+func TestParseKey(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key, %s", err)
+	}
+
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key, %s", err)
+	}
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key, %s", err)
+	}
+
+	sec1, err := x509.MarshalECPrivateKey(ecKey)
+	if err != nil {
+		t.Fatalf("Failed to marshal key, %s", err)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{
+			name: "PKCS1",
+			data: keyPEM(key),
+			want: nil,
+		},
+		{
+			name: "PKCS8",
+			data: pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}),
+			want: nil,
+		},
+		{
+			name: "SEC1",
+			data: pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: sec1}),
+			want: nil,
+		},
+		{
+			name: "Not PEM",
+			data: []byte("not a key"),
+			want: ErrPrivKeyNotReadable,
+		},
+		{
+			name: "Garbage PEM",
+			data: pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: []byte("garbage")}),
+			want: ErrPrivKeyNotReadable,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParseKey(tt.data); err != tt.want {
+				t.Errorf("ParseKey() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadPrivateKeyRestart(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key, %s", err)
+	}
+
+	file := filepath.Join(t.TempDir(), "key.pem")
+	if err := ioutil.WriteFile(file, keyPEM(key), 0600); err != nil {
+		t.Fatalf("Failed to write key, %s", err)
+	}
+
+	before, err := LoadPrivateKey(file)
+	if err != nil {
+		t.Fatalf("LoadPrivateKey() error = %s", err)
+	}
+
+	token, err := NewToken(&auth.UserInfo{Username: "john"}, 60)
+	if err != nil {
+		t.Fatalf("NewToken() error = %s", err)
+	}
+
+	payload, err := token.Payload(before)
+	if err != nil {
+		t.Fatalf("Payload() error = %s", err)
+	}
+
+	// simulate a restart
+	after, err := LoadPrivateKey(file)
+	if err != nil {
+		t.Fatalf("LoadPrivateKey() error = %s", err)
+	}
+
+	parsed, err := Parse(payload, []*Key{after})
+	if err != nil {
+		t.Fatalf("Parse() error = %s", err)
+	}
+
+	if !parsed.IsValid() {
+		t.Errorf("IsValid() = false, want true")
+	}
+}
+
+func TestGenerateKeyPEM(t *testing.T) {
+	for _, alg := range []jwa.SignatureAlgorithm{jwa.RS256, jwa.ES256} {
+		t.Run(alg.String(), func(t *testing.T) {
+			priv, pub, err := GenerateKeyPEM(alg)
+			if err != nil {
+				t.Fatalf("GenerateKeyPEM() error = %s", err)
+			}
+
+			dir := t.TempDir()
+			privFile, pubFile := filepath.Join(dir, "key.pem"), filepath.Join(dir, "key.pub")
+			if err := ioutil.WriteFile(privFile, priv, 0600); err != nil {
+				t.Fatalf("Failed to write private key, %s", err)
+			}
+			if err := ioutil.WriteFile(pubFile, pub, 0600); err != nil {
+				t.Fatalf("Failed to write public key, %s", err)
+			}
+
+			key, err := LoadKey(privFile, pubFile)
+			if err != nil {
+				t.Fatalf("LoadKey() error = %s", err)
+			}
+
+			if key.Algorithm() != alg {
+				t.Errorf("Algorithm() = %s, want %s", key.Algorithm(), alg)
+			}
+
+			// private and public keys printed one after the other can be loaded as one file
+			combined, err := ParseKey(append(priv, pub...))
+			if err != nil {
+				t.Fatalf("ParseKey() of the private and public keys error = %s", err)
+			}
+
+			if combined.ID() != key.ID() {
+				t.Errorf("ID() = %s, want %s", combined.ID(), key.ID())
+			}
+		})
+	}
+}
+
+func TestKeyCheck(t *testing.T) {
+	key, err := GenerateKey(jwa.ES256)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %s", err)
+	}
+
+	a, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key, %s", err)
+	}
+
+	b, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key, %s", err)
+	}
+
+	// the private half of a with the public half of b, its signatures cannot be verified
+	mismatched := *a
+	mismatched.PublicKey = b.PublicKey
+
+	broken, err := NewKey(&mismatched)
+	if err != nil {
+		t.Fatalf("NewKey() error = %s", err)
+	}
+
+	tests := []struct {
+		name string
+		key  *Key
+		want error
+	}{
+		{name: "usable key", key: key},
+		{name: "no key", want: ErrPrivKeyNotFound},
+		{name: "broken key", key: broken, want: ErrPrivKeyInvalid},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.key.Check(); !errors.Is(err, tt.want) {
+				t.Errorf("Check() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package types
+
+import "time"
+
+// DefaultLeeway is the clock skew tolerated between the server issuing tokens and the one
+// validating them
+const DefaultLeeway = 30 * time.Second
+
+// Clock tells the current time, when tokens are issued and validated
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// TokenOption function for configuring how tokens are issued and validated
+type TokenOption func(*tokenOptions)
+
+type tokenOptions struct {
+	issuer   string
+	audience string
+	leeway   time.Duration
+	// notBefore is the delay after issuance before the token can be used
+	notBefore time.Duration
+	// authTime is when the user authenticated with their credentials, now when zero
+	authTime time.Time
+	clock    Clock
+}
+
+func newTokenOptions(opts []TokenOption) tokenOptions {
+	o := tokenOptions{
+		leeway: DefaultLeeway,
+		clock:  systemClock{},
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return o
+}
+
+// WithIssuer set the iss claim of issued tokens, parsed tokens are only valid when issued
+// by issuer
+func WithIssuer(issuer string) TokenOption {
+	return func(o *tokenOptions) {
+		o.issuer = issuer
+	}
+}
+
+// WithAudience set the aud claim of issued tokens, parsed tokens are only valid when
+// audience is one of their audiences
+func WithAudience(audience string) TokenOption {
+	return func(o *tokenOptions) {
+		o.audience = audience
+	}
+}
+
+// WithLeeway set the clock skew tolerated when checking the iat, nbf and exp claims of
+// parsed tokens
+func WithLeeway(leeway time.Duration) TokenOption {
+	return func(o *tokenOptions) {
+		o.leeway = leeway
+	}
+}
+
+// WithNotBefore set the nbf claim of issued tokens, offset after their issuance. The tokens
+// are not valid until then.
+func WithNotBefore(offset time.Duration) TokenOption {
+	return func(o *tokenOptions) {
+		o.notBefore = offset
+	}
+}
+
+// WithAuthTime set the auth_time claim of issued tokens, the time the user authenticated
+// with their credentials. Tokens issued by refreshing another token keep its auth_time.
+func WithAuthTime(authTime time.Time) TokenOption {
+	return func(o *tokenOptions) {
+		o.authTime = authTime
+	}
+}
+
+// WithClock set the clock issued tokens are dated with and parsed tokens are validated
+// against, the system clock by default
+func WithClock(clock Clock) TokenOption {
+	return func(o *tokenOptions) {
+		o.clock = clock
+	}
+}
@@ -1,61 +1,172 @@
 package types
 
 import (
-	"crypto/rsa"
+	"crypto/rand"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"time"
 
-	"github.com/lestrrat-go/jwx/jwa"
 	"github.com/lestrrat-go/jwx/jwt"
 	"github.com/rs/zerolog/log"
 
 	auth "k8s.io/api/authentication/v1"
 )
 
+// AuthTimeKey is the claim holding the time the user authenticated with their credentials
+const AuthTimeKey = "auth_time"
+
+// VersionKey is the claim holding the schema version of the token claims
+const VersionKey = "ver"
+
+// TokenVersion is the schema version of the issued tokens, it is increased whenever their
+// claims change in a way older validators would misread. Tokens issued by previous versions
+// have no ver claim and share the schema of version 1.
+const TokenVersion = 1
+
 type Token struct {
 	token jwt.Token
+	opts  tokenOptions
 }
 
-func NewToken(user *auth.UserInfo, ttl int64) (*Token, error) {
-	now := time.Now()
+// NewToken create a token for user expiring after ttl seconds
+func NewToken(user *auth.UserInfo, ttl int64, opts ...TokenOption) (*Token, error) {
+	o := newTokenOptions(opts)
+
+	now := o.clock.Now()
 
 	data, err := json.Marshal(user)
 	if err != nil {
 		return nil, err
 	}
 
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
 	t := jwt.New()
+	t.Set(VersionKey, TokenVersion)
+	t.Set(jwt.JwtIDKey, hex.EncodeToString(id))
 	t.Set(jwt.IssuedAtKey, now.Unix())
 	t.Set(jwt.ExpirationKey, now.Add(time.Duration(ttl)*time.Second).Unix())
 	t.Set("user", data)
 
+	authTime := o.authTime
+	if authTime.IsZero() {
+		authTime = now
+	}
+	t.Set(AuthTimeKey, authTime.Unix())
+
+	if o.notBefore > 0 {
+		t.Set(jwt.NotBeforeKey, now.Add(o.notBefore).Unix())
+	}
+
+	if o.issuer != "" {
+		t.Set(jwt.IssuerKey, o.issuer)
+	}
+
+	if o.audience != "" {
+		t.Set(jwt.AudienceKey, []string{o.audience})
+	}
+
 	token := &Token{
 		token: t,
+		opts:  o,
 	}
 
 	return token, nil
 }
 
-func Parse(payload []byte, key *rsa.PrivateKey) (*Token, error) {
+var (
+	// ErrNoVerificationKey means Parse was not given any key to verify the token signature with
+	ErrNoVerificationKey = errors.New("No key to verify the token signature with")
+	// ErrMalformedToken means the payload is not a jwt at all
+	ErrMalformedToken = errors.New("Malformed token")
+	// ErrInvalidSignature means the payload is a jwt but none of the keys signed it, ie. it was
+	// tampered with, signed by an unknown key or not signed
+	ErrInvalidSignature = errors.New("Invalid token signature")
+	// ErrInvalidClaims means the token is properly signed but is not valid now, ie. it expired
+	ErrInvalidClaims = errors.New("Invalid token claims")
+	// ErrUnsupportedTokenVersion means the token is properly signed but was issued with a newer
+	// schema than this version understands, ie. by an upgraded server during a rolling upgrade
+	ErrUnsupportedTokenVersion = errors.New("Unsupported token version")
+)
+
+// Parse verify the payload signature with the key matching the token key id, allowing
+// tokens signed by retired keys to be verified. Tokens without key id are only accepted
+// when a single key is given. Unsigned tokens, and tokens signed with another algorithm
+// than the one of the key, are rejected. The options are used by IsValid.
+// The errors wrap ErrMalformedToken, ErrInvalidSignature, ErrInvalidClaims or
+// ErrUnsupportedTokenVersion, telling apart the garbage from the well formed tokens that are
+// rejected.
+func Parse(payload []byte, keys []*Key, opts ...TokenOption) (*Token, error) {
+	if len(keys) == 0 {
+		return nil, ErrNoVerificationKey
+	}
+
+	set, err := PublicJWKS(keys...)
+	if err != nil {
+		return nil, err
+	}
+
+	o := newTokenOptions(opts)
+
+	// the payload is only decoded first, to tell whether it is a jwt at all
+	if _, err := jwt.Parse(payload); err != nil {
+		return nil, fmt.Errorf("%w, %s", ErrMalformedToken, err.Error())
+	}
+
 	t, err := jwt.Parse(
 		payload,
-		jwt.WithVerify(jwa.RS256, &key.PublicKey),
-		jwt.WithValidate(true),
+		jwt.WithKeySet(set),
+		jwt.UseDefaultKey(true),
 	)
-
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w, %s", ErrInvalidSignature, err.Error())
+	}
+
+	if err := jwt.Validate(t, jwt.WithAcceptableSkew(o.leeway), jwt.WithClock(o.clock)); err != nil {
+		return nil, fmt.Errorf("%w, %s", ErrInvalidClaims, err.Error())
 	}
 
 	token := &Token{
 		token: t,
+		opts:  o,
+	}
+
+	// the claims of a newer schema are not read at all rather than misread
+	if v := token.Version(); v < 1 || v > TokenVersion {
+		return nil, fmt.Errorf("%w, got %d, want at most %d", ErrUnsupportedTokenVersion, v, TokenVersion)
 	}
 
 	return token, nil
 }
 
+// Version return the schema version of the token claims, 1 for the tokens issued by previous
+// versions without ver claim and 0 when the claim is not a number
+func (t *Token) Version() int {
+	v, ok := t.token.Get(VersionKey)
+	if !ok {
+		return 1
+	}
+
+	switch n := v.(type) {
+	case int:
+		return n
+	case int64:
+		return int(n)
+	case float64:
+		if n == float64(int(n)) {
+			return int(n)
+		}
+	}
+
+	return 0
+}
+
 func (t *Token) GetUser() (*auth.UserInfo, error) {
 	if v, ok := t.token.Get("user"); ok {
 		var user auth.UserInfo
@@ -78,16 +189,52 @@ func (t *Token) GetUser() (*auth.UserInfo, error) {
 	return nil, fmt.Errorf("Could not get user attribute of jwt token")
 }
 
+// ID return the jti claim of the token, used to revoke it. Tokens issued by previous
+// versions have no id.
+func (t *Token) ID() string {
+	return t.token.JwtID()
+}
+
+// Audiences return the aud claim of the token, tokens issued without audience have none
+func (t *Token) Audiences() []string {
+	return t.token.Audience()
+}
+
+// IsValid tells whether the token is not expired, is already usable and, when configured,
+// was issued by the expected issuer for the expected audience
 func (t *Token) IsValid() bool {
+	now := t.opts.clock.Now()
+
+	if t.opts.issuer != "" && t.token.Issuer() != t.opts.issuer {
+		log.Debug().Str("iss", t.token.Issuer()).Msg("token validation, unexpected issuer")
+		return false
+	}
+
+	if t.opts.audience != "" && !contains(t.token.Audience(), t.opts.audience) {
+		log.Debug().Strs("aud", t.token.Audience()).Msg("token validation, unexpected audience")
+		return false
+	}
+
+	if iat := t.token.IssuedAt(); !iat.IsZero() && iat.After(now.Add(t.opts.leeway)) {
+		log.Debug().Str("iat", iat.String()).Msg("token validation, issued in the future")
+		return false
+	}
+
+	if nbf := t.token.NotBefore(); !nbf.IsZero() && now.Add(t.opts.leeway).Before(nbf) {
+		log.Debug().Str("nbf", nbf.String()).Msg("token validation, not valid yet")
+		return false
+	}
+
 	exp, err := t.Expiration()
+	stillValid := err == nil && now.Unix() < exp.Add(t.opts.leeway).Unix()
 
 	if err != nil {
 		log.Debug().Str("err", err.Error()).Msg("token validation")
 	} else {
-		log.Debug().Str("exp", exp.String()).Bool("stillvalid", time.Now().Unix() < exp.Unix()).Msg("token validation")
+		log.Debug().Str("exp", exp.String()).Bool("stillvalid", stillValid).Msg("token validation")
 	}
 
-	return err == nil && time.Now().Unix() < exp.Unix()
+	return stillValid
 }
 
 func (t *Token) Expiration() (time.Time, error) {
@@ -98,11 +245,42 @@ func (t *Token) Expiration() (time.Time, error) {
 	return time.Time{}, fmt.Errorf("Could not get jwt expiration time")
 }
 
-func (t *Token) Payload(key *rsa.PrivateKey) ([]byte, error) {
-	signed, err := jwt.Sign(t.token, jwa.RS256, key)
+// AuthTime return the time the user authenticated with their credentials. Tokens issued by
+// previous versions have no auth_time claim, their issuance time is returned instead.
+func (t *Token) AuthTime() time.Time {
+	if v, ok := t.token.Get(AuthTimeKey); ok {
+		switch n := v.(type) {
+		case int64:
+			return time.Unix(n, 0)
+		case float64:
+			return time.Unix(int64(n), 0)
+		}
+	}
+
+	return t.token.IssuedAt()
+}
+
+// Payload sign the token with key, the key id is set in the token header
+func (t *Token) Payload(key *Key) ([]byte, error) {
+	k, err := jwkOf(key.private, key.alg)
+	if err != nil {
+		return nil, err
+	}
+
+	signed, err := jwt.Sign(t.token, key.alg, k)
 	if err != nil {
 		return nil, err
 	}
 
 	return signed, nil
 }
+
+func contains(a []string, s string) bool {
+	for _, v := range a {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,544 @@
+package types
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/lestrrat-go/jwx/jwt"
+
+	auth "k8s.io/api/authentication/v1"
+)
+
+// fakeClock is a clock that only moves forward when advanced
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(1600000000, 0)}
+}
+
+func TestTokenTTL(t *testing.T) {
+	clock := newFakeClock()
+	before := clock.Now()
+
+	token, err := NewToken(&auth.UserInfo{Username: "john"}, 1, WithLeeway(0), WithClock(clock))
+	if err != nil {
+		t.Fatalf("NewToken() error = %s", err)
+	}
+
+	exp, err := token.Expiration()
+	if err != nil {
+		t.Fatalf("Expiration() error = %s", err)
+	}
+
+	if !exp.Equal(before.Add(time.Second)) {
+		t.Errorf("Expiration() = %s, want %s", exp, before.Add(time.Second))
+	}
+
+	if !token.IsValid() {
+		t.Errorf("IsValid() = false right after issuance, want true")
+	}
+
+	clock.Advance(time.Second)
+
+	if token.IsValid() {
+		t.Errorf("IsValid() = true after the ttl, want false")
+	}
+}
+
+func TestTokenAlgorithms(t *testing.T) {
+	tests := []jwa.SignatureAlgorithm{jwa.RS256, jwa.ES256}
+
+	for _, alg := range tests {
+		t.Run(alg.String(), func(t *testing.T) {
+			key, err := GenerateKey(alg)
+			if err != nil {
+				t.Fatalf("GenerateKey() error = %s", err)
+			}
+
+			if key.Algorithm() != alg {
+				t.Errorf("Algorithm() = %s, want %s", key.Algorithm(), alg)
+			}
+
+			token, err := NewToken(&auth.UserInfo{Username: "john"}, 60)
+			if err != nil {
+				t.Fatalf("NewToken() error = %s", err)
+			}
+
+			payload, err := token.Payload(key)
+			if err != nil {
+				t.Fatalf("Payload() error = %s", err)
+			}
+
+			parsed, err := Parse(payload, []*Key{key})
+			if err != nil {
+				t.Fatalf("Parse() error = %s", err)
+			}
+
+			user, err := parsed.GetUser()
+			if err != nil {
+				t.Fatalf("GetUser() error = %s", err)
+			}
+
+			if user.Username != "john" {
+				t.Errorf("GetUser().Username = %s, want john", user.Username)
+			}
+
+			other, err := GenerateKey(alg)
+			if err != nil {
+				t.Fatalf("GenerateKey() error = %s", err)
+			}
+
+			if _, err := Parse(payload, []*Key{other}); err == nil {
+				t.Errorf("Parse() with another key succeeded, want an error")
+			}
+		})
+	}
+}
+
+func TestTokenClaims(t *testing.T) {
+	key, err := GenerateKey(jwa.ES256)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %s", err)
+	}
+
+	tests := []struct {
+		name     string
+		issuance []TokenOption
+		parsing  []TokenOption
+		want     bool
+	}{
+		{
+			name:     "No issuer nor audience",
+			issuance: nil,
+			parsing:  nil,
+			want:     true,
+		},
+		{
+			name:     "Matching issuer and audience",
+			issuance: []TokenOption{WithIssuer("k8s-ldap-auth"), WithAudience("cluster-a")},
+			parsing:  []TokenOption{WithIssuer("k8s-ldap-auth"), WithAudience("cluster-a")},
+			want:     true,
+		},
+		{
+			name:     "Mismatching issuer",
+			issuance: []TokenOption{WithIssuer("other"), WithAudience("cluster-a")},
+			parsing:  []TokenOption{WithIssuer("k8s-ldap-auth"), WithAudience("cluster-a")},
+			want:     false,
+		},
+		{
+			name:     "Mismatching audience",
+			issuance: []TokenOption{WithIssuer("k8s-ldap-auth"), WithAudience("cluster-b")},
+			parsing:  []TokenOption{WithIssuer("k8s-ldap-auth"), WithAudience("cluster-a")},
+			want:     false,
+		},
+		{
+			name:     "Missing audience",
+			issuance: []TokenOption{WithIssuer("k8s-ldap-auth")},
+			parsing:  []TokenOption{WithIssuer("k8s-ldap-auth"), WithAudience("cluster-a")},
+			want:     false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := NewToken(&auth.UserInfo{Username: "john"}, 60, tt.issuance...)
+			if err != nil {
+				t.Fatalf("NewToken() error = %s", err)
+			}
+
+			payload, err := token.Payload(key)
+			if err != nil {
+				t.Fatalf("Payload() error = %s", err)
+			}
+
+			parsed, err := Parse(payload, []*Key{key}, tt.parsing...)
+			if err != nil {
+				t.Fatalf("Parse() error = %s", err)
+			}
+
+			if got := parsed.IsValid(); got != tt.want {
+				t.Errorf("IsValid() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTokenLeeway(t *testing.T) {
+	key, err := GenerateKey(jwa.ES256)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %s", err)
+	}
+
+	tests := []struct {
+		name   string
+		ttl    int64
+		leeway time.Duration
+		want   bool
+	}{
+		{
+			name:   "Not expired",
+			ttl:    60,
+			leeway: DefaultLeeway,
+			want:   true,
+		},
+		{
+			name:   "Expired within the leeway",
+			ttl:    -5,
+			leeway: DefaultLeeway,
+			want:   true,
+		},
+		{
+			name:   "Expired past the leeway",
+			ttl:    -60,
+			leeway: DefaultLeeway,
+			want:   false,
+		},
+		{
+			name:   "Expired without leeway",
+			ttl:    -5,
+			leeway: 0,
+			want:   false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := NewToken(&auth.UserInfo{Username: "john"}, tt.ttl)
+			if err != nil {
+				t.Fatalf("NewToken() error = %s", err)
+			}
+
+			payload, err := token.Payload(key)
+			if err != nil {
+				t.Fatalf("Payload() error = %s", err)
+			}
+
+			parsed, err := Parse(payload, []*Key{key}, WithLeeway(tt.leeway))
+			if got := err == nil && parsed.IsValid(); got != tt.want {
+				t.Errorf("Parse() error = %v, valid = %t, want %t", err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTokenNotBefore(t *testing.T) {
+	key, err := GenerateKey(jwa.ES256)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %s", err)
+	}
+
+	tests := []struct {
+		name      string
+		notBefore time.Duration
+		leeway    time.Duration
+		want      bool
+	}{
+		{
+			name:      "No nbf",
+			notBefore: 0,
+			leeway:    0,
+			want:      true,
+		},
+		{
+			name:      "Used before nbf",
+			notBefore: time.Hour,
+			leeway:    DefaultLeeway,
+			want:      false,
+		},
+		{
+			name:      "Used before nbf within the leeway",
+			notBefore: 10 * time.Second,
+			leeway:    DefaultLeeway,
+			want:      true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := NewToken(&auth.UserInfo{Username: "john"}, 7200, WithNotBefore(tt.notBefore))
+			if err != nil {
+				t.Fatalf("NewToken() error = %s", err)
+			}
+
+			payload, err := token.Payload(key)
+			if err != nil {
+				t.Fatalf("Payload() error = %s", err)
+			}
+
+			parsed, err := Parse(payload, []*Key{key}, WithLeeway(tt.leeway))
+			if got := err == nil && parsed.IsValid(); got != tt.want {
+				t.Errorf("Parse() error = %v, valid = %t, want %t", err, got, tt.want)
+			}
+		})
+	}
+
+	t.Run("Used after nbf", func(t *testing.T) {
+		clock := newFakeClock()
+
+		token, err := NewToken(&auth.UserInfo{Username: "john"}, 60, WithNotBefore(time.Second), WithLeeway(0), WithClock(clock))
+		if err != nil {
+			t.Fatalf("NewToken() error = %s", err)
+		}
+
+		if token.IsValid() {
+			t.Errorf("IsValid() = true before nbf, want false")
+		}
+
+		clock.Advance(time.Second)
+
+		if !token.IsValid() {
+			t.Errorf("IsValid() = false after nbf, want true")
+		}
+	})
+}
+
+func TestTokenClock(t *testing.T) {
+	key, err := GenerateKey(jwa.ES256)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %s", err)
+	}
+
+	clock := newFakeClock()
+
+	token, err := NewToken(&auth.UserInfo{Username: "john"}, 3600, WithClock(clock))
+	if err != nil {
+		t.Fatalf("NewToken() error = %s", err)
+	}
+
+	payload, err := token.Payload(key)
+	if err != nil {
+		t.Fatalf("Payload() error = %s", err)
+	}
+
+	// the token was issued in 2020, it expired long ago by the system clock
+	if _, err := Parse(payload, []*Key{key}); !errors.Is(err, ErrInvalidClaims) {
+		t.Errorf("Parse() with the system clock error = %v, want %s", err, ErrInvalidClaims)
+	}
+
+	parsed, err := Parse(payload, []*Key{key}, WithClock(clock))
+	if err != nil {
+		t.Fatalf("Parse() error = %s", err)
+	}
+
+	if !parsed.IsValid() {
+		t.Errorf("IsValid() = false before expiry, want true")
+	}
+
+	// still valid within the leeway
+	clock.Advance(time.Hour + DefaultLeeway - time.Second)
+
+	if !parsed.IsValid() {
+		t.Errorf("IsValid() = false within the leeway, want true")
+	}
+
+	clock.Advance(time.Second)
+
+	if parsed.IsValid() {
+		t.Errorf("IsValid() = true after expiry, want false")
+	}
+
+	if _, err := Parse(payload, []*Key{key}, WithClock(clock)); !errors.Is(err, ErrInvalidClaims) {
+		t.Errorf("Parse() after expiry error = %v, want %s", err, ErrInvalidClaims)
+	}
+}
+
+func TestTokenVersion(t *testing.T) {
+	key, err := GenerateKey(jwa.ES256)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %s", err)
+	}
+
+	tests := []struct {
+		name    string
+		version interface{}
+		want    int
+		wantErr error
+	}{
+		{name: "current version", version: TokenVersion, want: TokenVersion},
+		{name: "previous versions without ver claim", want: 1},
+		{name: "future version", version: TokenVersion + 1, wantErr: ErrUnsupportedTokenVersion},
+		{name: "not a number", version: "2", wantErr: ErrUnsupportedTokenVersion},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := NewToken(&auth.UserInfo{Username: "john"}, 3600)
+			if err != nil {
+				t.Fatalf("NewToken() error = %s", err)
+			}
+
+			if tt.version == nil {
+				token.token.Remove(VersionKey)
+			} else {
+				token.token.Set(VersionKey, tt.version)
+			}
+
+			payload, err := token.Payload(key)
+			if err != nil {
+				t.Fatalf("Payload() error = %s", err)
+			}
+
+			parsed, err := Parse(payload, []*Key{key})
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("Parse() error = %v, want %s", err, tt.wantErr)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Parse() error = %s", err)
+			}
+
+			if got := parsed.Version(); got != tt.want {
+				t.Errorf("Version() = %d, want %d", got, tt.want)
+			}
+
+			if !parsed.IsValid() {
+				t.Errorf("IsValid() = false, want true")
+			}
+		})
+	}
+}
+
+func TestTokenAuthTime(t *testing.T) {
+	key, err := GenerateKey(jwa.ES256)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %s", err)
+	}
+
+	authenticated := time.Now().Add(-time.Hour).Truncate(time.Second)
+
+	tests := []struct {
+		name string
+		opts []TokenOption
+		want time.Time
+	}{
+		{name: "Defaults to the issuance", want: time.Now().Truncate(time.Second)},
+		{name: "Kept from an earlier authentication", opts: []TokenOption{WithAuthTime(authenticated)}, want: authenticated},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := NewToken(&auth.UserInfo{Username: "john"}, 60, tt.opts...)
+			if err != nil {
+				t.Fatalf("NewToken() error = %s", err)
+			}
+
+			payload, err := token.Payload(key)
+			if err != nil {
+				t.Fatalf("Payload() error = %s", err)
+			}
+
+			parsed, err := Parse(payload, []*Key{key})
+			if err != nil {
+				t.Fatalf("Parse() error = %s", err)
+			}
+
+			if got := parsed.AuthTime(); got.Sub(tt.want) > time.Second || tt.want.Sub(got) > time.Second {
+				t.Errorf("AuthTime() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSignature(t *testing.T) {
+	key, err := GenerateKey(jwa.RS256)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %s", err)
+	}
+
+	other, err := GenerateKey(jwa.RS256)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %s", err)
+	}
+
+	sign := func(k *Key, user string) string {
+		token, err := NewToken(&auth.UserInfo{Username: user}, 60)
+		if err != nil {
+			t.Fatalf("NewToken() error = %s", err)
+		}
+
+		payload, err := token.Payload(k)
+		if err != nil {
+			t.Fatalf("Payload() error = %s", err)
+		}
+
+		return string(payload)
+	}
+
+	valid := strings.Split(sign(key, "john"), ".")
+	forged := strings.Split(sign(key, "admin"), ".")
+	unsigned := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`))
+
+	// the public key is known to everyone, it must not be usable as a HMAC secret
+	pub, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		t.Fatalf("Failed to marshal public key, %s", err)
+	}
+
+	token, err := NewToken(&auth.UserInfo{Username: "admin"}, 60)
+	if err != nil {
+		t.Fatalf("NewToken() error = %s", err)
+	}
+
+	hmac, err := jwt.Sign(token.token, jwa.HS256, pub)
+	if err != nil {
+		t.Fatalf("Failed to sign with HS256, %s", err)
+	}
+
+	expired, err := NewToken(&auth.UserInfo{Username: "john"}, -60)
+	if err != nil {
+		t.Fatalf("NewToken() error = %s", err)
+	}
+
+	expiredPayload, err := expired.Payload(key)
+	if err != nil {
+		t.Fatalf("Payload() error = %s", err)
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		keys    []*Key
+		wantErr error
+	}{
+		{name: "Signed with another key", token: sign(other, "john"), keys: []*Key{key}, wantErr: ErrInvalidSignature},
+		{name: "Tampered payload", token: valid[0] + "." + forged[1] + "." + valid[2], keys: []*Key{key}, wantErr: ErrInvalidSignature},
+		{name: "Tampered signature", token: valid[0] + "." + valid[1] + "." + forged[2], keys: []*Key{key}, wantErr: ErrInvalidSignature},
+		{name: "Without signature", token: valid[0] + "." + valid[1] + ".", keys: []*Key{key}, wantErr: ErrInvalidSignature},
+		{name: "Unsigned", token: unsigned + "." + valid[1] + ".", keys: []*Key{key}, wantErr: ErrInvalidSignature},
+		{name: "HMAC signed with the public key", token: string(hmac), keys: []*Key{key}, wantErr: ErrInvalidSignature},
+		{name: "Expired", token: string(expiredPayload), keys: []*Key{key}, wantErr: ErrInvalidClaims},
+		{name: "Junk", token: "not-a-token", keys: []*Key{key}, wantErr: ErrMalformedToken},
+		{name: "Truncated", token: valid[0] + "." + valid[1], keys: []*Key{key}, wantErr: ErrMalformedToken},
+		{name: "No verification key", token: strings.Join(valid, "."), keys: nil, wantErr: ErrNoVerificationKey},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Parse([]byte(tt.token), tt.keys); !errors.Is(err, tt.wantErr) {
+				t.Errorf("Parse() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	if _, err := Parse([]byte(strings.Join(valid, ".")), []*Key{key}); err != nil {
+		t.Errorf("Parse() of the untampered token error = %s, want none", err)
+	}
+}